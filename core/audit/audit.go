@@ -0,0 +1,483 @@
+// Package audit writes the audit log as a hash chain, so edits to the audit log can be detected.
+// Each record includes a sequence number, the time, and the hash of the prior record, and
+// the record hash covers all of those plus the message. Periodically a checkpoint record is
+// written that is signed with the service's private key; since the signature covers the
+// hash of the prior record, it covers the entire chain up to that point. Records after the
+// last checkpoint are unprotected until the next checkpoint is written.
+//
+// The latest checkpoint is also written to a file next to the audit log, so truncation of
+// the audit log prior to that checkpoint can be detected. Note that someone with write access
+// to the files can roll back both the log and that file to an older checkpoint; forward the
+// audit log to a remote collector for protection against that.
+//
+// Verify checks the chain across all rotations of the audit log and reports gaps, edits,
+// invalid checkpoints, and truncation.
+package audit
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/logs"
+)
+
+type Config struct {
+	// AuditLogFilepath is the logh file path of the audit log; used to resume the chain at
+	// startup and for verification. When blank (STDOUT) the chain starts over on each run and
+	// cannot be verified.
+	AuditLogFilepath string
+	// AuditLogName is the name of the logh logger for the audit log.
+	AuditLogName string
+	// CheckpointInterval is the interval at which a checkpoint is written, if there are new
+	// records. Zero uses defaultCheckpointInterval.
+	CheckpointInterval time.Duration
+	// CheckpointRecords is the number of records after which a checkpoint is written, regardless
+	// of CheckpointInterval. Zero uses defaultCheckpointRecords.
+	CheckpointRecords int
+	// LogName is the name of the logh logger for general logging.
+	LogName string
+}
+
+// Checkpoint is the latest checkpoint, persisted in a file next to the audit log.
+type Checkpoint struct {
+	Hash string
+	Seq  uint64
+	Time string
+}
+
+// Problem is an issue found during verification.
+type Problem struct {
+	File string
+	// Line is the line number in File; 1 based.
+	Line        int
+	Description string
+}
+
+// Report is the result of Verify.
+type Report struct {
+	Checkpoints int
+	// CheckpointsVerified is false when no public key was provided, so checkpoint signatures
+	// were not checked.
+	CheckpointsVerified bool
+	Files               []string
+	FirstSeq            uint64
+	LastCheckpointSeq   uint64
+	LastSeq             uint64
+	Problems            []Problem
+	Records             int
+	// UnprotectedRecords is the count of records after the last checkpoint.
+	UnprotectedRecords int
+	Valid              bool
+}
+
+// record is a parsed audit record.
+type record struct {
+	hash string
+	msg  string
+	prev string
+	seq  uint64
+	time string
+}
+
+const (
+	// checkpointPrefix starts the message of a checkpoint record.
+	checkpointPrefix = "checkpoint|sig="
+	// checkpointSuffix is appended to the audit log file path for the persisted checkpoint file.
+	checkpointSuffix         = ".checkpoint"
+	chainStartMessage        = "chain start"
+	defaultCheckpointRecords = 100
+	recordTimeFormat         = time.RFC3339Nano
+	zeroHash                 = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+var (
+	config Config
+
+	defaultCheckpointInterval = time.Minute
+
+	lpf func(level logh.LoghLevel, format string, v ...interface{})
+
+	// mutex protects the chain state; records must be written in order.
+	mutex sync.Mutex
+	// prevHash and seq are the hash and sequence number of the last written record.
+	prevHash string
+	seq      uint64
+	// sinceCheckpoint is the count of records written since the last checkpoint.
+	sinceCheckpoint int
+
+	signingKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+
+	// auditRecord matches a chained record, after the logh prefix; I.E.
+	// "2024/03/25 18:30:00.123456 audit.go:123:   audit: seq=1|time=...|prev=...|msg=...|hash=..."
+	auditRecord = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6} \S+:\d+: +audit: ` +
+		`seq=(\d+)\|time=([^|]*)\|prev=([0-9a-f]{64})\|msg=(.*)\|hash=([0-9a-f]{64})$`)
+)
+
+// Init initializes the package and resumes the chain from the existing audit log, or starts
+// a new chain. Call Init after creating the logh logger for the audit log.
+func Init(configIn Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = configIn
+	lpf = logh.Map[config.LogName].Printf
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = defaultCheckpointInterval
+	}
+	if config.CheckpointRecords == 0 {
+		config.CheckpointRecords = defaultCheckpointRecords
+	}
+
+	prevHash = ""
+	seq = 0
+	sinceCheckpoint = 0
+	if config.AuditLogFilepath != "" {
+		last, err := lastRecord(config.AuditLogFilepath)
+		if err != nil {
+			lpf(logh.Error, "audit chain could not be resumed, starting a new chain, error:%v", err)
+		} else if last != nil {
+			prevHash = last.hash
+			seq = last.seq
+			lpf(logh.Info, "audit chain resumed at seq: %d", seq)
+		}
+	}
+	if prevHash == "" {
+		write(chainStartMessage)
+	}
+}
+
+// CheckpointInit enables signed checkpoints; key signs checkpoints, and the public key from key
+// is used by the verify handler. Checkpoints are written every CheckpointInterval, if there are
+// new records, and after every CheckpointRecords records. Call the returned stop function at
+// shutdown; it stops the periodic checkpoints and writes a checkpoint if there are new records,
+// so no records are left unprotected.
+func CheckpointInit(key *rsa.PrivateKey) (stop func()) {
+	mutex.Lock()
+	signingKey = key
+	publicKey = &key.PublicKey
+	interval := config.CheckpointInterval
+	mutex.Unlock()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				checkpointIfNew()
+				return
+			case <-ticker.C:
+				checkpointIfNew()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// Printf writes a record to the audit log. Messages are escaped so each record is a single line.
+func Printf(format string, v ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	write(fmt.Sprintf(format, v...))
+	if signingKey != nil && sinceCheckpoint >= config.CheckpointRecords {
+		if err := checkpoint(); err != nil {
+			lpf(logh.Error, "checkpoint error:%v", err)
+		}
+	}
+}
+
+// HandlerVerify
+// http.MethodGet - verify the audit log and return the Report. The status is http.StatusOK
+// when the chain is valid, otherwise http.StatusConflict.
+func HandlerVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.Lock()
+	pk := publicKey
+	mutex.Unlock()
+	report, err := Verify(config.AuditLogFilepath, pk)
+	if err != nil {
+		lpf(logh.Error, "Verify error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Valid {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusConflict)
+	}
+	if _, err = w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%v", err)
+	}
+}
+
+// Verify checks the chain in all rotations of the audit log at auditLogFilepath. When pub is
+// nil checkpoint signatures are not checked. The returned error is only for failures to read
+// the audit log; problems with the chain are in the Report.
+func Verify(auditLogFilepath string, pub *rsa.PublicKey) (Report, error) {
+	report := Report{CheckpointsVerified: pub != nil}
+	if auditLogFilepath == "" {
+		return report, fmt.Errorf("%s the audit log is written to STDOUT and cannot be verified", runtimeh.SourceInfo())
+	}
+	files, err := logs.Rotations(auditLogFilepath)
+	if err != nil {
+		return report, err
+	}
+	report.Files = files
+
+	var prior *record
+	hashes := map[uint64]string{}
+	for _, fp := range files {
+		err := scan(fp, func(line int, text string, rcd *record) {
+			problem := func(desc string) {
+				report.Problems = append(report.Problems, Problem{File: fp, Line: line, Description: desc})
+			}
+			if rcd == nil {
+				problem("not a chained audit record: " + text)
+				return
+			}
+			report.Records++
+			report.UnprotectedRecords++
+			if prior == nil {
+				report.FirstSeq = rcd.seq
+			}
+			report.LastSeq = rcd.seq
+			hashes[rcd.seq] = rcd.hash
+
+			if recordHash(rcd.seq, rcd.time, rcd.prev, rcd.msg) != rcd.hash {
+				problem(fmt.Sprintf("seq %d hash does not match the record; the record was edited", rcd.seq))
+			}
+			switch {
+			case prior == nil:
+			case rcd.prev == zeroHash && rcd.msg == chainStartMessage:
+				problem(fmt.Sprintf("seq %d starts a new chain; the chain could not be resumed at startup", rcd.seq))
+			case rcd.seq != prior.seq+1:
+				problem(fmt.Sprintf("seq %d follows seq %d; records are missing", rcd.seq, prior.seq))
+			case rcd.prev != prior.hash:
+				problem(fmt.Sprintf("seq %d prev does not match the hash of seq %d; the chain is broken", rcd.seq, prior.seq))
+			}
+
+			if strings.HasPrefix(rcd.msg, checkpointPrefix) {
+				report.Checkpoints++
+				report.LastCheckpointSeq = rcd.seq
+				report.UnprotectedRecords = 0
+				if pub != nil {
+					sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(rcd.msg, checkpointPrefix))
+					if err != nil || verifyCheckpoint(pub, rcd.seq, rcd.prev, sig) != nil {
+						problem(fmt.Sprintf("seq %d checkpoint signature is not valid", rcd.seq))
+					}
+				}
+			}
+			prior = rcd
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// Compare to the persisted checkpoint to detect truncation.
+	cp, err := checkpointRead(auditLogFilepath + checkpointSuffix)
+	if err != nil {
+		report.Problems = append(report.Problems, Problem{File: auditLogFilepath + checkpointSuffix,
+			Description: fmt.Sprintf("checkpoint file could not be read: %v", err)})
+	} else if cp != nil {
+		if h, ok := hashes[cp.Seq]; !ok {
+			report.Problems = append(report.Problems, Problem{File: auditLogFilepath + checkpointSuffix,
+				Description: fmt.Sprintf("checkpoint seq %d is not in the audit log; the log was truncated", cp.Seq)})
+		} else if h != cp.Hash {
+			report.Problems = append(report.Problems, Problem{File: auditLogFilepath + checkpointSuffix,
+				Description: fmt.Sprintf("checkpoint seq %d hash does not match the audit log", cp.Seq)})
+		}
+	}
+
+	report.Valid = len(report.Problems) == 0
+	return report, nil
+}
+
+// checkpointIfNew writes a checkpoint if there are records since the last checkpoint.
+func checkpointIfNew() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if sinceCheckpoint > 0 {
+		if err := checkpoint(); err != nil {
+			lpf(logh.Error, "checkpoint error:%v", err)
+		}
+	}
+}
+
+// checkpoint writes a signed checkpoint record and persists the checkpoint. The caller must hold mutex.
+func checkpoint() error {
+	sig, err := signCheckpoint(signingKey, seq+1, prevHash)
+	if err != nil {
+		return err
+	}
+	write(checkpointPrefix + base64.StdEncoding.EncodeToString(sig))
+	sinceCheckpoint = 0
+	if config.AuditLogFilepath == "" {
+		return nil
+	}
+	cp := Checkpoint{Hash: prevHash, Seq: seq, Time: time.Now().UTC().Format(recordTimeFormat)}
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	// Write then rename, so the file is never partially written.
+	fp := config.AuditLogFilepath + checkpointSuffix
+	if err := os.WriteFile(fp+".tmp", b, 0644); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return runtimeh.SourceInfoError("", os.Rename(fp+".tmp", fp))
+}
+
+// checkpointRead reads the persisted checkpoint; nil if there is no checkpoint file.
+func checkpointRead(path string) (*Checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	cp := Checkpoint{}
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	return &cp, nil
+}
+
+// escape makes msg a single line, and escapes the escape character so the original message can
+// be recovered.
+func escape(msg string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(msg)
+}
+
+// lastRecord returns the last chained record in the audit log; nil if there are no records.
+func lastRecord(auditLogFilepath string) (*record, error) {
+	files, err := logs.Rotations(auditLogFilepath)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		var last *record
+		err := scan(files[i], func(line int, text string, rcd *record) {
+			if rcd != nil {
+				last = rcd
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			return last, nil
+		}
+	}
+	return nil, nil
+}
+
+// parse parses a line from the audit log; nil if the line is not a chained record.
+func parse(line string) *record {
+	m := auditRecord.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	s, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &record{seq: s, time: m[2], prev: m[3], msg: m[4], hash: m[5]}
+}
+
+// recordHash is the SHA256 of the record fields, hex encoded.
+func recordHash(seq uint64, tm string, prev string, msg string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s", seq, tm, prev, msg)))
+	return hex.EncodeToString(h[:])
+}
+
+// scan calls fn for each line in the file at path; rcd is nil for lines that are not records.
+func scan(path string, fn func(line int, text string, rcd *record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	defer f.Close()
+	rdr := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		text, err := rdr.ReadString('\n')
+		if text != "" {
+			text = strings.TrimRight(text, "\n")
+			fn(line, text, parse(text))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+	}
+}
+
+// signCheckpoint signs the checkpoint at seq, which covers the chain through prev.
+func signCheckpoint(key *rsa.PrivateKey, seq uint64, prev string) ([]byte, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d|%s", seq, prev)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	return sig, runtimeh.SourceInfoError("", err)
+}
+
+// verifyCheckpoint verifies the signature of the checkpoint at seq.
+func verifyCheckpoint(pub *rsa.PublicKey, seq uint64, prev string, sig []byte) error {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d|%s", seq, prev)))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig)
+}
+
+// write writes a record to the audit log. The caller must hold mutex.
+func write(msg string) {
+	prev := prevHash
+	if prev == "" {
+		prev = zeroHash
+	} else {
+		seq++
+	}
+	tm := time.Now().UTC().Format(recordTimeFormat)
+	msg = escape(msg)
+	hash := recordHash(seq, tm, prev, msg)
+	logh.Map[config.AuditLogName].Printf(logh.Audit, "seq=%d|time=%s|prev=%s|msg=%s|hash=%s", seq, tm, prev, msg, hash)
+	prevHash = hash
+	sinceCheckpoint++
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+var (
+	testAuditLog string
+	testKey      *rsa.PrivateKey
+)
+
+func init() {
+	t := testing.T{}
+	testAuditLog = filepath.Join(t.TempDir(), "test.log.audit")
+
+	err := logh.New("test", "", logh.DefaultLevels, logh.Debug, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating log, error: %v", runtimeh.SourceInfo(), err)
+	}
+	err = logh.New("test.audit", testAuditLog, logh.DefaultLevels, logh.Audit, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating audit log, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if testKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		log.Fatalf("fatal: %s GenerateKey error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	Init(Config{AuditLogFilepath: testAuditLog, AuditLogName: "test.audit", CheckpointInterval: time.Hour,
+		CheckpointRecords: 5, LogName: "test"})
+	CheckpointInit(testKey)
+}
+
+func Example_escape() {
+	for _, msg := range []string{"one line", "two\nlines", `back\slash`} {
+		fmt.Println(escape(msg))
+	}
+
+	// Output:
+	// one line
+	// two\nlines
+	// back\\slash
+}
+
+// TestVerify writes records, including checkpoints, and validates the chain verifies; then
+// validates edits, deleted records, and truncation are detected.
+func TestVerify(t *testing.T) {
+	for i := 0; i < 12; i++ {
+		Printf("TestVerify record %d", i)
+	}
+	report, err := Verify(testAuditLog, &testKey.PublicKey)
+	if err != nil {
+		t.Errorf("Verify error: %v", err)
+		return
+	}
+	if !report.Valid || report.Checkpoints < 2 || report.Records < 12 {
+		t.Errorf("wrong report: %+v", report)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	if report, err = Verify(testAuditLog, &otherKey.PublicKey); err != nil || report.Valid {
+		t.Errorf("checkpoints verified with the wrong key, error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(lines []string) []string
+	}{
+		{"edit", func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], "TestVerify", "TestVerifx", 1)
+			return lines
+		}},
+		{"delete", func(lines []string) []string {
+			return append(lines[:3], lines[4:]...)
+		}},
+		{"truncate", func(lines []string) []string {
+			return lines[:3]
+		}},
+	}
+	for _, tst := range tests {
+		fp, err := tamperedCopy(t.TempDir(), tst.modify)
+		if err != nil {
+			t.Errorf("test: %s, tamperedCopy error: %v", tst.name, err)
+			continue
+		}
+		report, err := Verify(fp, &testKey.PublicKey)
+		if err != nil {
+			t.Errorf("test: %s, Verify error: %v", tst.name, err)
+			continue
+		}
+		if report.Valid || len(report.Problems) == 0 {
+			t.Errorf("test: %s, tampering not detected, report: %+v", tst.name, report)
+		}
+	}
+}
+
+// TestResume validates the chain is resumed from the existing audit log on Init.
+func TestResume(t *testing.T) {
+	Printf("TestResume before")
+	Init(Config{AuditLogFilepath: testAuditLog, AuditLogName: "test.audit", CheckpointInterval: time.Hour,
+		CheckpointRecords: 5, LogName: "test"})
+	Printf("TestResume after")
+	report, err := Verify(testAuditLog, &testKey.PublicKey)
+	if err != nil {
+		t.Errorf("Verify error: %v", err)
+		return
+	}
+	if !report.Valid {
+		t.Errorf("chain not resumed, report: %+v", report)
+	}
+}
+
+// TestCheckpointStop validates stopping checkpoints writes a checkpoint for the new records.
+func TestCheckpointStop(t *testing.T) {
+	stop := CheckpointInit(testKey)
+	Printf("TestCheckpointStop record")
+	stop()
+	stop()
+	report, err := Verify(testAuditLog, &testKey.PublicKey)
+	if err != nil {
+		t.Errorf("Verify error: %v", err)
+		return
+	}
+	if !report.Valid || report.UnprotectedRecords != 0 {
+		t.Errorf("wrong report: %+v", report)
+	}
+}
+
+// tamperedCopy copies the audit log and checkpoint file to dir, modifying the audit log lines
+// with modify, and returns the audit log file path of the copy.
+func tamperedCopy(dir string, modify func(lines []string) []string) (string, error) {
+	fp := filepath.Join(dir, "test.log.audit")
+	b, err := os.ReadFile(testAuditLog + ".0")
+	if err != nil {
+		return "", err
+	}
+	lines := modify(strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"))
+	if err := os.WriteFile(fp+".0", []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if b, err = os.ReadFile(testAuditLog + checkpointSuffix); err != nil {
+		return "", err
+	}
+	return fp, os.WriteFile(fp+checkpointSuffix, b, 0644)
+}
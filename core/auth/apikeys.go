@@ -0,0 +1,568 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// APIKey describes an API key; the key itself is only returned when the key is created.
+type APIKey struct {
+	// Audience is the audience claim of the key; see APIKeyRequest.Audience.
+	Audience string `json:",omitempty"`
+	// Created is the Unix (seconds) time the key was created.
+	Created int64
+	// Email is the service account the key belongs to.
+	Email string
+	// ExpiresAt is the Unix (seconds) time after which the key is not valid; zero for no expiry.
+	ExpiresAt int64 `json:",omitempty"`
+	ID        string
+	// LastUsed is the Unix (seconds) time the key was last used, to within apiKeyLastUsedInterval.
+	LastUsed int64 `json:",omitempty"`
+	Name     string
+	// Roles are the roles granted by the key; limited to the roles of the service account.
+	Roles []string
+	// Scopes are the scopes granted by the key for the Audience; see RequireScope.
+	Scopes []string `json:",omitempty"`
+}
+
+// APIKeyCreated is the body returned when an API key is created.
+type APIKeyCreated struct {
+	APIKey
+	// Key is provided in APIKeyHeader. It is not stored, and cannot be retrieved later.
+	Key string
+}
+
+// APIKeyRequest is the body for creating an API key with PathAPIKeys.
+type APIKeyRequest struct {
+	// Audience is the service the key is for; one of Config.Audiences. Services with
+	// Config.Audience only accept keys for their audience.
+	Audience string
+	Email    *string
+	// ExpiresAt is the Unix (seconds) time after which the key is not valid; zero for no expiry.
+	ExpiresAt int64
+	Name      string
+	// Roles default to the roles of the service account.
+	Roles []string
+	// Scopes, for a key with an Audience, are the scopes requested. Only scopes the roles of the
+	// key grant are allowed; if nil, all the scopes the roles grant.
+	Scopes []string
+}
+
+// ServiceAccount describes a service account; returned by PathServiceAccounts.
+type ServiceAccount struct {
+	Email  string
+	Roles  []string
+	Tenant string `json:",omitempty"`
+}
+
+// apiKey is persisted in kvsAPIKey, keyed by ID.
+type apiKey struct {
+	APIKey
+	// Hash is the SHA256 hash of the key, hex encoded.
+	Hash string
+}
+
+// apiKeyCached are claims for an API key, from the auth service, cached by a service without
+// the auth data source.
+type apiKeyCached struct {
+	claims  *CustomClaims
+	expires time.Time
+}
+
+const (
+	// APIKeyHeader is the request header with an API key; an alternative to a JWT in the
+	// Authorization header.
+	APIKeyHeader = "X-API-Key"
+
+	// apiKeyCacheInterval limits how long a service without the auth data source uses claims for
+	// an API key before asking the auth service again; I.E. how long a revoked key is accepted.
+	apiKeyCacheInterval = time.Minute
+	// apiKeyLastUsedInterval limits writes of APIKey.LastUsed.
+	apiKeyLastUsedInterval = time.Minute
+	kvsAPIKeyTable         = "authAPIKey"
+	queryParamEmail        = "email"
+	queryParamID           = "id"
+)
+
+var (
+	apiKeyCache      = map[string]apiKeyCached{}
+	apiKeyCacheMutex sync.Mutex
+)
+
+// handlerAPIKeys lists, creates, and revokes API keys for service accounts. Requires RoleAdmin.
+// http.MethodDelete - revoke the key with query parameter id.
+// http.MethodGet - list the keys, for the service account with query parameter email if provided.
+// http.MethodPost - create a key; the body is an APIKeyRequest, and an APIKeyCreated is returned.
+func handlerAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		id := r.URL.Query().Get(queryParamID)
+		ak := apiKey{}
+		if err := kvsAPIKey.Deserialize(id, &ak); err != nil {
+			lpf(logh.Error, "kvsAPIKey.Deserialize error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if ak.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := kvsAPIKey.Delete(id); err != nil {
+			lpf(logh.Error, "kvsAPIKey.Delete error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("API key revoked, id: %s, email: %s", id, ak.Email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		em := r.URL.Query().Get(queryParamEmail)
+		keys, err := apiKeysList(func(ak apiKey) bool { return em == "" || ak.Email == em })
+		if err != nil {
+			lpf(logh.Error, "apiKeysList error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out := make([]APIKey, 0, len(keys))
+		for _, ak := range keys {
+			out = append(out, ak.APIKey)
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		akr := APIKeyRequest{}
+		if err := httph.BodyUnmarshal(w, r, &akr); err != nil {
+			lpf(logh.Error, "API key error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		if akr.Email == nil || rolesValidate(akr.Roles) != nil ||
+			(akr.ExpiresAt != 0 && akr.ExpiresAt <= time.Now().Unix()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		auth, err := authGet(*akr.Email)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.Email == nil || !auth.ServiceAccount {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		roles := akr.Roles
+		if roles == nil {
+			roles = auth.Roles
+		}
+		for _, role := range roles {
+			if !hasRole(auth.Roles, role) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		scopes, err := audienceScopes(akr.Audience, akr.Scopes, roles)
+		if err != nil {
+			lpf(logh.Error, "audienceScopes error:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if akr.Scopes != nil && len(scopes) != len(akr.Scopes) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		created, err := apiKeyCreate(*akr.Email, akr.Name, roles, akr.ExpiresAt, akr.Audience, scopes)
+		if err != nil {
+			lpf(logh.Error, "apiKeyCreate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("API key created, id: %s, email: %s, roles: %v", created.ID, created.Email, created.Roles)
+			if created.Audience != "" {
+				aw.Message += fmt.Sprintf(", audience: %s, scopes: %v", created.Audience, created.Scopes)
+			}
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerAPIKeyToken exchanges the API key in APIKeyHeader for a token; used by services
+// without the auth data source to authenticate API keys.
+// http.MethodPost - get a token; the body is the token.
+func handlerAPIKeyToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := apiKeyClaims(r.Header.Get(APIKeyHeader))
+	if err != nil {
+		lpf(logh.Error, "apiKeyClaims error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if claims == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	tc := CustomClaims{Email: claims.Email, Roles: claims.Roles, Scopes: claims.Scopes, Tenant: claims.Tenant}
+	tc.Audience = claims.Audience
+	tokenString, err := tokenStringCreate(tc, r)
+	if err != nil {
+		lpf(logh.Error, "tokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("API key exchanged for a token, id: %s, email: %s", claims.TokenID, claims.Email)
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerServiceAccounts lists, creates, and deletes service accounts. Service accounts have no
+// password, and authenticate using API keys. Requires RoleAdmin.
+// http.MethodDelete - delete the service account with query parameter email, and its API keys.
+// http.MethodGet - list the service accounts.
+// http.MethodPost - create a service account; the body is a Credential with Email, Roles, and
+// Tenant, the Password is ignored.
+func handlerServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		em := r.URL.Query().Get(queryParamEmail)
+		auth, err := authGet(em)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.Email == nil || !auth.ServiceAccount {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, err := apiKeysRevoke(func(ak apiKey) bool { return ak.Email == em })
+		if err != nil {
+			lpf(logh.Error, "apiKeysRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := kvsAuth.Delete(em); err != nil {
+			lpf(logh.Error, "kvsAuth.Delete error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := subjectRevoke(em); err != nil {
+			lpf(logh.Error, "subjectRevoke error:%v", err)
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("service account deleted, and %d API keys revoked, for email: %s", n, em)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		keys, err := kvsAuth.Keys()
+		if err != nil {
+			lpf(logh.Error, "kvsAuth.Keys error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out := []ServiceAccount{}
+		for _, key := range keys {
+			auth, err := authGet(key)
+			if err != nil {
+				lpf(logh.Error, "authGet error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if auth.Email != nil && auth.ServiceAccount {
+				out = append(out, ServiceAccount{Email: *auth.Email, Roles: auth.Roles, Tenant: auth.Tenant})
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		em := ""
+		cred := Credential{Email: &em}
+		if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+			lpf(logh.Error, "service account error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		em = strings.TrimSpace(em)
+		tenant := ""
+		if cred.Tenant != nil {
+			tenant = *cred.Tenant
+		}
+		if em == "" || rolesValidate(cred.Roles) != nil || TenantValidate(tenant) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		auth, err := authGet(em)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.Email != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		roles := cred.Roles
+		if roles == nil {
+			roles = config.DefaultRoles
+		}
+		if err := authCreate(authentication{Email: &em, Roles: roles, ServiceAccount: true, Tenant: tenant}); err != nil {
+			lpf(logh.Error, "authCreate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("service account created for email: %s, roles: %v, tenant: %s", em, roles, tenant)
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// apiKeyAuthenticated authenticates the API key. Services with the auth data source validate the
+// key, other services exchange the key with the auth service (Config.APIKeyTokenURL) and cache
+// the claims for apiKeyCacheInterval. The key must be for this service; see audienceValid. On
+// any error the header is written with the appropriate
+// http.Status; callers should not write header status.
+func apiKeyAuthenticated(w http.ResponseWriter, key string) (*CustomClaims, error) {
+	var claims *CustomClaims
+	var err error
+	if config.DataSourcePath != "" {
+		claims, err = apiKeyClaims(key)
+	} else {
+		claims, err = apiKeyClaimsRemote(key)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	if claims == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key not valid", runtimeh.SourceInfo())
+	}
+	if !audienceValid(claims) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s API key audience: %s not valid", runtimeh.SourceInfo(), claims.Audience)
+	}
+	return claims, nil
+}
+
+// apiKeyClaims returns the claims for a valid API key, or nil. The roles are the roles of the
+// key that the service account still has, and the scopes are the scopes of the key those roles
+// still grant. LastUsed is updated.
+func apiKeyClaims(key string) (*CustomClaims, error) {
+	id, _, found := strings.Cut(key, ".")
+	if !found {
+		return nil, nil
+	}
+	ak := apiKey{}
+	if err := kvsAPIKey.Deserialize(id, &ak); err != nil {
+		return nil, err
+	}
+	hash := apiKeyHash(key)
+	if ak.ID == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(ak.Hash)) != 1 {
+		return nil, nil
+	}
+	now := time.Now()
+	if ak.ExpiresAt != 0 && now.Unix() > ak.ExpiresAt {
+		return nil, nil
+	}
+	auth, err := authGet(ak.Email)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Email == nil || !auth.ServiceAccount || auth.Disabled {
+		return nil, nil
+	}
+	roles := []string{}
+	for _, role := range ak.Roles {
+		if hasRole(auth.Roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	var scopes []string
+	if ak.Audience != "" {
+		granted, err := audienceScopes(ak.Audience, nil, roles)
+		if err != nil {
+			return nil, err
+		}
+		scopes = []string{}
+		for _, s := range ak.Scopes {
+			if slices.Contains(granted, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+
+	if now.Sub(time.Unix(ak.LastUsed, 0)) > apiKeyLastUsedInterval {
+		ak.LastUsed = now.Unix()
+		if err := kvsAPIKey.Serialize(ak.ID, ak); err != nil {
+			lpf(logh.Error, "kvsAPIKey.Serialize error:%v", err)
+		}
+	}
+	claims := &CustomClaims{Email: ak.Email, Roles: roles, Scopes: scopes, Tenant: auth.Tenant, TokenID: ak.ID}
+	claims.Audience = ak.Audience
+	return claims, nil
+}
+
+// apiKeyClaimsRemote returns the claims for a valid API key, or nil, using the auth service.
+func apiKeyClaimsRemote(key string) (*CustomClaims, error) {
+	if config.APIKeyTokenURL == "" {
+		return nil, nil
+	}
+	hash := apiKeyHash(key)
+	apiKeyCacheMutex.Lock()
+	cached, ok := apiKeyCache[hash]
+	apiKeyCacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.claims, nil
+	}
+
+	client := config.AuthServiceClient
+	if client == nil {
+		client = &http.Client{Timeout: jwksTimeout}
+	}
+	req, err := http.NewRequest(http.MethodPost, config.APIKeyTokenURL, nil)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	req.Header.Set(APIKeyHeader, key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("%s API key POST %s status: %d", runtimeh.SourceInfo(), config.APIKeyTokenURL, resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, jwksResponseLimit))
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	claims, err := parseClaims(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(apiKeyCacheInterval)
+	if exp := time.Unix(claims.ExpiresAt, 0); exp.Before(expires) {
+		expires = exp
+	}
+	apiKeyCacheMutex.Lock()
+	for k, v := range apiKeyCache {
+		if time.Now().After(v.expires) {
+			delete(apiKeyCache, k)
+		}
+	}
+	apiKeyCache[hash] = apiKeyCached{claims: claims, expires: expires}
+	apiKeyCacheMutex.Unlock()
+	return claims, nil
+}
+
+// apiKeyCreate creates and stores an API key.
+func apiKeyCreate(email string, name string, roles []string, expiresAt int64, audience string, scopes []string) (APIKeyCreated, error) {
+	id, err := uniqueID(false)
+	if err != nil {
+		return APIKeyCreated{}, err
+	}
+	// 256 bits
+	s1, err := uniqueID(false)
+	if err != nil {
+		return APIKeyCreated{}, err
+	}
+	s2, err := uniqueID(false)
+	if err != nil {
+		return APIKeyCreated{}, err
+	}
+	key := id + "." + s1 + s2
+
+	ak := apiKey{APIKey: APIKey{Audience: audience, Created: time.Now().Unix(), Email: email, ExpiresAt: expiresAt,
+		ID: id, Name: name, Roles: roles, Scopes: scopes}, Hash: apiKeyHash(key)}
+	if err := kvsAPIKey.Serialize(id, ak); err != nil {
+		return APIKeyCreated{}, err
+	}
+	return APIKeyCreated{APIKey: ak.APIKey, Key: key}, nil
+}
+
+// apiKeyHash returns the SHA256 hash of the key, hex encoded.
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeysList returns the API keys for which match returns true, oldest first.
+func apiKeysList(match func(apiKey) bool) ([]apiKey, error) {
+	keys, err := kvsAPIKey.Keys()
+	if err != nil {
+		return nil, err
+	}
+	out := []apiKey{}
+	for _, key := range keys {
+		ak := apiKey{}
+		if err := kvsAPIKey.Deserialize(key, &ak); err != nil {
+			return nil, err
+		}
+		if match(ak) {
+			out = append(out, ak)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created < out[j].Created })
+	return out, nil
+}
+
+// apiKeysRevoke deletes the API keys for which match returns true, and returns the count.
+func apiKeysRevoke(match func(apiKey) bool) (int, error) {
+	keys, err := apiKeysList(match)
+	if err != nil {
+		return 0, err
+	}
+	for i, ak := range keys {
+		if _, err := kvsAPIKey.Delete(ak.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// writeJSON writes v as the JSON body with status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
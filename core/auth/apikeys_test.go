@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAPIKeys verifies service accounts and API keys are managed by administrators, and that
+// API keys authenticate in the wrappers, with the roles of the key.
+func TestAPIKeys(t *testing.T) {
+	testSetup()
+
+	saServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerServiceAccounts)))
+	defer saServer.Close()
+	akServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerAPIKeys)))
+	defer akServer.Close()
+	opServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleOperator, handlerTest)))
+	defer opServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+
+	em := "robot@auth.com"
+	body, _ := json.Marshal(Credential{Email: &em, Roles: []string{RoleOperator}})
+	if status, _ := request(t, saServer.URL, http.MethodPost, adminToken, body); status != http.StatusCreated {
+		t.Errorf("create service account status: %d", status)
+		return
+	}
+	if status, _ := request(t, saServer.URL, http.MethodPost, adminToken, body); status != http.StatusConflict {
+		t.Errorf("create existing service account status: %d", status)
+		return
+	}
+
+	// Keys cannot have roles the service account does not have.
+	body, _ = json.Marshal(APIKeyRequest{Email: &em, Roles: []string{RoleAdmin}})
+	if status, _ := request(t, akServer.URL, http.MethodPost, adminToken, body); status != http.StatusBadRequest {
+		t.Errorf("create key with admin status: %d", status)
+		return
+	}
+	body, _ = json.Marshal(APIKeyRequest{Email: &em, Name: "ci"})
+	status, b := request(t, akServer.URL, http.MethodPost, adminToken, body)
+	created := APIKeyCreated{}
+	if err := json.Unmarshal(b, &created); status != http.StatusCreated || err != nil || created.Key == "" {
+		t.Errorf("create key status: %d, error: %v", status, err)
+		return
+	}
+	if b, _ := kvsAPIKey.Get(created.ID); bytes.Contains(b, []byte(created.Key)) {
+		t.Errorf("API key was not stored hashed")
+		return
+	}
+
+	if status := apiKeyRequest(t, opServer.URL, created.Key); status != http.StatusNoContent {
+		t.Errorf("request with API key status: %d", status)
+		return
+	}
+	if status := apiKeyRequest(t, opServer.URL, created.ID+".bad"); status != http.StatusUnauthorized {
+		t.Errorf("request with bad API key status: %d", status)
+		return
+	}
+	status, b = request(t, akServer.URL+"?email="+em, http.MethodGet, adminToken, nil)
+	keys := []APIKey{}
+	if err := json.Unmarshal(b, &keys); status != http.StatusOK || err != nil || len(keys) != 1 ||
+		keys[0].LastUsed == 0 || bytes.Contains(b, []byte(created.Key)) {
+		t.Errorf("list status: %d, keys: %+v, error: %v", status, keys, err)
+		return
+	}
+
+	expired, err := apiKeyCreate(em, "expired", []string{RoleOperator}, time.Now().Add(-time.Second).Unix(), "", nil)
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	if status := apiKeyRequest(t, opServer.URL, expired.Key); status != http.StatusUnauthorized {
+		t.Errorf("request with expired API key status: %d", status)
+		return
+	}
+
+	if status, _ := request(t, akServer.URL+"?id="+created.ID, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("revoke status: %d", status)
+		return
+	}
+	if status := apiKeyRequest(t, opServer.URL, created.Key); status != http.StatusUnauthorized {
+		t.Errorf("request with revoked API key status: %d", status)
+		return
+	}
+
+	if status, _ := request(t, saServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("delete service account status: %d", status)
+		return
+	}
+	if keys, err := apiKeysList(func(ak apiKey) bool { return ak.Email == em }); err != nil || len(keys) != 0 {
+		t.Errorf("keys not revoked with the service account: %+v, error: %v", keys, err)
+		return
+	}
+}
+
+// TestAPIKeysRemote verifies a service without the auth data source exchanges API keys with the
+// auth service, and caches the claims.
+func TestAPIKeysRemote(t *testing.T) {
+	testSetup()
+
+	em := "robot@auth.com"
+	if err := authCreate(authentication{Email: &em, Roles: []string{RoleViewer}, ServiceAccount: true}); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	created, err := apiKeyCreate(em, "remote", []string{RoleViewer}, 0, "", nil)
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerAPIKeyToken)))
+	defer tokenServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+	config.DataSourcePath = ""
+	config.APIKeyTokenURL = tokenServer.URL
+	defer func() {
+		config.DataSourcePath = dataSourcePath
+		config.APIKeyTokenURL = ""
+	}()
+
+	if status := apiKeyRequest(t, viewerServer.URL, created.Key); status != http.StatusNoContent {
+		t.Errorf("request with API key status: %d", status)
+		return
+	}
+	if status := apiKeyRequest(t, viewerServer.URL, created.ID+".bad"); status != http.StatusUnauthorized {
+		t.Errorf("request with bad API key status: %d", status)
+		return
+	}
+
+	// Revoked keys are accepted until the cached claims expire.
+	if _, err := apiKeysRevoke(func(ak apiKey) bool { return true }); err != nil {
+		t.Errorf("apiKeysRevoke error: %v", err)
+		return
+	}
+	if status := apiKeyRequest(t, viewerServer.URL, created.Key); status != http.StatusNoContent {
+		t.Errorf("request with cached API key status: %d", status)
+		return
+	}
+	apiKeyCacheMutex.Lock()
+	apiKeyCache = map[string]apiKeyCached{}
+	apiKeyCacheMutex.Unlock()
+	if status := apiKeyRequest(t, viewerServer.URL, created.Key); status != http.StatusUnauthorized {
+		t.Errorf("request with revoked API key status: %d", status)
+		return
+	}
+}
+
+// TestAPIKeysAudience verifies API keys for an audience have the scopes requested, are only
+// accepted by that audience, locally and by services exchanging the key, and that keys without
+// an audience are rejected by services requiring their audience.
+func TestAPIKeysAudience(t *testing.T) {
+	testSetup()
+	config.Audiences = []Audience{{Name: "telemetry",
+		Scopes: map[string]string{"telemetry:execute": RoleOperator, "telemetry:read": RoleViewer}}}
+
+	akServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerAPIKeys)))
+	defer akServer.Close()
+	tokenServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerAPIKeyToken)))
+	defer tokenServer.Close()
+	executeServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer,
+		func(w http.ResponseWriter, r *http.Request) {
+			if !RequireScope(w, r, "telemetry:execute") {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	defer executeServer.Close()
+	readServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer,
+		func(w http.ResponseWriter, r *http.Request) {
+			if !RequireScope(w, r, "telemetry:read") {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	defer readServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "robot@auth.com"
+	if err := authCreate(authentication{Email: &em, Roles: []string{RoleOperator}, ServiceAccount: true}); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+
+	for _, akr := range []APIKeyRequest{{Audience: "other", Email: &em},
+		{Audience: "telemetry", Email: &em, Scopes: []string{"telemetry:write"}},
+		{Audience: "telemetry", Email: &em, Roles: []string{RoleViewer}, Scopes: []string{"telemetry:execute"}},
+		{Email: &em, Scopes: []string{"telemetry:read"}}} {
+		body, _ := json.Marshal(akr)
+		if status, _ := request(t, akServer.URL, http.MethodPost, adminToken, body); status != http.StatusBadRequest {
+			t.Errorf("request: %+v, status: %d", akr, status)
+			return
+		}
+	}
+	body, _ := json.Marshal(APIKeyRequest{Audience: "telemetry", Email: &em, Scopes: []string{"telemetry:read"}})
+	status, b := request(t, akServer.URL, http.MethodPost, adminToken, body)
+	created := APIKeyCreated{}
+	if err := json.Unmarshal(b, &created); status != http.StatusCreated || err != nil ||
+		created.Audience != "telemetry" || len(created.Scopes) != 1 || created.Scopes[0] != "telemetry:read" {
+		t.Errorf("create key status: %d, key: %+v, error: %v", status, created.APIKey, err)
+		return
+	}
+	noAudience, err := apiKeyCreate(em, "none", []string{RoleOperator}, 0, "", nil)
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+
+	tests := []struct {
+		url    string
+		key    string
+		status int
+	}{
+		{readServer.URL, created.Key, http.StatusNoContent},
+		{executeServer.URL, created.Key, http.StatusForbidden},
+		{readServer.URL, noAudience.Key, http.StatusUnauthorized},
+	}
+	check := func(name string) bool {
+		for i, test := range tests {
+			if status := apiKeyRequest(t, test.url, test.key); status != test.status {
+				t.Errorf("%s i: %d, status: %d", name, i, status)
+				return false
+			}
+		}
+		return true
+	}
+	if status := apiKeyRequest(t, readServer.URL, created.Key); status != http.StatusUnauthorized {
+		t.Errorf("other audience status: %d", status)
+		return
+	}
+	config.Audience = "telemetry"
+	defer func() { config.Audience = "" }()
+	if !check("local") {
+		return
+	}
+
+	config.DataSourcePath = ""
+	config.APIKeyTokenURL = tokenServer.URL
+	defer func() {
+		config.DataSourcePath = dataSourcePath
+		config.APIKeyTokenURL = ""
+	}()
+	check("remote")
+}
+
+// apiKeyRequest sends a GET with the API key and returns the response status.
+func apiKeyRequest(t *testing.T, url string, key string) int {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return 0
+	}
+	req.Header.Set(APIKeyHeader, key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Do error: %v", err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
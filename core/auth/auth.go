@@ -0,0 +1,1112 @@
+// Package auth implements JWT authentication, and role based authorization, for rest-app.
+// It is a fork of github.com/paulfdunn/authjwt v1.3.2, so rest-app can extend it. The API differs
+// from authjwt: Config.AuditLogName was removed, as the handler wrappers write audit records to
+// the hash chained audit log (core/audit). Other differences are additions; I.E. accounts have
+// roles, which are carried as claims in the JWT.
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/storage"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type Config struct {
+	// AdminEmails are accounts given RoleAdmin at Init when they have no roles; I.E. accounts
+	// created before roles were added. Other accounts without roles are given DefaultRoles.
+	AdminEmails []string
+	// APIKeyTokenURL is the URL of PathAPIKeyToken of the auth service, for services that only
+	// validate tokens; API keys are exchanged for claims using the auth service. If empty, API
+	// keys are only accepted by services with a DataSourcePath.
+	APIKeyTokenURL string
+	// AppName is used to populate the Issuer field of the Claims, unless IssuerURL is provided.
+	AppName string
+	// Audience is the audience claim required of tokens; I.E. the AppName of this service, so
+	// tokens issued for other services are rejected with http.StatusUnauthorized. If empty, tokens
+	// without an audience, or with the audience AppName, are accepted. API keys are limited by
+	// audience the same as tokens; see APIKeyRequest.Audience.
+	Audience string
+	// Audiences are the services, and their scopes, for which this auth service issues tokens;
+	// see Credential.Audience.
+	Audiences []Audience
+	// AuthServiceClient is the client used for requests to the auth service (JWKSURL,
+	// APIKeyTokenURL); I.E. to provide a TLS configuration. If nil, a client with a timeout is used.
+	AuthServiceClient *http.Client
+	// DataSourcePath is the path to the data source used to persist auth and tokens.
+	DataSourcePath string
+	// CreateRequiresAuth - when true, requires an already authorized caller to create new
+	// credentials. When false any caller can create their own auth.
+	CreateRequiresAuth bool
+	// CredentialBackend verifies the passwords, and provides the roles, of accounts without a
+	// password in the auth datastore; I.E. HtpasswdBackend or LDAPBackend for an existing user
+	// directory. Those accounts are added to the auth datastore at login, with the roles from the
+	// backend, and cannot set a password with this service. If nil, DatastoreBackend is used.
+	CredentialBackend CredentialBackend
+	// DefaultRoles are the roles given to new accounts when none are specified. If nil,
+	// RoleViewer is used.
+	DefaultRoles []string
+	// ImpersonationExpirationInterval is the duration for which an impersonation token is valid;
+	// see PathImpersonate. If zero, 15 minutes is used. Tokens are never valid longer than
+	// JWTAuthExpirationInterval.
+	ImpersonationExpirationInterval time.Duration
+	// IssuerURL is the URL of this service, used as the issuer in PathOpenIDConfiguration and
+	// the Issuer field of the Claims. If empty, the issuer in PathOpenIDConfiguration is the
+	// URL of the request, and AppName is the Issuer of the Claims.
+	IssuerURL string
+	// JWKSRefreshInterval is the interval at which the JWKS is fetched again. If zero, an hour is
+	// used. The JWKS is also fetched when a token has an unknown kid.
+	JWKSRefreshInterval time.Duration
+	// JWKSURL is the URL of the JWKS (see PathJWKS) of the auth service, for services that
+	// only validate tokens. The keys are fetched and cached, and when the JWKS cannot be fetched
+	// the pinned key at JWTPublicKeyPath is used. If empty, only JWTPublicKeyPath is used.
+	JWKSURL string
+	// JWTAuthRemoveInterval is the interval at which a GO routine runs, checks for expired
+	// tokens, and invalidates all expired tokens. (A user can login from multiple devices
+	// and can have more than one outstanding token.) If negative, expired tokens are not removed.
+	JWTAuthRemoveInterval time.Duration
+	// JWTAuthExpirationInterval is the duration for which a token is valid.
+	JWTAuthExpirationInterval time.Duration
+	// JWTPrivateKeyPath is the path to the private key used for signing the tokens. With a
+	// DataSourcePath, this key is added to the keyset when the keyset is empty, and the keyset
+	// is used thereafter; see PathKeys.
+	JWTPrivateKeyPath string
+	// KeyRotationInterval is the interval at which a new signing key is created. Prior keys are
+	// accepted until the tokens they signed expire. If zero, keys are only rotated using PathKeys.
+	KeyRotationInterval time.Duration
+	// JWTPublicKeyPath is the path to the public key used for signing the tokens. Optional
+	// when JWKSURL is provided.
+	JWTPublicKeyPath string
+	// LoginFailureDelay is the delay after a failed login before another login is allowed, for
+	// the Email and for the source IP. The delay doubles with each consecutive failure, up to
+	// LoginFailureDelayMax. If zero, 1 second is used.
+	LoginFailureDelay time.Duration
+	// LoginFailureDelayMax is the maximum delay after a failed login. If zero, 30 seconds is
+	// used.
+	LoginFailureDelayMax time.Duration
+	// LoginLockoutDuration is the duration an Email or source IP is locked out after
+	// LoginLockoutThreshold or LoginLockoutIPThreshold failed logins. Failures are forgotten
+	// after this duration without a failure. If zero, 15 minutes is used.
+	LoginLockoutDuration time.Duration
+	// LoginLockoutIPThreshold is the count of failed logins from a source IP, for any Email,
+	// after which the IP is locked out. If zero, 20 is used.
+	LoginLockoutIPThreshold int
+	// LoginLockoutThreshold is the count of failed logins for an Email after which the account
+	// is locked out. If zero, 5 is used.
+	LoginLockoutThreshold int
+	// LogName is the name of the logh logger for general logging. Callers
+	// must create their own logh loggers or output will go to STDOUT.
+	LogName string
+	// PasswordPolicy is the policy passwords must comply with, until an administrator updates the
+	// policy using PathPasswordPolicy. If nil, the policy is PasswordValidation.
+	PasswordPolicy *PasswordPolicy
+	// PasswordResetExpirationInterval is the duration for which a password reset token is valid.
+	// If zero, 15 minutes is used.
+	PasswordResetExpirationInterval time.Duration
+	// PasswordResetNotifier delivers password reset tokens to users; see PathPasswordReset. If
+	// nil, self-service password reset is disabled, and an administrator must set the password.
+	PasswordResetNotifier Notifier
+	// PasswordValidation is a slice of REGEX used for password validation when PasswordPolicy is
+	// nil. If nothing is provided, defaultPasswordValidation is used.
+	PasswordValidation []string
+	// RefreshTokenExpirationInterval is the duration for which a refresh token is valid. Refresh
+	// tokens are rotated on each use, so a session lasts while the refresh token is used within
+	// this interval. If zero, refresh tokens are not issued.
+	RefreshTokenExpirationInterval time.Duration
+	// RefreshTokenMaxInterval is the maximum duration of a session using refresh tokens,
+	// regardless of use; the user must then login. If zero there is no maximum.
+	RefreshTokenMaxInterval time.Duration
+	// PathAPIKeys is the URL path for administrators to list, create, and revoke API keys.
+	// If empty the default is used: /auth/api-keys
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet, http.MethodPost
+	PathAPIKeys string
+	// PathAPIKeyToken is the URL path to exchange an API key for a token; see APIKeyTokenURL.
+	// If empty the default is used: /auth/api-key-token
+	// Valid HTTP methods: http.MethodPost
+	PathAPIKeyToken string
+	// PathCreateOrUpdate is the final portion of the URL path for auth create or update.
+	// If empty the default is used: /auth/createorupdate
+	// Valid HTTP methods: http.MethodPost, http.MethodPut
+	PathCreateOrUpdate string
+	// PathDelete is the final portion of the URL path for delete. If empty the
+	// default is used: /auth/delete
+	// Valid HTTP methods: http.MethodDelete
+	PathDelete string
+	// PathImpersonate is the URL path for administrators to get a token for another user. If
+	// empty the default is used: /auth/impersonate
+	// Valid HTTP methods: http.MethodPost
+	PathImpersonate string
+	// PathInfo is the final portion of the URL path for info. If empty the
+	// default is used: /auth/info
+	// Valid HTTP methods: http.MethodGet
+	PathInfo string
+	// PathJWKS is the URL path for the JWKS with the public keys used to verify tokens. If empty
+	// the default is used: /.well-known/jwks.json
+	// Valid HTTP methods: http.MethodGet
+	PathJWKS string
+	// PathKeys is the URL path for administrators to list the signing keys, or rotate the
+	// signing key. If empty the default is used: /auth/keys
+	// Valid HTTP methods: http.MethodGet, http.MethodPost
+	PathKeys string
+	// PathLockouts is the URL path for administrators to list the failed logins of accounts and
+	// source IPs, and to unlock them. If empty the default is used: /auth/lockouts
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet
+	PathLockouts string
+	// PathLogin is the final portion of the URL path for login. If empty the
+	// default is used: /auth/login
+	// Valid HTTP methods: http.MethodPut
+	PathLogin string
+	// PathLogout is the final portion of the URL path for logout. If empty the
+	// default is used: /auth/logout
+	// Valid HTTP methods: http.MethodDelete
+	PathLogout string
+	// PathLogoutAll is the final portion of the URL path for logout-all. If empty the
+	// default is used: /auth/logout-all
+	// Valid HTTP methods: http.MethodDelete
+	PathLogoutAll string
+	// PathOAuthIntrospect is the URL path for OAuth2 token introspection (RFC 7662). If empty
+	// the default is used: /oauth/introspect
+	// Valid HTTP methods: http.MethodPost
+	PathOAuthIntrospect string
+	// PathOAuthToken is the URL path for the OAuth2 client credentials grant. If empty the
+	// default is used: /oauth/token
+	// Valid HTTP methods: http.MethodPost
+	PathOAuthToken string
+	// PathOpenIDConfiguration is the URL path for the OpenID Connect Discovery metadata. If empty
+	// the default is used: /.well-known/openid-configuration
+	// Valid HTTP methods: http.MethodGet
+	PathOpenIDConfiguration string
+	// PathPasswordPolicy is the URL path for administrators to view and update the password
+	// policy. If empty the default is used: /auth/password-policy
+	// Valid HTTP methods: http.MethodGet, http.MethodPut
+	PathPasswordPolicy string
+	// PathPasswordReset is the URL path for users to request a password reset token, and to set
+	// a new password using the token. Registered when PasswordResetNotifier is provided. If empty
+	// the default is used: /auth/password-reset
+	// Valid HTTP methods: http.MethodPost, http.MethodPut
+	PathPasswordReset string
+	// PathRefresh is the final portion of the URL path for refresh. If empty the
+	// default is used: /auth/refresh
+	// Valid HTTP methods: http.MethodPost
+	PathRefresh string
+	// PathRefreshToken is the final portion of the URL path for exchanging a refresh token for
+	// an access token. If empty the default is used: /auth/refresh-token
+	// Valid HTTP methods: http.MethodDelete, http.MethodPost
+	PathRefreshToken string
+	// PathServiceAccounts is the URL path for administrators to list, create, and delete service
+	// accounts. If empty the default is used: /auth/service-accounts
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet, http.MethodPost
+	PathServiceAccounts string
+	// PathSessions is the URL path for users to list and revoke their sessions (issued tokens),
+	// and administrators to list and revoke the sessions of any user. If empty the default is
+	// used: /auth/sessions
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet
+	PathSessions string
+	// PathRevocations is the URL path for the list of revoked tokens; see RevocationsURL.
+	// If empty the default is used: /auth/revocations
+	// Valid HTTP methods: http.MethodGet
+	PathRevocations string
+	// PathRoles is the final portion of the URL path for setting the roles of an account.
+	// If empty the default is used: /auth/roles
+	// Valid HTTP methods: http.MethodPut
+	PathRoles string
+	// PathTOTP is the URL path for TOTP two factor authentication enrollment. If empty the
+	// default is used: /auth/totp
+	// Valid HTTP methods: http.MethodDelete, http.MethodPost, http.MethodPut
+	PathTOTP string
+	// PathUsers is the URL path for administrators to list, get, disable, enable, require a
+	// password reset for, and delete users. If empty the default is used: /auth/users
+	// Valid HTTP methods: http.MethodDelete, http.MethodGet, http.MethodPut
+	PathUsers string
+	// RevocationPollInterval is the interval at which the list of revoked tokens is fetched from
+	// RevocationsURL. If zero, 5 seconds is used.
+	RevocationPollInterval time.Duration
+	// RevocationsURL is the URL of PathRevocations of the auth service, for services that only
+	// validate tokens; tokens in the list are rejected. If empty, tokens are valid until they
+	// expire.
+	RevocationsURL string
+	// TOTPRequiredRole requires TOTP for accounts with this role, or a role that grants it; I.E.
+	// RoleOperator for accounts that can run commands. Until TOTP is enabled, tokens issued to
+	// those accounts have no roles, and can only be used for PathTOTP and other paths that do not
+	// require a role. If empty, TOTP is optional.
+	TOTPRequiredRole string
+	// testing true bypasses loading keys.
+	testing bool
+}
+
+// Credential is what is supplied by the HTTP request in order to authenticate.
+// Roles and Tenant are only used when creating or updating an auth, and only an administrator
+// can specify them.
+type Credential struct {
+	Email    *string
+	Password *string
+	Roles    []string `json:",omitempty"`
+	// PasswordResetRequired is set by applications calling AuthCreate, to require the user set
+	// a new password before any other authenticated call is allowed; I.E. for an initial
+	// credential. It is not read from requests.
+	PasswordResetRequired bool `json:"-"`
+	// Audience, for login, is the service the token is for; one of Config.Audiences. The token is
+	// only accepted by that service.
+	Audience string `json:",omitempty"`
+	// Scopes, for login with an Audience, are the scopes requested. Only scopes the roles of the
+	// account grant are issued. If nil, all scopes the roles grant are issued.
+	Scopes []string `json:",omitempty"`
+	// Tenant is the organization of the account, carried in its tokens; see TenantValidate.
+	// When nil, an update keeps the existing tenant and a create uses the default tenant, "".
+	Tenant *string `json:",omitempty"`
+	// TOTP is the TOTP code, or a recovery code, for login to accounts with TOTP enabled; see
+	// PathTOTP.
+	TOTP string `json:",omitempty"`
+}
+
+// CustomClaims are the Claims for the JWT token.
+type CustomClaims struct {
+	jwt.StandardClaims
+	// Actor is the email of the administrator using an impersonation token for the user Email;
+	// see PathImpersonate.
+	Actor string `json:",omitempty"`
+	Email string
+	// PasswordResetRequired tokens can only be used to set a new password; see
+	// Credential.PasswordResetRequired.
+	PasswordResetRequired bool     `json:",omitempty"`
+	Roles                 []string `json:",omitempty"`
+	// Scopes are the scopes granted for the Audience; see RequireScope.
+	Scopes []string `json:",omitempty"`
+	// Tenant is the organization of the account; services partition their data by tenant.
+	Tenant  string `json:",omitempty"`
+	TokenID string
+}
+
+// Info is used to provide information back to the user.
+type Info struct {
+	OutstandingTokens int
+	// PasswordResetRequired is true when the user must set a new password; tokens have no roles
+	// until then.
+	PasswordResetRequired bool
+	Roles                 []string
+	// TOTPEnabled is true when login requires a TOTP code.
+	TOTPEnabled bool
+	// TOTPRequired is true when Config.TOTPRequiredRole applies to the account; tokens have no
+	// roles until TOTP is enabled.
+	TOTPRequired bool
+}
+
+// authentication is persisted data about a user and their authorization.
+type authentication struct {
+	Authorizations []string `json:",omitempty"`
+	// Directory is true for accounts verified by Config.CredentialBackend; they have no password,
+	// and their roles are set at login.
+	Directory bool `json:",omitempty"`
+	// Disabled accounts cannot login, or use API keys.
+	Disabled bool    `json:",omitempty"`
+	Email    *string `json:",omitempty"`
+	// LastLogin is the Unix (seconds) time of the last login.
+	LastLogin int64 `json:",omitempty"`
+	// PasswordChanged is the Unix (seconds) time the password was set; see
+	// PasswordPolicy.MaxAgeDays.
+	PasswordChanged int64  `json:",omitempty"`
+	PasswordHash    []byte `json:",omitempty"`
+	// PasswordHistory are the hashes of prior passwords, most recent first; see
+	// PasswordPolicy.History.
+	PasswordHistory [][]byte `json:",omitempty"`
+	// PasswordResetRequired is true when the user must set a new password; see UserRequest.
+	PasswordResetRequired bool `json:",omitempty"`
+	// RecoveryCodes are the SHA256 hashes, hex encoded, of the unused TOTP recovery codes.
+	RecoveryCodes []string `json:",omitempty"`
+	Roles         []string
+	// ServiceAccount is true for accounts that authenticate with API keys, and have no password.
+	ServiceAccount bool `json:",omitempty"`
+	// Tenant is the organization of the account; see Credential.Tenant.
+	Tenant string `json:",omitempty"`
+	// TOTPEnabled is true once TOTP enrollment is confirmed; login then requires a code.
+	TOTPEnabled bool `json:",omitempty"`
+	// TOTPLastStep is the time step of the last TOTP code accepted, so codes cannot be replayed.
+	TOTPLastStep int64 `json:",omitempty"`
+	// TOTPSecret is the TOTP secret, base32 encoded. Set when enrollment starts.
+	TOTPSecret string `json:",omitempty"`
+}
+
+const (
+	// The table names are those used by authjwt, so existing data sources can be used.
+	kvsAuthTable  = "authjwtAuth"
+	kvsTokenTable = "authjwtToken"
+
+	// bcrypt, used to hash the password, has a length limit of 72
+	// https://pkg.go.dev/golang.org/x/crypto@v0.21.0/bcrypt#GenerateFromPassword
+	passwordLengthLimit = 72
+)
+
+var (
+	// config used by this package.
+	config Config
+
+	// default password validation: 8-32 characters, 1 lower case, 1 upper case, 1 special, 1 number.
+	defaultPasswordValidation = []string{`^[\S]{8,32}$`, `[a-z]`, `[A-Z]`, `[!#$%'()*+,-.\\/:;=?@\[\]^_{|}~]`, `[0-9]`}
+
+	lp  func(level logh.LoghLevel, v ...interface{})
+	lpf func(level logh.LoghLevel, format string, v ...interface{})
+
+	// The auth KVS stores authentications; one per Email.
+	kvsAuth storage.Store
+	// The token KVS stores the key (encoded as Email|TokenID) and the value is the
+	// experation in Unix (seconds) time. A user may have more than one valid token.
+	kvsToken storage.Store
+	// The refresh KVS stores refresh tokens; see refreshToken.
+	kvsRefresh storage.Store
+	// The API key KVS stores API keys; see apiKey.
+	kvsAPIKey storage.Store
+	// The revocation KVS stores revoked tokens that have not expired; see Revocation.
+	kvsRevocation storage.Store
+	// The lockout KVS stores failed logins; see LoginFailures.
+	kvsLockout storage.Store
+	// The password policy KVS stores the PasswordPolicy set using PathPasswordPolicy.
+	kvsPasswordPolicy storage.Store
+	// The password reset KVS stores password reset tokens; see passwordReset.
+	kvsPasswordReset storage.Store
+	// The session KVS stores the Session of each token, with the same key as kvsToken.
+	kvsSession storage.Store
+	// The keys KVS stores the keyset; see signingKey.
+	kvsKeys storage.Store
+
+	rsaPrivateKey *rsa.PrivateKey
+	rsaPublicKey  *rsa.PublicKey
+)
+
+// Init initializes the package.
+// createRequiresAuth == true requires auth creates to be from an already authenticated
+// user. (Use for apps that require users be added by an admin.)
+func Init(configIn Config, mux *http.ServeMux) {
+	config = configIn
+	keyset = map[string]signingKey{}
+	if config.DefaultRoles == nil {
+		config.DefaultRoles = []string{RoleViewer}
+	}
+	if err := rolesValidate(config.DefaultRoles); err != nil {
+		log.Fatalf("fatal: %s DefaultRoles error: %v", runtimeh.SourceInfo(), err)
+	}
+	if config.CredentialBackend == nil {
+		config.CredentialBackend = DatastoreBackend{}
+	}
+	if err := backendRolesValidate(config.CredentialBackend); err != nil {
+		log.Fatalf("fatal: %s CredentialBackend error: %v", runtimeh.SourceInfo(), err)
+	}
+	for _, aud := range config.Audiences {
+		for scope, role := range aud.Scopes {
+			if err := rolesValidate([]string{role}); err != nil {
+				log.Fatalf("fatal: %s Audiences %s scope %s error: %v", runtimeh.SourceInfo(), aud.Name, scope, err)
+			}
+		}
+	}
+	if config.TOTPRequiredRole != "" {
+		if err := rolesValidate([]string{config.TOTPRequiredRole}); err != nil {
+			log.Fatalf("fatal: %s TOTPRequiredRole error: %v", runtimeh.SourceInfo(), err)
+		}
+	}
+	if config.LoginFailureDelay == 0 {
+		config.LoginFailureDelay = defaultLoginFailureDelay
+	}
+	if config.LoginFailureDelayMax == 0 {
+		config.LoginFailureDelayMax = defaultLoginFailureDelayMax
+	}
+	if config.LoginLockoutDuration == 0 {
+		config.LoginLockoutDuration = defaultLoginLockoutDuration
+	}
+	if config.LoginLockoutIPThreshold == 0 {
+		config.LoginLockoutIPThreshold = defaultLoginLockoutIPThreshold
+	}
+	if config.LoginLockoutThreshold == 0 {
+		config.LoginLockoutThreshold = defaultLoginLockoutThreshold
+	}
+	if config.ImpersonationExpirationInterval == 0 {
+		config.ImpersonationExpirationInterval = defaultImpersonationExpirationInterval
+	}
+	if config.PasswordResetExpirationInterval == 0 {
+		config.PasswordResetExpirationInterval = defaultPasswordResetExpirationInterval
+	}
+
+	lp = logh.Map[config.LogName].Println
+	lpf = logh.Map[config.LogName].Printf
+
+	if configIn.testing {
+		var err error
+		rsaPrivateKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			log.Fatalf("could not generate keys for testing, error: %+v", err)
+		}
+		//nolint:errcheck // There is no error value to check.
+		pubKey := rsaPrivateKey.Public().(*rsa.PublicKey)
+		rsaPublicKey = pubKey
+	} else {
+		loadKeys(config)
+	}
+	if rsaPrivateKey != nil {
+		signingKeyID = KeyID(&rsaPrivateKey.PublicKey)
+	}
+	if config.JWKSURL != "" {
+		jwksInit()
+	}
+	if config.RevocationsURL != "" {
+		revocationsInit()
+	}
+
+	// Applicaitons must provide a mux or register the handlers themselves.
+	// For testing purposes, no mux is required.
+	if mux != nil {
+		// Set default auth paths where none was provided by the caller.
+		if config.PathAPIKeys == "" {
+			config.PathAPIKeys = "/auth/api-keys"
+		}
+		if config.PathAPIKeyToken == "" {
+			config.PathAPIKeyToken = "/auth/api-key-token"
+		}
+		if config.PathCreateOrUpdate == "" {
+			config.PathCreateOrUpdate = "/auth/createorupdate"
+		}
+		if config.PathDelete == "" {
+			config.PathDelete = "/auth/delete"
+		}
+		if config.PathImpersonate == "" {
+			config.PathImpersonate = "/auth/impersonate"
+		}
+		if config.PathInfo == "" {
+			config.PathInfo = "/auth/info"
+		}
+		if config.PathJWKS == "" {
+			config.PathJWKS = "/.well-known/jwks.json"
+		}
+		if config.PathKeys == "" {
+			config.PathKeys = "/auth/keys"
+		}
+		if config.PathLockouts == "" {
+			config.PathLockouts = "/auth/lockouts"
+		}
+		if config.PathLogin == "" {
+			config.PathLogin = "/auth/login"
+		}
+		if config.PathLogout == "" {
+			config.PathLogout = "/auth/logout"
+		}
+		if config.PathLogoutAll == "" {
+			config.PathLogoutAll = "/auth/logout-all"
+		}
+		if config.PathOAuthIntrospect == "" {
+			config.PathOAuthIntrospect = "/oauth/introspect"
+		}
+		if config.PathOAuthToken == "" {
+			config.PathOAuthToken = "/oauth/token"
+		}
+		if config.PathOpenIDConfiguration == "" {
+			config.PathOpenIDConfiguration = "/.well-known/openid-configuration"
+		}
+		if config.PathPasswordPolicy == "" {
+			config.PathPasswordPolicy = "/auth/password-policy"
+		}
+		if config.PathPasswordReset == "" {
+			config.PathPasswordReset = "/auth/password-reset"
+		}
+		if config.PathRefresh == "" {
+			config.PathRefresh = "/auth/refresh"
+		}
+		if config.PathRefreshToken == "" {
+			config.PathRefreshToken = "/auth/refresh-token"
+		}
+		if config.PathServiceAccounts == "" {
+			config.PathServiceAccounts = "/auth/service-accounts"
+		}
+		if config.PathSessions == "" {
+			config.PathSessions = "/auth/sessions"
+		}
+		if config.PathRevocations == "" {
+			config.PathRevocations = "/auth/revocations"
+		}
+		if config.PathRoles == "" {
+			config.PathRoles = "/auth/roles"
+		}
+		if config.PathTOTP == "" {
+			config.PathTOTP = "/auth/totp"
+		}
+		if config.PathUsers == "" {
+			config.PathUsers = "/auth/users"
+		}
+
+		// Registering with the trailing slash means the naked path is redirected to this path.
+		akpath := config.PathAPIKeys + "/"
+		mux.HandleFunc(akpath, HandlerFuncRoleWrapper(RoleAdmin, handlerAPIKeys))
+		lpf(logh.Info, "Registered handler: %s\n", akpath)
+		aktpath := config.PathAPIKeyToken + "/"
+		mux.HandleFunc(aktpath, HandlerFuncNoAuthWrapper(handlerAPIKeyToken))
+		lpf(logh.Info, "Registered handler: %s\n", aktpath)
+		crpath := config.PathCreateOrUpdate + "/"
+		if config.CreateRequiresAuth {
+			mux.HandleFunc(crpath, handlerFuncAuthJWTWrapper(handlerCreateOrUpdate, true))
+		} else {
+			mux.HandleFunc(crpath, HandlerFuncNoAuthWrapper(handlerCreateOrUpdate))
+		}
+		lpf(logh.Info, "Registered handler: %s\n", crpath)
+		dltpath := config.PathDelete + "/"
+		mux.HandleFunc(dltpath, HandlerFuncAuthJWTWrapper(handlerDelete))
+		lpf(logh.Info, "Registered handler: %s\n", dltpath)
+		impath := config.PathImpersonate + "/"
+		mux.HandleFunc(impath, HandlerFuncRoleWrapper(RoleAdmin, handlerImpersonate))
+		lpf(logh.Info, "Registered handler: %s\n", impath)
+		infpath := config.PathInfo + "/"
+		mux.HandleFunc(infpath, HandlerFuncAuthJWTWrapper(handlerInfo))
+		lpf(logh.Info, "Registered handler: %s\n", infpath)
+		mux.HandleFunc(config.PathJWKS, handlerJWKS)
+		lpf(logh.Info, "Registered handler: %s\n", config.PathJWKS)
+		kspath := config.PathKeys + "/"
+		mux.HandleFunc(kspath, HandlerFuncRoleWrapper(RoleAdmin, handlerKeys))
+		lpf(logh.Info, "Registered handler: %s\n", kspath)
+		lkpath := config.PathLockouts + "/"
+		mux.HandleFunc(lkpath, HandlerFuncRoleWrapper(RoleAdmin, handlerLockouts))
+		lpf(logh.Info, "Registered handler: %s\n", lkpath)
+		lipath := config.PathLogin + "/"
+		mux.HandleFunc(lipath, HandlerFuncNoAuthWrapper(handlerLogin))
+		lpf(logh.Info, "Registered handler: %s\n", lipath)
+		lopath := config.PathLogout + "/"
+		mux.HandleFunc(lopath, HandlerFuncAuthJWTWrapper(handlerLogout))
+		lpf(logh.Info, "Registered handler: %s\n", lopath)
+		loapath := config.PathLogoutAll + "/"
+		mux.HandleFunc(loapath, HandlerFuncAuthJWTWrapper(handlerLogoutAll))
+		lpf(logh.Info, "Registered handler: %s\n", loapath)
+		// The OAuth2 paths are registered without the trailing slash, as clients POST to the
+		// URLs from PathOpenIDConfiguration, and a redirect would drop the body.
+		mux.HandleFunc(config.PathOAuthIntrospect, HandlerFuncNoAuthWrapper(handlerOAuthIntrospect))
+		lpf(logh.Info, "Registered handler: %s\n", config.PathOAuthIntrospect)
+		mux.HandleFunc(config.PathOAuthToken, HandlerFuncNoAuthWrapper(handlerOAuthToken))
+		lpf(logh.Info, "Registered handler: %s\n", config.PathOAuthToken)
+		mux.HandleFunc(config.PathOpenIDConfiguration, handlerOpenIDConfiguration)
+		lpf(logh.Info, "Registered handler: %s\n", config.PathOpenIDConfiguration)
+		pppath := config.PathPasswordPolicy + "/"
+		mux.HandleFunc(pppath, HandlerFuncRoleWrapper(RoleAdmin, handlerPasswordPolicy))
+		lpf(logh.Info, "Registered handler: %s\n", pppath)
+		if config.PasswordResetNotifier != nil {
+			prpath := config.PathPasswordReset + "/"
+			mux.HandleFunc(prpath, HandlerFuncNoAuthWrapper(handlerPasswordReset))
+			lpf(logh.Info, "Registered handler: %s\n", prpath)
+		}
+		rfpath := config.PathRefresh + "/"
+		mux.HandleFunc(rfpath, HandlerFuncAuthJWTWrapper(handlerRefresh))
+		lpf(logh.Info, "Registered handler: %s\n", rfpath)
+		rtpath := config.PathRefreshToken + "/"
+		mux.HandleFunc(rtpath, HandlerFuncNoAuthWrapper(handlerRefreshToken))
+		lpf(logh.Info, "Registered handler: %s\n", rtpath)
+		rvpath := config.PathRevocations + "/"
+		mux.HandleFunc(rvpath, handlerRevocations)
+		lpf(logh.Info, "Registered handler: %s\n", rvpath)
+		rlpath := config.PathRoles + "/"
+		mux.HandleFunc(rlpath, HandlerFuncRoleWrapper(RoleAdmin, handlerRoles))
+		lpf(logh.Info, "Registered handler: %s\n", rlpath)
+		sapath := config.PathServiceAccounts + "/"
+		mux.HandleFunc(sapath, HandlerFuncRoleWrapper(RoleAdmin, handlerServiceAccounts))
+		lpf(logh.Info, "Registered handler: %s\n", sapath)
+		sspath := config.PathSessions + "/"
+		mux.HandleFunc(sspath, HandlerFuncAuthJWTWrapper(handlerSessions))
+		lpf(logh.Info, "Registered handler: %s\n", sspath)
+		tppath := config.PathTOTP + "/"
+		mux.HandleFunc(tppath, HandlerFuncAuthJWTWrapper(handlerTOTP))
+		lpf(logh.Info, "Registered handler: %s\n", tppath)
+		uspath := config.PathUsers + "/"
+		mux.HandleFunc(uspath, HandlerFuncRoleWrapper(RoleAdmin, handlerUsers))
+		lpf(logh.Info, "Registered handler: %s\n", uspath)
+	}
+
+	if config.DataSourcePath != "" {
+		lpf(logh.Info, "auth running with DataSourcePath: %s", config.DataSourcePath)
+		initializeKVS(config.DataSourcePath)
+		if err := passwordPolicyLoad(); err != nil {
+			log.Fatalf("fatal: %s passwordPolicyLoad error: %v", runtimeh.SourceInfo(), err)
+		}
+		if err := rolesMigrate(); err != nil {
+			log.Fatalf("fatal: %s rolesMigrate error: %v", runtimeh.SourceInfo(), err)
+		}
+		if rsaPrivateKey != nil {
+			if err := keysInit(); err != nil {
+				log.Fatalf("fatal: %s keysInit error: %v", runtimeh.SourceInfo(), err)
+			}
+			if config.KeyRotationInterval > 0 {
+				keyRotateScheduled(config.KeyRotationInterval)
+			}
+		}
+		if config.JWTAuthRemoveInterval >= 0 {
+			removeExpiredTokens(config.JWTAuthRemoveInterval, config.JWTAuthExpirationInterval)
+		}
+	} else {
+		lp(logh.Info, "auth running without DataSourcePath - tokens can only be validated")
+	}
+}
+
+// AuthCreate creates or updates an ID/authentication pair to kvsAuth. The scope of the function
+// is public to allow apps to create auths directly, without going through the ReST API.
+// When cred.Roles is nil, an update keeps the existing roles and a create uses Config.DefaultRoles.
+// Setting the password clears a required password reset, unless cred.PasswordResetRequired. An
+// update of the Roles or Tenant with the current password does not change the password; the
+// password history is not checked, and the password age and any required reset are kept.
+func (cred *Credential) AuthCreate() error {
+	if err := cred.validate(); err != nil {
+		return err
+	}
+
+	// An update keeps the remainder of the prior authentication; I.E. TOTP enrollment.
+	auth, err := authGet(*cred.Email)
+	if err != nil {
+		return err
+	}
+	if auth.Email == nil {
+		auth.Roles = config.DefaultRoles
+	}
+	if cred.Roles != nil {
+		auth.Roles = cred.Roles
+	}
+	if cred.Tenant != nil {
+		auth.Tenant = *cred.Tenant
+	}
+	auth.Email = cred.Email
+	if cred.passwordUnchanged(auth) {
+		auth.PasswordResetRequired = auth.PasswordResetRequired || cred.PasswordResetRequired
+		return authCreate(auth)
+	}
+
+	ph, err := passwordHash(*cred.Password)
+	if err != nil {
+		return err
+	}
+	if err := passwordHistoryCheck(&auth, *cred.Password); err != nil {
+		return err
+	}
+	auth.PasswordChanged = time.Now().Unix()
+	auth.PasswordHash = ph
+	auth.PasswordResetRequired = cred.PasswordResetRequired
+	return authCreate(auth)
+}
+
+// AuthExists returns true when there is an auth for email; I.E. for apps to create an initial
+// account, using AuthCreate, only when it does not exist. Requires Config.DataSourcePath.
+func AuthExists(email string) (bool, error) {
+	if kvsAuth == nil {
+		return false, fmt.Errorf("%s auth running without DataSourcePath", runtimeh.SourceInfo())
+	}
+	auth, err := authGet(email)
+	if err != nil {
+		return false, err
+	}
+	return auth.Email != nil, nil
+}
+
+// passwordUnchanged returns true when cred updates only the Roles or Tenant of auth, with the
+// current password.
+func (cred *Credential) passwordUnchanged(auth authentication) bool {
+	if cred.Roles == nil && cred.Tenant == nil || auth.PasswordHash == nil {
+		return false
+	}
+	return passwordVerifyHash(*cred.Password, auth.PasswordHash) == nil
+}
+
+// Authenticated checks the request for a valid token and will return
+// the users CustomClaims, or an error is auth fails. The token is verified to still
+// exist in kvsToken; meaning the user has not logged out with that token. On any error the header
+// is written with the appropriate http.Status; callers should not write header status.
+func Authenticated(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	var claims *CustomClaims
+	var err error
+	if claims, err = AuthenticatedNoTokenInvalidation(w, r); err != nil {
+		return nil, err
+	}
+	// Validate the token is in the token store; it may be invalidated by the user logging out,
+	// or the token expiring.
+	b, err := kvsToken.Get(claims.tokenKVSKey())
+	if b == nil || err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s token not valid", runtimeh.SourceInfo())
+	}
+	return claims, nil
+}
+
+// AuthenticatedNoTokenInvalidation checks the request for a valid token and will return
+// the users CustomClaims, or an error is auth fails. The token is NOT verified to still
+// exist in kvsToken; the token may have been invalidated but no error from this function
+// means the token was valid at some point. This function should only be used by independent
+// services that recieve tokens but don't have access to kvsToken. On any error the header
+// is written with the appropriate http.Status; callers should not write header status.
+func AuthenticatedNoTokenInvalidation(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	tokenString, err := tokenFromRequestHeader(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, err
+	}
+	if !audienceValid(claims) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s token audience: %s not valid", runtimeh.SourceInfo(), claims.Audience)
+	}
+	return claims, nil
+}
+
+// tokenKVSKey creates a key for kvsToken using the Email and TokenID.
+func (cc CustomClaims) tokenKVSKey() string {
+	return cc.Email + "|" + cc.TokenID
+}
+
+// validate will validate the Credential, as well as trim space from members.
+func (cred *Credential) validate() error {
+	if cred.Email == nil || cred.Password == nil {
+		return fmt.Errorf("%s either email or password were nil in credential", runtimeh.SourceInfo())
+	}
+	if len(*cred.Password) > passwordLengthLimit {
+		return fmt.Errorf("%s password exceeds length limit of %d", runtimeh.SourceInfo(), passwordLengthLimit)
+	}
+	if err := rolesValidate(cred.Roles); err != nil {
+		return err
+	}
+	if cred.Tenant != nil {
+		if err := TenantValidate(*cred.Tenant); err != nil {
+			return err
+		}
+	}
+
+	em := strings.TrimSpace(*cred.Email)
+	pwd := strings.TrimSpace(*cred.Password)
+	cred.Email = &em
+	cred.Password = &pwd
+	return passwordCheck(*cred.Password)
+}
+
+// authenticated authenticates the request, with the API key in APIKeyHeader if provided, otherwise
+// the token. When this service has the auth data source token invalidation is checked, otherwise
+// the list of revoked tokens from Config.RevocationsURL is. Tokens requiring a password reset
+// get http.StatusForbidden with PasswordResetRequiredHeader, unless allowPasswordReset.
+func authenticated(w http.ResponseWriter, r *http.Request, allowPasswordReset bool) (*CustomClaims, error) {
+	claims, err := authenticatedClaims(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if claims.PasswordResetRequired && !allowPasswordReset {
+		w.Header().Set(PasswordResetRequiredHeader, "true")
+		w.WriteHeader(http.StatusForbidden)
+		return nil, fmt.Errorf("%s password reset required, email: %s", runtimeh.SourceInfo(), claims.Email)
+	}
+	return claims, nil
+}
+
+// authenticatedClaims returns the claims for authenticated; see authenticated.
+func authenticatedClaims(w http.ResponseWriter, r *http.Request) (*CustomClaims, error) {
+	var claims *CustomClaims
+	var err error
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		claims, err = apiKeyAuthenticated(w, key)
+	} else if config.DataSourcePath != "" {
+		return Authenticated(w, r)
+	} else {
+		claims, err = AuthenticatedNoTokenInvalidation(w, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.DataSourcePath == "" && revoked(claims) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%s token revoked", runtimeh.SourceInfo())
+	}
+	return claims, nil
+}
+
+// authGet returns the authentication for the provided id. If the id is not in kvsAuth,
+// there is no error, but the returned authentication object is empty.
+func authGet(id string) (authentication, error) {
+	auth := authentication{}
+	if err := kvsAuth.Deserialize(id, &auth); err != nil {
+		return authentication{}, runtimeh.SourceInfoError("authGet error", err)
+	}
+	return auth, nil
+}
+
+// authCreate sets an authentication in kvsAuth and will overwrite any existing
+// value.
+func authCreate(auth authentication) error {
+	if err := kvsAuth.Serialize(*auth.Email, auth); err != nil {
+		return runtimeh.SourceInfoError("serialize error", err)
+	}
+	return nil
+}
+
+// authTokenStringCreate stores a token in kvsToken, where the key is
+// generated using tokenKVSKey() and the value is the claims.ExpiresAt. r is the request for
+// which the token is issued, for the Session; nil when there is no request.
+func authTokenStringCreate(email string, roles []string, r *http.Request) (string, error) {
+	return tokenStringCreate(CustomClaims{Email: email, Roles: roles}, r)
+}
+
+// userTokenStringCreate is authTokenStringCreate for a user logging in; see tokenRoles. The
+// token is for the audience with the scopes granted by audienceScopes.
+func userTokenStringCreate(auth authentication, audience string, scopes []string, r *http.Request) (string, error) {
+	claims := CustomClaims{Email: *auth.Email, PasswordResetRequired: auth.PasswordResetRequired,
+		Roles: tokenRoles(auth), Scopes: scopes, Tenant: auth.Tenant}
+	claims.Audience = audience
+	return tokenStringCreate(claims, r)
+}
+
+// tokenStringCreate sets the StandardClaims and TokenID of claims, stores the token in kvsToken,
+// and the Session in kvsSession, and returns the signed token. The token expires after
+// Config.JWTAuthExpirationInterval, or at claims.ExpiresAt when that is sooner.
+func tokenStringCreate(claims CustomClaims, r *http.Request) (string, error) {
+	tokenID, err := uniqueID(true)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("authTokenStringCreate error", err)
+	}
+	issuer := config.AppName
+	if config.IssuerURL != "" {
+		issuer = config.IssuerURL
+	}
+	expiresAt := time.Now().Add(config.JWTAuthExpirationInterval).Unix()
+	if claims.ExpiresAt != 0 && claims.ExpiresAt < expiresAt {
+		expiresAt = claims.ExpiresAt
+	}
+	claims.StandardClaims = jwt.StandardClaims{
+		Audience:  claims.Audience,
+		ExpiresAt: expiresAt,
+		IssuedAt:  time.Now().Unix(),
+		Issuer:    issuer,
+	}
+	claims.TokenID = tokenID
+
+	kid, key := currentSigningKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, claims.ExpiresAt)
+	if err != nil {
+		if err := runtimeh.SourceInfoError("binary.Write failed", err); err != nil {
+			lpf(logh.Error, "runtimeh.SourceInfoError error:%+v", err)
+		}
+	}
+	if err := kvsToken.Set(claims.tokenKVSKey(), buf.Bytes()); err != nil {
+		lpf(logh.Error, "kvsToken.Set error:%+v", err)
+	}
+	if err := sessionCreate(claims, r); err != nil {
+		lpf(logh.Error, "sessionCreate error:%+v", err)
+	}
+	return token.SignedString(key)
+}
+
+// parseClaims parses a JWT token string (from the Authorization header)
+// into a CustomClaims object.
+func parseClaims(tokenString string) (*CustomClaims, error) {
+	claimsIn := &CustomClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claimsIn,
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			kid, _ := token.Header["kid"].(string)
+			return publicKey(kid)
+		})
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("ParseWithClaims error", err)
+	}
+	//nolint:errcheck // There is no error value to check.
+	claimsOut := token.Claims.(*CustomClaims)
+	if !token.Valid {
+		return nil, fmt.Errorf("%s token not valid, token: %+v", runtimeh.SourceInfo(), *token)
+	}
+
+	return claimsOut, nil
+}
+
+// passwordHash hashes a password using bcrypt.
+func passwordHash(pasword string) (hash []byte, err error) {
+	if hash, err = bcrypt.GenerateFromPassword([]byte(pasword), bcrypt.DefaultCost); err != nil {
+		return nil, runtimeh.SourceInfoError("could not hash password, error: %+v", err)
+	}
+	return hash, nil
+}
+
+// passwordVerifyHash verifies that the provided password hashes to the provided hash,
+// or returns an error if they do not match.
+func passwordVerifyHash(password string, hash []byte) error {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// removeExpiredTokens is a go routine that continuously runs in the background
+// and will remove tokens from kvsToken if expiresAt is more than expireInterval
+// old, the sessions of removed tokens, expired refresh tokens, revocations, login failures, and
+// password reset tokens, and retired keys.
+// Calling with rate == 0 causes the go routine to return after running once.
+// The logging alias lpf is not used as that triggers race detection errors in testing.
+func removeExpiredTokens(rate time.Duration, expireInterval time.Duration) {
+	go func() {
+		for {
+			keys, err := kvsToken.Keys()
+			if err == nil {
+				for i := range keys {
+					b, err := kvsToken.Get(keys[i])
+					if err != nil {
+						logh.Map[config.LogName].Printf(logh.Error, "getting token: %v\n", err)
+						continue
+					}
+
+					buf := bytes.NewBuffer(b)
+					var expiresAt int64
+					err = binary.Read(buf, binary.LittleEndian, &expiresAt)
+					if err != nil {
+						logh.Map[config.LogName].Printf(logh.Error, "reading expiresAt: %v\n", err)
+						continue
+					}
+					if time.Since(time.Unix(expiresAt, 0)) > expireInterval {
+						_, err := kvsToken.Delete(keys[i])
+						if err != nil {
+							logh.Map[config.LogName].Printf(logh.Error, "deleting expired token: %v\n", err)
+							continue
+						}
+					}
+
+				}
+			} else {
+				logh.Map[config.LogName].Printf(logh.Error, "getting keys: %v\n", err)
+			}
+			if _, err := removeExpiredRefreshTokens(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "removing expired refresh tokens: %v\n", err)
+			}
+			if _, err := removeExpiredRevocations(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "removing expired revocations: %v\n", err)
+			}
+			if _, err := removeExpiredLoginFailures(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "removing expired login failures: %v\n", err)
+			}
+			if _, err := removeExpiredSessions(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "removing expired sessions: %v\n", err)
+			}
+			if _, err := removeExpiredPasswordResets(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "removing expired password resets: %v\n", err)
+			}
+			if _, err := keysRetire(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "retiring keys: %v\n", err)
+			}
+
+			if rate == 0 {
+				return
+			}
+
+			time.Sleep(rate)
+		}
+	}()
+}
+
+// rolesMigrate gives roles to accounts persisted without roles; see Config.AdminEmails.
+func rolesMigrate() error {
+	keys, err := kvsAuth.Keys()
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	for _, key := range keys {
+		auth, err := authGet(key)
+		if err != nil {
+			return err
+		}
+		if auth.Email == nil || auth.Roles != nil {
+			continue
+		}
+		auth.Roles = config.DefaultRoles
+		for _, em := range config.AdminEmails {
+			if em == *auth.Email {
+				auth.Roles = []string{RoleAdmin}
+			}
+		}
+		if err := authCreate(auth); err != nil {
+			return err
+		}
+		audit.Printf("roles set to %v for email: %s, account had no roles", auth.Roles, *auth.Email)
+	}
+	return nil
+}
+
+// tokenFromRequestHeader returns the data in the Authorization header.
+func tokenFromRequestHeader(r *http.Request) (string, error) {
+	var tokenHeader []string
+	var ok bool
+	if tokenHeader, ok = r.Header["Authorization"]; !ok {
+		return "", fmt.Errorf("%s no Authorization header provided", runtimeh.SourceInfo())
+	}
+
+	return regexp.MustCompile(`[bB]earer|\s*`).ReplaceAllString(tokenHeader[0], ""), nil
+}
+
+// tokenRoles returns the roles for tokens issued to the auth. Tokens have no roles when the user
+// must set a new password, or when Config.TOTPRequiredRole applies to the account and TOTP is
+// not enabled; those tokens can only be used for PathCreateOrUpdate, PathTOTP, and other paths
+// that do not require a role.
+func tokenRoles(auth authentication) []string {
+	if auth.PasswordResetRequired {
+		return nil
+	}
+	if config.TOTPRequiredRole != "" && !auth.TOTPEnabled && hasRole(auth.Roles, config.TOTPRequiredRole) {
+		return nil
+	}
+	return auth.Roles
+}
+
+// uniqueID is used to generate 16 byte (32 character) ID's; as a UUID (includeHuphens) or
+// hex string. The return value is a hex string formatted in ASCII.
+// 16 bytes = 128 bits, 2^128 = 3.4028237e+38
+func uniqueID(includeHyphens bool) (id string, err error) {
+	idBin := make([]byte, 16)
+	_, err = rand.Read(idBin)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("creating unique binary ID", err)
+	}
+
+	if includeHyphens {
+		return fmt.Sprintf("%x-%x-%x-%x-%x", idBin[0:4], idBin[4:6], idBin[6:8], idBin[8:10], idBin[10:]), err
+	}
+
+	return fmt.Sprintf("%x", idBin[:]), err
+}
+
+// userTokens gets a count of tokens in kvsToken for the specified email. If
+// remove == true, all tokens, and all refresh tokens, are removed and the count is the number
+// of removed tokens; the tokens are revoked (see tokenRevoke).
+func userTokens(email string, remove bool) (int, error) {
+	keys, err := kvsToken.Keys()
+	if err != nil {
+		lpf(logh.Error, "getting keys: %v\n", err)
+		return 0, err
+	}
+
+	if remove {
+		if _, err := refreshTokensRevoke(func(t refreshToken) bool { return t.Email == email }); err != nil {
+			lpf(logh.Error, "refreshTokensRevoke error:%+v", err)
+			return 0, err
+		}
+	}
+
+	count := 0
+	for i := range keys {
+		if strings.HasPrefix(keys[i], email+"|") {
+			if remove {
+				if _, err := tokenRevoke(keys[i]); err != nil {
+					lpf(logh.Error, "tokenRevoke error:%+v", err)
+				}
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
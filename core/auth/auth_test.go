@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/storage"
+)
+
+var (
+	dataSourcePath string
+)
+
+func init() {
+	t := testing.T{}
+	testDir := t.TempDir()
+	dataSourcePath = filepath.Join(testDir, "test.db")
+
+	if err := logh.New("auth", filepath.Join(testDir, "auth.log"), logh.DefaultLevels, logh.Info, logh.DefaultFlags, 100, int64(10e6)); err != nil {
+		panic(err)
+	}
+	audit.Init(audit.Config{AuditLogName: "auth", LogName: "auth"})
+	// testSetup only to initialize config
+	testSetup()
+}
+
+// TestAuthCreateGetDelete tests functions to create, get, and delete auth.
+func TestAuthCreateGetDelete(t *testing.T) {
+	testSetup()
+
+	em := "someone@somewhere.com"
+	ps := "P@ss1234"
+	cred := Credential{Email: &em, Password: &ps}
+
+	auth, err := authGet(em)
+	if auth.Email != nil {
+		t.Errorf("authGet before create did not produce nil auth: %v", err)
+		return
+	}
+	if exists, err := AuthExists(em); exists || err != nil {
+		t.Errorf("AuthExists before create: %t, error: %v", exists, err)
+		return
+	}
+
+	err = cred.AuthCreate()
+	if err != nil {
+		t.Errorf("AuthCreate error: %v", err)
+		return
+	}
+
+	auth, err = authGet(em)
+	if err != nil || *auth.Email != em || passwordVerifyHash(ps, auth.PasswordHash) != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	if len(auth.Roles) != 1 || auth.Roles[0] != RoleViewer {
+		t.Errorf("new auth did not have default roles: %v", auth.Roles)
+		return
+	}
+	if exists, err := AuthExists(em); !exists || err != nil {
+		t.Errorf("AuthExists after create: %t, error: %v", exists, err)
+		return
+	}
+
+	// Update without roles keeps the existing roles.
+	if err := authCreate(authentication{Email: &em, PasswordHash: auth.PasswordHash, Roles: []string{RoleOperator}}); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	if err := cred.AuthCreate(); err != nil {
+		t.Errorf("AuthCreate error: %v", err)
+		return
+	}
+	if auth, err = authGet(em); err != nil || len(auth.Roles) != 1 || auth.Roles[0] != RoleOperator {
+		t.Errorf("update did not keep roles: %v, error: %v", auth.Roles, err)
+		return
+	}
+
+	count, err := authDelete(em)
+	if count != 1 || err != nil {
+		t.Errorf("authDelete count: %d, error: %v", count, err)
+		return
+	}
+
+	count, err = authDelete(em)
+	if count != 0 || err != nil {
+		t.Errorf("authDelete count: %d, error: %v", count, err)
+		return
+	}
+}
+
+// TestAuthTokenCreate tests creating a token for a given auth.
+func TestAuthTokenCreate(t *testing.T) {
+	testSetup()
+
+	tokenString, err := authTokenStringCreate("testEmail", []string{RoleOperator}, nil)
+	if err != nil {
+		t.Errorf("creating auth token, error: %v", err)
+		return
+	}
+
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		t.Errorf("parsing claims, error: %v", err)
+		return
+	}
+	if claims.Email != "testEmail" || !claims.HasRole(RoleViewer) || claims.HasRole(RoleAdmin) {
+		t.Errorf("claims not correct: %+v", claims)
+		return
+	}
+	b, err := kvsToken.Get(claims.tokenKVSKey())
+	if b == nil || err != nil {
+		t.Errorf("token not in kvsToken, error: %v", err)
+		return
+	}
+}
+
+// TestRemoveExpiredTokens verifies expired tokens are removed.
+func TestRemoveExpiredTokens(t *testing.T) {
+	testSetup()
+
+	config.JWTAuthExpirationInterval = -time.Minute
+	tokenString, err := authTokenStringCreate("testEmail", nil, nil)
+	config.JWTAuthExpirationInterval = time.Minute * 15
+	if err != nil {
+		t.Errorf("creating auth token, error: %v", err)
+		return
+	}
+	if c, err := userTokens("testEmail", false); c != 1 || err != nil {
+		t.Errorf("userTokens count: %d, error: %v", c, err)
+		return
+	}
+	if _, err := parseClaims(tokenString); err == nil {
+		t.Errorf("expired token parsed")
+		return
+	}
+
+	removeExpiredTokens(0, 0)
+	time.Sleep(time.Second)
+	if c, err := userTokens("testEmail", false); c != 0 || err != nil {
+		t.Errorf("userTokens count: %d, error: %v", c, err)
+		return
+	}
+}
+
+// TestValidate tests Credential.validate with invalid and valid credentials.
+func TestValidate(t *testing.T) {
+	testSetup()
+
+	em := "someone@somewhere.com"
+	for _, ps := range []string{"short", "nouppercase1!", "NOLOWERCASE1!", "NoNumber!!", "NoSpecial12", "Has Space1!"} {
+		ps := ps
+		cred := Credential{Email: &em, Password: &ps}
+		if err := cred.validate(); err == nil {
+			t.Errorf("password should not be valid: %s", ps)
+		}
+	}
+
+	ps := "P@ssword1234"
+	cred := Credential{Email: &em, Password: &ps}
+	if err := cred.validate(); err != nil {
+		t.Errorf("password should be valid: %s, error: %v", ps, err)
+	}
+	cred.Roles = []string{"superuser"}
+	if err := cred.validate(); err == nil {
+		t.Errorf("role should not be valid: %v", cred.Roles)
+	}
+}
+
+// TestUniqueID tests uniqueID formats.
+func TestUniqueID(t *testing.T) {
+	id, err := uniqueID(false)
+	if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(id) || err != nil {
+		t.Errorf("id not right format, id: %s", id)
+	}
+
+	id, err = uniqueID(true)
+	if !regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$").MatchString(id) || err != nil {
+		t.Errorf("id not right format, id: %s", id)
+	}
+}
+
+// authDelete removes an ID/authentication pair from the KVS.
+// Returns the count, which is zero (and no error) if the id did not exist.
+func authDelete(id string) (int64, error) {
+	return kvsAuth.Delete(id)
+}
+
+// createAuth creates an entry in kvsAuth, with the provided roles.
+func createAuth(t *testing.T, email string, roles []string) ([]byte, error) {
+	ps := "P@ssword1234"
+	cred := &Credential{Email: &email, Password: &ps, Roles: roles}
+	if err := cred.AuthCreate(); err != nil {
+		t.Errorf("cred.AuthCreate error: %v", err)
+		return nil, err
+	}
+	cred.Roles = nil
+	credBytes, err := json.Marshal(cred)
+	if err != nil {
+		t.Errorf("marshal error: %v", err)
+		return nil, err
+	}
+	return credBytes, nil
+}
+
+// login using the provided credentials and return a token and claims.
+func login(t *testing.T, credBytes []byte) ([]byte, *CustomClaims, error) {
+	testServerLogin := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServerLogin.Close()
+	client := http.Client{}
+	req, err := http.NewRequest(http.MethodPut, testServerLogin.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("PUT error: %v", err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code: %d", resp.StatusCode)
+		return nil, nil, err
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+		return nil, nil, err
+	}
+	claimsOut, err := parseClaims(string(tokenBytes))
+	if err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return nil, nil, err
+	}
+	return tokenBytes, claimsOut, err
+}
+
+// request sends a request, with the token if not nil, and returns the response status and body.
+func request(t *testing.T, url string, method string, token []byte, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return 0, nil
+	}
+	if token != nil {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Do error: %v", err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+	}
+	return resp.StatusCode, b
+}
+
+func testSetup() {
+	if err := storage.RemoveAll(dataSourcePath); err != nil {
+		panic(err)
+	}
+
+	// Tests remove expired tokens explicitly, so removal is not started by Init.
+	config = Config{AppName: "auth", LogName: "auth",
+		JWTAuthExpirationInterval: time.Minute * 15, JWTAuthRemoveInterval: -1, testing: true,
+	}
+	config.DataSourcePath = dataSourcePath
+	Init(config, nil)
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialBackend verifies the passwords of users, and provides their roles; see
+// Config.CredentialBackend.
+type CredentialBackend interface {
+	// Authenticate returns the roles of the user when the password is correct. Otherwise
+	// ErrCredentialsInvalid is returned, or another error when the backend could not be used.
+	Authenticate(email string, password string) (roles []string, err error)
+}
+
+// DatastoreBackend is the CredentialBackend using the accounts in the auth datastore; the
+// default.
+type DatastoreBackend struct{}
+
+// HtpasswdBackend is a read-only CredentialBackend using an Apache htpasswd file, with bcrypt
+// hashes (htpasswd -B). The files are read for each login, so changes take effect without a
+// restart.
+type HtpasswdBackend struct {
+	// GroupPath is the path of an Apache group file; lines of "group: user1 user2". If empty,
+	// users have no groups.
+	GroupPath string
+	// GroupRoles maps the groups of GroupPath to roles.
+	GroupRoles map[string]string
+	// Path is the path of the htpasswd file; lines of "user:hash".
+	Path string
+}
+
+var (
+	// ErrCredentialsInvalid is returned by CredentialBackend.Authenticate for an unknown user, or
+	// an incorrect password.
+	ErrCredentialsInvalid = errors.New("credentials invalid")
+)
+
+// Authenticate verifies the password against the hash in the auth datastore.
+func (DatastoreBackend) Authenticate(email string, password string) ([]string, error) {
+	auth, err := authGet(email)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	if err := passwordVerifyHash(password, auth.PasswordHash); err != nil {
+		return nil, ErrCredentialsInvalid
+	}
+	return auth.Roles, nil
+}
+
+// Authenticate verifies the password against the hash in the htpasswd file, and returns the
+// roles of the groups of the user.
+func (hb HtpasswdBackend) Authenticate(email string, password string) ([]string, error) {
+	users, err := htpasswdRead(hb.Path)
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := users[email]
+	if !ok || password == "" {
+		return nil, ErrCredentialsInvalid
+	}
+	if !strings.HasPrefix(hash, "$2") {
+		return nil, fmt.Errorf("%s htpasswd hash for user: %s is not bcrypt", runtimeh.SourceInfo(), email)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, ErrCredentialsInvalid
+	}
+	if hb.GroupPath == "" {
+		return nil, nil
+	}
+	groups, err := htpasswdRead(hb.GroupPath)
+	if err != nil {
+		return nil, err
+	}
+	member := []string{}
+	for group, users := range groups {
+		for _, user := range strings.Fields(users) {
+			if user == email {
+				member = append(member, group)
+			}
+		}
+	}
+	return groupRoles(member, hb.GroupRoles), nil
+}
+
+// backendRolesValidate validates the roles that groups are mapped to by the backend.
+func backendRolesValidate(backend CredentialBackend) error {
+	var gr map[string]string
+	switch b := backend.(type) {
+	case HtpasswdBackend:
+		gr = b.GroupRoles
+	case LDAPBackend:
+		gr = b.GroupRoles
+	}
+	for group, role := range gr {
+		if err := rolesValidate([]string{role}); err != nil {
+			return fmt.Errorf("%s group: %s, error: %v", runtimeh.SourceInfo(), group, err)
+		}
+	}
+	return nil
+}
+
+// credentialsVerify verifies the password for auth, the account with email, which may not exist
+// in the auth datastore. Accounts with a password in the auth datastore, I.E. the initial
+// administrator, and service accounts, are verified by DatastoreBackend; other accounts by
+// Config.CredentialBackend. For accounts verified by another backend, the returned auth is the
+// directory account, with the roles from the backend, to be persisted at login.
+func credentialsVerify(auth authentication, email string, password string) (authentication, error) {
+	backend := config.CredentialBackend
+	if auth.PasswordHash != nil || auth.ServiceAccount {
+		backend = DatastoreBackend{}
+	}
+	roles, err := backend.Authenticate(email, password)
+	if err != nil {
+		return auth, err
+	}
+	if _, ok := backend.(DatastoreBackend); ok {
+		return auth, nil
+	}
+	if auth.Email == nil {
+		auth.Email = &email
+	}
+	auth.Directory = true
+	auth.Roles = roles
+	if auth.Roles == nil {
+		auth.Roles = []string{}
+	}
+	return auth, nil
+}
+
+// groupRoles returns the roles, sorted and unique, mapped from the groups by gr; groups are
+// compared case insensitively.
+func groupRoles(groups []string, gr map[string]string) []string {
+	roles := []string{}
+	for _, group := range groups {
+		for g, role := range gr {
+			if strings.EqualFold(group, g) && !hasRole(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// htpasswdRead returns the lines of the htpasswd or group file at path, split on the first
+// colon, as a map; blank lines, and lines starting with #, are skipped.
+func htpasswdRead(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	defer f.Close()
+	out := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		out[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestHtpasswdBackend verifies directory accounts login with the roles of their groups, and
+// cannot set a password, while accounts with a password in the auth datastore are unchanged.
+func TestHtpasswdBackend(t *testing.T) {
+	testSetup()
+	testDir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("P@ssword1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Errorf("GenerateFromPassword error: %v", err)
+		return
+	}
+	hb := HtpasswdBackend{GroupPath: filepath.Join(testDir, "htgroup"),
+		GroupRoles: map[string]string{"operators": RoleOperator}, Path: filepath.Join(testDir, "htpasswd")}
+	if err := os.WriteFile(hb.Path, []byte("# users\ndir@auth.com:"+string(hash)+"\nmd5@auth.com:$apr1$salt$hash\n"), 0600); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	if err := os.WriteFile(hb.GroupPath, []byte("operators: other@auth.com dir@auth.com\n"), 0600); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	config.CredentialBackend = hb
+
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+	updateServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate)))
+	defer updateServer.Close()
+
+	em := "dir@auth.com"
+	pw := "P@ssword1234"
+	credBytes, _ := json.Marshal(Credential{Email: &em, Password: &pw})
+	token, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if !slices.Equal(claims.Roles, []string{RoleOperator}) {
+		t.Errorf("directory roles: %v", claims.Roles)
+		return
+	}
+	if auth, err := authGet(em); err != nil || !auth.Directory || auth.PasswordHash != nil {
+		t.Errorf("directory account: %+v, error: %v", auth, err)
+		return
+	}
+	if status, _ := request(t, updateServer.URL, http.MethodPut, token, credBytes); status != http.StatusConflict {
+		t.Errorf("directory account set password status: %d", status)
+		return
+	}
+
+	// Accounts with a password in the auth datastore are verified by DatastoreBackend.
+	localBytes, err := createAuth(t, "local@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	if _, claims, err := login(t, localBytes); err != nil || !slices.Equal(claims.Roles, []string{RoleAdmin}) {
+		t.Errorf("local account claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	// Failures delay later logins from the IP, so are tested last.
+	bad := "Wr0ng@ssword"
+	badBytes, _ := json.Marshal(Credential{Email: &em, Password: &bad})
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, badBytes); status != http.StatusUnauthorized {
+		t.Errorf("incorrect password status: %d", status)
+		return
+	}
+	if _, err := hb.Authenticate("none@auth.com", pw); err != ErrCredentialsInvalid {
+		t.Errorf("unknown user error: %v", err)
+		return
+	}
+	if _, err := hb.Authenticate("md5@auth.com", pw); err == nil || err == ErrCredentialsInvalid {
+		t.Errorf("non bcrypt hash error: %v", err)
+		return
+	}
+
+	if err := backendRolesValidate(HtpasswdBackend{GroupRoles: map[string]string{"g": "none"}}); err == nil {
+		t.Errorf("invalid group role did not error")
+		return
+	}
+}
@@ -0,0 +1,588 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/rest-app/core/audit"
+)
+
+// AuditWriter is used to wrap the http.ResponseWriter passed to handlers in order to
+// store information that is then written to the audit log as the handler exits.
+// Applications using this package need to populate the Message as is done in these handlers
+// in order for messages to show up in the audit log. Best practice is to only add logging
+// information to the audit log once all validations are complete and the command is returning
+// good status. Other information should be logged to an application log.
+type AuditWriter struct {
+	http.ResponseWriter
+	Message    string
+	StatusCode int
+}
+
+func (aw *AuditWriter) WriteHeader(status int) {
+	aw.StatusCode = status
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter; used by http.ResponseController.
+func (aw *AuditWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// HandlerFuncNoAuthWrapper is a basic wrapper that DOES NOT authenticate, but does
+// handle audit logging (logging for all DELETE/POST/PUT methods) to the hash chained audit log.
+func HandlerFuncNoAuthWrapper(hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := &AuditWriter{ResponseWriter: w}
+		hf(aw, r)
+		auditRequest(aw, r)
+	}
+}
+
+// HandlerFuncAuthJWTWrapper is a basic wrapper that verifies the call is authenticated; the
+// claims are available to hf from ClaimsFromRequest. Use HandlerFuncPermissionsWrapper or
+// HandlerFuncRoleWrapper to also require a role.
+// Note this wrapper also handles audit logging (logging for all DELETE/POST/PUT methods)
+func HandlerFuncAuthJWTWrapper(hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return handlerFuncAuthJWTWrapper(hf, false)
+}
+
+// handlerFuncAuthJWTWrapper is HandlerFuncAuthJWTWrapper; allowPasswordReset true also accepts
+// tokens that require a password reset, for the path used to set the password.
+func handlerFuncAuthJWTWrapper(hf func(w http.ResponseWriter, r *http.Request), allowPasswordReset bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := &AuditWriter{ResponseWriter: w}
+		claims, err := authenticated(aw, r, allowPasswordReset)
+		if err != nil {
+			return
+		}
+		r = r.WithContext(ContextWithClaims(r.Context(), claims))
+		hf(aw, r)
+		auditRequest(aw, r)
+	}
+}
+
+// auditPrint writes the audit record for a request. For authenticated requests the record has
+// the subject, the user of the token, and the actor; for impersonation tokens the administrator,
+// otherwise the subject.
+func auditPrint(status int, r *http.Request, msg string) {
+	if claims, ok := ClaimsFromRequest(r); ok {
+		audit.Printf("status: %d| subject: %s| actor: %s| req:%+v| msg: %s|", status, claims.Email, claims.actor(), r, msg)
+		return
+	}
+	audit.Printf("status: %d| req:%+v| msg: %s|", status, r, msg)
+}
+
+// auditRequest writes the audit record for DELETE/POST/PUT methods, and for any request
+// that was forbidden.
+func auditRequest(aw *AuditWriter, r *http.Request) {
+	if r.Method == http.MethodDelete || r.Method == http.MethodPost || r.Method == http.MethodPut ||
+		aw.StatusCode == http.StatusForbidden {
+		auditPrint(aw.StatusCode, r, aw.Message)
+	}
+}
+
+// handlerCreateOrUpdate is the handler to create/update an auth (entry in kvsAuth). The handler
+// will error if there is already an auth for the specified Email for create (http.MethodPost).
+// Update (http.MethodPut) requires the user is logged in and provides a valid token; only an
+// administrator can update an auth other than their own. When Config.CreateRequiresAuth, only an
+// administrator can create an auth. Only an administrator can specify Roles or Tenant; changing
+// the Tenant revokes the tokens of the account. Impersonation tokens get http.StatusForbidden.
+func handlerCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	em := ""
+	pw := ""
+	cred := Credential{Email: &em, Password: &pw}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "create error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	// Either create or update require valid credentials in the body.
+	auth, err := authGet(em)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// On create, the auth must not exist. On update, the user must be logged in.
+	claims, authed := ClaimsFromRequest(r)
+	// Service accounts do not have a password, see handlerServiceAccounts, and directory
+	// accounts set their password in the directory; see Config.CredentialBackend.
+	if auth.ServiceAccount || auth.Directory {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if auth.PasswordHash != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if config.CreateRequiresAuth && !RequireRole(w, r, RoleAdmin) {
+			return
+		}
+	} else { // http.MethodPut
+		if !authed {
+			if claims, err = Authenticated(w, r); err != nil {
+				return
+			}
+			r = r.WithContext(ContextWithClaims(r.Context(), claims))
+		}
+		if claims.Email != em && !RequireRole(w, r, RoleAdmin) {
+			return
+		}
+		// A required password reset must set a new password; an update of only the roles or
+		// tenant keeps the required reset.
+		if auth.PasswordResetRequired && !cred.passwordUnchanged(auth) && passwordVerifyHash(pw, auth.PasswordHash) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if impersonating(w, r) {
+		return
+	}
+	if (cred.Roles != nil || cred.Tenant != nil) && !RequireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	if err := cred.AuthCreate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Tokens carry the tenant, so those for the prior tenant are revoked.
+	n := 0
+	if auth.Email != nil && cred.Tenant != nil && *cred.Tenant != auth.Tenant {
+		if n, err = userRevoke(*cred.Email); err != nil {
+			lpf(logh.Error, "userRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("credential create or update for email: %s", *cred.Email)
+		if cred.Roles != nil {
+			aw.Message += fmt.Sprintf(", roles: %v", cred.Roles)
+		}
+		if cred.Tenant != nil {
+			aw.Message += fmt.Sprintf(", tenant: %s, %d tokens revoked", *cred.Tenant, n)
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	} else { // http.MethodPut
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handlerDelete deletes the entries in kvsAuth and kvsToken for
+// the specified Email.
+func handlerDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// re-authenticate to get claims, in order to delete the auth and the token.
+	claims, err := Authenticated(w, r)
+	if err != nil {
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("auth and tokens deleted for email: %s", claims.Email)
+	}
+
+	// Remove all users tokens then delete the kvsAuth
+	// handlerLogoutCommon sets http.StatusNoContent
+	handlerLogoutCommon(w, r, true)
+	if _, err := kvsAuth.Delete(claims.Email); err != nil {
+		lpf(logh.Error, "kvsAuth.Delete error: %+v", err)
+	}
+	if err := subjectRevoke(claims.Email); err != nil {
+		lpf(logh.Error, "subjectRevoke error: %+v", err)
+	}
+}
+
+// handlerInfo will return an Info object for the caller.
+func handlerInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// re-authenticate to get claims, in order to get claims.
+	claims, err := Authenticated(w, r)
+	if err != nil {
+		return
+	}
+	c, err := userTokens(claims.Email, false)
+	if err != nil {
+		lpf(logh.Error, "userTokens error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info := Info{OutstandingTokens: c, PasswordResetRequired: auth.PasswordResetRequired,
+		Roles: auth.Roles, TOTPEnabled: auth.TOTPEnabled,
+		TOTPRequired: config.TOTPRequiredRole != "" && hasRole(auth.Roles, config.TOTPRequiredRole)}
+	b, err := json.Marshal(info)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerLogin will validate a callers credentials and, if the credentials are
+// valid, will return a JWT token for the caller. When Config.RefreshTokenExpirationInterval
+// is not zero, a refresh token is returned in RefreshTokenHeader. For accounts with TOTP enabled,
+// Credential.TOTP is required; without it http.StatusUnauthorized is returned with
+// TOTPRequiredHeader. Disabled accounts get http.StatusForbidden. When the user must set a new
+// password, PasswordResetRequiredHeader is set; see UserRequest. Failed logins, including invalid TOTP codes, delay, then
+// lock out, further logins for the Email and the source IP (see LoginFailures); those logins
+// get http.StatusTooManyRequests with the Retry-After header. Failures are audited.
+func handlerLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	em := ""
+	pw := ""
+	cred := Credential{Email: &em, Password: &pw}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "login error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	ip := requestIP(r)
+	retryAfter, err := loginAllowed(*cred.Email, ip)
+	if err != nil {
+		lpf(logh.Error, "loginAllowed error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("login rejected for email: %s, ip: %s, retry after: %s", *cred.Email, ip, retryAfter)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	auth, err := authGet(*cred.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	auth, passwordErr := credentialsVerify(auth, *cred.Email, *cred.Password)
+	if passwordErr != nil && !errors.Is(passwordErr, ErrCredentialsInvalid) {
+		// The backend could not be used; not a login failure.
+		lpf(logh.Error, "credentialsVerify error:%v", passwordErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if passwordErr == nil && auth.TOTPEnabled && cred.TOTP == "" {
+		w.Header().Set(TOTPRequiredHeader, "true")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	totpRecovery := false
+	if passwordErr == nil && auth.TOTPEnabled {
+		remaining := len(auth.RecoveryCodes)
+		if !totpVerify(&auth, cred.TOTP, true) {
+			passwordErr = fmt.Errorf("TOTP code not valid")
+		}
+		totpRecovery = len(auth.RecoveryCodes) < remaining
+	}
+	if passwordErr != nil {
+		account, source, err := loginFailed(*cred.Email, ip)
+		if err != nil {
+			lpf(logh.Error, "loginFailed error:%v", err)
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("login failed for email: %s, ip: %s, failures: %d, ip failures: %d",
+				*cred.Email, ip, account.Count, source.Count)
+			if account.Locked {
+				aw.Message += fmt.Sprintf(", email locked until: %s", time.Unix(account.LockedUntil, 0).UTC().Format(time.RFC3339))
+			}
+			if source.Locked {
+				aw.Message += fmt.Sprintf(", ip locked until: %s", time.Unix(source.LockedUntil, 0).UTC().Format(time.RFC3339))
+			}
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if auth.Disabled {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("login rejected for email: %s, account disabled", *cred.Email)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// Passwords that no longer comply with the password policy must be changed.
+	policyReason := passwordPolicyLogin(&auth, *cred.Password)
+	scopes, err := audienceScopes(cred.Audience, cred.Scopes, tokenRoles(auth))
+	if err != nil {
+		lpf(logh.Error, "audienceScopes error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Persists LastLogin, the TOTP code or recovery code used, and the password policy result.
+	if err := userLoggedIn(auth); err != nil {
+		lpf(logh.Error, "userLoggedIn error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := userTokenStringCreate(auth, cred.Audience, scopes, r)
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if config.RefreshTokenExpirationInterval > 0 {
+		jti, err := accessTokenID(tokenString)
+		if err != nil {
+			lpf(logh.Error, "accessTokenID error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		refreshToken, err := refreshTokenCreate(refreshToken{Audience: cred.Audience, Email: *cred.Email, JTI: jti,
+			Scopes: cred.Scopes})
+		if err != nil {
+			lpf(logh.Error, "refreshTokenCreate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(RefreshTokenHeader, refreshToken)
+	}
+	// Failures are only cleared once the login is not refused for any other reason, and the
+	// tokens were created.
+	if err := loginSucceeded(*cred.Email); err != nil {
+		lpf(logh.Error, "loginSucceeded error:%v", err)
+	}
+	if auth.PasswordResetRequired {
+		w.Header().Set(PasswordResetRequiredHeader, "true")
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("login for email: %s", *cred.Email)
+		if auth.Directory {
+			aw.Message += fmt.Sprintf(", directory roles: %v", auth.Roles)
+		}
+		if cred.Audience != "" {
+			aw.Message += fmt.Sprintf(", audience: %s, scopes: %v", cred.Audience, scopes)
+		}
+		if totpRecovery {
+			aw.Message += fmt.Sprintf(", TOTP recovery code used, %d remaining", len(auth.RecoveryCodes))
+		}
+		if policyReason != "" {
+			aw.Message += fmt.Sprintf(", password reset required: %s", policyReason)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerLogout will delete the token the caller is currently using,
+// effectively logging them out as the token is no longer valid.
+func handlerLogout(w http.ResponseWriter, r *http.Request) {
+	handlerLogoutCommon(w, r, false)
+}
+
+// handlerLogoutAll will delete all tokens, and refresh tokens, for the current caller,
+// effectively logging them out of all sessions, as none of their issued
+// tokens will be valid.
+func handlerLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete && impersonating(w, r) {
+		return
+	}
+	handlerLogoutCommon(w, r, true)
+}
+
+func handlerLogoutCommon(w http.ResponseWriter, r *http.Request, logoutAll bool) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// re-authenticate to get claims, in order to delete the token.
+	claims, err := Authenticated(w, r)
+	if err != nil {
+		return
+	}
+
+	if logoutAll {
+		_, err := userTokens(claims.Email, true)
+		if err != nil {
+			lpf(logh.Error, "userTokens error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok && aw.Message == "" {
+			aw.Message = fmt.Sprintf("all tokens deleted for email: %s", claims.Email)
+		}
+	} else {
+		n, err := tokenRevoke(claims.tokenKVSKey())
+		if err != nil {
+			lpf(logh.Error, "tokenRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("%d tokens deleted for email: %s", n, claims.Email)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRefresh deletes the callers current token and returns
+// a new token. The new token has the current roles of the caller. Impersonation tokens get
+// http.StatusForbidden.
+func handlerRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if r.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// re-authenticate to get claims.
+	claims, err := Authenticated(w, r)
+	if err != nil {
+		return
+	}
+	// Impersonation tokens are short lived; the administrator gets another.
+	if claims.Actor != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	auth, err := authGet(claims.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The new token keeps the audience and scopes, limited to those the roles still grant; a
+	// token with an audience and no scopes keeps no scopes.
+	requested := claims.Scopes
+	if requested == nil && claims.Audience != "" {
+		requested = []string{}
+	}
+	scopes, err := audienceScopes(claims.Audience, requested, tokenRoles(auth))
+	if err != nil {
+		lpf(logh.Error, "audienceScopes error:%v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	tokenString, err := userTokenStringCreate(auth, claims.Audience, scopes, r)
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	n, err := tokenRevoke(claims.tokenKVSKey())
+	if err != nil {
+		lpf(logh.Error, "tokenRevoke error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("%d tokens deleted during token refresh for email: %s", n, claims.Email)
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// handlerRoles sets the roles for an existing auth; the body is a Credential with Email and
+// Roles, the Password is ignored. All tokens, and refresh tokens, for the auth are deleted, so
+// the new roles are used after the user logs in again. Requires RoleAdmin.
+// http.MethodPut - set the roles.
+func handlerRoles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	em := ""
+	cred := Credential{Email: &em}
+	if err := httph.BodyUnmarshal(w, r, &cred); err != nil {
+		lpf(logh.Error, "roles error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if cred.Roles == nil || rolesValidate(cred.Roles) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	auth.Roles = cred.Roles
+	if err := authCreate(auth); err != nil {
+		lpf(logh.Error, "authCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := userTokens(em, true)
+	if err != nil {
+		lpf(logh.Error, "userTokens error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("roles set to %v, and %d tokens deleted, for email: %s", cred.Roles, n, em)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,443 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHandlerFuncAuthJWTWrapper tests the wrapper function to show that wrapping a handler
+// does then require authentication, and provides the claims to the handler.
+func TestHandlerFuncAuthJWTWrapper(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	if status, _ := request(t, testServer.URL, http.MethodGet, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("HandlerFuncAuthJWTWrapper did not return proper status: %d", status)
+		return
+	}
+
+	credBytes, err := createAuth(t, "someone@auth.com", nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodDelete, tokenBytes, nil); status != http.StatusNoContent {
+		t.Errorf("HandlerFuncAuthJWTWrapper did not return proper status: %d", status)
+		return
+	}
+}
+
+// TestHandlerFuncPermissionsWrapper verifies the roles required by method.
+func TestHandlerFuncPermissionsWrapper(t *testing.T) {
+	testSetup()
+
+	permissions := Permissions{http.MethodGet: RoleViewer, http.MethodPost: RoleOperator, http.MethodDelete: RoleAdmin}
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncPermissionsWrapper(permissions, handlerTest)))
+	defer testServer.Close()
+
+	tokens := map[string][]byte{}
+	for _, role := range []string{RoleAdmin, RoleOperator, RoleViewer} {
+		credBytes, err := createAuth(t, role+"@auth.com", []string{role})
+		if err != nil {
+			return
+		}
+		if tokens[role], _, err = login(t, credBytes); err != nil {
+			return
+		}
+	}
+
+	tests := []struct {
+		role   string
+		method string
+		status int
+	}{
+		{RoleViewer, http.MethodGet, http.StatusNoContent},
+		{RoleViewer, http.MethodPost, http.StatusForbidden},
+		{RoleViewer, http.MethodDelete, http.StatusForbidden},
+		{RoleOperator, http.MethodGet, http.StatusNoContent},
+		{RoleOperator, http.MethodPost, http.StatusNoContent},
+		{RoleOperator, http.MethodDelete, http.StatusForbidden},
+		{RoleAdmin, http.MethodPost, http.StatusNoContent},
+		{RoleAdmin, http.MethodDelete, http.StatusNoContent},
+		{RoleAdmin, http.MethodPut, http.StatusMethodNotAllowed},
+	}
+	for i, test := range tests {
+		if status, _ := request(t, testServer.URL, test.method, tokens[test.role], nil); status != test.status {
+			t.Errorf("test: %d, role: %s, method: %s, status: %d, expected: %d", i, test.role, test.method, status, test.status)
+		}
+	}
+	if status, _ := request(t, testServer.URL, http.MethodGet, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("no token status: %d", status)
+	}
+}
+
+// TestHandlerCreateOrUpdate verifies only administrators can set roles, create auths when
+// CreateRequiresAuth, or update the auth of another user.
+func TestHandlerCreateOrUpdate(t *testing.T) {
+	testSetup()
+
+	config.CreateRequiresAuth = true
+	defer func() { config.CreateRequiresAuth = false }()
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate)))
+	defer testServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	viewerCred, err := createAuth(t, "viewer@auth.com", nil)
+	if err != nil {
+		return
+	}
+	viewerToken, _, err := login(t, viewerCred)
+	if err != nil {
+		return
+	}
+
+	em := "new@auth.com"
+	ps := "P@ssword1234"
+	newCred, _ := json.Marshal(Credential{Email: &em, Password: &ps, Roles: []string{RoleOperator}})
+	if status, _ := request(t, testServer.URL, http.MethodPost, viewerToken, newCred); status != http.StatusForbidden {
+		t.Errorf("viewer create status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPost, adminToken, newCred); status != http.StatusCreated {
+		t.Errorf("admin create status: %d", status)
+		return
+	}
+	if auth, err := authGet(em); err != nil || len(auth.Roles) != 1 || auth.Roles[0] != RoleOperator {
+		t.Errorf("created roles: %v, error: %v", auth.Roles, err)
+		return
+	}
+
+	// A viewer can update their own password, but not roles, and not another auth.
+	if status, _ := request(t, testServer.URL, http.MethodPut, viewerToken, viewerCred); status != http.StatusNoContent {
+		t.Errorf("viewer update self status: %d", status)
+		return
+	}
+	vem := "viewer@auth.com"
+	viewerAdmin, _ := json.Marshal(Credential{Email: &vem, Password: &ps, Roles: []string{RoleAdmin}})
+	if status, _ := request(t, testServer.URL, http.MethodPut, viewerToken, viewerAdmin); status != http.StatusForbidden {
+		t.Errorf("viewer update roles status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, viewerToken, newCred); status != http.StatusForbidden {
+		t.Errorf("viewer update other status: %d", status)
+		return
+	}
+}
+
+// TestHandlerRoles verifies setting roles, and that tokens are then invalidated and new tokens
+// have the new roles.
+func TestHandlerRoles(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerRoles)))
+	defer testServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "viewer@auth.com"
+	viewerCred, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	viewerToken, _, err := login(t, viewerCred)
+	if err != nil {
+		return
+	}
+
+	body, _ := json.Marshal(Credential{Email: &em, Roles: []string{RoleOperator}})
+	if status, _ := request(t, testServer.URL, http.MethodPut, viewerToken, body); status != http.StatusForbidden {
+		t.Errorf("viewer set roles status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, adminToken, body); status != http.StatusNoContent {
+		t.Errorf("admin set roles status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, viewerToken, body); status != http.StatusUnauthorized {
+		t.Errorf("token was not invalidated, status: %d", status)
+		return
+	}
+	_, claims, err := login(t, viewerCred)
+	if err != nil || !claims.HasRole(RoleOperator) || claims.HasRole(RoleAdmin) {
+		t.Errorf("claims roles: %v, error: %v", claims, err)
+		return
+	}
+
+	invalid, _ := json.Marshal(Credential{Email: &em, Roles: []string{"superuser"}})
+	if status, _ := request(t, testServer.URL, http.MethodPut, adminToken, invalid); status != http.StatusBadRequest {
+		t.Errorf("invalid role status: %d", status)
+		return
+	}
+}
+
+// TestRolesMigrate verifies accounts without roles are given roles.
+func TestRolesMigrate(t *testing.T) {
+	testSetup()
+
+	for _, em := range []string{"admin", "user"} {
+		em := em
+		if err := authCreate(authentication{Email: &em, PasswordHash: []byte("hash")}); err != nil {
+			t.Errorf("authCreate error: %v", err)
+			return
+		}
+	}
+	config.AdminEmails = []string{"admin"}
+	defer func() { config.AdminEmails = nil }()
+	if err := rolesMigrate(); err != nil {
+		t.Errorf("rolesMigrate error: %v", err)
+		return
+	}
+	for em, role := range map[string]string{"admin": RoleAdmin, "user": RoleViewer} {
+		auth, err := authGet(em)
+		if err != nil || len(auth.Roles) != 1 || auth.Roles[0] != role {
+			t.Errorf("email: %s, roles: %v, error: %v", em, auth.Roles, err)
+		}
+	}
+}
+
+// TestHandlerDelete verifies a call to the delete handler deletes the auth of the caller.
+func TestHandlerDelete(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerDelete)))
+	defer testServer.Close()
+	if status, _ := request(t, testServer.URL, http.MethodDelete, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("no token status: %d", status)
+		return
+	}
+
+	em := "delete@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodDelete, tokenBytes, nil); status != http.StatusNoContent {
+		t.Errorf("delete status: %d", status)
+		return
+	}
+	if auth, err := authGet(em); err != nil || auth.Email != nil {
+		t.Errorf("auth not deleted: %+v, error: %v", auth, err)
+		return
+	}
+}
+
+// TestHandlerInfo does several logins for one user and verifies the Info returned.
+func TestHandlerInfo(t *testing.T) {
+	testSetup()
+
+	credBytes, err := createAuth(t, "someone@auth.com", nil)
+	if err != nil {
+		return
+	}
+	if _, _, err = login(t, credBytes); err != nil {
+		return
+	}
+
+	manyLogins := 3
+	if credBytes, err = createAuth(t, "many@login.com", nil); err != nil {
+		return
+	}
+	var tokenBytes []byte
+	for i := 0; i < manyLogins; i++ {
+		if tokenBytes, _, err = login(t, credBytes); err != nil {
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerInfo)))
+	defer testServer.Close()
+	status, b := request(t, testServer.URL, http.MethodGet, tokenBytes, nil)
+	info := Info{}
+	if err := json.Unmarshal(b, &info); status != http.StatusOK || err != nil {
+		t.Errorf("info status: %d, error: %v", status, err)
+		return
+	}
+	if info.OutstandingTokens != manyLogins {
+		t.Errorf("wrong number of OutstandingTokens: %d", info.OutstandingTokens)
+	}
+}
+
+// TestHandlerLogin verifies login returns a valid token, and fails for a deleted auth.
+func TestHandlerLogin(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServer.Close()
+	if status, _ := request(t, testServer.URL, http.MethodGet, nil, nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, nil, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("no body status: %d", status)
+		return
+	}
+
+	em := "testLogin@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	expectedExpireTime := time.Now().Add(config.JWTAuthExpirationInterval).Unix()
+	status, tokenBytes := request(t, testServer.URL, http.MethodPut, nil, credBytes)
+	if status != http.StatusOK {
+		t.Errorf("login status: %d", status)
+		return
+	}
+	claims, err := parseClaims(string(tokenBytes))
+	if err != nil || claims.Email != em {
+		t.Errorf("token not valid, claims: %+v, error: %v", claims, err)
+		return
+	}
+	if expireDiff := expectedExpireTime - claims.ExpiresAt; expireDiff < -5 || expireDiff > 5 {
+		t.Errorf("wrong expiration, difference: %d", expireDiff)
+		return
+	}
+
+	if _, err := authDelete(em); err != nil {
+		t.Errorf("authDelete error: %v", err)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, nil, credBytes); status != http.StatusUnauthorized {
+		t.Errorf("deleted auth status: %d", status)
+		return
+	}
+}
+
+// TestHandlerLogout verifies logout deletes the token.
+func TestHandlerLogout(t *testing.T) {
+	testSetup()
+
+	credBytes, err := createAuth(t, "logout@auth.com", nil)
+	if err != nil {
+		return
+	}
+	tokenBytes, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogout)))
+	defer testServer.Close()
+	if status, _ := request(t, testServer.URL, http.MethodDelete, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("no token status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodDelete, tokenBytes, nil); status != http.StatusNoContent {
+		t.Errorf("logout status: %d", status)
+		return
+	}
+	if b, err := kvsToken.Get(claims.tokenKVSKey()); b != nil || err != nil {
+		t.Errorf("token not deleted, error: %v", err)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodDelete, tokenBytes, nil); status != http.StatusUnauthorized {
+		t.Errorf("logged out token status: %d", status)
+		return
+	}
+}
+
+// TestHandlerLogoutAll verifies logout all deletes all tokens of the caller, and only the caller.
+func TestHandlerLogoutAll(t *testing.T) {
+	testSetup()
+
+	credBytes, err := createAuth(t, "someone@auth.com", nil)
+	if err != nil {
+		return
+	}
+	if _, _, err = login(t, credBytes); err != nil {
+		return
+	}
+
+	if credBytes, err = createAuth(t, "many@login.com", nil); err != nil {
+		return
+	}
+	var tokenBytes []byte
+	for i := 0; i < 3; i++ {
+		if tokenBytes, _, err = login(t, credBytes); err != nil {
+			return
+		}
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer testServer.Close()
+	if status, _ := request(t, testServer.URL, http.MethodDelete, tokenBytes, nil); status != http.StatusNoContent {
+		t.Errorf("logout all status: %d", status)
+		return
+	}
+	if n, err := userTokens("many@login.com", false); n != 0 || err != nil {
+		t.Errorf("tokens: %d, error: %v", n, err)
+		return
+	}
+	if n, err := userTokens("someone@auth.com", false); n != 1 || err != nil {
+		t.Errorf("other user tokens: %d, error: %v", n, err)
+		return
+	}
+}
+
+// TestHandlerRefresh verifies refresh returns a new token, and invalidates the token used.
+func TestHandlerRefresh(t *testing.T) {
+	testSetup()
+
+	credBytes, err := createAuth(t, "refresh@auth.com", nil)
+	if err != nil {
+		return
+	}
+	tokenBytesLogin, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerRefresh)))
+	defer testServer.Close()
+	expectedExpireTime := time.Now().Add(config.JWTAuthExpirationInterval).Unix()
+	status, tokenBytes := request(t, testServer.URL, http.MethodPost, tokenBytesLogin, nil)
+	if status != http.StatusCreated {
+		t.Errorf("refresh status: %d", status)
+		return
+	}
+	claims, err := parseClaims(string(tokenBytes))
+	if err != nil {
+		t.Errorf("token not valid, error: %v", err)
+		return
+	}
+	if expireDiff := expectedExpireTime - claims.ExpiresAt; expireDiff < -5 || expireDiff > 5 {
+		t.Errorf("wrong expiration, difference: %d", expireDiff)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPost, tokenBytesLogin, nil); status != http.StatusUnauthorized {
+		t.Errorf("refreshed token status: %d", status)
+		return
+	}
+}
+
+func handlerTest(w http.ResponseWriter, r *http.Request) {
+	if _, ok := ClaimsFromRequest(r); !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
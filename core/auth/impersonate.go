@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+const (
+	defaultImpersonationExpirationInterval = 15 * time.Minute
+	queryParamAudience                     = "audience"
+)
+
+// handlerImpersonate is for administrators to get a token for another user; I.E. for support
+// staff to reproduce what the user sees without knowing their password. The token has the roles
+// and tenant of the user, the Actor claim is the administrator, and it expires after
+// Config.ImpersonationExpirationInterval. The token is a session of the user, so is listed and
+// revoked with the sessions of the user. Impersonation tokens cannot be refreshed, change the
+// credentials of the user, delete the user, revoke the sessions of the user, or impersonate.
+// Users with RoleAdmin cannot be impersonated. Requires RoleAdmin.
+// http.MethodPost - get a token for the user with query parameter email, for the audience in the
+// optional query parameter audience; the body is the token.
+func handlerImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := ClaimsFromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	em := r.URL.Query().Get(queryParamEmail)
+	if em == "" || em == claims.Email {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if auth.Disabled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if hasRole(auth.Roles, RoleAdmin) {
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("impersonation of administrator not allowed, email: %s", em)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	audience := r.URL.Query().Get(queryParamAudience)
+	scopes, err := audienceScopes(audience, nil, tokenRoles(auth))
+	if err != nil {
+		lpf(logh.Error, "audienceScopes error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ic := CustomClaims{Actor: claims.Email, Email: em, PasswordResetRequired: auth.PasswordResetRequired,
+		Roles: tokenRoles(auth), Scopes: scopes, Tenant: auth.Tenant}
+	ic.Audience = audience
+	ic.ExpiresAt = time.Now().Add(config.ImpersonationExpirationInterval).Unix()
+	tokenString, err := tokenStringCreate(ic, r)
+	if err != nil {
+		lpf(logh.Error, "tokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("impersonation token issued for email: %s, audience: %s, expires: %s",
+			em, audience, time.Unix(ic.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// actor returns the email of the caller; the administrator for an impersonation token, otherwise
+// the user.
+func (cc CustomClaims) actor() string {
+	if cc.Actor != "" {
+		return cc.Actor
+	}
+	return cc.Email
+}
+
+// impersonating returns true when the request is authenticated with an impersonation token; then
+// http.StatusForbidden is written, and callers should return without writing header status. Used
+// by handlers that change the credentials of the account, or issue tokens.
+func impersonating(w http.ResponseWriter, r *http.Request) bool {
+	claims, ok := ClaimsFromRequest(r)
+	if !ok || claims.Actor == "" {
+		return false
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		// The wrapper writes the audit record.
+		aw.Message = "impersonation token not allowed"
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return true
+}
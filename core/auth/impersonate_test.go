@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/rest-app/core/audit"
+)
+
+// TestImpersonate verifies only administrators get impersonation tokens, the tokens carry the
+// actor, are short lived, cannot refresh or change credentials, and are audited with the actor
+// and subject.
+func TestImpersonate(t *testing.T) {
+	testSetup()
+	config.ImpersonationExpirationInterval = time.Minute
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	if err := logh.New("impersonate", auditPath, logh.DefaultLevels, logh.Info, logh.DefaultFlags, 100, int64(10e6)); err != nil {
+		t.Errorf("logh.New error: %v", err)
+		return
+	}
+	audit.Init(audit.Config{AuditLogName: "impersonate", LogName: "auth"})
+	defer audit.Init(audit.Config{AuditLogName: "auth", LogName: "auth"})
+
+	impersonateServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerImpersonate)))
+	defer impersonateServer.Close()
+	refreshServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerRefresh)))
+	defer refreshServer.Close()
+	sessionsServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerSessions)))
+	defer sessionsServer.Close()
+	updateServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate)))
+	defer updateServer.Close()
+	deleteServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerDelete)))
+	defer deleteServer.Close()
+	logoutAllServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerLogoutAll)))
+	defer logoutAllServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "user@auth.com"
+	userCred, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, userCred)
+	if err != nil {
+		return
+	}
+	if _, err := createAuth(t, "admin2@auth.com", []string{RoleAdmin}); err != nil {
+		return
+	}
+
+	tests := []struct {
+		query  string
+		token  []byte
+		status int
+	}{
+		{"?email=" + em, userToken, http.StatusForbidden},
+		{"", adminToken, http.StatusBadRequest},
+		{"?email=admin@auth.com", adminToken, http.StatusBadRequest},
+		{"?email=none@auth.com", adminToken, http.StatusNotFound},
+		{"?email=" + em + "&audience=none", adminToken, http.StatusBadRequest},
+		{"?email=admin2@auth.com", adminToken, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		if status, _ := request(t, impersonateServer.URL+test.query, http.MethodPost, test.token, nil); status != test.status {
+			t.Errorf("i: %d, status: %d", i, status)
+			return
+		}
+	}
+
+	status, token := request(t, impersonateServer.URL+"?email="+em, http.MethodPost, adminToken, nil)
+	if status != http.StatusCreated {
+		t.Errorf("impersonate status: %d", status)
+		return
+	}
+	claims, err := parseClaims(string(token))
+	if err != nil || claims.Actor != "admin@auth.com" || claims.Email != em || !claims.HasRole(RoleViewer) ||
+		claims.ExpiresAt > time.Now().Add(time.Minute).Unix() {
+		t.Errorf("claims: %+v, error: %v", claims, err)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodPost, token, nil); status != http.StatusNoContent {
+		t.Errorf("impersonation token status: %d", status)
+		return
+	}
+	// logh appends the rotation to the file path.
+	b, err := os.ReadFile(auditPath + ".0")
+	if err != nil || !strings.Contains(string(b), "subject: user@auth.com| actor: admin@auth.com|") {
+		t.Errorf("audit log missing actor, error: %v", err)
+		return
+	}
+
+	status, b = request(t, sessionsServer.URL, http.MethodGet, userToken, nil)
+	sessions := []Session{}
+	if err := json.Unmarshal(b, &sessions); status != http.StatusOK || err != nil || len(sessions) != 2 {
+		t.Errorf("sessions status: %d, sessions: %+v, error: %v", status, sessions, err)
+		return
+	}
+	for _, s := range sessions {
+		if (s.ID == claims.TokenID) != (s.Actor == "admin@auth.com") {
+			t.Errorf("sessions: %+v", sessions)
+			return
+		}
+	}
+
+	if status, _ := request(t, refreshServer.URL, http.MethodPost, token, []byte("{}")); status != http.StatusForbidden {
+		t.Errorf("refresh status: %d", status)
+		return
+	}
+	if status, _ := request(t, updateServer.URL, http.MethodPut, token, userCred); status != http.StatusForbidden {
+		t.Errorf("update status: %d", status)
+		return
+	}
+
+	// The subject's account and sessions cannot be destroyed with an impersonation token.
+	destroyTests := []struct {
+		url    string
+		method string
+	}{
+		{deleteServer.URL, http.MethodDelete},
+		{logoutAllServer.URL, http.MethodDelete},
+		{sessionsServer.URL, http.MethodDelete},
+		{sessionsServer.URL + "?id=" + claims.TokenID, http.MethodDelete},
+	}
+	for i, test := range destroyTests {
+		if status, _ := request(t, test.url, test.method, token, nil); status != http.StatusForbidden {
+			t.Errorf("i: %d, status: %d", i, status)
+			return
+		}
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodPost, userToken, nil); status != http.StatusNoContent {
+		t.Errorf("user token status: %d", status)
+		return
+	}
+	if auth, err := authGet(em); err != nil || auth.Email == nil {
+		t.Errorf("auth deleted, error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"os"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/storage"
+)
+
+// initializeKVS initializes KVS kvsAuth, kvsToken, kvsRefresh, kvsKeys, kvsAPIKey, kvsRevocation,
+// kvsLockout, kvsPasswordPolicy, kvsPasswordReset, and kvsSession; these are the key value stores
+// (KVS) for authentication, tokens, refresh tokens, the signing keys, API keys, revoked tokens,
+// failed logins, the password policy, password reset tokens, and sessions.
+func initializeKVS(dataSourcePath string) {
+	var err error
+	if kvsAuth, err = storage.Open(dataSourcePath, kvsAuthTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsToken, err = storage.Open(dataSourcePath, kvsTokenTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsRefresh, err = storage.Open(dataSourcePath, kvsRefreshTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsKeys, err = storage.Open(dataSourcePath, kvsKeysTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsAPIKey, err = storage.Open(dataSourcePath, kvsAPIKeyTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsRevocation, err = storage.Open(dataSourcePath, kvsRevocationTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsLockout, err = storage.Open(dataSourcePath, kvsLockoutTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsPasswordPolicy, err = storage.Open(dataSourcePath, kvsPasswordPolicyTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsPasswordReset, err = storage.Open(dataSourcePath, kvsPasswordResetTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	if kvsSession, err = storage.Open(dataSourcePath, kvsSessionTable); err != nil {
+		log.Fatalf("fatal: %s fatal: could not open store, error: %v", runtimeh.SourceInfo(), err)
+	}
+}
+
+// loadKeys loads the key for signing tokens.
+func loadKeys(config Config) {
+	var privKeyBytes, pubKeyBytes []byte
+	var err error
+
+	// For clients using an auth service, they will not have a JWTPrivateKeyPath
+	if config.JWTPrivateKeyPath != "" {
+		if privKeyBytes, err = os.ReadFile(config.JWTPrivateKeyPath); err != nil {
+			log.Fatalf("fatal: %s could not load private key from path: %s, error: %v",
+				runtimeh.SourceInfo(), config.JWTPrivateKeyPath, err)
+		}
+		block, _ := pem.Decode(privKeyBytes)
+		if block == nil {
+			log.Fatalf("fatal: %s no PEM data in private key: %s", runtimeh.SourceInfo(), config.JWTPrivateKeyPath)
+		}
+		var key any
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			log.Fatalf("fatal: %s x509.ParsePKCS8PrivateKey error: %+v", runtimeh.SourceInfo(), err)
+		}
+		if k, ok := key.(*rsa.PrivateKey); ok {
+			rsaPrivateKey = k
+		}
+	} else {
+		lp(logh.Info, "No JWTPrivateKeyPath provided.")
+	}
+
+	// Services using a JWKS do not require a pinned public key.
+	if config.JWKSURL != "" {
+		if config.JWTPublicKeyPath == "" {
+			lp(logh.Info, "No JWTPublicKeyPath provided.")
+			return
+		}
+		if _, err := os.Stat(config.JWTPublicKeyPath); err != nil {
+			lpf(logh.Error, "pinned public key not available, tokens can only be validated using the JWKS, error: %v", err)
+			return
+		}
+	}
+	if pubKeyBytes, err = os.ReadFile(config.JWTPublicKeyPath); err != nil {
+		log.Fatalf("fatal: %s could not load public key from path: %s, error: %v",
+			runtimeh.SourceInfo(), config.JWTPublicKeyPath, err)
+	}
+
+	block, _ := pem.Decode(pubKeyBytes)
+	if block == nil {
+		log.Fatalf("fatal: %s no PEM data in public key: %s", runtimeh.SourceInfo(), config.JWTPublicKeyPath)
+	}
+	var key any
+	if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		log.Fatalf("fatal: %s x509.ParsePKIXPublicKey error: %+v", runtimeh.SourceInfo(), err)
+	}
+	if k, ok := key.(*rsa.PublicKey); ok {
+		rsaPublicKey = k
+	}
+}
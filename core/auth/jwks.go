@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// JWK is a JSON Web Key (RFC 7517) for an RSA public key.
+type JWK struct {
+	Alg string `json:"alg"`
+	E   string `json:"e"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	Use string `json:"use"`
+}
+
+// JWKS is a JSON Web Key Set; the body returned by PathJWKS.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+const (
+	defaultJWKSRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits fetches of the JWKS caused by tokens with an unknown kid.
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksResponseLimit      = 1 << 20
+	jwksTimeout            = 10 * time.Second
+)
+
+var (
+	// publicKeys are the keys fetched from Config.JWKSURL, by kid.
+	publicKeys      = map[string]*rsa.PublicKey{}
+	publicKeysMutex sync.RWMutex
+
+	// jwksFetched is the time of the last fetch; jwksMutex serializes fetches.
+	jwksFetched time.Time
+	jwksMutex   sync.Mutex
+)
+
+// KeyID returns the kid for a public key; the RFC 7638 JWK thumbprint, base64url encoded.
+func KeyID(pub *rsa.PublicKey) string {
+	e, n := jwkEncode(pub)
+	// Members in lexical order, with no whitespace, per RFC 7638.
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, e, n)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handlerJWKS returns the JWKS with the public keys used to verify tokens issued by this service;
+// the keyset, including keys that are not yet retired.
+// http.MethodGet - get the JWKS.
+func handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	jwks := JWKS{Keys: []JWK{}}
+	keysetMutex.RLock()
+	for _, sk := range keyset {
+		jwks.Keys = append(jwks.Keys, jwkFromPublicKey(&sk.private.PublicKey))
+	}
+	keysetMutex.RUnlock()
+	if len(jwks.Keys) == 0 && rsaPublicKey != nil {
+		jwks.Keys = append(jwks.Keys, jwkFromPublicKey(rsaPublicKey))
+	}
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(defaultJWKSRefreshInterval.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// jwkFromPublicKey returns the JWK for pub.
+func jwkFromPublicKey(pub *rsa.PublicKey) JWK {
+	e, n := jwkEncode(pub)
+	return JWK{Alg: "RS256", E: e, Kid: KeyID(pub), Kty: "RSA", N: n, Use: "sig"}
+}
+
+// jwkEncode returns the base64url encoded exponent and modulus of pub.
+func jwkEncode(pub *rsa.PublicKey) (e string, n string) {
+	return base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+}
+
+// jwksFetch gets the JWKS from Config.JWKSURL and returns the RSA signing keys by kid.
+func jwksFetch() (map[string]*rsa.PublicKey, error) {
+	client := config.AuthServiceClient
+	if client == nil {
+		client = &http.Client{Timeout: jwksTimeout}
+	}
+	resp, err := client.Get(config.JWKSURL)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s JWKS GET %s status: %d", runtimeh.SourceInfo(), config.JWKSURL, resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, jwksResponseLimit))
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	jwks := JWKS{}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		pub, err := publicKeyFromJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+		kid := jwk.Kid
+		if kid == "" {
+			kid = KeyID(pub)
+		}
+		keys[kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s JWKS from %s has no RSA signing keys", runtimeh.SourceInfo(), config.JWKSURL)
+	}
+	return keys, nil
+}
+
+// jwksInit fetches the JWKS, and starts a GO routine to refresh it every
+// Config.JWKSRefreshInterval. When the JWKS cannot be fetched, tokens are verified with the pinned
+// key (Config.JWTPublicKeyPath) until a fetch succeeds.
+func jwksInit() {
+	if err := jwksRefresh(true); err != nil {
+		lpf(logh.Error, "JWKS could not be fetched, using the pinned key until it is, error:%v", err)
+	}
+	interval := config.JWKSRefreshInterval
+	if interval == 0 {
+		interval = defaultJWKSRefreshInterval
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := jwksRefresh(true); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "JWKS refresh error:%v", err)
+			}
+		}
+	}()
+}
+
+// jwksRefresh fetches the JWKS and replaces the cached keys. Unless force, the JWKS is not
+// fetched if it was fetched within jwksMinRefreshInterval.
+func jwksRefresh(force bool) error {
+	jwksMutex.Lock()
+	defer jwksMutex.Unlock()
+	if !force && time.Since(jwksFetched) < jwksMinRefreshInterval {
+		return fmt.Errorf("%s JWKS was fetched at %s", runtimeh.SourceInfo(), jwksFetched.Format(time.RFC3339))
+	}
+	jwksFetched = time.Now()
+	keys, err := jwksFetch()
+	if err != nil {
+		return err
+	}
+	publicKeysMutex.Lock()
+	publicKeys = keys
+	publicKeysMutex.Unlock()
+	return nil
+}
+
+// publicKey returns the key for verifying a token with the kid. The JWKS is fetched again
+// for an unknown kid, as the auth service may have a new key.
+func publicKey(kid string) (*rsa.PublicKey, error) {
+	if pub := publicKeyCached(kid); pub != nil {
+		return pub, nil
+	}
+	if kid != "" && config.JWKSURL != "" {
+		if err := jwksRefresh(false); err != nil {
+			lpf(logh.Debug, "jwksRefresh error:%v", err)
+		}
+		if pub := publicKeyCached(kid); pub != nil {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("%s no key for kid: %s", runtimeh.SourceInfo(), kid)
+}
+
+// publicKeyCached returns the key from the keyset, the JWKS, or the pinned key, or nil. When
+// there is a keyset only its keys are trusted, so retired keys are not. Tokens without a kid,
+// issued before kid was added, use the pinned key, or the only key in the JWKS.
+func publicKeyCached(kid string) *rsa.PublicKey {
+	if pub, ok := keysetPublicKey(kid); ok {
+		return pub
+	}
+	publicKeysMutex.RLock()
+	defer publicKeysMutex.RUnlock()
+	if kid == "" {
+		if rsaPublicKey != nil {
+			return rsaPublicKey
+		}
+		if len(publicKeys) == 1 {
+			for _, pub := range publicKeys {
+				return pub
+			}
+		}
+		return nil
+	}
+	if pub, ok := publicKeys[kid]; ok {
+		return pub
+	}
+	if rsaPublicKey != nil && KeyID(rsaPublicKey) == kid {
+		return rsaPublicKey
+	}
+	return nil
+}
+
+// publicKeyFromJWK returns the RSA public key for the JWK.
+func publicKeyFromJWK(jwk JWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("JWK n", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("JWK e", err)
+	}
+	eInt := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !eInt.IsInt64() || eInt.Int64() < 3 || eInt.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("%s invalid JWK kid: %s", runtimeh.SourceInfo(), jwk.Kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(eInt.Int64())}, nil
+}
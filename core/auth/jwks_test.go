@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandlerJWKS verifies the JWKS has the public key, with the kid used in tokens.
+func TestHandlerJWKS(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerJWKS))
+	defer testServer.Close()
+	resp, err := http.Get(testServer.URL)
+	if err != nil {
+		t.Errorf("GET error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	jwks := JWKS{}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("status: %d, error: %v", resp.StatusCode, err)
+		return
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != signingKeyID || signingKeyID == "" {
+		t.Errorf("JWKS keys: %+v, signingKeyID: %s", jwks.Keys, signingKeyID)
+		return
+	}
+	pub, err := publicKeyFromJWK(jwks.Keys[0])
+	if err != nil || !pub.Equal(rsaPublicKey) {
+		t.Errorf("JWK did not match the public key, error: %v", err)
+		return
+	}
+
+	token, err := authTokenStringCreate("jwks@auth.com", []string{RoleViewer}, nil)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	if _, err := parseClaims(token); err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+}
+
+// TestJWKSRemote verifies a service without a private key validates tokens using the JWKS of an
+// auth service, fetches the JWKS for an unknown kid, and uses the pinned key when offline.
+func TestJWKSRemote(t *testing.T) {
+	testSetup()
+	defer func() {
+		config.JWKSURL = ""
+		publicKeys = map[string]*rsa.PublicKey{}
+		jwksFetched = time.Time{}
+	}()
+
+	// The auth service publishes keyA.
+	keyA := rsaPrivateKey
+	tokenA, err := authTokenStringCreate("jwks@auth.com", []string{RoleViewer}, nil)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	var jwksMutex sync.Mutex
+	jwks := JWKS{Keys: []JWK{jwkFromPublicKey(&keyA.PublicKey)}}
+	fetches := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksMutex.Lock()
+		defer jwksMutex.Unlock()
+		fetches++
+		if err := json.NewEncoder(w).Encode(jwks); err != nil {
+			t.Errorf("Encode error: %v", err)
+		}
+	}))
+	defer testServer.Close()
+
+	// The resource service has no pinned key, and no keyset.
+	rsaPublicKey = nil
+	keyset = map[string]signingKey{}
+	config.JWKSURL = testServer.URL
+	if err := jwksRefresh(true); err != nil {
+		t.Errorf("jwksRefresh error: %v", err)
+		return
+	}
+	if _, err := parseClaims(tokenA); err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+
+	// The auth service changes to keyB; the unknown kid causes the JWKS to be fetched.
+	keyB, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Errorf("GenerateKey error: %v", err)
+		return
+	}
+	rsaPrivateKey = keyB
+	signingKeyID = KeyID(&keyB.PublicKey)
+	tokenB, err := authTokenStringCreate("jwks@auth.com", []string{RoleViewer}, nil)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	jwksMutex.Lock()
+	jwks.Keys = append(jwks.Keys, jwkFromPublicKey(&keyB.PublicKey))
+	jwksMutex.Unlock()
+	jwksFetched = time.Time{}
+	if _, err := parseClaims(tokenB); err != nil || fetches != 2 {
+		t.Errorf("parseClaims fetches: %d, error: %v", fetches, err)
+		return
+	}
+	// Unknown kids do not cause a fetch within jwksMinRefreshInterval.
+	if _, err := publicKey("unknown"); err == nil || fetches != 2 {
+		t.Errorf("publicKey fetches: %d, error: %v", fetches, err)
+		return
+	}
+
+	// Offline, with only the pinned keyA.
+	testServer.Close()
+	publicKeys = map[string]*rsa.PublicKey{}
+	rsaPublicKey = &keyA.PublicKey
+	if err := jwksRefresh(true); err == nil {
+		t.Errorf("jwksRefresh did not fail with the auth service offline")
+		return
+	}
+	if _, err := parseClaims(tokenA); err != nil {
+		t.Errorf("parseClaims with pinned key error: %v", err)
+		return
+	}
+	if _, err := parseClaims(tokenB); err == nil {
+		t.Errorf("parseClaims did not fail for key not in the JWKS or pinned")
+		return
+	}
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/audit"
+)
+
+// KeyInfo describes a key in the keyset; returned by PathKeys.
+type KeyInfo struct {
+	// Created is the Unix (seconds) time the key was created.
+	Created int64
+	Kid     string
+	// RetireAt is the Unix (seconds) time after which the key is removed from the keyset; zero
+	// for the signing key.
+	RetireAt int64 `json:",omitempty"`
+	// Signing is true for the key used to sign new tokens.
+	Signing bool
+}
+
+// signingKey is persisted in kvsKeys, keyed by Kid.
+type signingKey struct {
+	Created int64
+	Kid     string
+	// PrivateKey is PKCS8, DER encoded.
+	PrivateKey []byte
+	RetireAt   int64
+
+	private *rsa.PrivateKey
+}
+
+const (
+	// keyBits is the size of keys created by rotation.
+	keyBits      = 2048
+	kvsKeysTable = "authKeys"
+)
+
+var (
+	// keyset are the keys trusted to verify tokens, by kid; the newest is the signing key.
+	// Empty when there is no DataSourcePath.
+	keyset      = map[string]signingKey{}
+	keysetMutex sync.RWMutex
+
+	// signingKeyID is the kid of rsaPrivateKey.
+	signingKeyID string
+)
+
+// handlerKeys lists the keyset, or rotates the signing key. Prior signing keys are accepted until
+// the tokens they signed have expired (Config.JWTAuthExpirationInterval), then retired.
+// http.MethodGet - list the keys.
+// http.MethodPost - create a new signing key; the body is the KeyInfo of the new key.
+func handlerKeys(w http.ResponseWriter, r *http.Request) {
+	var out any
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		out = keysInfo()
+	case http.MethodPost:
+		kid, err := keyRotate()
+		if err != nil {
+			lpf(logh.Error, "keyRotate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("signing key rotated, kid: %s", kid)
+		}
+		for _, ki := range keysInfo() {
+			if ki.Kid == kid {
+				out = ki
+			}
+		}
+		status = http.StatusCreated
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, status, out)
+}
+
+// currentSigningKey returns the kid and key used to sign new tokens.
+func currentSigningKey() (string, *rsa.PrivateKey) {
+	keysetMutex.RLock()
+	defer keysetMutex.RUnlock()
+	return signingKeyID, rsaPrivateKey
+}
+
+// keyRotate creates a new signing key, schedules the prior signing key for retirement, and
+// returns the kid of the new key.
+func keyRotate() (string, error) {
+	if kvsKeys == nil {
+		return "", fmt.Errorf("%s keys can only be rotated with a DataSourcePath", runtimeh.SourceInfo())
+	}
+	private, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	now := time.Now()
+	sk := signingKey{Created: now.Unix(), Kid: KeyID(&private.PublicKey), PrivateKey: der, private: private}
+
+	keysetMutex.Lock()
+	defer keysetMutex.Unlock()
+	if err := kvsKeys.Serialize(sk.Kid, sk); err != nil {
+		return "", err
+	}
+	keyset[sk.Kid] = sk
+	priorKid := signingKeyID
+	if prior, ok := keyset[priorKid]; ok {
+		prior.RetireAt = now.Add(config.JWTAuthExpirationInterval).Unix()
+		if err := kvsKeys.Serialize(prior.Kid, prior); err != nil {
+			return "", err
+		}
+		keyset[prior.Kid] = prior
+	}
+	signingKeyID = sk.Kid
+	rsaPrivateKey = private
+	audit.Printf("signing key rotated, kid: %s, prior kid: %s retires at: %s", sk.Kid, priorKid,
+		now.Add(config.JWTAuthExpirationInterval).UTC().Format(time.RFC3339))
+	return sk.Kid, nil
+}
+
+// keyRotateScheduled is a go routine that rotates the signing key when it is older than rate.
+func keyRotateScheduled(rate time.Duration) {
+	go func() {
+		for {
+			keysetMutex.RLock()
+			created := keyset[signingKeyID].Created
+			keysetMutex.RUnlock()
+			if wait := time.Until(time.Unix(created, 0).Add(rate)); wait > 0 {
+				time.Sleep(wait)
+				continue
+			}
+			if _, err := keyRotate(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "keyRotate error: %v\n", err)
+				time.Sleep(time.Minute)
+			}
+		}
+	}()
+}
+
+// keysInfo returns the keyset, oldest first, and the signing key last.
+func keysInfo() []KeyInfo {
+	keysetMutex.RLock()
+	defer keysetMutex.RUnlock()
+	out := make([]KeyInfo, 0, len(keyset))
+	for _, sk := range keyset {
+		out = append(out, KeyInfo{Created: sk.Created, Kid: sk.Kid, RetireAt: sk.RetireAt, Signing: sk.Kid == signingKeyID})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Created == out[j].Created {
+			return out[j].Signing
+		}
+		return out[i].Created < out[j].Created
+	})
+	return out
+}
+
+// keysInit loads the keyset from kvsKeys. An empty keyset is created with the key loaded from
+// Config.JWTPrivateKeyPath, so tokens issued before the keyset existed remain valid.
+func keysInit() error {
+	keys, err := kvsKeys.Keys()
+	if err != nil {
+		return err
+	}
+	loaded := map[string]signingKey{}
+	newest := ""
+	for _, key := range keys {
+		sk := signingKey{}
+		if err := kvsKeys.Deserialize(key, &sk); err != nil {
+			return err
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(sk.PrivateKey)
+		if err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+		var ok bool
+		if sk.private, ok = parsed.(*rsa.PrivateKey); !ok {
+			return fmt.Errorf("%s key is not RSA, kid: %s", runtimeh.SourceInfo(), sk.Kid)
+		}
+		loaded[sk.Kid] = sk
+		if sk.RetireAt == 0 && (newest == "" || sk.Created > loaded[newest].Created) {
+			newest = sk.Kid
+		}
+	}
+
+	keysetMutex.Lock()
+	defer keysetMutex.Unlock()
+	if newest == "" {
+		der, err := x509.MarshalPKCS8PrivateKey(rsaPrivateKey)
+		if err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+		sk := signingKey{Created: time.Now().Unix(), Kid: KeyID(&rsaPrivateKey.PublicKey), PrivateKey: der,
+			private: rsaPrivateKey}
+		if err := kvsKeys.Serialize(sk.Kid, sk); err != nil {
+			return err
+		}
+		loaded[sk.Kid] = sk
+		newest = sk.Kid
+		audit.Printf("signing key added to the keyset, kid: %s", sk.Kid)
+	}
+	keyset = loaded
+	signingKeyID = newest
+	rsaPrivateKey = loaded[newest].private
+	return nil
+}
+
+// keysRetire removes keys from the keyset after their RetireAt, and returns the count.
+func keysRetire() (int, error) {
+	keysetMutex.Lock()
+	defer keysetMutex.Unlock()
+	now := time.Now().Unix()
+	count := 0
+	for kid, sk := range keyset {
+		if sk.RetireAt == 0 || now <= sk.RetireAt {
+			continue
+		}
+		if _, err := kvsKeys.Delete(kid); err != nil {
+			return count, err
+		}
+		delete(keyset, kid)
+		audit.Printf("signing key retired, kid: %s", kid)
+		count++
+	}
+	return count, nil
+}
+
+// keysetPublicKey returns the public key from the keyset for the kid, and whether the keyset is
+// in use. Tokens without a kid were signed by the key loaded from Config.JWTPrivateKeyPath.
+func keysetPublicKey(kid string) (*rsa.PublicKey, bool) {
+	keysetMutex.RLock()
+	defer keysetMutex.RUnlock()
+	if len(keyset) == 0 {
+		return nil, false
+	}
+	if kid == "" && rsaPublicKey != nil {
+		kid = KeyID(rsaPublicKey)
+	}
+	if sk, ok := keyset[kid]; ok {
+		return &sk.private.PublicKey, true
+	}
+	return nil, true
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestKeyRotation verifies tokens signed by prior keys are accepted until the key is retired,
+// and that the keyset is persisted.
+func TestKeyRotation(t *testing.T) {
+	testSetup()
+
+	tokenA, err := authTokenStringCreate("keys@auth.com", []string{RoleViewer}, nil)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	kidA := signingKeyID
+	kidB, err := keyRotate()
+	if err != nil || kidB == kidA {
+		t.Errorf("keyRotate kid: %s, error: %v", kidB, err)
+		return
+	}
+	tokenB, err := authTokenStringCreate("keys@auth.com", []string{RoleViewer}, nil)
+	if err != nil {
+		t.Errorf("authTokenStringCreate error: %v", err)
+		return
+	}
+	for _, token := range []string{tokenA, tokenB} {
+		if _, err := parseClaims(token); err != nil {
+			t.Errorf("parseClaims error: %v", err)
+			return
+		}
+	}
+	ki := keysInfo()
+	if len(ki) != 2 || ki[0].Kid != kidA || ki[0].RetireAt == 0 || ki[0].Signing || ki[1].Kid != kidB || !ki[1].Signing {
+		t.Errorf("keysInfo: %+v", ki)
+		return
+	}
+
+	// The keyset is loaded at Init.
+	Init(config, nil)
+	if signingKeyID != kidB || len(keysInfo()) != 2 {
+		t.Errorf("keyset not persisted, signingKeyID: %s, keysInfo: %+v", signingKeyID, keysInfo())
+		return
+	}
+
+	// Rotating with a negative expiration retires kidB immediately.
+	expiration := config.JWTAuthExpirationInterval
+	config.JWTAuthExpirationInterval = -2 * time.Second
+	_, err = keyRotate()
+	config.JWTAuthExpirationInterval = expiration
+	if err != nil {
+		t.Errorf("keyRotate error: %v", err)
+		return
+	}
+	if n, err := keysRetire(); n != 1 || err != nil {
+		t.Errorf("keysRetire count: %d, error: %v", n, err)
+		return
+	}
+	if _, err := parseClaims(tokenB); err == nil {
+		t.Errorf("token signed by a retired key was accepted")
+		return
+	}
+	if _, err := parseClaims(tokenA); err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+}
+
+// TestHandlerKeys verifies only administrators can list and rotate keys, and the JWKS has the
+// keyset.
+func TestHandlerKeys(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerKeys)))
+	defer testServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	viewerCred, err := createAuth(t, "viewer@auth.com", nil)
+	if err != nil {
+		return
+	}
+	viewerToken, _, err := login(t, viewerCred)
+	if err != nil {
+		return
+	}
+
+	if status, _ := request(t, testServer.URL, http.MethodPost, viewerToken, nil); status != http.StatusForbidden {
+		t.Errorf("viewer rotate status: %d", status)
+		return
+	}
+	status, body := request(t, testServer.URL, http.MethodPost, adminToken, nil)
+	ki := KeyInfo{}
+	if err := json.Unmarshal(body, &ki); status != http.StatusCreated || err != nil || !ki.Signing || ki.Kid != signingKeyID {
+		t.Errorf("admin rotate status: %d, KeyInfo: %+v, error: %v", status, ki, err)
+		return
+	}
+	// The admin token was signed by the prior key.
+	status, body = request(t, testServer.URL, http.MethodGet, adminToken, nil)
+	kis := []KeyInfo{}
+	if err := json.Unmarshal(body, &kis); status != http.StatusOK || err != nil || len(kis) != 2 {
+		t.Errorf("list status: %d, keys: %+v, error: %v", status, kis, err)
+		return
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(handlerJWKS))
+	defer jwksServer.Close()
+	resp, err := http.Get(jwksServer.URL)
+	if err != nil {
+		t.Errorf("GET error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	jwks := JWKS{}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil || len(jwks.Keys) != 2 {
+		t.Errorf("JWKS keys: %+v, error: %v", jwks.Keys, err)
+		return
+	}
+}
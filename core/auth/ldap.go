@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// LDAPBackend is a CredentialBackend that binds to an LDAP directory as the user, then maps the
+// directory groups of the user to roles.
+type LDAPBackend struct {
+	// GroupBaseDN is the base DN searched, as the user, for the groups of the user. If empty,
+	// users have no groups.
+	GroupBaseDN string
+	// GroupFilter is the filter for the groups of the user, with %s replaced by the DN of the
+	// user. If empty the default is used: (member=%s)
+	GroupFilter string
+	// GroupRoles maps the DNs of groups to roles; DNs are compared case insensitively.
+	GroupRoles map[string]string
+	// TLSConfig is used for ldaps:// URLs; if nil the system roots are used.
+	TLSConfig *tls.Config
+	// Timeout is the timeout for connecting, and for each request. If zero the default is used:
+	// 10 seconds.
+	Timeout time.Duration
+	// URL is the URL of the directory; I.E. ldaps://ldap.example.com
+	URL string
+	// UserDN is the DN of the user, with %s replaced by the email used to login; I.E.
+	// uid=%s,ou=people,dc=example,dc=com
+	UserDN string
+}
+
+const (
+	ldapGroupFilterDefault = "(member=%s)"
+	ldapTimeoutDefault     = 10 * time.Second
+)
+
+// Authenticate binds to the directory as the user, and returns the roles of the groups of the
+// user.
+func (lb LDAPBackend) Authenticate(email string, password string) ([]string, error) {
+	// An empty password is an unauthenticated bind, which directories accept.
+	if email == "" || password == "" {
+		return nil, ErrCredentialsInvalid
+	}
+	timeout := lb.Timeout
+	if timeout == 0 {
+		timeout = ldapTimeoutDefault
+	}
+	conn, err := ldap.DialURL(lb.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(lb.TLSConfig))
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	userDN := fmt.Sprintf(lb.UserDN, ldap.EscapeDN(email))
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrCredentialsInvalid
+		}
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	if lb.GroupBaseDN == "" {
+		return nil, nil
+	}
+
+	filter := lb.GroupFilter
+	if filter == "" {
+		filter = ldapGroupFilterDefault
+	}
+	filter = strings.ReplaceAll(filter, "%s", ldap.EscapeFilter(userDN))
+	req := ldap.NewSearchRequest(lb.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0,
+		int(timeout/time.Second), false, filter, []string{"dn"}, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	groups := make([]string, len(result.Entries))
+	for i, entry := range result.Entries {
+		groups[i] = entry.DN
+	}
+	return groupRoles(groups, lb.GroupRoles), nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// TestLDAPBackend verifies users bind as themselves, and get the roles of their groups, using a
+// minimal in-process LDAP server.
+func TestLDAPBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Listen error: %v", err)
+		return
+	}
+	defer ln.Close()
+	users := map[string]string{"uid=dir@auth.com,ou=people,dc=auth": "P@ssword1234"}
+	groups := map[string][]string{
+		"cn=operators,ou=groups,dc=auth": {"uid=dir@auth.com,ou=people,dc=auth"},
+		"cn=admins,ou=groups,dc=auth":    {"uid=other@auth.com,ou=people,dc=auth"},
+		"cn=unmapped,ou=groups,dc=auth":  {"uid=dir@auth.com,ou=people,dc=auth"},
+	}
+	go ldapServe(ln, users, groups)
+
+	lb := LDAPBackend{GroupBaseDN: "ou=groups,dc=auth",
+		GroupRoles: map[string]string{"CN=Operators,ou=groups,dc=auth": RoleOperator, "cn=admins,ou=groups,dc=auth": RoleAdmin},
+		URL:        "ldap://" + ln.Addr().String(), UserDN: "uid=%s,ou=people,dc=auth"}
+	roles, err := lb.Authenticate("dir@auth.com", "P@ssword1234")
+	if err != nil || !slices.Equal(roles, []string{RoleOperator}) {
+		t.Errorf("roles: %v, error: %v", roles, err)
+		return
+	}
+	for _, pw := range []string{"Wr0ng@ssword", ""} {
+		if _, err := lb.Authenticate("dir@auth.com", pw); err != ErrCredentialsInvalid {
+			t.Errorf("password: %s, error: %v", pw, err)
+			return
+		}
+	}
+	if _, err := lb.Authenticate("dir@auth.com,ou=people", "P@ssword1234"); err != ErrCredentialsInvalid {
+		t.Errorf("DN injection error: %v", err)
+		return
+	}
+
+	lb.URL = "ldap://127.0.0.1:1"
+	if _, err := lb.Authenticate("dir@auth.com", "P@ssword1234"); err == nil || err == ErrCredentialsInvalid {
+		t.Errorf("unreachable directory error: %v", err)
+		return
+	}
+}
+
+// ldapServe accepts connections on ln, responding to simple bind, search for the groups of the
+// bound user by the filter (member=<DN>), and unbind.
+func ldapServe(ln net.Listener, users map[string]string, groups map[string][]string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			bound := ""
+			for {
+				packet, err := ber.ReadPacket(conn)
+				if err != nil || len(packet.Children) < 2 {
+					return
+				}
+				id, _ := packet.Children[0].Value.(int64)
+				op := packet.Children[1]
+				switch op.Tag {
+				case ldap.ApplicationBindRequest:
+					dn := op.Children[1].Data.String()
+					pw := op.Children[2].Data.String()
+					code := int64(ldap.LDAPResultInvalidCredentials)
+					if p, ok := users[dn]; ok && p == pw && pw != "" {
+						bound = dn
+						code = ldap.LDAPResultSuccess
+					}
+					conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+				case ldap.ApplicationSearchRequest:
+					if bound == "" {
+						conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+						continue
+					}
+					base := op.Children[0].Data.String()
+					filter, _ := ldap.DecompileFilter(op.Children[6])
+					member := strings.TrimSuffix(strings.TrimPrefix(filter, "(member="), ")")
+					for dn, members := range groups {
+						if !strings.HasSuffix(dn, base) || !slices.Contains(members, member) {
+							continue
+						}
+						p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+						p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+						entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+						entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+						entry.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+						p.AppendChild(entry)
+						conn.Write(p.Bytes())
+					}
+					conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+				case ldap.ApplicationUnbindRequest:
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// ldapResult returns the LDAP message with id, of the result operation tag, with code.
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(result)
+	return p
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// LoginFailures is the failed login state for an account (Email) or source IP. After each
+// failure logins are rejected until LockedUntil; the delay doubles with each failure, and after
+// the lockout threshold is reached the account or IP is locked out.
+type LoginFailures struct {
+	// Count is the count of failed logins; reset by a successful login, or when there has been
+	// no failure for Config.LoginLockoutDuration.
+	Count int
+	Email string `json:",omitempty"`
+	IP    string `json:",omitempty"`
+	// LastFailure is the Unix (seconds) time of the last failed login.
+	LastFailure int64
+	// Locked is true when Count reached the lockout threshold.
+	Locked bool
+	// LockedUntil is the Unix (seconds) time until which logins are rejected.
+	LockedUntil int64
+}
+
+const (
+	defaultLoginFailureDelay       = time.Second
+	defaultLoginFailureDelayMax    = 30 * time.Second
+	defaultLoginLockoutDuration    = 15 * time.Minute
+	defaultLoginLockoutIPThreshold = 20
+	defaultLoginLockoutThreshold   = 5
+
+	kvsLockoutTable = "authLockout"
+)
+
+var (
+	// loginFailuresMutex serializes updates to kvsLockout, as each update reads then writes.
+	loginFailuresMutex sync.Mutex
+)
+
+// handlerLockouts is for administrators to list the failed login state of accounts and source
+// IPs, and to unlock them.
+// http.MethodDelete - unlock the account with query parameter email, or the IP with query
+// parameter ip.
+// http.MethodGet - list the accounts and IPs with failed logins.
+func handlerLockouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		em := r.URL.Query().Get(queryParamEmail)
+		ip := r.URL.Query().Get("ip")
+		if (em == "") == (ip == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key, subject := loginFailuresKey("", ip), "ip: "+ip
+		if em != "" {
+			key, subject = loginFailuresKey(em, ""), "email: "+em
+		}
+		loginFailuresMutex.Lock()
+		n, err := kvsLockout.Delete(key)
+		loginFailuresMutex.Unlock()
+		if err != nil {
+			lpf(logh.Error, "kvsLockout.Delete error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("login failures cleared, unlocked %s", subject)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		lfs, err := loginFailuresList()
+		if err != nil {
+			lpf(logh.Error, "loginFailuresList error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, lfs)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// loginAllowed returns zero when a login is allowed for the email from the IP, otherwise the
+// duration until a login is allowed.
+func loginAllowed(email string, ip string) (time.Duration, error) {
+	now := time.Now().Unix()
+	var until int64
+	for _, key := range []string{loginFailuresKey(email, ""), loginFailuresKey("", ip)} {
+		lf := LoginFailures{}
+		if err := kvsLockout.Deserialize(key, &lf); err != nil {
+			return 0, runtimeh.SourceInfoError("", err)
+		}
+		if lf.LockedUntil > now && lf.LockedUntil > until {
+			until = lf.LockedUntil
+		}
+	}
+	if until == 0 {
+		return 0, nil
+	}
+	return time.Duration(until-now) * time.Second, nil
+}
+
+// loginFailed records a failed login for the email and the IP, and returns the updated state of
+// each.
+func loginFailed(email string, ip string) (LoginFailures, LoginFailures, error) {
+	loginFailuresMutex.Lock()
+	defer loginFailuresMutex.Unlock()
+	account, err := loginFailuresUpdate(LoginFailures{Email: email}, config.LoginLockoutThreshold)
+	if err != nil {
+		return LoginFailures{}, LoginFailures{}, err
+	}
+	source, err := loginFailuresUpdate(LoginFailures{IP: ip}, config.LoginLockoutIPThreshold)
+	if err != nil {
+		return LoginFailures{}, LoginFailures{}, err
+	}
+	return account, source, nil
+}
+
+// loginFailuresExpired returns true when the LoginFailures is no longer locked, and the last
+// failure was more than Config.LoginLockoutDuration ago.
+func loginFailuresExpired(lf LoginFailures, now int64) bool {
+	return now >= lf.LockedUntil && now-lf.LastFailure > int64(config.LoginLockoutDuration/time.Second)
+}
+
+// loginFailuresKey returns the kvsLockout key for the email, or the IP when email is empty.
+func loginFailuresKey(email string, ip string) string {
+	if email != "" {
+		return "email|" + email
+	}
+	return "ip|" + ip
+}
+
+// loginFailuresList returns the LoginFailures that have not expired, ordered by LastFailure.
+func loginFailuresList() ([]LoginFailures, error) {
+	keys, err := kvsLockout.Keys()
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	now := time.Now().Unix()
+	out := []LoginFailures{}
+	for _, key := range keys {
+		lf := LoginFailures{}
+		if err := kvsLockout.Deserialize(key, &lf); err != nil {
+			return nil, runtimeh.SourceInfoError("", err)
+		}
+		if !loginFailuresExpired(lf, now) {
+			out = append(out, lf)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastFailure < out[j].LastFailure })
+	return out, nil
+}
+
+// loginFailuresUpdate increments the count of the persisted LoginFailures for lf.Email or lf.IP,
+// and sets LockedUntil using the progressive delay, or the lockout once the count reaches
+// threshold. Callers must hold loginFailuresMutex.
+func loginFailuresUpdate(lf LoginFailures, threshold int) (LoginFailures, error) {
+	key := loginFailuresKey(lf.Email, lf.IP)
+	now := time.Now()
+	prior := LoginFailures{}
+	if err := kvsLockout.Deserialize(key, &prior); err != nil {
+		return LoginFailures{}, runtimeh.SourceInfoError("", err)
+	}
+	if prior.Count > 0 && !loginFailuresExpired(prior, now.Unix()) {
+		lf.Count = prior.Count
+	}
+	lf.Count++
+	lf.LastFailure = now.Unix()
+
+	if lf.Count >= threshold {
+		lf.Locked = true
+		lf.LockedUntil = now.Add(config.LoginLockoutDuration).Unix()
+	} else {
+		delay := config.LoginFailureDelay << (lf.Count - 1)
+		if delay > config.LoginFailureDelayMax || delay <= 0 {
+			delay = config.LoginFailureDelayMax
+		}
+		// Round up to the next second, so the delay is never shorter than configured.
+		lf.LockedUntil = now.Add(delay + time.Second - 1).Unix()
+	}
+	if err := kvsLockout.Serialize(key, lf); err != nil {
+		return LoginFailures{}, runtimeh.SourceInfoError("", err)
+	}
+	return lf, nil
+}
+
+// loginSucceeded clears the failed logins of the email. The failures of the IP are not cleared,
+// as one valid account would otherwise allow unlimited guessing of others.
+func loginSucceeded(email string) error {
+	loginFailuresMutex.Lock()
+	defer loginFailuresMutex.Unlock()
+	if _, err := kvsLockout.Delete(loginFailuresKey(email, "")); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return nil
+}
+
+// removeExpiredLoginFailures deletes LoginFailures that have expired.
+func removeExpiredLoginFailures() (int, error) {
+	loginFailuresMutex.Lock()
+	defer loginFailuresMutex.Unlock()
+	keys, err := kvsLockout.Keys()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	count := 0
+	for _, key := range keys {
+		lf := LoginFailures{}
+		if err := kvsLockout.Deserialize(key, &lf); err != nil {
+			return count, err
+		}
+		if !loginFailuresExpired(lf, now) {
+			continue
+		}
+		if _, err := kvsLockout.Delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// requestIP returns the IP of the source of the request.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestLockout verifies failed logins delay further logins, then lock out the account and the
+// source IP, and that administrators can unlock them.
+func TestLockout(t *testing.T) {
+	testSetup()
+	config.LoginFailureDelay = 10 * time.Second
+	config.LoginLockoutThreshold = 2
+	config.LoginLockoutIPThreshold = 4
+
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+	lockoutsServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerLockouts)))
+	defer lockoutsServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "user@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	pw := "Bad@ss1234"
+	badBytes, _ := json.Marshal(Credential{Email: &em, Password: &pw})
+
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, badBytes); status != http.StatusUnauthorized {
+		t.Errorf("bad password status: %d", status)
+		return
+	}
+	// The correct password is rejected during the delay.
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, credBytes); status != http.StatusTooManyRequests {
+		t.Errorf("login during delay status: %d", status)
+		return
+	}
+
+	// Reaching the threshold locks the account.
+	if _, _, err := loginFailed(em, "192.0.2.1"); err != nil {
+		t.Errorf("loginFailed error: %v", err)
+		return
+	}
+	status, b := request(t, lockoutsServer.URL, http.MethodGet, adminToken, nil)
+	lfs := []LoginFailures{}
+	if err := json.Unmarshal(b, &lfs); status != http.StatusOK || err != nil || len(lfs) != 3 {
+		t.Errorf("list status: %d, failures: %+v, error: %v", status, lfs, err)
+		return
+	}
+	for _, lf := range lfs {
+		if (lf.Email == em) != lf.Locked {
+			t.Errorf("locked: %+v", lf)
+			return
+		}
+	}
+	if status, _ := request(t, lockoutsServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("unlock status: %d", status)
+		return
+	}
+	if status, _ := request(t, lockoutsServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNotFound {
+		t.Errorf("unlock again status: %d", status)
+		return
+	}
+
+	// The IP is still delayed from the failure, then locked out at its threshold, for all accounts.
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, credBytes); status != http.StatusTooManyRequests {
+		t.Errorf("login from delayed IP status: %d", status)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := loginFailed("other@auth.com", "127.0.0.1"); err != nil {
+			t.Errorf("loginFailed error: %v", err)
+			return
+		}
+	}
+	if retryAfter, err := loginAllowed(em, "127.0.0.1"); err != nil || retryAfter <= config.LoginFailureDelayMax {
+		t.Errorf("IP not locked out, retry after: %s, error: %v", retryAfter, err)
+		return
+	}
+	if status, _ := request(t, lockoutsServer.URL+"?ip=127.0.0.1", http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("unlock IP status: %d", status)
+		return
+	}
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, credBytes); status != http.StatusOK {
+		t.Errorf("login after unlock status: %d", status)
+		return
+	}
+}
+
+// TestLockoutRefused verifies a login with the correct password that is refused, as the account
+// is disabled, does not clear the failed logins of the account.
+func TestLockoutRefused(t *testing.T) {
+	testSetup()
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+
+	em := "disabled@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	auth.Disabled = true
+	if err := authCreate(auth); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	// The failure is from another IP, and the delay has passed.
+	lf, _, err := loginFailed(em, "192.0.2.1")
+	if err != nil {
+		t.Errorf("loginFailed error: %v", err)
+		return
+	}
+	lf.LockedUntil = time.Now().Add(-time.Second).Unix()
+	if err := kvsLockout.Serialize(loginFailuresKey(em, ""), lf); err != nil {
+		t.Errorf("Serialize error: %v", err)
+		return
+	}
+
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, credBytes); status != http.StatusForbidden {
+		t.Errorf("disabled login status: %d", status)
+		return
+	}
+	stored := LoginFailures{}
+	if err := kvsLockout.Deserialize(loginFailuresKey(em, ""), &stored); err != nil || stored.Count != 1 {
+		t.Errorf("failures cleared: %+v, error: %v", stored, err)
+		return
+	}
+}
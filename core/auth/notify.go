@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Notification is a message to the user of an account; I.E. a password reset token.
+type Notification struct {
+	Body  string
+	Email string
+	// ExpiresAt is the Unix (seconds) time after which Token is not valid.
+	ExpiresAt int64 `json:",omitempty"`
+	Subject   string
+	// Token is the secret delivered by the notification, if any; it is also in the Body.
+	Token string `json:",omitempty"`
+}
+
+// Notifier delivers Notifications to users; see Config.PasswordResetNotifier.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// LogNotifier writes notifications, including any token, to the log; for devices without mail
+// or network access, where an operator reads the log and relays the token.
+type LogNotifier struct{}
+
+// SMTPNotifier sends notifications as email using SMTP. Notification.Email must be an email
+// address.
+type SMTPNotifier struct {
+	// Address is the host:port of the SMTP server.
+	Address string
+	// Auth is the SMTP authentication; I.E. smtp.PlainAuth. If nil, no authentication is used.
+	Auth smtp.Auth
+	// From is the sender address.
+	From string
+}
+
+// WebhookNotifier POSTs notifications, as JSON, to URL; I.E. to a messaging gateway.
+type WebhookNotifier struct {
+	// Client is used for the requests. If nil, a client with a timeout is used.
+	Client *http.Client
+	// Header is added to each request; I.E. for an Authorization header.
+	Header http.Header
+	URL    string
+}
+
+const (
+	webhookTimeout = 10 * time.Second
+)
+
+// Notify writes the notification to the log.
+func (ln LogNotifier) Notify(n Notification) error {
+	logh.Map[config.LogName].Printf(logh.Warning, "notification for email: %s, subject: %s, token: %s, expires: %s",
+		n.Email, n.Subject, n.Token, time.Unix(n.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// Notify sends the notification as an email.
+func (sn SMTPNotifier) Notify(n Notification) error {
+	// Prevent header injection; the address and subject are written into the message headers.
+	if strings.ContainsAny(n.Email+n.Subject+sn.From, "\r\n") {
+		return fmt.Errorf("%s invalid email: %q", runtimeh.SourceInfo(), n.Email)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		sn.From, n.Email, n.Subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(n.Body, "\n", "\r\n"))
+	if err := smtp.SendMail(sn.Address, sn.Auth, sn.From, []string{n.Email}, []byte(msg)); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return nil
+}
+
+// Notify POSTs the notification to the webhook.
+func (wn WebhookNotifier) Notify(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, wn.URL, bytes.NewBuffer(b))
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	for k, v := range wn.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := wn.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s webhook POST %s status: %d", runtimeh.SourceInfo(), wn.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestSMTPNotifier verifies notifications are sent as email, using a minimal SMTP server.
+func TestSMTPNotifier(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Listen error: %v", err)
+		return
+	}
+	defer ln.Close()
+	messages := make(chan string, 1)
+	go smtpServe(ln, messages)
+
+	sn := SMTPNotifier{Address: ln.Addr().String(), From: "auth@auth.com"}
+	n := Notification{Body: "reset token: abc", Email: "user@auth.com", Subject: "password reset"}
+	if err := sn.Notify(n); err != nil {
+		t.Errorf("Notify error: %v", err)
+		return
+	}
+	msg := <-messages
+	if !strings.Contains(msg, "To: user@auth.com\r\n") || !strings.Contains(msg, "Subject: password reset\r\n") ||
+		!strings.Contains(msg, "reset token: abc") {
+		t.Errorf("message: %s", msg)
+		return
+	}
+
+	n.Email = "user@auth.com\r\nBcc: other@auth.com"
+	if err := sn.Notify(n); err == nil {
+		t.Errorf("header injection was not rejected")
+		return
+	}
+}
+
+// TestWebhookNotifier verifies notifications are POSTed as JSON.
+func TestWebhookNotifier(t *testing.T) {
+	received := Notification{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	wn := WebhookNotifier{URL: server.URL}
+	n := Notification{Email: "user@auth.com", Subject: "password reset", Token: "abc"}
+	if err := wn.Notify(n); err == nil {
+		t.Errorf("webhook without authorization did not error")
+		return
+	}
+	wn.Header = http.Header{"Authorization": []string{"Bearer secret"}}
+	if err := wn.Notify(n); err != nil {
+		t.Errorf("Notify error: %v", err)
+		return
+	}
+	if received != n {
+		t.Errorf("received: %+v", received)
+		return
+	}
+}
+
+// smtpServe accepts connections on ln, responding to the SMTP commands used by smtp.SendMail,
+// and sends the message data on messages.
+func smtpServe(ln net.Listener, messages chan string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		reply := func(s string) {
+			rw.WriteString(s + "\r\n")
+			rw.Flush()
+		}
+		reply("220 localhost SMTP")
+		data := false
+		msg := strings.Builder{}
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if data {
+				if line == ".\r\n" {
+					data = false
+					messages <- msg.String()
+					reply("250 OK")
+					continue
+				}
+				msg.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				data = true
+				reply("354 End data with <CR><LF>.<CR><LF>")
+			case cmd == "QUIT":
+				reply("221 Bye")
+			default:
+				reply("250 OK")
+			}
+		}
+		conn.Close()
+	}
+}
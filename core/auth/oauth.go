@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+)
+
+// OAuthError is the body of an OAuth2 error response (RFC 6749 section 5.2).
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// OAuthIntrospection is the body returned by PathOAuthIntrospect (RFC 7662). Only Active is
+// returned for tokens that are not active.
+type OAuthIntrospection struct {
+	Active    bool   `json:"active"`
+	Audience  string `json:"aud,omitempty"`
+	Email     string `json:"email,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	JWTID     string `json:"jti,omitempty"`
+	// Scope is the roles, and the scopes, of the token, space separated.
+	Scope     string `json:"scope,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// OAuthToken is the body returned by PathOAuthToken (RFC 6749 section 5.1).
+type OAuthToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	TokenType   string `json:"token_type"`
+}
+
+// OpenIDConfiguration is the body returned by PathOpenIDConfiguration; the OpenID Connect
+// Discovery / OAuth2 authorization server metadata (RFC 8414) for the endpoints of this package.
+type OpenIDConfiguration struct {
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	Issuer                            string   `json:"issuer"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+const (
+	grantTypeClientCredentials = "client_credentials"
+	tokenTypeBearer            = "Bearer"
+)
+
+// handlerOAuthIntrospect is the OAuth2 token introspection endpoint (RFC 7662). The caller
+// authenticates as an OAuth2 client (see handlerOAuthToken); the form parameter token is the
+// token to introspect. A token is active when it is valid and has not been logged out.
+// http.MethodPost - introspect the token.
+func handlerOAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	client, ok := oauthClient(w, r)
+	if !ok {
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	out := OAuthIntrospection{}
+	if claims, err := parseClaims(token); err == nil {
+		if b, err := kvsToken.Get(claims.tokenKVSKey()); err == nil && b != nil {
+			out = OAuthIntrospection{Active: true, Audience: claims.Audience, Email: claims.Email,
+				ExpiresAt: claims.ExpiresAt, IssuedAt: claims.IssuedAt, Issuer: claims.Issuer, JWTID: claims.TokenID,
+				Scope: oauthScope(claims.Roles, claims.Scopes), Subject: claims.Email, Tenant: claims.Tenant, TokenType: tokenTypeBearer}
+		}
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("token introspected by client: %s, active: %t", client.TokenID, out.Active)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handlerOAuthToken is the OAuth2 token endpoint (RFC 6749) for the client credentials grant.
+// OAuth2 clients are API keys; the client_id is the API key ID, and the client_secret is the part
+// of the key after the ".". Clients authenticate with HTTP Basic authentication
+// (client_secret_basic) or form parameters (client_secret_post).
+// The optional form parameter audience requests a token for one of Config.Audiences, with the
+// scopes in the form parameter scope, space separated, or all scopes the roles grant. Tokens for
+// an API key with an Audience are for that audience, with at most the scopes of the key.
+// http.MethodPost - get a token; the form parameter grant_type must be client_credentials.
+func handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	if gt := r.PostForm.Get("grant_type"); gt != grantTypeClientCredentials {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	client, ok := oauthClient(w, r)
+	if !ok {
+		return
+	}
+
+	claims := CustomClaims{Email: client.Email, Roles: client.Roles, Tenant: client.Tenant}
+	claims.Audience = r.PostForm.Get("audience")
+	if client.Audience != "" {
+		// The token is limited to the audience and scopes of the API key.
+		if claims.Audience != "" && claims.Audience != client.Audience {
+			oauthError(w, http.StatusBadRequest, "invalid_target", "")
+			return
+		}
+		claims.Audience = client.Audience
+	}
+	if claims.Audience != "" {
+		var requested []string
+		if scope := r.PostForm.Get("scope"); scope != "" {
+			requested = strings.Fields(scope)
+		} else if client.Audience != "" {
+			requested = client.Scopes
+		}
+		var err error
+		if claims.Scopes, err = audienceScopes(claims.Audience, requested, client.Roles); err != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_scope", "")
+			return
+		}
+		if client.Audience != "" {
+			for _, s := range claims.Scopes {
+				if !slices.Contains(client.Scopes, s) {
+					oauthError(w, http.StatusBadRequest, "invalid_scope", "")
+					return
+				}
+			}
+		}
+	}
+	tokenString, err := tokenStringCreate(claims, r)
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("client credentials token for client: %s, email: %s", client.TokenID, client.Email)
+		if claims.Audience != "" {
+			aw.Message += fmt.Sprintf(", audience: %s, scopes: %v", claims.Audience, claims.Scopes)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, OAuthToken{AccessToken: tokenString,
+		ExpiresIn: int64(config.JWTAuthExpirationInterval / time.Second), Scope: oauthScope(client.Roles, claims.Scopes),
+		TokenType: tokenTypeBearer})
+}
+
+// handlerOpenIDConfiguration returns the OpenIDConfiguration. The URLs use Config.IssuerURL, or
+// the URL of the request when IssuerURL is empty.
+// http.MethodGet - get the configuration.
+func handlerOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	issuer := strings.TrimSuffix(config.IssuerURL, "/")
+	if issuer == "" {
+		scheme := "https"
+		if r.TLS == nil {
+			scheme = "http"
+		}
+		issuer = scheme + "://" + r.Host
+	}
+	writeJSON(w, http.StatusOK, OpenIDConfiguration{
+		GrantTypesSupported:               []string{grantTypeClientCredentials},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		IntrospectionEndpoint:             issuer + config.PathOAuthIntrospect,
+		Issuer:                            issuer,
+		JWKSURI:                           issuer + config.PathJWKS,
+		ResponseTypesSupported:            []string{"token"},
+		ScopesSupported:                   oauthScopesSupported(),
+		SubjectTypesSupported:             []string{"public"},
+		TokenEndpoint:                     issuer + config.PathOAuthToken,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+// oauthClient authenticates the OAuth2 client of the request, and returns the claims of the
+// client's API key. On failure the OAuth2 error is written, and false returned; callers should
+// then return without writing header status. r.ParseForm must have been called.
+func oauthClient(w http.ResponseWriter, r *http.Request) (*CustomClaims, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1; the client_id and client_secret are form encoded.
+		var err error
+		if id, err = url.QueryUnescape(id); err == nil {
+			secret, err = url.QueryUnescape(secret)
+		}
+		if err != nil {
+			id = ""
+		}
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	var claims *CustomClaims
+	if id != "" && secret != "" {
+		var err error
+		if claims, err = apiKeyClaims(id + "." + secret); err != nil {
+			lpf(logh.Error, "apiKeyClaims error:%v", err)
+			oauthError(w, http.StatusInternalServerError, "server_error", "")
+			return nil, false
+		}
+	}
+	if claims == nil {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+config.AppName+`"`)
+		}
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return nil, false
+	}
+	return claims, true
+}
+
+// oauthError writes an OAuth2 error response.
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, OAuthError{Error: code, ErrorDescription: description})
+}
+
+// oauthScope returns the OAuth2 scope for the roles and scopes of a token; space separated.
+func oauthScope(roles []string, scopes []string) string {
+	return strings.Join(append(append([]string{}, roles...), scopes...), " ")
+}
+
+// oauthScopesSupported returns the roles, and the scopes of Config.Audiences.
+func oauthScopesSupported() []string {
+	out := []string{RoleAdmin, RoleOperator, RoleViewer}
+	for _, aud := range config.Audiences {
+		scopes := []string{}
+		for s := range aud.Scopes {
+			scopes = append(scopes, s)
+		}
+		sort.Strings(scopes)
+		out = append(out, scopes...)
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestOAuth verifies the client credentials grant, token introspection, and the OpenID
+// configuration.
+func TestOAuth(t *testing.T) {
+	testSetup()
+
+	em := "client@auth.com"
+	if err := authCreate(authentication{Email: &em, Roles: []string{RoleOperator}, ServiceAccount: true}); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	created, err := apiKeyCreate(em, "oauth", []string{RoleOperator}, 0, "", nil)
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	id, secret, _ := strings.Cut(created.Key, ".")
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerOAuthToken)))
+	defer tokenServer.Close()
+	introspectServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerOAuthIntrospect)))
+	defer introspectServer.Close()
+
+	form := url.Values{"grant_type": {grantTypeClientCredentials}}
+	status, b := oauthPost(t, tokenServer.URL, id, secret, form)
+	token := OAuthToken{}
+	if err := json.Unmarshal(b, &token); status != http.StatusOK || err != nil || token.TokenType != tokenTypeBearer {
+		t.Errorf("token status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+	claims, err := parseClaims(token.AccessToken)
+	if err != nil || claims.Email != em || !claims.HasRole(RoleOperator) || claims.HasRole(RoleAdmin) {
+		t.Errorf("claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	// client_secret_post
+	form = url.Values{"grant_type": {grantTypeClientCredentials}, "client_id": {id}, "client_secret": {secret}}
+	if status, b := oauthPost(t, tokenServer.URL, "", "", form); status != http.StatusOK {
+		t.Errorf("client_secret_post status: %d, body: %s", status, b)
+		return
+	}
+	form = url.Values{"grant_type": {grantTypeClientCredentials}}
+	status, b = oauthPost(t, tokenServer.URL, id, "bad", form)
+	oe := OAuthError{}
+	if err := json.Unmarshal(b, &oe); status != http.StatusUnauthorized || err != nil || oe.Error != "invalid_client" {
+		t.Errorf("bad secret status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+	form = url.Values{"grant_type": {"password"}}
+	status, b = oauthPost(t, tokenServer.URL, id, secret, form)
+	if err := json.Unmarshal(b, &oe); status != http.StatusBadRequest || err != nil || oe.Error != "unsupported_grant_type" {
+		t.Errorf("grant type status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+
+	form = url.Values{"token": {token.AccessToken}}
+	status, b = oauthPost(t, introspectServer.URL, id, secret, form)
+	intro := OAuthIntrospection{}
+	if err := json.Unmarshal(b, &intro); status != http.StatusOK || err != nil || !intro.Active || intro.Subject != em ||
+		intro.Scope != RoleOperator || intro.JWTID != claims.TokenID {
+		t.Errorf("introspect status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+	if status, _ := oauthPost(t, introspectServer.URL, "", "", form); status != http.StatusUnauthorized {
+		t.Errorf("introspect without client status: %d", status)
+		return
+	}
+	if _, err := userTokens(em, true); err != nil {
+		t.Errorf("userTokens error: %v", err)
+		return
+	}
+	status, b = oauthPost(t, introspectServer.URL, id, secret, form)
+	intro = OAuthIntrospection{}
+	if err := json.Unmarshal(b, &intro); status != http.StatusOK || err != nil || intro.Active || string(b) != `{"active":false}` {
+		t.Errorf("introspect logged out status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+
+	// Tokens for an API key with an audience are for that audience, with the scopes of the key.
+	config.Audiences = []Audience{{Name: "telemetry",
+		Scopes: map[string]string{"telemetry:execute": RoleOperator, "telemetry:read": RoleViewer}}}
+	scoped, err := apiKeyCreate(em, "scoped", []string{RoleOperator}, 0, "telemetry", []string{"telemetry:read"})
+	if err != nil {
+		t.Errorf("apiKeyCreate error: %v", err)
+		return
+	}
+	sid, ssecret, _ := strings.Cut(scoped.Key, ".")
+	for _, f := range []url.Values{{"grant_type": {grantTypeClientCredentials}, "audience": {"other"}},
+		{"grant_type": {grantTypeClientCredentials}, "scope": {"telemetry:execute"}}} {
+		if status, b := oauthPost(t, tokenServer.URL, sid, ssecret, f); status != http.StatusBadRequest {
+			t.Errorf("form: %v, status: %d, body: %s", f, status, b)
+			return
+		}
+	}
+	form = url.Values{"grant_type": {grantTypeClientCredentials}}
+	status, b = oauthPost(t, tokenServer.URL, sid, ssecret, form)
+	token = OAuthToken{}
+	if err := json.Unmarshal(b, &token); status != http.StatusOK || err != nil {
+		t.Errorf("scoped token status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+	if claims, err := parseClaims(token.AccessToken); err != nil || claims.Audience != "telemetry" ||
+		len(claims.Scopes) != 1 || !claims.HasScope("telemetry:read") {
+		t.Errorf("scoped claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	config.PathJWKS = "/.well-known/jwks.json"
+	config.PathOAuthToken = "/oauth/token"
+	config.IssuerURL = "https://auth.example.com/"
+	defer func() { config.IssuerURL = "" }()
+	oidcServer := httptest.NewServer(http.HandlerFunc(handlerOpenIDConfiguration))
+	defer oidcServer.Close()
+	status, b = request(t, oidcServer.URL, http.MethodGet, nil, nil)
+	oc := OpenIDConfiguration{}
+	if err := json.Unmarshal(b, &oc); status != http.StatusOK || err != nil || oc.Issuer != "https://auth.example.com" ||
+		oc.TokenEndpoint != "https://auth.example.com/oauth/token" || oc.JWKSURI != "https://auth.example.com/.well-known/jwks.json" {
+		t.Errorf("openid configuration status: %d, body: %s, error: %v", status, b, err)
+		return
+	}
+}
+
+// oauthPost posts the form, with HTTP Basic authentication when id is not empty, and returns the
+// response status and body.
+func oauthPost(t *testing.T, target string, id string, secret string, form url.Values) (int, []byte) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return 0, nil
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		req.SetBasicAuth(id, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Do error: %v", err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+	}
+	return resp.StatusCode, b
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy is the policy passwords must comply with; see Config.PasswordPolicy and
+// PathPasswordPolicy. Passwords are checked when set. At login, accounts with a password that
+// no longer complies, or has expired, must set a new password; see
+// Credential.PasswordResetRequired.
+type PasswordPolicy struct {
+	// Banned are passwords that cannot be used, compared case insensitively; I.E. common
+	// passwords.
+	Banned []string `json:",omitempty"`
+	// History is the count of recent passwords of an account, including the current password,
+	// that cannot be reused. If zero, passwords can be reused. The maximum is
+	// passwordHistoryLimit.
+	History int `json:",omitempty"`
+	// MaxAgeDays is the age, in days, after which a password must be changed. If zero, passwords
+	// do not expire.
+	MaxAgeDays int `json:",omitempty"`
+	// MinLength is the minimum count of characters in a password.
+	MinLength int `json:",omitempty"`
+	// Regex are REGEX that passwords must match.
+	Regex []string `json:",omitempty"`
+	// RequireDigit, RequireLower, RequireSymbol, and RequireUpper require at least one character
+	// of the class.
+	RequireDigit  bool `json:",omitempty"`
+	RequireLower  bool `json:",omitempty"`
+	RequireSymbol bool `json:",omitempty"`
+	RequireUpper  bool `json:",omitempty"`
+}
+
+const (
+	kvsPasswordPolicyKey   = "policy"
+	kvsPasswordPolicyTable = "authPasswordPolicy"
+	// passwordHistoryLimit limits PasswordPolicy.History, as each prior password is a bcrypt
+	// comparison when a password is set.
+	passwordHistoryLimit = 24
+)
+
+var (
+	// passwordPolicy is the current policy, with the compiled Regex in passwordPolicyRegexps.
+	passwordPolicy        PasswordPolicy
+	passwordPolicyMutex   sync.RWMutex
+	passwordPolicyRegexps []*regexp.Regexp
+)
+
+// handlerPasswordPolicy is for administrators to view and update the password policy. Updates
+// are persisted, and used instead of Config.PasswordPolicy thereafter. Requires RoleAdmin.
+// http.MethodGet - get the PasswordPolicy.
+// http.MethodPut - replace the PasswordPolicy; the body is the PasswordPolicy.
+func handlerPasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		passwordPolicyMutex.RLock()
+		policy := passwordPolicy
+		passwordPolicyMutex.RUnlock()
+		writeJSON(w, http.StatusOK, policy)
+	case http.MethodPut:
+		policy := PasswordPolicy{}
+		if err := httph.BodyUnmarshal(w, r, &policy); err != nil {
+			lpf(logh.Error, "password policy error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		if err := passwordPolicySet(policy); err != nil {
+			lpf(logh.Error, "passwordPolicySet error:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := kvsPasswordPolicy.Serialize(kvsPasswordPolicyKey, policy); err != nil {
+			lpf(logh.Error, "kvsPasswordPolicy.Serialize error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("password policy updated, history: %d, max age days: %d, min length: %d, "+
+				"regex: %v, banned: %d, require digit: %t, lower: %t, symbol: %t, upper: %t", policy.History,
+				policy.MaxAgeDays, policy.MinLength, policy.Regex, len(policy.Banned), policy.RequireDigit,
+				policy.RequireLower, policy.RequireSymbol, policy.RequireUpper)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// passwordCheck returns an error when the password does not comply with the password policy.
+func passwordCheck(password string) error {
+	passwordPolicyMutex.RLock()
+	defer passwordPolicyMutex.RUnlock()
+	if utf8.RuneCountInString(password) < passwordPolicy.MinLength {
+		return fmt.Errorf("%s password is shorter than %d characters", runtimeh.SourceInfo(), passwordPolicy.MinLength)
+	}
+	classes := []struct {
+		required bool
+		name     string
+		is       func(rune) bool
+	}{
+		{passwordPolicy.RequireDigit, "digit", unicode.IsDigit},
+		{passwordPolicy.RequireLower, "lower case", unicode.IsLower},
+		{passwordPolicy.RequireSymbol, "symbol", func(c rune) bool { return unicode.IsPunct(c) || unicode.IsSymbol(c) }},
+		{passwordPolicy.RequireUpper, "upper case", unicode.IsUpper},
+	}
+	for _, class := range classes {
+		if class.required && strings.IndexFunc(password, class.is) < 0 {
+			return fmt.Errorf("%s password requires a %s character", runtimeh.SourceInfo(), class.name)
+		}
+	}
+	for _, v := range passwordPolicyRegexps {
+		if v.FindString(password) == "" {
+			return fmt.Errorf("%s password does not meet validation criteria %s", runtimeh.SourceInfo(), v.String())
+		}
+	}
+	for _, banned := range passwordPolicy.Banned {
+		if strings.EqualFold(password, banned) {
+			return fmt.Errorf("%s password is banned", runtimeh.SourceInfo())
+		}
+	}
+	return nil
+}
+
+// passwordHistoryCheck returns an error when the password is one of the recent passwords of auth,
+// per PasswordPolicy.History; otherwise the history of auth is updated for the password being
+// replaced.
+func passwordHistoryCheck(auth *authentication, password string) error {
+	passwordPolicyMutex.RLock()
+	history := passwordPolicy.History
+	passwordPolicyMutex.RUnlock()
+	recent := auth.PasswordHistory
+	if auth.PasswordHash != nil {
+		recent = append([][]byte{auth.PasswordHash}, recent...)
+	}
+	if len(recent) > history {
+		recent = recent[:history]
+	}
+	for _, hash := range recent {
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return fmt.Errorf("%s password is one of the %d most recent passwords", runtimeh.SourceInfo(), history)
+		}
+	}
+	auth.PasswordHistory = recent
+	return nil
+}
+
+// passwordPolicyLoad loads the persisted password policy, or when none was persisted,
+// Config.PasswordPolicy.
+func passwordPolicyLoad() error {
+	policy := PasswordPolicy{Regex: defaultPasswordValidation}
+	if config.PasswordPolicy != nil {
+		policy = *config.PasswordPolicy
+	} else if config.PasswordValidation != nil {
+		policy.Regex = config.PasswordValidation
+	}
+	if kvsPasswordPolicy != nil {
+		b, err := kvsPasswordPolicy.Get(kvsPasswordPolicyKey)
+		if err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+		if b != nil {
+			policy = PasswordPolicy{}
+			if err := kvsPasswordPolicy.Deserialize(kvsPasswordPolicyKey, &policy); err != nil {
+				return runtimeh.SourceInfoError("", err)
+			}
+		}
+	}
+	return passwordPolicySet(policy)
+}
+
+// passwordPolicyLogin requires auth set a new password, setting PasswordResetRequired, when the
+// password used to login does not comply with the password policy, or is older than
+// PasswordPolicy.MaxAgeDays; the reason is returned. Only accounts with a password in the auth
+// datastore are checked. The age of passwords set before the policy had a MaxAgeDays starts at
+// their next login.
+func passwordPolicyLogin(auth *authentication, password string) string {
+	if auth.PasswordHash == nil || auth.PasswordResetRequired {
+		return ""
+	}
+	if auth.PasswordChanged == 0 {
+		auth.PasswordChanged = time.Now().Unix()
+	}
+	if err := passwordCheck(strings.TrimSpace(password)); err != nil {
+		auth.PasswordResetRequired = true
+		return "password does not comply with the password policy"
+	}
+	passwordPolicyMutex.RLock()
+	maxAge := time.Duration(passwordPolicy.MaxAgeDays) * 24 * time.Hour
+	passwordPolicyMutex.RUnlock()
+	if maxAge > 0 && time.Since(time.Unix(auth.PasswordChanged, 0)) > maxAge {
+		auth.PasswordResetRequired = true
+		return "password expired"
+	}
+	return ""
+}
+
+// passwordPolicySet validates the policy and makes it the current password policy.
+func passwordPolicySet(policy PasswordPolicy) error {
+	if policy.History < 0 || policy.History > passwordHistoryLimit {
+		return fmt.Errorf("%s History must be 0 to %d", runtimeh.SourceInfo(), passwordHistoryLimit)
+	}
+	if policy.MaxAgeDays < 0 {
+		return fmt.Errorf("%s MaxAgeDays must not be negative", runtimeh.SourceInfo())
+	}
+	if policy.MinLength < 0 || policy.MinLength > passwordLengthLimit {
+		return fmt.Errorf("%s MinLength must be 0 to %d", runtimeh.SourceInfo(), passwordLengthLimit)
+	}
+	regexps := make([]*regexp.Regexp, len(policy.Regex))
+	for i, v := range policy.Regex {
+		rg, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("%s password validation regex %s does not compile", runtimeh.SourceInfo(), v)
+		}
+		regexps[i] = rg
+	}
+	passwordPolicyMutex.Lock()
+	defer passwordPolicyMutex.Unlock()
+	passwordPolicy = policy
+	passwordPolicyRegexps = regexps
+	return nil
+}
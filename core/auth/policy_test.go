@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPasswordPolicy verifies administrators view and update the password policy, the policy is
+// persisted, passwords are checked against it and the history, and at login passwords that no
+// longer comply, or have expired, must be changed.
+func TestPasswordPolicy(t *testing.T) {
+	testSetup()
+
+	policyServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerPasswordPolicy)))
+	defer policyServer.Close()
+	updateServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate)))
+	defer updateServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "user@auth.com"
+	userCred, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	userToken, _, err := login(t, userCred)
+	if err != nil {
+		return
+	}
+
+	status, b := request(t, policyServer.URL, http.MethodGet, adminToken, nil)
+	policy := PasswordPolicy{}
+	if err := json.Unmarshal(b, &policy); status != http.StatusOK || err != nil ||
+		!reflect.DeepEqual(policy, PasswordPolicy{Regex: defaultPasswordValidation}) {
+		t.Errorf("default policy status: %d, policy: %+v, error: %v", status, policy, err)
+		return
+	}
+	if status, _ := request(t, policyServer.URL, http.MethodGet, userToken, nil); status != http.StatusForbidden {
+		t.Errorf("user get policy status: %d", status)
+		return
+	}
+	for _, invalid := range []PasswordPolicy{{History: passwordHistoryLimit + 1}, {MaxAgeDays: -1},
+		{MinLength: passwordLengthLimit + 1}, {Regex: []string{"("}}} {
+		b, _ := json.Marshal(invalid)
+		if status, _ := request(t, policyServer.URL, http.MethodPut, adminToken, b); status != http.StatusBadRequest {
+			t.Errorf("policy: %+v, status: %d", invalid, status)
+			return
+		}
+	}
+	policy = PasswordPolicy{Banned: []string{"p@ssword1234"}, History: 2, MinLength: 12, RequireDigit: true,
+		RequireLower: true, RequireSymbol: true, RequireUpper: true}
+	b, _ = json.Marshal(policy)
+	if status, _ := request(t, policyServer.URL, http.MethodPut, adminToken, b); status != http.StatusNoContent {
+		t.Errorf("update policy status: %d", status)
+		return
+	}
+
+	// The password of the user is banned, so the user must set a new password.
+	if _, claims, err := login(t, userCred); err != nil || !claims.PasswordResetRequired {
+		t.Errorf("non compliant password claims: %+v, error: %v", claims, err)
+		return
+	}
+	ps := "N3w@Password1"
+	for i, test := range []struct {
+		password string
+		status   int
+	}{
+		{"N3w@Pass1", http.StatusBadRequest},
+		{"new@password1", http.StatusBadRequest},
+		{"NewPassword12", http.StatusBadRequest},
+		{ps, http.StatusNoContent},
+		{"N3w@Password2", http.StatusNoContent},
+		{ps, http.StatusBadRequest},
+		{"N3w@Password3", http.StatusNoContent},
+		{ps, http.StatusNoContent},
+	} {
+		b, _ := json.Marshal(Credential{Email: &em, Password: &test.password})
+		if status, _ := request(t, updateServer.URL, http.MethodPut, adminToken, b); status != test.status {
+			t.Errorf("i: %d, password: %s, status: %d", i, test.password, status)
+			return
+		}
+	}
+	// Changing only the roles, with the current password, is not a password change.
+	before, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	b, _ = json.Marshal(Credential{Email: &em, Password: &ps, Roles: []string{RoleOperator}})
+	if status, _ := request(t, updateServer.URL, http.MethodPut, adminToken, b); status != http.StatusNoContent {
+		t.Errorf("roles update status: %d", status)
+		return
+	}
+	if after, err := authGet(em); err != nil || !hasRole(after.Roles, RoleOperator) ||
+		after.PasswordChanged != before.PasswordChanged || len(after.PasswordHistory) != len(before.PasswordHistory) {
+		t.Errorf("roles update auth: %+v, error: %v", after, err)
+		return
+	}
+	b, _ = json.Marshal(Credential{Email: &em, Password: &ps})
+	if status, _ := request(t, updateServer.URL, http.MethodPut, adminToken, b); status != http.StatusBadRequest {
+		t.Errorf("current password status: %d", status)
+		return
+	}
+	newCred, _ := json.Marshal(Credential{Email: &em, Password: &ps})
+	if _, claims, err := login(t, newCred); err != nil || claims.PasswordResetRequired {
+		t.Errorf("compliant password claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	policy.MaxAgeDays = 1
+	b, _ = json.Marshal(policy)
+	if status, _ := request(t, policyServer.URL, http.MethodPut, adminToken, b); status != http.StatusNoContent {
+		t.Errorf("update policy status: %d", status)
+		return
+	}
+	auth, err := authGet(em)
+	if err != nil {
+		t.Errorf("authGet error: %v", err)
+		return
+	}
+	auth.PasswordChanged = time.Now().Add(-48 * time.Hour).Unix()
+	if err := authCreate(auth); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	if _, claims, err := login(t, newCred); err != nil || !claims.PasswordResetRequired {
+		t.Errorf("expired password claims: %+v, error: %v", claims, err)
+		return
+	}
+
+	// The persisted policy is used instead of Config.PasswordPolicy.
+	config.PasswordPolicy = &PasswordPolicy{MinLength: 8}
+	if err := passwordPolicyLoad(); err != nil || !reflect.DeepEqual(passwordPolicy, policy) {
+		t.Errorf("loaded policy: %+v, error: %v", passwordPolicy, err)
+		return
+	}
+}
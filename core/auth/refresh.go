@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// RefreshRequest is the body for PathRefreshToken.
+type RefreshRequest struct {
+	RefreshToken *string
+}
+
+// refreshToken is persisted in kvsRefresh, keyed by the SHA256 hash of the token; the token
+// itself is never persisted.
+type refreshToken struct {
+	// Audience and Scopes are those requested at login; see Credential.Audience.
+	Audience string `json:",omitempty"`
+	Email    string
+	// ExpiresAt is the Unix (seconds) time after which the token is not valid.
+	ExpiresAt int64
+	// Family is shared by a token issued at login and all tokens it is rotated to.
+	Family string
+	// FamilyExpiresAt is the Unix (seconds) time after which no token in the family is valid;
+	// zero when there is no limit.
+	FamilyExpiresAt int64
+	// JTI is the TokenID of the access token issued with the refresh token; access tokens are
+	// revoked with their family.
+	JTI string `json:",omitempty"`
+	// Scopes is not omitted when empty, as nil and empty differ; see audienceScopes.
+	Scopes []string
+	// Used is true once the token has been exchanged. Used tokens are kept until they expire
+	// so that reuse can be detected.
+	Used bool
+}
+
+const (
+	// RefreshTokenHeader is the response header with the refresh token, for login and
+	// PathRefreshToken, when refresh tokens are enabled.
+	RefreshTokenHeader = "Refresh-Token"
+
+	kvsRefreshTable = "authRefresh"
+)
+
+// handlerRefreshToken exchanges a refresh token for a new access token; the refresh token is
+// rotated, and the new refresh token returned in RefreshTokenHeader. Presenting a refresh token
+// that was already exchanged revokes all tokens in its family, and the access tokens issued
+// with them, as the token has been stolen, and is audited.
+// http.MethodDelete - revoke the refresh token and all tokens in its family, and the access
+// tokens issued with them; I.E. logout.
+// http.MethodPost - exchange the refresh token for an access token.
+func handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rr := RefreshRequest{}
+	if err := httph.BodyUnmarshal(w, r, &rr); err != nil {
+		lpf(logh.Error, "refresh token error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+	if rr.RefreshToken == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rt, err := refreshTokenGet(*rr.RefreshToken)
+	if err != nil {
+		lpf(logh.Error, "refreshTokenGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rt == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		n, na, err := refreshFamilyRevoke(rt.Family)
+		if err != nil {
+			lpf(logh.Error, "refreshFamilyRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("%d refresh tokens, and %d access tokens, revoked for email: %s", n, na, rt.Email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	newRefreshToken, reused, err := refreshTokenRotate(*rr.RefreshToken, *rt)
+	if err != nil {
+		lpf(logh.Error, "refreshTokenRotate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if reused {
+		n, na, err := refreshFamilyRevoke(rt.Family)
+		if err != nil {
+			lpf(logh.Error, "refreshFamilyRevoke error:%v", err)
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("refresh token reuse detected for email: %s, %d refresh tokens, and %d access tokens, revoked",
+				rt.Email, n, na)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if newRefreshToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The account may have been deleted, or disabled, since the refresh token was issued.
+	auth, err := authGet(rt.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.Disabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	scopes, err := audienceScopes(rt.Audience, rt.Scopes, tokenRoles(auth))
+	if err != nil {
+		lpf(logh.Error, "audienceScopes error:%v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	tokenString, err := userTokenStringCreate(auth, rt.Audience, scopes, r)
+	if err != nil {
+		lpf(logh.Error, "authTokenStringCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jti, err := accessTokenID(tokenString)
+	if err != nil {
+		lpf(logh.Error, "accessTokenID error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	set, err := refreshTokenJTISet(newRefreshToken, jti)
+	if err != nil || !set {
+		// The family was revoked after the token was rotated; revoke the new access token too.
+		if err != nil {
+			lpf(logh.Error, "refreshTokenJTISet error:%v", err)
+		}
+		if _, err := tokenRevoke(CustomClaims{Email: rt.Email, TokenID: jti}.tokenKVSKey()); err != nil {
+			lpf(logh.Error, "tokenRevoke error:%v", err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("refresh token exchanged for email: %s", rt.Email)
+	}
+	w.Header().Set(RefreshTokenHeader, newRefreshToken)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write([]byte(tokenString)); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// accessTokenID returns the TokenID of the access token tokenString.
+func accessTokenID(tokenString string) (string, error) {
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.TokenID, nil
+}
+
+// refreshFamilyRevoke deletes all refresh tokens in the family, and revokes the access tokens
+// issued with them. The counts of refresh and access tokens revoked are returned.
+func refreshFamilyRevoke(family string) (int, int, error) {
+	keys := []string{}
+	n, err := refreshTokensRevoke(func(t refreshToken) bool {
+		if t.Family != family {
+			return false
+		}
+		if t.JTI != "" {
+			keys = append(keys, CustomClaims{Email: t.Email, TokenID: t.JTI}.tokenKVSKey())
+		}
+		return true
+	})
+	na := 0
+	for _, key := range keys {
+		c, errRevoke := tokenRevoke(key)
+		if errRevoke != nil {
+			err = fmt.Errorf("%s tokenRevoke error: %v, prior errors: %v", runtimeh.SourceInfo(), errRevoke, err)
+			continue
+		}
+		na += int(c)
+	}
+	return n, na, err
+}
+
+// refreshTokenCreate creates and stores a refresh token with the Audience, Email, Family,
+// FamilyExpiresAt, JTI, and Scopes of rt. A blank Family starts a new family; I.E. at login.
+func refreshTokenCreate(rt refreshToken) (string, error) {
+	var err error
+	if rt.Family == "" {
+		if rt.Family, err = uniqueID(true); err != nil {
+			return "", err
+		}
+		if config.RefreshTokenMaxInterval > 0 {
+			rt.FamilyExpiresAt = time.Now().Add(config.RefreshTokenMaxInterval).Unix()
+		}
+	}
+	// 256 bits
+	id1, err := uniqueID(false)
+	if err != nil {
+		return "", err
+	}
+	id2, err := uniqueID(false)
+	if err != nil {
+		return "", err
+	}
+	token := id1 + id2
+
+	rt.ExpiresAt = time.Now().Add(config.RefreshTokenExpirationInterval).Unix()
+	rt.Used = false
+	if rt.FamilyExpiresAt != 0 && rt.ExpiresAt > rt.FamilyExpiresAt {
+		rt.ExpiresAt = rt.FamilyExpiresAt
+	}
+	if err := kvsRefresh.Serialize(refreshTokenKey(token), rt); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// refreshTokenJTISet sets the JTI of the stored refresh token. set is false when the token no
+// longer exists, or was used, since it was created; I.E. the family was revoked.
+func refreshTokenJTISet(token string, jti string) (set bool, err error) {
+	key := refreshTokenKey(token)
+	old, err := kvsRefresh.Get(key)
+	if err != nil || old == nil {
+		return false, err
+	}
+	rt := refreshToken{}
+	if err := json.Unmarshal(old, &rt); err != nil {
+		return false, runtimeh.SourceInfoError("", err)
+	}
+	if rt.Used {
+		return false, nil
+	}
+	rt.JTI = jti
+	b, err := json.Marshal(rt)
+	if err != nil {
+		return false, runtimeh.SourceInfoError("", err)
+	}
+	return kvsRefresh.CompareAndSwap(key, old, b)
+}
+
+// refreshTokenGet returns the stored refresh token, or nil if the token does not exist.
+func refreshTokenGet(token string) (*refreshToken, error) {
+	b, err := kvsRefresh.Get(refreshTokenKey(token))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	rt := refreshToken{}
+	if err := json.Unmarshal(b, &rt); err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	return &rt, nil
+}
+
+// refreshTokenKey returns the kvsRefresh key for the token.
+func refreshTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshTokenRotate marks the token used and returns a new token in the same family. reused
+// is true when the token was already used, including by a concurrent call. The returned token is
+// blank, and reused false, when the token has expired.
+func refreshTokenRotate(token string, rt refreshToken) (newToken string, reused bool, err error) {
+	if rt.Used {
+		return "", true, nil
+	}
+	if time.Now().Unix() > rt.ExpiresAt {
+		return "", false, nil
+	}
+
+	old, err := json.Marshal(rt)
+	if err != nil {
+		return "", false, runtimeh.SourceInfoError("", err)
+	}
+	rt.Used = true
+	used, err := json.Marshal(rt)
+	if err != nil {
+		return "", false, runtimeh.SourceInfoError("", err)
+	}
+	swapped, err := kvsRefresh.CompareAndSwap(refreshTokenKey(token), old, used)
+	if err != nil {
+		return "", false, err
+	}
+	if !swapped {
+		return "", true, nil
+	}
+	// The JTI of the new token is set by refreshTokenJTISet.
+	rt.JTI = ""
+	newToken, err = refreshTokenCreate(rt)
+	return newToken, false, err
+}
+
+// refreshTokensRevoke deletes all refresh tokens for which match returns true, and returns
+// the count.
+func refreshTokensRevoke(match func(refreshToken) bool) (int, error) {
+	keys, err := kvsRefresh.Keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		rt := refreshToken{}
+		if err := kvsRefresh.Deserialize(key, &rt); err != nil {
+			return count, err
+		}
+		if !match(rt) {
+			continue
+		}
+		if _, err := kvsRefresh.Delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// removeExpiredRefreshTokens deletes expired refresh tokens.
+func removeExpiredRefreshTokens() (int, error) {
+	now := time.Now().Unix()
+	return refreshTokensRevoke(func(t refreshToken) bool { return now > t.ExpiresAt })
+}
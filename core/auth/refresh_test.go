@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestRefreshToken verifies login returns a refresh token, that the refresh token can be
+// exchanged for an access token and is rotated, and that reuse revokes the family and the
+// access tokens issued with it.
+func TestRefreshToken(t *testing.T) {
+	testSetup()
+	config.RefreshTokenExpirationInterval = time.Hour
+	defer func() { config.RefreshTokenExpirationInterval = 0 }()
+
+	em := "refresh@auth.com"
+	credBytes, err := createAuth(t, em, []string{RoleOperator})
+	if err != nil {
+		return
+	}
+	rt1, err := loginRefreshToken(t, credBytes)
+	if err != nil {
+		return
+	}
+	if b, _ := kvsRefresh.Get(rt1); b != nil {
+		t.Errorf("refresh token was not stored hashed")
+		return
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(handlerRefreshToken))
+	defer testServer.Close()
+
+	status, rt2, token := exchange(t, testServer.URL, rt1)
+	if status != http.StatusCreated || rt2 == "" || rt2 == rt1 {
+		t.Errorf("exchange status: %d, refresh token: %s", status, rt2)
+		return
+	}
+	claims, err := parseClaims(token)
+	if err != nil || claims.Email != em || !claims.HasRole(RoleOperator) {
+		t.Errorf("claims: %+v, error: %v", claims, err)
+		return
+	}
+	status, rt3, token3 := exchange(t, testServer.URL, rt2)
+	if status != http.StatusCreated || rt3 == "" {
+		t.Errorf("exchange status: %d", status)
+		return
+	}
+	claims3, err := parseClaims(token3)
+	if err != nil {
+		t.Errorf("parseClaims error: %v", err)
+		return
+	}
+
+	// Reuse of rt1 revokes the family, so rt3 and the access tokens are no longer valid.
+	if status, _, _ := exchange(t, testServer.URL, rt1); status != http.StatusUnauthorized {
+		t.Errorf("reuse status: %d", status)
+		return
+	}
+	if status, _, _ := exchange(t, testServer.URL, rt3); status != http.StatusUnauthorized {
+		t.Errorf("revoked status: %d", status)
+		return
+	}
+	rl, err := revocationsList()
+	if err != nil {
+		t.Errorf("revocationsList error: %v", err)
+		return
+	}
+	for _, c := range []*CustomClaims{claims, claims3} {
+		if b, err := kvsToken.Get(c.tokenKVSKey()); b != nil || err != nil {
+			t.Errorf("access token not revoked: %s, error: %v", c.TokenID, err)
+			return
+		}
+		if !slices.ContainsFunc(rl.Revocations, func(rv Revocation) bool { return rv.JTI == c.TokenID }) {
+			t.Errorf("access token not in the revocation list: %s", c.TokenID)
+			return
+		}
+	}
+
+	// Logout all revokes refresh tokens.
+	rt4, err := loginRefreshToken(t, credBytes)
+	if err != nil {
+		return
+	}
+	if _, err := userTokens(em, true); err != nil {
+		t.Errorf("userTokens error: %v", err)
+		return
+	}
+	if status, _, _ := exchange(t, testServer.URL, rt4); status != http.StatusUnauthorized {
+		t.Errorf("status after logout all: %d", status)
+		return
+	}
+}
+
+// TestRefreshTokenExpiration verifies the maximum session duration, and expired refresh tokens.
+func TestRefreshTokenExpiration(t *testing.T) {
+	testSetup()
+	config.RefreshTokenExpirationInterval = time.Hour
+	config.RefreshTokenMaxInterval = time.Minute
+	defer func() {
+		config.RefreshTokenExpirationInterval = 0
+		config.RefreshTokenMaxInterval = 0
+	}()
+
+	rt, err := refreshTokenCreate(refreshToken{Email: "max@auth.com"})
+	if err != nil {
+		t.Errorf("refreshTokenCreate error: %v", err)
+		return
+	}
+	stored, err := refreshTokenGet(rt)
+	if err != nil || stored == nil {
+		t.Errorf("refreshTokenGet error: %v", err)
+		return
+	}
+	if stored.ExpiresAt != stored.FamilyExpiresAt || stored.ExpiresAt > time.Now().Add(time.Minute).Unix() {
+		t.Errorf("expiration not limited by RefreshTokenMaxInterval: %+v", stored)
+		return
+	}
+
+	config.RefreshTokenExpirationInterval = -time.Second
+	config.RefreshTokenMaxInterval = 0
+	if rt, err = refreshTokenCreate(refreshToken{Email: "expired@auth.com"}); err != nil {
+		t.Errorf("refreshTokenCreate error: %v", err)
+		return
+	}
+	if stored, err = refreshTokenGet(rt); err != nil || stored == nil {
+		t.Errorf("refreshTokenGet error: %v", err)
+		return
+	}
+	if newToken, reused, err := refreshTokenRotate(rt, *stored); newToken != "" || reused || err != nil {
+		t.Errorf("expired token rotated: %s, reused: %t, error: %v", newToken, reused, err)
+		return
+	}
+	if n, err := removeExpiredRefreshTokens(); n != 1 || err != nil {
+		t.Errorf("removeExpiredRefreshTokens count: %d, error: %v", n, err)
+		return
+	}
+}
+
+// exchange exchanges a refresh token and returns the status, new refresh token, and access token.
+func exchange(t *testing.T, url string, refreshToken string) (int, string, string) {
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: &refreshToken})
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Errorf("POST error: %v", err)
+		return 0, "", ""
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get(RefreshTokenHeader), string(b)
+}
+
+// loginRefreshToken logs in and returns the refresh token.
+func loginRefreshToken(t *testing.T, credBytes []byte) (string, error) {
+	testServer := httptest.NewServer(http.HandlerFunc(handlerLogin))
+	defer testServer.Close()
+	req, err := http.NewRequest(http.MethodPut, testServer.URL, bytes.NewBuffer(credBytes))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("PUT error: %v", err)
+		return "", err
+	}
+	resp.Body.Close()
+	rt := resp.Header.Get(RefreshTokenHeader)
+	if resp.StatusCode != http.StatusOK || rt == "" {
+		err := fmt.Errorf("login status: %d, refresh token: %s", resp.StatusCode, rt)
+		t.Errorf("%v", err)
+		return "", err
+	}
+	return rt, nil
+}
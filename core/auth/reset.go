@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// PasswordResetRequest is the body for PathPasswordReset.
+type PasswordResetRequest struct {
+	// Email is the account for which a reset token is sent; for http.MethodPost.
+	Email *string `json:",omitempty"`
+	// Password is the new password; for http.MethodPut.
+	Password *string `json:",omitempty"`
+	// Token is the reset token from the Notification; for http.MethodPut.
+	Token *string `json:",omitempty"`
+}
+
+// passwordReset is persisted in kvsPasswordReset, keyed by the SHA256 hash of the reset token;
+// the token itself is never persisted.
+type passwordReset struct {
+	// Created is the Unix (seconds) time the token was created.
+	Created int64
+	Email   string
+	// ExpiresAt is the Unix (seconds) time after which the token is not valid.
+	ExpiresAt int64
+}
+
+const (
+	defaultPasswordResetExpirationInterval = 15 * time.Minute
+	// passwordResetMinInterval is the minimum interval between reset tokens sent to an account,
+	// so the reset request cannot be used to flood a user with notifications.
+	passwordResetMinInterval = time.Minute
+
+	kvsPasswordResetTable = "authPasswordReset"
+)
+
+var (
+	// passwordResetMutex serializes updates to kvsPasswordReset, as each update reads then writes.
+	passwordResetMutex sync.Mutex
+)
+
+// handlerPasswordReset is for users that forgot their password to set a new password using a
+// single use, time limited, reset token delivered by Config.PasswordResetNotifier. Resetting the
+// password revokes all tokens of the account, and clears its failed logins; TOTP, when enabled,
+// is still required at login.
+// http.MethodPost - request a reset token; the body is a PasswordResetRequest with the Email.
+// http.StatusAccepted is returned whether or not the account exists, so the response cannot be
+// used to discover accounts.
+// http.MethodPut - set a new password; the body is a PasswordResetRequest with the Token and the
+// Password.
+func handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	prr := PasswordResetRequest{}
+	if err := httph.BodyUnmarshal(w, r, &prr); err != nil {
+		lpf(logh.Error, "password reset error:%v", err)
+		// WriteHeader provided by BodyUnmarshal
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if prr.Email == nil || *prr.Email == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sent, err := passwordResetSend(*prr.Email)
+		if err != nil {
+			lpf(logh.Error, "passwordResetSend error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("password reset requested for email: %s, token sent: %t", *prr.Email, sent)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// http.MethodPut
+	if prr.Token == nil || prr.Password == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := passwordResetKey(*prr.Token)
+	pr := passwordReset{}
+	if err := kvsPasswordReset.Deserialize(key, &pr); err != nil {
+		lpf(logh.Error, "kvsPasswordReset.Deserialize error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if pr.Email == "" || time.Now().Unix() > pr.ExpiresAt {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// Validate, and check the history, before the token is used, so a password that fails either
+	// can be retried. The history is checked on a copy; AuthCreate updates the history.
+	cred := Credential{Email: &pr.Email, Password: prr.Password}
+	if err := cred.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	current, err := authGet(pr.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := passwordHistoryCheck(&current, *cred.Password); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Delete, rather than Get then Delete, so concurrent requests cannot both use the token.
+	passwordResetMutex.Lock()
+	n, err := kvsPasswordReset.Delete(key)
+	passwordResetMutex.Unlock()
+	if err != nil {
+		lpf(logh.Error, "kvsPasswordReset.Delete error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// The account may have been deleted, or disabled, since the token was sent.
+	auth, err := authGet(pr.Email)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil || auth.ServiceAccount || auth.Directory {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if auth.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := cred.AuthCreate(); err != nil {
+		lpf(logh.Error, "AuthCreate error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	revoked, err := userRevoke(pr.Email)
+	if err != nil {
+		lpf(logh.Error, "userRevoke error:%v", err)
+	}
+	if err := loginSucceeded(pr.Email); err != nil {
+		lpf(logh.Error, "loginSucceeded error:%v", err)
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = fmt.Sprintf("password reset with a reset token for email: %s, and %d tokens revoked", pr.Email, revoked)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passwordResetKey returns the kvsPasswordReset key for the token.
+func passwordResetKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// passwordResetSend creates a reset token for the email, replacing any prior token, and sends it
+// using Config.PasswordResetNotifier. The notification is sent in a go routine, so the response
+// time does not reveal whether the account exists. Returns true when a token was sent; no token
+// is sent for accounts that do not exist, are disabled, or are service or directory accounts, or
+// when a token was sent within passwordResetMinInterval.
+func passwordResetSend(email string) (bool, error) {
+	auth, err := authGet(email)
+	if err != nil {
+		return false, err
+	}
+	if auth.Email == nil || auth.Directory || auth.Disabled || auth.ServiceAccount ||
+		config.PasswordResetNotifier == nil {
+		return false, nil
+	}
+
+	passwordResetMutex.Lock()
+	defer passwordResetMutex.Unlock()
+	keys, err := kvsPasswordReset.Keys()
+	if err != nil {
+		return false, runtimeh.SourceInfoError("", err)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		pr := passwordReset{}
+		if err := kvsPasswordReset.Deserialize(key, &pr); err != nil {
+			return false, runtimeh.SourceInfoError("", err)
+		}
+		if pr.Email != email {
+			continue
+		}
+		if now.Sub(time.Unix(pr.Created, 0)) < passwordResetMinInterval {
+			return false, nil
+		}
+		if _, err := kvsPasswordReset.Delete(key); err != nil {
+			return false, runtimeh.SourceInfoError("", err)
+		}
+	}
+
+	// 256 bits
+	s1, err := uniqueID(false)
+	if err != nil {
+		return false, err
+	}
+	s2, err := uniqueID(false)
+	if err != nil {
+		return false, err
+	}
+	token := s1 + s2
+	pr := passwordReset{Created: now.Unix(), Email: email,
+		ExpiresAt: now.Add(config.PasswordResetExpirationInterval).Unix()}
+	if err := kvsPasswordReset.Serialize(passwordResetKey(token), pr); err != nil {
+		return false, runtimeh.SourceInfoError("", err)
+	}
+
+	n := Notification{Email: email, ExpiresAt: pr.ExpiresAt, Subject: config.AppName + " password reset", Token: token}
+	n.Body = fmt.Sprintf("A password reset was requested for the account: %s\n\n"+
+		"To set a new password, PUT the reset token and the new password to %s/ before %s.\n\n"+
+		"Reset token: %s\n\nIf you did not request a password reset, no action is required.",
+		email, config.PathPasswordReset, time.Unix(pr.ExpiresAt, 0).UTC().Format(time.RFC1123), token)
+	notifier := config.PasswordResetNotifier
+	go func() {
+		if err := notifier.Notify(n); err != nil {
+			logh.Map[config.LogName].Printf(logh.Error, "password reset notification for email: %s, error: %v", email, err)
+		}
+	}()
+	return true, nil
+}
+
+// removeExpiredPasswordResets deletes password reset tokens that have expired.
+func removeExpiredPasswordResets() (int, error) {
+	passwordResetMutex.Lock()
+	defer passwordResetMutex.Unlock()
+	keys, err := kvsPasswordReset.Keys()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	count := 0
+	for _, key := range keys {
+		pr := passwordReset{}
+		if err := kvsPasswordReset.Deserialize(key, &pr); err != nil {
+			return count, err
+		}
+		if now <= pr.ExpiresAt {
+			continue
+		}
+		if _, err := kvsPasswordReset.Delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
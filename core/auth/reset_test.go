@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testNotifier sends Notifications on the channel.
+type testNotifier chan Notification
+
+func (tn testNotifier) Notify(n Notification) error {
+	tn <- n
+	return nil
+}
+
+// TestPasswordReset verifies reset tokens are sent only for valid accounts, are single use, and
+// reset the password, revoking tokens.
+func TestPasswordReset(t *testing.T) {
+	testSetup()
+	notifications := make(testNotifier, 1)
+	config.PasswordResetNotifier = notifications
+	config.PasswordResetExpirationInterval = time.Minute
+
+	resetServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerPasswordReset)))
+	defer resetServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+
+	em := "user@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	token, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	// Unknown accounts get the same response, and no token is sent.
+	unknown, _ := json.Marshal(PasswordResetRequest{Email: strPtr("unknown@auth.com")})
+	if status, _ := request(t, resetServer.URL, http.MethodPost, nil, unknown); status != http.StatusAccepted {
+		t.Errorf("unknown account status: %d", status)
+		return
+	}
+	body, _ := json.Marshal(PasswordResetRequest{Email: &em})
+	if status, _ := request(t, resetServer.URL, http.MethodPost, nil, body); status != http.StatusAccepted {
+		t.Errorf("request status: %d", status)
+		return
+	}
+	var n Notification
+	select {
+	case n = <-notifications:
+	case <-time.After(5 * time.Second):
+		t.Errorf("no notification")
+		return
+	}
+	if n.Email != em || n.Token == "" || n.ExpiresAt <= time.Now().Unix() {
+		t.Errorf("notification: %+v", n)
+		return
+	}
+	// A second request within passwordResetMinInterval is not sent.
+	if sent, err := passwordResetSend(em); sent || err != nil {
+		t.Errorf("second request sent: %t, error: %v", sent, err)
+		return
+	}
+
+	// A password that fails validation does not use the token.
+	body, _ = json.Marshal(PasswordResetRequest{Password: strPtr("short"), Token: &n.Token})
+	if status, _ := request(t, resetServer.URL, http.MethodPut, nil, body); status != http.StatusBadRequest {
+		t.Errorf("invalid password status: %d", status)
+		return
+	}
+	// A recent password does not use the token.
+	passwordPolicyMutex.Lock()
+	passwordPolicy.History = 1
+	passwordPolicyMutex.Unlock()
+	defer func() {
+		passwordPolicyMutex.Lock()
+		passwordPolicy.History = 0
+		passwordPolicyMutex.Unlock()
+	}()
+	body, _ = json.Marshal(PasswordResetRequest{Password: strPtr("P@ssword1234"), Token: &n.Token})
+	if status, _ := request(t, resetServer.URL, http.MethodPut, nil, body); status != http.StatusBadRequest {
+		t.Errorf("recent password status: %d", status)
+		return
+	}
+	newPassword := "N3w@ssword1234"
+	body, _ = json.Marshal(PasswordResetRequest{Password: &newPassword, Token: &n.Token})
+	if status, _ := request(t, resetServer.URL, http.MethodPut, nil, body); status != http.StatusNoContent {
+		t.Errorf("reset status: %d", status)
+		return
+	}
+	if status, _ := request(t, resetServer.URL, http.MethodPut, nil, body); status != http.StatusUnauthorized {
+		t.Errorf("reused token status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, token, nil); status != http.StatusUnauthorized {
+		t.Errorf("token after reset status: %d", status)
+		return
+	}
+	newCred, _ := json.Marshal(Credential{Email: &em, Password: &newPassword})
+	if _, _, err := login(t, newCred); err != nil {
+		return
+	}
+
+	// Expired tokens are rejected, and removed.
+	if err := kvsPasswordReset.Serialize(passwordResetKey("expired"), passwordReset{Email: em, ExpiresAt: 1}); err != nil {
+		t.Errorf("Serialize error: %v", err)
+		return
+	}
+	body, _ = json.Marshal(PasswordResetRequest{Password: &newPassword, Token: strPtr("expired")})
+	if status, _ := request(t, resetServer.URL, http.MethodPut, nil, body); status != http.StatusUnauthorized {
+		t.Errorf("expired token status: %d", status)
+		return
+	}
+	if n, err := removeExpiredPasswordResets(); n != 1 || err != nil {
+		t.Errorf("removeExpiredPasswordResets count: %d, error: %v", n, err)
+		return
+	}
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Revocation is an entry in the RevocationList; either a token (JTI), or all tokens for a
+// subject issued at or before RevokedAt.
+type Revocation struct {
+	// ExpiresAt is the Unix (seconds) time after which the revoked tokens have expired, and the
+	// entry is removed.
+	ExpiresAt int64
+	// JTI is the TokenID of the revoked token.
+	JTI       string `json:",omitempty"`
+	RevokedAt int64
+	// Subject is the SHA256 hash of the Email, hex encoded, so the list does not disclose emails.
+	Subject string `json:",omitempty"`
+}
+
+// RevocationList is the body returned by PathRevocations.
+type RevocationList struct {
+	Revocations []Revocation
+}
+
+const (
+	defaultRevocationPollInterval = 5 * time.Second
+	kvsRevocationTable            = "authRevocation"
+)
+
+var (
+	// revokedJTI and revokedSubjects are the revocations fetched from Config.RevocationsURL;
+	// the values are Revocation.ExpiresAt and Revocation.RevokedAt.
+	revokedJTI       = map[string]int64{}
+	revokedSubjects  = map[string]int64{}
+	revocationsETag  string
+	revocationsMutex sync.RWMutex
+)
+
+// handlerRevocations returns the RevocationList; tokens that were revoked and have not expired.
+// Services without the auth data source poll the list (Config.RevocationsURL), so revocations
+// take effect within Config.RevocationPollInterval. The ETag header is supported.
+// http.MethodGet - get the list.
+func handlerRevocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rl, err := revocationsList()
+	if err != nil {
+		lpf(logh.Error, "revocationsList error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(rl)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%+v", err)
+	}
+}
+
+// removeExpiredRevocations deletes revocations for tokens that have expired.
+func removeExpiredRevocations() (int, error) {
+	keys, err := kvsRevocation.Keys()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	count := 0
+	for _, key := range keys {
+		rv := Revocation{}
+		if err := kvsRevocation.Deserialize(key, &rv); err != nil {
+			return count, err
+		}
+		if now <= rv.ExpiresAt {
+			continue
+		}
+		if _, err := kvsRevocation.Delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// revocationAdd persists the revocation.
+func revocationAdd(rv Revocation) error {
+	key := "jti|" + rv.JTI
+	if rv.Subject != "" {
+		key = "sub|" + rv.Subject
+	}
+	return kvsRevocation.Serialize(key, rv)
+}
+
+// revocationSubject returns Revocation.Subject for the email.
+func revocationSubject(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// revocationsInit fetches the RevocationList, and starts a GO routine to fetch it every
+// Config.RevocationPollInterval.
+func revocationsInit() {
+	if err := revocationsRefresh(); err != nil {
+		lpf(logh.Error, "revocationsRefresh error:%v", err)
+	}
+	interval := config.RevocationPollInterval
+	if interval == 0 {
+		interval = defaultRevocationPollInterval
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := revocationsRefresh(); err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "revocationsRefresh error:%v", err)
+			}
+		}
+	}()
+}
+
+// revocationsList returns the revocations that have not expired.
+func revocationsList() (RevocationList, error) {
+	keys, err := kvsRevocation.Keys()
+	if err != nil {
+		return RevocationList{}, err
+	}
+	now := time.Now().Unix()
+	rl := RevocationList{Revocations: []Revocation{}}
+	for _, key := range keys {
+		rv := Revocation{}
+		if err := kvsRevocation.Deserialize(key, &rv); err != nil {
+			return RevocationList{}, err
+		}
+		if now <= rv.ExpiresAt {
+			rl.Revocations = append(rl.Revocations, rv)
+		}
+	}
+	return rl, nil
+}
+
+// revocationsRefresh fetches the RevocationList from Config.RevocationsURL. On error, the prior
+// list continues to be used.
+func revocationsRefresh() error {
+	client := config.AuthServiceClient
+	if client == nil {
+		client = &http.Client{Timeout: jwksTimeout}
+	}
+	req, err := http.NewRequest(http.MethodGet, config.RevocationsURL, nil)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	revocationsMutex.RLock()
+	if revocationsETag != "" {
+		req.Header.Set("If-None-Match", revocationsETag)
+	}
+	revocationsMutex.RUnlock()
+	resp, err := client.Do(req)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s revocations GET %s status: %d", runtimeh.SourceInfo(), config.RevocationsURL, resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, jwksResponseLimit))
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	rl := RevocationList{}
+	if err := json.Unmarshal(b, &rl); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+
+	jtis := map[string]int64{}
+	subjects := map[string]int64{}
+	for _, rv := range rl.Revocations {
+		if rv.Subject != "" {
+			subjects[rv.Subject] = rv.RevokedAt
+		} else if rv.JTI != "" {
+			jtis[rv.JTI] = rv.ExpiresAt
+		}
+	}
+	revocationsMutex.Lock()
+	revokedJTI = jtis
+	revokedSubjects = subjects
+	revocationsETag = resp.Header.Get("ETag")
+	revocationsMutex.Unlock()
+	return nil
+}
+
+// revoked returns true when the claims are in the RevocationList fetched from
+// Config.RevocationsURL.
+func revoked(claims *CustomClaims) bool {
+	revocationsMutex.RLock()
+	defer revocationsMutex.RUnlock()
+	if len(revokedJTI) == 0 && len(revokedSubjects) == 0 {
+		return false
+	}
+	if _, ok := revokedJTI[claims.TokenID]; ok {
+		return true
+	}
+	revokedAt, ok := revokedSubjects[revocationSubject(claims.Email)]
+	return ok && claims.IssuedAt <= revokedAt
+}
+
+// subjectRevoke revokes all tokens issued to the email; I.E. when the account is deleted.
+func subjectRevoke(email string) error {
+	now := time.Now()
+	return revocationAdd(Revocation{ExpiresAt: now.Add(config.JWTAuthExpirationInterval).Unix(),
+		RevokedAt: now.Unix(), Subject: revocationSubject(email)})
+}
+
+// tokenRevoke deletes the token, with kvsToken key, and adds it to the revocation list. The
+// count of deleted tokens is returned.
+func tokenRevoke(key string) (int64, error) {
+	b, err := kvsToken.Get(key)
+	if err != nil || b == nil {
+		return 0, err
+	}
+	var expiresAt int64
+	if err := binary.Read(bytes.NewBuffer(b), binary.LittleEndian, &expiresAt); err != nil {
+		return 0, runtimeh.SourceInfoError("", err)
+	}
+	n, err := kvsToken.Delete(key)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	if time.Now().Unix() > expiresAt {
+		return n, nil
+	}
+	jti := key[strings.LastIndex(key, "|")+1:]
+	return n, revocationAdd(Revocation{ExpiresAt: expiresAt, JTI: jti, RevokedAt: time.Now().Unix()})
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRevocations verifies revoked tokens are published, and rejected by a service without the
+// auth data source once it has fetched the list.
+func TestRevocations(t *testing.T) {
+	testSetup()
+
+	em := "revoked@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	token1, claims1, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	token2, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if n, err := tokenRevoke(claims1.tokenKVSKey()); n != 1 || err != nil {
+		t.Errorf("tokenRevoke count: %d, error: %v", n, err)
+		return
+	}
+
+	revocationsServer := httptest.NewServer(http.HandlerFunc(handlerRevocations))
+	defer revocationsServer.Close()
+	resp, err := http.Get(revocationsServer.URL)
+	if err != nil {
+		t.Errorf("GET error: %v", err)
+		return
+	}
+	rl := RevocationList{}
+	err = json.NewDecoder(resp.Body).Decode(&rl)
+	resp.Body.Close()
+	if err != nil || len(rl.Revocations) != 1 || rl.Revocations[0].JTI != claims1.TokenID {
+		t.Errorf("revocations: %+v, error: %v", rl, err)
+		return
+	}
+	req, _ := http.NewRequest(http.MethodGet, revocationsServer.URL, nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match response: %+v, error: %v", resp, err)
+		return
+	}
+
+	// A service without the auth data source.
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTest)))
+	defer testServer.Close()
+	config.DataSourcePath = ""
+	config.RevocationsURL = revocationsServer.URL
+	defer func() {
+		config.DataSourcePath = dataSourcePath
+		config.RevocationsURL = ""
+		revocationsMutex.Lock()
+		revokedJTI = map[string]int64{}
+		revokedSubjects = map[string]int64{}
+		revocationsETag = ""
+		revocationsMutex.Unlock()
+	}()
+	if status, _ := request(t, testServer.URL, http.MethodGet, token1, nil); status != http.StatusNoContent {
+		t.Errorf("status before the list was fetched: %d", status)
+		return
+	}
+	if err := revocationsRefresh(); err != nil {
+		t.Errorf("revocationsRefresh error: %v", err)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodGet, token1, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked token status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodGet, token2, nil); status != http.StatusNoContent {
+		t.Errorf("token status: %d", status)
+		return
+	}
+
+	// Revoking the subject revokes all tokens issued to the subject.
+	if err := subjectRevoke(em); err != nil {
+		t.Errorf("subjectRevoke error: %v", err)
+		return
+	}
+	if err := revocationsRefresh(); err != nil {
+		t.Errorf("revocationsRefresh error: %v", err)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodGet, token2, nil); status != http.StatusUnauthorized {
+		t.Errorf("subject revoked token status: %d", status)
+		return
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Permissions maps an HTTP method to the role required to call a route with that method.
+// Methods not in the map are rejected with http.StatusMethodNotAllowed.
+type Permissions map[string]string
+
+// claimsKey is the context key for the CustomClaims of an authenticated request.
+type claimsKey struct{}
+
+// Roles, in order of decreasing privilege. A role grants all lesser roles; I.E. an operator
+// can do anything a viewer can do.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+var (
+	// roleRank orders the roles; a higher rank grants all lower ranks.
+	roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+)
+
+// ClaimsFromRequest returns the CustomClaims of a request authenticated by one of the handler
+// wrappers in this package.
+func ClaimsFromRequest(r *http.Request) (*CustomClaims, bool) {
+	claims, ok := r.Context().Value(claimsKey{}).(*CustomClaims)
+	return claims, ok && claims != nil
+}
+
+// ContextWithClaims returns a copy of ctx carrying claims; the handler wrappers use this to
+// provide the claims to handlers, and it may be used to test handlers without a token.
+func ContextWithClaims(ctx context.Context, claims *CustomClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// HandlerFuncPermissionsWrapper verifies the call is authenticated, like HandlerFuncAuthJWTWrapper,
+// and that the caller has the role required by permissions for the request method. Callers
+// without the role get http.StatusForbidden, which is audited.
+// Note this wrapper also handles audit logging (logging for all DELETE/POST/PUT methods)
+func HandlerFuncPermissionsWrapper(permissions Permissions, hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	for method, role := range permissions {
+		if _, ok := roleRank[role]; !ok {
+			panic(fmt.Sprintf("%s invalid role: %s, for method: %s", runtimeh.SourceInfo(), role, method))
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := &AuditWriter{ResponseWriter: w}
+		role, ok := permissions[r.Method]
+		if !ok {
+			aw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		claims, err := authenticated(aw, r, false)
+		if err != nil {
+			return
+		}
+		r = r.WithContext(ContextWithClaims(r.Context(), claims))
+		if !RequireRole(aw, r, role) {
+			auditRequest(aw, r)
+			return
+		}
+		hf(aw, r)
+		auditRequest(aw, r)
+	}
+}
+
+// HandlerFuncRoleWrapper is HandlerFuncPermissionsWrapper requiring role for all methods.
+func HandlerFuncRoleWrapper(role string, hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	permissions := Permissions{}
+	for _, method := range []string{http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodPatch,
+		http.MethodPost, http.MethodPut} {
+		permissions[method] = role
+	}
+	return HandlerFuncPermissionsWrapper(permissions, hf)
+}
+
+// HasRole returns true when the claims have role, or a role that grants role.
+func (cc CustomClaims) HasRole(role string) bool {
+	return hasRole(cc.Roles, role)
+}
+
+// RequireRole is for handlers that need a role based on the request content, rather than only
+// the method; I.E. a role in addition to that required by the route. Returns true if the caller
+// has role. Otherwise http.StatusForbidden is written, the denial audited, and false returned;
+// callers should then return without writing header status. The request must have been
+// authenticated by one of the handler wrappers in this package.
+func RequireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	claims, ok := ClaimsFromRequest(r)
+	if ok && claims.HasRole(role) {
+		return true
+	}
+	email := ""
+	if ok {
+		email = claims.Email
+	}
+	msg := fmt.Sprintf("role %s required, email: %s", role, email)
+	w.WriteHeader(http.StatusForbidden)
+	if aw, ok := w.(*AuditWriter); ok {
+		// The wrapper writes the audit record.
+		aw.Message = msg
+	} else {
+		auditPrint(http.StatusForbidden, r, msg)
+	}
+	return false
+}
+
+// hasRole returns true when roles has role, or a role that grants role.
+func hasRole(roles []string, role string) bool {
+	rank, ok := roleRank[role]
+	if !ok {
+		return false
+	}
+	for _, r := range roles {
+		if roleRank[r] >= rank {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesValidate returns an error if any role is not a known role.
+func rolesValidate(roles []string) error {
+	for _, r := range roles {
+		if _, ok := roleRank[r]; !ok {
+			return fmt.Errorf("%s invalid role: %s, valid roles: %s", runtimeh.SourceInfo(), r,
+				strings.Join([]string{RoleAdmin, RoleOperator, RoleViewer}, ","))
+		}
+	}
+	return nil
+}
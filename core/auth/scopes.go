@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Audience is a service that accepts tokens issued for it, and the scopes it defines; see
+// Config.Audiences.
+type Audience struct {
+	// Name is the audience claim of tokens for the service; the Config.Audience of the service.
+	Name string
+	// Scopes maps each scope of the service to the role required for the scope to be granted;
+	// I.E. "telemetry:read": RoleViewer.
+	Scopes map[string]string
+}
+
+// HasScope returns true when the claims grant scope. Tokens without an audience have no scopes,
+// and are limited only by their roles; services use Config.Audience to reject those tokens.
+func (cc CustomClaims) HasScope(scope string) bool {
+	if cc.Audience == "" {
+		return true
+	}
+	for _, s := range cc.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope is RequireRole for scopes; handlers call it to require the token grants scope.
+// Returns true if it does. Otherwise http.StatusForbidden is written, the denial audited, and false
+// returned; callers should then return without writing header status.
+func RequireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	claims, ok := ClaimsFromRequest(r)
+	if ok && claims.HasScope(scope) {
+		return true
+	}
+	email := ""
+	if ok {
+		email = claims.Email
+	}
+	msg := fmt.Sprintf("scope %s required, email: %s", scope, email)
+	w.WriteHeader(http.StatusForbidden)
+	if aw, ok := w.(*AuditWriter); ok {
+		// The wrapper writes the audit record.
+		aw.Message = msg
+	} else {
+		auditPrint(http.StatusForbidden, r, msg)
+	}
+	return false
+}
+
+// audienceScopes returns the scopes of the audience, from requested, that roles grant, or when
+// requested is nil all the scopes that roles grant. An error is returned for an audience not in
+// Config.Audiences, a scope the audience does not define, or scopes without an audience.
+func audienceScopes(audience string, requested []string, roles []string) ([]string, error) {
+	if audience == "" {
+		if len(requested) > 0 {
+			return nil, fmt.Errorf("%s scopes require an audience", runtimeh.SourceInfo())
+		}
+		return nil, nil
+	}
+	var aud *Audience
+	for i := range config.Audiences {
+		if config.Audiences[i].Name == audience {
+			aud = &config.Audiences[i]
+			break
+		}
+	}
+	if aud == nil {
+		return nil, fmt.Errorf("%s unknown audience: %s", runtimeh.SourceInfo(), audience)
+	}
+	if requested == nil {
+		for s := range aud.Scopes {
+			requested = append(requested, s)
+		}
+	}
+
+	granted := []string{}
+	for _, s := range requested {
+		role, ok := aud.Scopes[s]
+		if !ok {
+			return nil, fmt.Errorf("%s unknown scope: %s, for audience: %s", runtimeh.SourceInfo(), s, audience)
+		}
+		if hasRole(roles, role) {
+			granted = append(granted, s)
+		}
+	}
+	sort.Strings(granted)
+	return granted, nil
+}
+
+// audienceValid returns true when the claims are for this service; see Config.Audience.
+func audienceValid(claims *CustomClaims) bool {
+	if config.Audience != "" {
+		return claims.Audience == config.Audience
+	}
+	return claims.Audience == "" || claims.Audience == config.AppName
+}
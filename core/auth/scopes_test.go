@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAudienceScopes verifies tokens for an audience have the scopes the roles grant, are only
+// accepted by that audience, and keep the audience when refreshed.
+func TestAudienceScopes(t *testing.T) {
+	testSetup()
+	config.Audiences = []Audience{{Name: "telemetry",
+		Scopes: map[string]string{"telemetry:execute": RoleOperator, "telemetry:read": RoleViewer}}}
+	config.RefreshTokenExpirationInterval = time.Hour
+	defer func() { config.RefreshTokenExpirationInterval = 0 }()
+
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+	executeServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer,
+		func(w http.ResponseWriter, r *http.Request) {
+			if !RequireScope(w, r, "telemetry:execute") {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	defer executeServer.Close()
+	refreshServer := httptest.NewServer(http.HandlerFunc(handlerRefreshToken))
+	defer refreshServer.Close()
+
+	em := "viewer@auth.com"
+	if _, err := createAuth(t, em, []string{RoleViewer}); err != nil {
+		return
+	}
+	pw := "P@ssword1234"
+	cred := Credential{Audience: "telemetry", Email: &em, Password: &pw}
+	credBytes, _ := json.Marshal(cred)
+	token, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if claims.Audience != "telemetry" || len(claims.Scopes) != 1 || !claims.HasScope("telemetry:read") {
+		t.Errorf("claims: %+v", claims)
+		return
+	}
+	for _, c := range []Credential{{Audience: "other", Email: &em, Password: &pw},
+		{Audience: "telemetry", Email: &em, Password: &pw, Scopes: []string{"telemetry:write"}},
+		{Email: &em, Password: &pw, Scopes: []string{"telemetry:read"}}} {
+		b, _ := json.Marshal(c)
+		if status, _ := request(t, loginServer.URL, http.MethodPut, nil, b); status != http.StatusBadRequest {
+			t.Errorf("credential: %+v, status: %d", c, status)
+			return
+		}
+	}
+
+	// Tokens for another audience are rejected; tokens without an audience are accepted unless
+	// the service requires its audience.
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, token, nil); status != http.StatusUnauthorized {
+		t.Errorf("other audience status: %d", status)
+		return
+	}
+	noAudienceBytes, _ := json.Marshal(Credential{Email: &em, Password: &pw})
+	noAudienceToken, _, err := login(t, noAudienceBytes)
+	if err != nil {
+		return
+	}
+	config.Audience = "telemetry"
+	defer func() { config.Audience = "" }()
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, token, nil); status != http.StatusNoContent {
+		t.Errorf("audience status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, noAudienceToken, nil); status != http.StatusUnauthorized {
+		t.Errorf("no audience status: %d", status)
+		return
+	}
+	if status, _ := request(t, executeServer.URL, http.MethodGet, token, nil); status != http.StatusForbidden {
+		t.Errorf("scope not granted status: %d", status)
+		return
+	}
+
+	// The refresh token keeps the audience.
+	rt, err := loginRefreshToken(t, credBytes)
+	if err != nil {
+		return
+	}
+	status, _, refreshed := exchange(t, refreshServer.URL, rt)
+	if status != http.StatusCreated {
+		t.Errorf("exchange status: %d", status)
+		return
+	}
+	if claims, err := parseClaims(refreshed); err != nil || claims.Audience != "telemetry" || !claims.HasScope("telemetry:read") {
+		t.Errorf("refreshed claims: %+v, error: %v", claims, err)
+		return
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Session is an issued token that has not expired or been revoked, as returned by PathSessions.
+type Session struct {
+	// Actor is the administrator that impersonated the user; see PathImpersonate.
+	Actor string `json:",omitempty"`
+	// Created is the Unix (seconds) time the token was issued.
+	Created int64
+	// Current is true for the session of the token used for the request.
+	Current bool `json:",omitempty"`
+	Email   string
+	// ExpiresAt is the Unix (seconds) time the token expires.
+	ExpiresAt int64
+	// ID is the TokenID of the token; used with the query parameter id to revoke the session.
+	ID string
+	// IP is the source IP of the request for which the token was issued.
+	IP string `json:",omitempty"`
+	// UserAgent is the User-Agent header of the request for which the token was issued.
+	UserAgent string `json:",omitempty"`
+}
+
+const (
+	kvsSessionTable = "authSession"
+	// sessionUserAgentLimit is the maximum length of Session.UserAgent that is persisted.
+	sessionUserAgentLimit = 256
+)
+
+// handlerSessions is for users to list and revoke their sessions, and administrators to list and
+// revoke the sessions of any user. Administrators use the query parameter email for the sessions
+// of another user. Revoking a session revokes its token, in this service and in services using
+// Config.RevocationsURL.
+// http.MethodDelete - revoke the session with query parameter id, or without id all sessions,
+// including the current session, and all refresh tokens.
+// http.MethodGet - list the sessions, oldest first.
+func handlerSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := ClaimsFromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	em := claims.Email
+	if qem := r.URL.Query().Get(queryParamEmail); qem != "" && qem != em {
+		if !RequireRole(w, r, RoleAdmin) {
+			return
+		}
+		em = qem
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if impersonating(w, r) {
+			return
+		}
+		id := r.URL.Query().Get(queryParamID)
+		if id == "" {
+			n, err := userRevoke(em)
+			if err != nil {
+				lpf(logh.Error, "userRevoke error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if aw, ok := w.(*AuditWriter); ok {
+				aw.Message = fmt.Sprintf("all sessions revoked, %d tokens, for email: %s, by: %s", n, em, claims.Email)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		n, err := sessionRevoke(em, id)
+		if err != nil {
+			lpf(logh.Error, "sessionRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("session revoked, id: %s, for email: %s, by: %s", id, em, claims.Email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		sessions, err := sessionsList(em)
+		if err != nil {
+			lpf(logh.Error, "sessionsList error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Email == claims.Email && sessions[i].ID == claims.TokenID
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	}
+}
+
+// removeExpiredSessions deletes sessions for which the token is no longer in kvsToken; I.E.
+// the token expired, or was revoked.
+func removeExpiredSessions() (int, error) {
+	keys, err := kvsSession.Keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		b, err := kvsToken.Get(key)
+		if err != nil {
+			return count, err
+		}
+		if b != nil {
+			continue
+		}
+		if _, err := kvsSession.Delete(key); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// sessionCreate stores the Session for the token with claims, issued for the request r; r may be
+// nil when there is no request.
+func sessionCreate(claims CustomClaims, r *http.Request) error {
+	s := Session{Actor: claims.Actor, Created: claims.IssuedAt, Email: claims.Email, ExpiresAt: claims.ExpiresAt, ID: claims.TokenID}
+	if r != nil {
+		s.IP = requestIP(r)
+		s.UserAgent = r.UserAgent()
+		if len(s.UserAgent) > sessionUserAgentLimit {
+			s.UserAgent = s.UserAgent[:sessionUserAgentLimit]
+		}
+	}
+	if err := kvsSession.Serialize(claims.tokenKVSKey(), s); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return nil
+}
+
+// sessionRevoke revokes the token of the session with id, for the email, and deletes the
+// session. The count of revoked tokens is returned.
+func sessionRevoke(email string, id string) (int64, error) {
+	key := CustomClaims{Email: email, TokenID: id}.tokenKVSKey()
+	n, err := tokenRevoke(key)
+	if err != nil {
+		return n, err
+	}
+	if _, err := kvsSession.Delete(key); err != nil {
+		return n, runtimeh.SourceInfoError("", err)
+	}
+	return n, nil
+}
+
+// sessionsList returns the sessions of the email for which the token is valid, oldest first.
+func sessionsList(email string) ([]Session, error) {
+	keys, err := kvsSession.Keys()
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	now := time.Now().Unix()
+	out := []Session{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, email+"|") {
+			continue
+		}
+		// The token is the source of truth; sessions of revoked tokens are removed later.
+		b, err := kvsToken.Get(key)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("", err)
+		}
+		if b == nil {
+			continue
+		}
+		s := Session{}
+		if err := kvsSession.Deserialize(key, &s); err != nil {
+			return nil, runtimeh.SourceInfoError("", err)
+		}
+		if s.Email != email || s.ExpiresAt < now {
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created < out[j].Created })
+	return out, nil
+}
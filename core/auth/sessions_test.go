@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestSessions verifies users can list and revoke their sessions, and administrators can revoke
+// all sessions of another user.
+func TestSessions(t *testing.T) {
+	testSetup()
+
+	sessionsServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerSessions)))
+	defer sessionsServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "user@auth.com"
+	credBytes, err := createAuth(t, em, nil)
+	if err != nil {
+		return
+	}
+	tokenA, claimsA, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	tokenB, claimsB, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+
+	status, b := request(t, sessionsServer.URL, http.MethodGet, tokenA, nil)
+	sessions := []Session{}
+	if err := json.Unmarshal(b, &sessions); status != http.StatusOK || err != nil || len(sessions) != 2 {
+		t.Errorf("list status: %d, sessions: %+v, error: %v", status, sessions, err)
+		return
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == claimsA.TokenID) || s.IP != "127.0.0.1" || s.UserAgent == "" {
+			t.Errorf("sessions: %+v", sessions)
+			return
+		}
+	}
+
+	// Revoke the other session; its token is rejected.
+	if status, _ := request(t, sessionsServer.URL+"?id="+claimsB.TokenID, http.MethodDelete, tokenA, nil); status != http.StatusNoContent {
+		t.Errorf("revoke status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, tokenB, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked session token status: %d", status)
+		return
+	}
+	if status, _ := request(t, sessionsServer.URL+"?id="+claimsB.TokenID, http.MethodDelete, tokenA, nil); status != http.StatusNotFound {
+		t.Errorf("revoke revoked session status: %d", status)
+		return
+	}
+	if status, _ := request(t, sessionsServer.URL+"?email=admin@auth.com", http.MethodGet, tokenA, nil); status != http.StatusForbidden {
+		t.Errorf("user list other sessions status: %d", status)
+		return
+	}
+
+	// An administrator revokes all sessions of the user.
+	status, b = request(t, sessionsServer.URL+"?email="+em, http.MethodGet, adminToken, nil)
+	sessions = []Session{}
+	if err := json.Unmarshal(b, &sessions); status != http.StatusOK || err != nil || len(sessions) != 1 || sessions[0].Current {
+		t.Errorf("admin list status: %d, sessions: %+v, error: %v", status, sessions, err)
+		return
+	}
+	if status, _ := request(t, sessionsServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("admin revoke all status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, tokenA, nil); status != http.StatusUnauthorized {
+		t.Errorf("token after revoke all status: %d", status)
+		return
+	}
+	if n, err := removeExpiredSessions(); n != 1 || err != nil {
+		t.Errorf("removeExpiredSessions count: %d, error: %v", n, err)
+		return
+	}
+}
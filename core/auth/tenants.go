@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// tenantRegexp matches valid tenant names; they are used by services in paths and keys, so
+// are limited to lower case letters, digits, '-' and '_'.
+var tenantRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// TenantValidate returns an error if tenant is not a valid tenant name: 1-63 lower case letters,
+// digits, '-' or '_', starting with a letter or digit. The default tenant, "", is valid.
+// Services use it to validate CustomClaims.Tenant before using it in paths.
+func TenantValidate(tenant string) error {
+	if tenant != "" && !tenantRegexp.MatchString(tenant) {
+		return fmt.Errorf("%s invalid tenant: %q", runtimeh.SourceInfo(), tenant)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTenants verifies only administrators set the tenant of an account, tokens carry the
+// tenant, and changing the tenant revokes the tokens of the account.
+func TestTenants(t *testing.T) {
+	testSetup()
+
+	testServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerCreateOrUpdate)))
+	defer testServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+
+	em := "user@auth.com"
+	ps := "P@ssword1234"
+	for _, tenant := range []string{"../team-a", "Team-A", "-team"} {
+		b, _ := json.Marshal(Credential{Email: &em, Password: &ps, Tenant: strPtr(tenant)})
+		if status, _ := request(t, testServer.URL, http.MethodPost, adminToken, b); status != http.StatusBadRequest {
+			t.Errorf("tenant: %s, status: %d", tenant, status)
+			return
+		}
+	}
+	credA, _ := json.Marshal(Credential{Email: &em, Password: &ps, Tenant: strPtr("team-a")})
+	if status, _ := request(t, testServer.URL, http.MethodPost, adminToken, credA); status != http.StatusCreated {
+		t.Errorf("admin create status: %d", status)
+		return
+	}
+	userCred, _ := json.Marshal(Credential{Email: &em, Password: &ps})
+	token, claims, err := login(t, userCred)
+	if err != nil {
+		return
+	}
+	if claims.Tenant != "team-a" {
+		t.Errorf("claims tenant: %s", claims.Tenant)
+		return
+	}
+
+	// Users cannot change their tenant; an update without Tenant keeps it.
+	credB, _ := json.Marshal(Credential{Email: &em, Password: &ps, Tenant: strPtr("team-b")})
+	if status, _ := request(t, testServer.URL, http.MethodPut, token, credB); status != http.StatusForbidden {
+		t.Errorf("user change tenant status: %d", status)
+		return
+	}
+	if status, _ := request(t, testServer.URL, http.MethodPut, token, userCred); status != http.StatusNoContent {
+		t.Errorf("user update status: %d", status)
+		return
+	}
+	if auth, err := authGet(em); err != nil || auth.Tenant != "team-a" {
+		t.Errorf("tenant after update: %s, error: %v", auth.Tenant, err)
+		return
+	}
+
+	if status, _ := request(t, testServer.URL, http.MethodPut, adminToken, credB); status != http.StatusNoContent {
+		t.Errorf("admin change tenant status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, token, nil); status != http.StatusUnauthorized {
+		t.Errorf("token for prior tenant status: %d", status)
+		return
+	}
+	if _, claims, err := login(t, userCred); err != nil || claims.Tenant != "team-b" {
+		t.Errorf("claims: %+v, error: %v", claims, err)
+		return
+	}
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// TOTPEnrollment is returned by PathTOTP when enrollment starts. The URI is the otpauth URI
+// to present as a QR code to authenticator apps; the Secret is for manual entry.
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// TOTPRecoveryCodes is returned by PathTOTP when enrollment is confirmed. Each recovery code can
+// be used once in place of a TOTP code; they are only returned once.
+type TOTPRecoveryCodes struct {
+	RecoveryCodes []string
+}
+
+// TOTPRequest is the body for PathTOTP.
+type TOTPRequest struct {
+	// Code is a TOTP code, or for http.MethodDelete a recovery code.
+	Code string
+}
+
+const (
+	// TOTPRequiredHeader is set on the http.StatusUnauthorized response to login when the
+	// password is valid, and the account requires a TOTP code; see Credential.TOTP.
+	TOTPRequiredHeader = "TOTP-Required"
+
+	totpDigits             = 6
+	totpModulus            = 1000000 // 10^totpDigits
+	totpPeriod             = 30
+	totpRecoveryCodeCount  = 10
+	totpSecretLength       = 20
+	totpStepsAllowedToSkew = 1
+)
+
+var (
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// handlerTOTP is for users to enroll in, and disable, TOTP two factor authentication (RFC 6238).
+// Once enabled, login requires Credential.TOTP. Impersonation tokens get http.StatusForbidden.
+// http.MethodDelete - disable TOTP; the body is a TOTPRequest with a TOTP or recovery code. An
+// administrator can disable TOTP for another account, without a code, using the query
+// parameter email; I.E. for a lost device.
+// http.MethodPost - start enrollment; the TOTPEnrollment is returned.
+// http.MethodPut - confirm enrollment, or when already enabled replace the recovery codes; the
+// body is a TOTPRequest with a TOTP code. The TOTPRecoveryCodes are returned.
+func handlerTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := ClaimsFromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if impersonating(w, r) {
+		return
+	}
+	em := claims.Email
+	if qem := r.URL.Query().Get(queryParamEmail); qem != "" && qem != em {
+		// Administrators can only disable TOTP for other accounts.
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !RequireRole(w, r, RoleAdmin) {
+			return
+		}
+		em = qem
+	}
+
+	auth, err := authGet(em)
+	if err != nil {
+		lpf(logh.Error, "authGet error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if auth.Email == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if auth.ServiceAccount {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	tr := TOTPRequest{}
+	if r.Method != http.MethodPost && em == claims.Email {
+		if err := httph.BodyUnmarshal(w, r, &tr); err != nil {
+			lpf(logh.Error, "TOTP error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+	}
+
+	var msg string
+	var out any
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodDelete:
+		if !auth.TOTPEnabled {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if em == claims.Email && !totpVerify(&auth, tr.Code, true) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		auth.RecoveryCodes = nil
+		auth.TOTPEnabled = false
+		auth.TOTPLastStep = 0
+		auth.TOTPSecret = ""
+		msg = fmt.Sprintf("TOTP disabled for email: %s, by: %s", em, claims.Email)
+		status = http.StatusNoContent
+	case http.MethodPost:
+		if auth.TOTPEnabled {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		secret := make([]byte, totpSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			lpf(logh.Error, "rand.Read error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		auth.TOTPSecret = totpEncoding.EncodeToString(secret)
+		out = TOTPEnrollment{Secret: auth.TOTPSecret, URI: totpURI(em, auth.TOTPSecret)}
+		msg = fmt.Sprintf("TOTP enrollment started for email: %s", em)
+		status = http.StatusCreated
+	case http.MethodPut:
+		if auth.TOTPSecret == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !totpVerify(&auth, tr.Code, false) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		codes, hashes, err := totpRecoveryCodes()
+		if err != nil {
+			lpf(logh.Error, "totpRecoveryCodes error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		msg = fmt.Sprintf("TOTP recovery codes replaced for email: %s", em)
+		if !auth.TOTPEnabled {
+			msg = fmt.Sprintf("TOTP enabled for email: %s", em)
+		}
+		auth.RecoveryCodes = hashes
+		auth.TOTPEnabled = true
+		out = TOTPRecoveryCodes{RecoveryCodes: codes}
+	}
+
+	if err := authCreate(auth); err != nil {
+		lpf(logh.Error, "authCreate error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if aw, ok := w.(*AuditWriter); ok {
+		aw.Message = msg
+	}
+	if out == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, out)
+}
+
+// totpCode returns the TOTP code for the secret at the time step (RFC 4226 section 5.3).
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulus)
+}
+
+// totpRecoveryCodes returns new recovery codes, and the hashes of the codes for persisting.
+func totpRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, totpRecoveryCodeCount)
+	hashes := make([]string, totpRecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, runtimeh.SourceInfoError("", err)
+		}
+		codes[i] = hex.EncodeToString(b)
+		hashes[i] = totpRecoveryCodeHash(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// totpRecoveryCodeHash returns the hash of a recovery code, hex encoded.
+func totpRecoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// totpURI returns the otpauth URI for the secret; the Key Uri Format used by authenticator apps.
+func totpURI(email string, secret string) string {
+	label := url.PathEscape(config.AppName) + ":" + url.PathEscape(email)
+	q := url.Values{}
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("issuer", config.AppName)
+	q.Set("period", fmt.Sprint(totpPeriod))
+	q.Set("secret", secret)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// totpVerify returns true when code is a valid TOTP code for the auth, or when allowRecovery
+// is true an unused recovery code. Codes are accepted for one time step either side of the
+// current step, and each TOTP code and recovery code is accepted only once; auth is updated to
+// record that, and callers must persist it.
+func totpVerify(auth *authentication, code string, allowRecovery bool) bool {
+	code = strings.TrimSpace(code)
+	if code == "" || auth.TOTPSecret == "" {
+		return false
+	}
+	secret, err := totpEncoding.DecodeString(auth.TOTPSecret)
+	if err != nil {
+		lpf(logh.Error, "TOTP secret decode error:%v", err)
+		return false
+	}
+	step := time.Now().Unix() / totpPeriod
+	for s := step - totpStepsAllowedToSkew; s <= step+totpStepsAllowedToSkew; s++ {
+		if s <= auth.TOTPLastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			auth.TOTPLastStep = s
+			return true
+		}
+	}
+
+	if !allowRecovery {
+		return false
+	}
+	hash := totpRecoveryCodeHash(code)
+	for i, h := range auth.RecoveryCodes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			auth.RecoveryCodes = append(auth.RecoveryCodes[:i], auth.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTOTPCode verifies totpCode with the RFC 6238 appendix B test vectors for SHA1, truncated to
+// 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 20000000000: "353130"}
+	for unix, code := range tests {
+		if got := totpCode(secret, unix/totpPeriod); got != code {
+			t.Errorf("time: %d, code: %s, expected: %s", unix, got, code)
+		}
+	}
+}
+
+// TestTOTP verifies enrollment, login with TOTP and recovery codes, and the policy requiring
+// TOTP for elevated roles.
+func TestTOTP(t *testing.T) {
+	testSetup()
+	config.TOTPRequiredRole = RoleOperator
+
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+	totpServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTOTP)))
+	defer totpServer.Close()
+	operatorServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleOperator, handlerTest)))
+	defer operatorServer.Close()
+
+	em := "operator@auth.com"
+	credBytes, err := createAuth(t, em, []string{RoleOperator})
+	if err != nil {
+		return
+	}
+	token, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	// Without TOTP, the token has no roles.
+	if len(claims.Roles) != 0 {
+		t.Errorf("roles before TOTP enabled: %v", claims.Roles)
+		return
+	}
+	if status, _ := request(t, operatorServer.URL, http.MethodGet, token, nil); status != http.StatusForbidden {
+		t.Errorf("status before TOTP enabled: %d", status)
+		return
+	}
+
+	status, b := request(t, totpServer.URL, http.MethodPost, token, nil)
+	enrollment := TOTPEnrollment{}
+	if err := json.Unmarshal(b, &enrollment); status != http.StatusCreated || err != nil ||
+		!strings.HasPrefix(enrollment.URI, "otpauth://totp/auth:") || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Errorf("enroll status: %d, enrollment: %+v, error: %v", status, enrollment, err)
+		return
+	}
+	secret, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := time.Now().Unix() / totpPeriod
+
+	body, _ := json.Marshal(TOTPRequest{Code: "000000"})
+	if totpCode(secret, step) == "000000" {
+		body, _ = json.Marshal(TOTPRequest{Code: "111111"})
+	}
+	if status, _ := request(t, totpServer.URL, http.MethodPut, token, body); status != http.StatusBadRequest {
+		t.Errorf("confirm with bad code status: %d", status)
+		return
+	}
+	body, _ = json.Marshal(TOTPRequest{Code: totpCode(secret, step)})
+	status, b = request(t, totpServer.URL, http.MethodPut, token, body)
+	rc := TOTPRecoveryCodes{}
+	if err := json.Unmarshal(b, &rc); status != http.StatusOK || err != nil || len(rc.RecoveryCodes) != totpRecoveryCodeCount {
+		t.Errorf("confirm status: %d, recovery codes: %+v, error: %v", status, rc, err)
+		return
+	}
+	if auth, _ := authGet(em); !auth.TOTPEnabled || strings.Contains(strings.Join(auth.RecoveryCodes, ""), rc.RecoveryCodes[0]) {
+		t.Errorf("TOTP not enabled, or recovery codes not hashed: %+v", auth)
+		return
+	}
+
+	// Login requires the code once TOTP is enabled.
+	status, _ = request(t, loginServer.URL, http.MethodPut, nil, credBytes)
+	if status != http.StatusUnauthorized {
+		t.Errorf("login without code status: %d", status)
+		return
+	}
+	cred := Credential{}
+	if err := json.Unmarshal(credBytes, &cred); err != nil {
+		t.Errorf("Unmarshal error: %v", err)
+		return
+	}
+	// The code used to confirm cannot be replayed; the next step is within the skew.
+	cred.TOTP = totpCode(secret, step+1)
+	b, _ = json.Marshal(cred)
+	token, claims, err = login(t, b)
+	if err != nil {
+		return
+	}
+	if !claims.HasRole(RoleOperator) {
+		t.Errorf("roles after TOTP enabled: %v", claims.Roles)
+		return
+	}
+	cred.TOTP = rc.RecoveryCodes[0]
+	b, _ = json.Marshal(cred)
+	if _, _, err := login(t, b); err != nil {
+		return
+	}
+	if auth, _ := authGet(em); len(auth.RecoveryCodes) != totpRecoveryCodeCount-1 {
+		t.Errorf("recovery code not consumed, count: %d", len(auth.RecoveryCodes))
+		return
+	}
+
+	// Disable with a recovery code; a used code is rejected.
+	body, _ = json.Marshal(TOTPRequest{Code: rc.RecoveryCodes[0]})
+	if status, _ := request(t, totpServer.URL, http.MethodDelete, token, body); status != http.StatusBadRequest {
+		t.Errorf("disable with used recovery code status: %d", status)
+		return
+	}
+	body, _ = json.Marshal(TOTPRequest{Code: strings.ToUpper(rc.RecoveryCodes[1])})
+	if status, _ := request(t, totpServer.URL, http.MethodDelete, token, body); status != http.StatusNoContent {
+		t.Errorf("disable status: %d", status)
+		return
+	}
+	if auth, _ := authGet(em); auth.TOTPEnabled || auth.TOTPSecret != "" || auth.RecoveryCodes != nil {
+		t.Errorf("TOTP not disabled: %+v", auth)
+		return
+	}
+}
+
+// TestTOTPAdminDisable verifies an administrator can disable TOTP for another account, and
+// that password updates keep TOTP enabled.
+func TestTOTPAdminDisable(t *testing.T) {
+	testSetup()
+
+	totpServer := httptest.NewServer(http.HandlerFunc(HandlerFuncAuthJWTWrapper(handlerTOTP)))
+	defer totpServer.Close()
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	em := "user@auth.com"
+	if _, err := createAuth(t, em, nil); err != nil {
+		return
+	}
+	auth, _ := authGet(em)
+	auth.TOTPEnabled = true
+	auth.TOTPSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	if err := authCreate(auth); err != nil {
+		t.Errorf("authCreate error: %v", err)
+		return
+	}
+	if _, err := createAuth(t, em, nil); err != nil {
+		return
+	}
+	if auth, _ := authGet(em); !auth.TOTPEnabled {
+		t.Errorf("TOTP disabled by password update")
+		return
+	}
+
+	if status, _ := request(t, totpServer.URL+"?email="+em, http.MethodPost, adminToken, nil); status != http.StatusBadRequest {
+		t.Errorf("admin enroll other status: %d", status)
+		return
+	}
+	if status, _ := request(t, totpServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("admin disable status: %d", status)
+		return
+	}
+	if auth, _ := authGet(em); auth.TOTPEnabled {
+		t.Errorf("TOTP not disabled by admin")
+		return
+	}
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// User is an account as returned by PathUsers; the authentication without secrets.
+type User struct {
+	// Directory is true for accounts verified by Config.CredentialBackend.
+	Directory bool
+	Disabled  bool
+	Email     string
+	// LastLogin is the Unix (seconds) time of the last login; zero if the user has not logged in.
+	LastLogin int64
+	// PasswordChanged is the Unix (seconds) time the password was set; see
+	// PasswordPolicy.MaxAgeDays.
+	PasswordChanged       int64 `json:",omitempty"`
+	PasswordResetRequired bool
+	Roles                 []string
+	ServiceAccount        bool
+	Tenant                string `json:",omitempty"`
+	TOTPEnabled           bool
+}
+
+// UserPage is a page of Users, ordered by Email, returned by PathUsers.
+type UserPage struct {
+	// Next is the query parameter after for the next page; empty for the last page.
+	Next  string `json:",omitempty"`
+	Users []User
+}
+
+// UserRequest is the body for PathUsers. Fields that are nil are not changed.
+type UserRequest struct {
+	// Disabled true disables the account; login is rejected, and all tokens are revoked.
+	Disabled *bool
+	Email    *string
+	// PasswordResetRequired true requires the user to set a new password; all tokens are
+	// revoked, and tokens issued at login have no roles until the password is updated using
+	// PathCreateOrUpdate.
+	PasswordResetRequired *bool
+}
+
+const (
+	// PasswordResetRequiredHeader is set on the response to login when the user must set a new
+	// password; see UserRequest.PasswordResetRequired.
+	PasswordResetRequiredHeader = "Password-Reset-Required"
+
+	defaultUserPageLimit = 100
+	maxUserPageLimit     = 1000
+	queryParamAfter      = "after"
+	queryParamLimit      = "limit"
+)
+
+// handlerUsers is for administrators to list, get, update, and delete users. Requires RoleAdmin.
+// http.MethodDelete - delete the user with query parameter email; tokens, refresh tokens, and
+// API keys are revoked.
+// http.MethodGet - with query parameter email get the User, otherwise get a UserPage. Paging uses
+// query parameters limit (default 100, maximum 1000) and after, from UserPage.Next.
+// http.MethodPut - disable, enable, or require a password reset; the body is a UserRequest.
+func handlerUsers(w http.ResponseWriter, r *http.Request) {
+	claims, _ := ClaimsFromRequest(r)
+	switch r.Method {
+	case http.MethodDelete:
+		em := r.URL.Query().Get(queryParamEmail)
+		if claims != nil && em == claims.Email {
+			// Use PathDelete to delete your own account.
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		auth, err := authGet(em)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.Email == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, err := userRevoke(em)
+		if err != nil {
+			lpf(logh.Error, "userRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := apiKeysRevoke(func(ak apiKey) bool { return ak.Email == em }); err != nil {
+			lpf(logh.Error, "apiKeysRevoke error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := kvsAuth.Delete(em); err != nil {
+			lpf(logh.Error, "kvsAuth.Delete error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("user deleted, and %d tokens revoked, for email: %s", n, em)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if em := r.URL.Query().Get(queryParamEmail); em != "" {
+			auth, err := authGet(em)
+			if err != nil {
+				lpf(logh.Error, "authGet error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if auth.Email == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, userFromAuth(auth))
+			return
+		}
+		limit := defaultUserPageLimit
+		if l := r.URL.Query().Get(queryParamLimit); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxUserPageLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		page, err := usersList(r.URL.Query().Get(queryParamAfter), limit)
+		if err != nil {
+			lpf(logh.Error, "usersList error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	case http.MethodPut:
+		ur := UserRequest{}
+		if err := httph.BodyUnmarshal(w, r, &ur); err != nil {
+			lpf(logh.Error, "user update error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		if ur.Email == nil || (ur.Disabled == nil && ur.PasswordResetRequired == nil) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if claims != nil && *ur.Email == claims.Email {
+			// Administrators cannot lock themselves out.
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		auth, err := authGet(*ur.Email)
+		if err != nil {
+			lpf(logh.Error, "authGet error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if auth.Email == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if (auth.ServiceAccount || auth.Directory) && ur.PasswordResetRequired != nil {
+			// Service accounts, and directory accounts, do not have a password.
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		changes := []string{}
+		revoke := false
+		if ur.Disabled != nil && *ur.Disabled != auth.Disabled {
+			auth.Disabled = *ur.Disabled
+			revoke = revoke || auth.Disabled
+			changes = append(changes, fmt.Sprintf("disabled: %t", auth.Disabled))
+		}
+		if ur.PasswordResetRequired != nil && *ur.PasswordResetRequired != auth.PasswordResetRequired {
+			auth.PasswordResetRequired = *ur.PasswordResetRequired
+			revoke = revoke || auth.PasswordResetRequired
+			changes = append(changes, fmt.Sprintf("password reset required: %t", auth.PasswordResetRequired))
+		}
+		if err := authCreate(auth); err != nil {
+			lpf(logh.Error, "authCreate error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n := 0
+		if revoke {
+			if n, err = userRevoke(*ur.Email); err != nil {
+				lpf(logh.Error, "userRevoke error:%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if aw, ok := w.(*AuditWriter); ok {
+			aw.Message = fmt.Sprintf("user updated, %s, and %d tokens revoked, for email: %s",
+				strings.Join(changes, ", "), n, *ur.Email)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// userFromAuth returns the User for the authentication.
+func userFromAuth(auth authentication) User {
+	return User{Directory: auth.Directory, Disabled: auth.Disabled, Email: *auth.Email, LastLogin: auth.LastLogin,
+		PasswordChanged: auth.PasswordChanged, PasswordResetRequired: auth.PasswordResetRequired, Roles: auth.Roles,
+		ServiceAccount: auth.ServiceAccount, Tenant: auth.Tenant, TOTPEnabled: auth.TOTPEnabled}
+}
+
+// userRevoke revokes all tokens, and refresh tokens, issued to the email, in this service and in
+// services using Config.RevocationsURL. The count of revoked tokens is returned.
+func userRevoke(email string) (int, error) {
+	n, err := userTokens(email, true)
+	if err != nil {
+		return n, err
+	}
+	if err := subjectRevoke(email); err != nil {
+		return n, runtimeh.SourceInfoError("", err)
+	}
+	return n, nil
+}
+
+// usersList returns up to limit Users, ordered by Email, with Email greater than after.
+func usersList(after string, limit int) (UserPage, error) {
+	keys, err := kvsAuth.Keys()
+	if err != nil {
+		return UserPage{}, runtimeh.SourceInfoError("", err)
+	}
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+	page := UserPage{Users: []User{}}
+	for _, key := range keys[start:] {
+		if len(page.Users) == limit {
+			page.Next = page.Users[len(page.Users)-1].Email
+			break
+		}
+		auth, err := authGet(key)
+		if err != nil {
+			return UserPage{}, err
+		}
+		if auth.Email != nil {
+			page.Users = append(page.Users, userFromAuth(auth))
+		}
+	}
+	return page, nil
+}
+
+// userLoggedIn records the time of a successful login.
+func userLoggedIn(auth authentication) error {
+	auth.LastLogin = time.Now().Unix()
+	return authCreate(auth)
+}
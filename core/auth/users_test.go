@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestUsers verifies administrators can list, get, disable, enable, require a password reset
+// for, and delete users.
+func TestUsers(t *testing.T) {
+	testSetup()
+
+	usersServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleAdmin, handlerUsers)))
+	defer usersServer.Close()
+	loginServer := httptest.NewServer(http.HandlerFunc(HandlerFuncNoAuthWrapper(handlerLogin)))
+	defer loginServer.Close()
+	viewerServer := httptest.NewServer(http.HandlerFunc(HandlerFuncRoleWrapper(RoleViewer, handlerTest)))
+	defer viewerServer.Close()
+	updateServer := httptest.NewServer(http.HandlerFunc(handlerFuncAuthJWTWrapper(handlerCreateOrUpdate, true)))
+	defer updateServer.Close()
+
+	adminCred, err := createAuth(t, "admin@auth.com", []string{RoleAdmin})
+	if err != nil {
+		return
+	}
+	adminToken, _, err := login(t, adminCred)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := createAuth(t, fmt.Sprintf("user%d@auth.com", i), nil); err != nil {
+			return
+		}
+	}
+
+	// Page through the users.
+	emails := []string{}
+	after := ""
+	for pages := 0; pages < 10; pages++ {
+		status, b := request(t, usersServer.URL+"?limit=2&after="+after, http.MethodGet, adminToken, nil)
+		page := UserPage{}
+		if err := json.Unmarshal(b, &page); status != http.StatusOK || err != nil {
+			t.Errorf("list status: %d, error: %v", status, err)
+			return
+		}
+		for _, u := range page.Users {
+			emails = append(emails, u.Email)
+		}
+		if after = page.Next; after == "" {
+			break
+		}
+	}
+	if len(emails) != 5 || emails[0] != "admin@auth.com" || emails[4] != "user3@auth.com" {
+		t.Errorf("users: %v", emails)
+		return
+	}
+	if status, _ := request(t, usersServer.URL+"?limit=0", http.MethodGet, adminToken, nil); status != http.StatusBadRequest {
+		t.Errorf("bad limit status: %d", status)
+		return
+	}
+
+	em := "user0@auth.com"
+	credBytes, _ := json.Marshal(Credential{Email: &em, Password: strPtr("P@ssword1234")})
+	userToken, _, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	status, b := request(t, usersServer.URL+"?email="+em, http.MethodGet, adminToken, nil)
+	user := User{}
+	if err := json.Unmarshal(b, &user); status != http.StatusOK || err != nil || user.LastLogin == 0 {
+		t.Errorf("get status: %d, user: %+v, error: %v", status, user, err)
+		return
+	}
+
+	// Disable revokes tokens, and login is rejected.
+	disabled := true
+	body, _ := json.Marshal(UserRequest{Email: &em, Disabled: &disabled})
+	if status, _ := request(t, usersServer.URL, http.MethodPut, adminToken, body); status != http.StatusNoContent {
+		t.Errorf("disable status: %d", status)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, userToken, nil); status != http.StatusUnauthorized {
+		t.Errorf("disabled user token status: %d", status)
+		return
+	}
+	if status, _ := request(t, loginServer.URL, http.MethodPut, nil, credBytes); status != http.StatusForbidden {
+		t.Errorf("disabled user login status: %d", status)
+		return
+	}
+	disabled = false
+	body, _ = json.Marshal(UserRequest{Email: &em, Disabled: &disabled})
+	if status, _ := request(t, usersServer.URL, http.MethodPut, adminToken, body); status != http.StatusNoContent {
+		t.Errorf("enable status: %d", status)
+		return
+	}
+
+	// A required password reset gives tokens that can only set a new password.
+	reset := true
+	body, _ = json.Marshal(UserRequest{Email: &em, PasswordResetRequired: &reset})
+	if status, _ := request(t, usersServer.URL, http.MethodPut, adminToken, body); status != http.StatusNoContent {
+		t.Errorf("password reset status: %d", status)
+		return
+	}
+	userToken, claims, err := login(t, credBytes)
+	if err != nil {
+		return
+	}
+	if len(claims.Roles) != 0 || !claims.PasswordResetRequired {
+		t.Errorf("claims with password reset required: %+v", claims)
+		return
+	}
+	if status, _ := request(t, viewerServer.URL, http.MethodGet, userToken, nil); status != http.StatusForbidden {
+		t.Errorf("password reset required token status: %d", status)
+		return
+	}
+	if status, _ := request(t, updateServer.URL, http.MethodPut, userToken, credBytes); status != http.StatusBadRequest {
+		t.Errorf("password update to the same password status: %d", status)
+		return
+	}
+	newCred, _ := json.Marshal(Credential{Email: &em, Password: strPtr("N3w@ssword1234")})
+	if status, _ := request(t, updateServer.URL, http.MethodPut, userToken, newCred); status != http.StatusNoContent {
+		t.Errorf("password update status: %d", status)
+		return
+	}
+	if _, claims, err = login(t, newCred); err != nil {
+		return
+	}
+	if !claims.HasRole(RoleViewer) {
+		t.Errorf("roles after password reset: %v", claims.Roles)
+		return
+	}
+
+	// Administrators cannot disable or delete themselves.
+	admin := "admin@auth.com"
+	disabled = true
+	body, _ = json.Marshal(UserRequest{Email: &admin, Disabled: &disabled})
+	if status, _ := request(t, usersServer.URL, http.MethodPut, adminToken, body); status != http.StatusConflict {
+		t.Errorf("disable self status: %d", status)
+		return
+	}
+	if status, _ := request(t, usersServer.URL+"?email="+admin, http.MethodDelete, adminToken, nil); status != http.StatusConflict {
+		t.Errorf("delete self status: %d", status)
+		return
+	}
+	if status, _ := request(t, usersServer.URL+"?email="+em, http.MethodDelete, adminToken, nil); status != http.StatusNoContent {
+		t.Errorf("delete status: %d", status)
+		return
+	}
+	if status, _ := request(t, usersServer.URL+"?email="+em, http.MethodGet, adminToken, nil); status != http.StatusNotFound {
+		t.Errorf("get deleted status: %d", status)
+		return
+	}
+}
+
+// strPtr returns a pointer to s.
+func strPtr(s string) *string {
+	return &s
+}
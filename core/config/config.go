@@ -9,10 +9,11 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/paulfdunn/go-helper/databaseh/kvs"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/osh"
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/storage"
 )
 
 type Config struct {
@@ -28,11 +29,18 @@ type Config struct {
 	LogLevel *int `json:",omitempty"`
 	// PersistentDirectory - see CLI help for description.
 	PersistentDirectory *string `json:",omitempty"`
+	// SyslogAddress - see CLI help for description.
+	SyslogAddress *string `json:",omitempty"`
+	// SyslogNetwork - see CLI help for description.
+	SyslogNetwork *string `json:",omitempty"`
 
 	// Other - can be passed into Init.
 	// AppName is used to populate the Issuer field of the JWT Claims and will be used
 	// as the file name, prefix '.db', for the persistent data source.
 	AppName *string `json:",omitempty"`
+	// AuditLogFilepath is an output of calling Init and is the file path of the audit log;
+	// LogFilepath + ".audit", or blank for STDOUT.
+	AuditLogFilepath *string `json:",omitempty"`
 	// AuditLogName is the name used for the logh audit log; defaults to LogName + ".audit"
 	AuditLogName *string `json:",omitempty"`
 	// DataSourceIsNew is an output of calling Init and indicates that there was no file
@@ -54,7 +62,7 @@ var (
 	// DefaultConfig are the default configuration parameters. These come from flags or get
 	// set during Init.
 	DefaultConfig Config
-	configKVS     kvs.KVS
+	configKVS     storage.Store
 )
 
 // flags for CLI
@@ -66,15 +74,19 @@ var (
 	persistentDirectory = flag.String("persistent-directory", "", "Fully qualified path to directory for persisted data; default to directory of this executable.")
 	reset               = flag.Bool("reset", false, "Reset will remove all persisted data for this instance; "+
 		"includes user accounts, settings, log files, etc.")
+	syslogAddress = flag.String("syslog-address", "", "Syslog collector address to forward the logs to; host:port, "+
+		"or a socket path for unix/unixgram. Default (blank) does not forward.")
+	syslogNetwork = flag.String("syslog-network", "udp", "Syslog collector network; one of unix, unixgram, udp, tcp, tls.")
 )
 
 // Init initializes the configuration and logging for the application; calls flag.Parse().
 // Applicaitons should not call flag.Parse() as flag.Parse() can only be called once per application.
 // checkLogSize/maxLogSize - logh parameters for the application log.
 // checkLogSizeAudit/maxLogSizeAudit - logh parameters for the audit log.
-// filepathsToDeleteOnReset - fully qualified file paths for any files that need deleted on
+// filepathsToDeleteOnReset - file paths for any files, or directories, that need deleted on
 //
-//	application reset via CLI parameter. Uses Glob patterns.
+//	application reset via CLI parameter. Uses Glob patterns. Relative paths are relative to the
+//	persistent directory, as it is not known until the CLI parameters are parsed.
 //
 // The only required config inputs are: AppName (used to populate the Issuer field of the JWT
 // Claims) and LogName.
@@ -143,11 +155,14 @@ func Init(initConfig Config, checkLogSize int, maxLogSize int64,
 	}
 
 	logh.Map[*initConfig.LogName].Printf(logh.Info, "%s is starting....", *initConfig.LogName)
-	logh.Map[*initConfig.AuditLogName].Printf(logh.Audit, "%s is starting....", *initConfig.LogName)
+	// The audit chain is resumed from the existing audit log; do AFTER reset.
+	audit.Init(audit.Config{AuditLogFilepath: auditLogFilepath, AuditLogName: *initConfig.AuditLogName,
+		LogName: *initConfig.LogName})
+	audit.Printf("%s is starting....", *initConfig.LogName)
 	logh.Map[*initConfig.LogName].Printf(logh.Info, "logFilepath:%s", *logFilepath)
 	logh.Map[*initConfig.LogName].Printf(logh.Info, "auditLogFilepath:%s", auditLogFilepath)
 
-	initializeKVInstance(dataSourcePath)
+	initializeKVInstance(dataSourcePath, *initConfig.LogName)
 
 	DefaultConfig = initConfig
 	// CLI
@@ -155,9 +170,12 @@ func Init(initConfig Config, checkLogSize int, maxLogSize int64,
 	DefaultConfig.LogFilepath = logFilepath
 	DefaultConfig.LogLevel = logLevel
 	DefaultConfig.PersistentDirectory = persistentDirectory
+	DefaultConfig.SyslogAddress = syslogAddress
+	DefaultConfig.SyslogNetwork = syslogNetwork
 	DefaultConfig.DataSourcePath = &dataSourcePath
 	// Other
 	DefaultConfig.AppName = initConfig.AppName
+	DefaultConfig.AuditLogFilepath = &auditLogFilepath
 	DefaultConfig.AuditLogName = initConfig.AuditLogName
 	DefaultConfig.DataSourceIsNew = &dataSourceIsNew
 	DefaultConfig.LogName = initConfig.LogName
@@ -192,23 +210,29 @@ func Get() (Config, error) {
 }
 
 // resetIfRequested - delete all configuration and log data if reset == true.
-// filepathsToDeleteOnReset is a slice of glob patterns; all specified files will be deleted.
+// filepathsToDeleteOnReset is a slice of glob patterns; all specified files, and directories, will
+// be deleted. Relative patterns are relative to the directory of dataSourcePath.
 func resetIfRequested(reset bool, dataSourcePath string, filepathsToDeleteOnReset []string) error {
 	var errOut error
 	if reset {
-		// If the dataSourcePath is a file, delete it.
-		if _, err := os.Stat(dataSourcePath); err == nil {
-			err := os.Remove(dataSourcePath)
-			if err != nil {
-				errOut = fmt.Errorf("deleting file: %s, error: %v, prior errors: %v", dataSourcePath, err, errOut)
-			}
+		// Delete the dataSourcePath, including snapshots and quarantined data.
+		if err := storage.RemoveAll(dataSourcePath); err != nil {
+			errOut = fmt.Errorf("deleting file: %s, error: %v, prior errors: %v", dataSourcePath, err, errOut)
 		}
 
 		for _, v := range filepathsToDeleteOnReset {
-			err := osh.RemoveAllFiles(v)
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(filepath.Dir(dataSourcePath), v)
+			}
+			files, err := filepath.Glob(v)
 			if err != nil {
 				errOut = fmt.Errorf("deleting file: %s, error: %v, prior errors: %v", v, err, errOut)
 			}
+			for _, f := range files {
+				if err := os.RemoveAll(f); err != nil {
+					errOut = fmt.Errorf("deleting file: %s, error: %v, prior errors: %v", f, err, errOut)
+				}
+			}
 		}
 
 		if *logFilepath != "" {
@@ -222,10 +246,24 @@ func resetIfRequested(reset bool, dataSourcePath string, filepathsToDeleteOnRese
 }
 
 // initializeKVInstance - Initialize the KVS
-func initializeKVInstance(dataSourcePath string) {
+func initializeKVInstance(dataSourcePath string, logName string) {
 	var err error
 	// The KVS table name and key will both use configKey.
-	if configKVS, err = kvs.New(dataSourcePath, configKey); err != nil {
-		log.Fatalf("fatal: %s could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	// The data source is checked for integrity; an unreadable configuration is quarantined and
+	// restored from a snapshot, or the defaults are used, rather than failing to start.
+	validate := func(key string, value []byte) error {
+		return json.Unmarshal(value, &Config{})
+	}
+	var rcv storage.Recovery
+	configKVS, rcv, err = storage.OpenChecked(dataSourcePath, configKey,
+		storage.RecoveryConfig{LogName: logName, Validate: validate})
+	if err != nil {
+		log.Fatalf("fatal: %s could not open storage, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if rcv.Changed() {
+		logh.Map[logName].Printf(logh.Error, "configuration recovered: %s", rcv)
+		audit.Printf("configuration recovered: %s", rcv)
+	} else {
+		logh.Map[logName].Printf(logh.Info, "configuration integrity check passed: %s", rcv)
 	}
 }
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"log"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
 )
 
 var (
@@ -14,6 +18,11 @@ func init() {
 	t := testing.T{}
 	testDir := t.TempDir()
 	dataSourcePath = filepath.Join(testDir, "test.db")
+
+	// log to STDOUT
+	if err := logh.New("test", "", logh.DefaultLevels, logh.Info, logh.DefaultFlags, 0, 0); err != nil {
+		log.Fatalf("fatal: %s error creating log, error: %v", runtimeh.SourceInfo(), err)
+	}
 }
 
 func TestSetGetDelete(t *testing.T) {
@@ -21,7 +30,7 @@ func TestSetGetDelete(t *testing.T) {
 		t.Errorf("testSetup error: %+v", err)
 	}
 
-	initializeKVInstance(dataSourcePath)
+	initializeKVInstance(dataSourcePath, "test")
 	value, err := configKVS.Get(configKey)
 	if !(value == nil && err == nil) {
 		t.Error("Get to empty config should produce nil data and error.")
@@ -98,6 +107,14 @@ func TestReset(t *testing.T) {
 		return
 	}
 
+	// Relative patterns are relative to the directory of dataSourcePath, and directories are
+	// deleted.
+	killDir := filepath.Join(filepath.Dir(dataSourcePath), "kill.dir")
+	if err := os.MkdirAll(filepath.Join(killDir, "sub"), 0755); err != nil {
+		t.Errorf("os.MkdirAll error:%+v", err)
+		return
+	}
+
 	// Test deleting logs.
 	lfp := filepath.Join(t.TempDir(), "kill.me.log")
 	logFilepath = &lfp
@@ -118,7 +135,7 @@ func TestReset(t *testing.T) {
 		return
 	}
 
-	if err := resetIfRequested(true, dataSourcePath, []string{killFileBase + "*"}); err != nil {
+	if err := resetIfRequested(true, dataSourcePath, []string{killFileBase + "*", "kill.dir"}); err != nil {
 		t.Errorf("resetIfRequested error: %v", err)
 		return
 	}
@@ -131,6 +148,10 @@ func TestReset(t *testing.T) {
 		t.Error("test delete file was not deleted")
 		return
 	}
+	if _, err := os.Stat(killDir); err == nil {
+		t.Error("test delete directory was not deleted")
+		return
+	}
 	if _, err := os.Stat(lfp0); err == nil {
 		t.Error("test delete log.0 was not deleted")
 		return
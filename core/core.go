@@ -1,18 +1,28 @@
 // Package core provides core functionality used across any apps you create with rest-app.
-// Call ConfigInit to initialize the application configuration, OtherInit to initialize
-// any other provided functionality, then call blocking function ListenAndServeTLS
-// to start serving your API.
+// Call ConfigInit to initialize the application configuration, optionally SyslogInit to forward
+// the logs to a syslog collector, OtherInit to initialize any other provided functionality,
+// optionally LogAPIInit to serve the logs to administrators and AuditCheckpointInit to sign the
+// audit log, then call blocking function ListenAndServeTLS to start serving your API. Shutdown is
+// called when ListenAndServeTLS returns.
 package core
 
 import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
-	"github.com/paulfdunn/authjwt"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/auth"
 	"github.com/paulfdunn/rest-app/core/config"
+	"github.com/paulfdunn/rest-app/core/logs"
+	"github.com/paulfdunn/rest-app/core/syslog"
 )
 
 // Add defaults can be changed  prior to calling ConfigInit
@@ -23,6 +33,19 @@ var (
 	MaxLogSizeAudit   = int64(2e6)
 )
 
+const (
+	pathAuditVerify = "/logs/audit/verify/"
+)
+
+var (
+	// auditCheckpointStop is set by AuditCheckpointInit.
+	auditCheckpointStop func()
+	// authConfig is the configuration provided to OtherInit.
+	authConfig *auth.Config
+	// syslogSink is set by SyslogInit, and closed by Shutdown.
+	syslogSink *syslog.Sink
+)
+
 // ConfigInit initializes the configuration. It is separate from OtherInit as some configuration
 // may be required prior to calling other Init functions.
 func ConfigInit(cnfg config.Config, filepathsToDeleteOnReset []string) {
@@ -31,9 +54,10 @@ func ConfigInit(cnfg config.Config, filepathsToDeleteOnReset []string) {
 }
 
 // OtherInit calls all required Init functions. Note that authentication is entirely optional.
-func OtherInit(authConfig *authjwt.Config, mux *http.ServeMux, initialCred *authjwt.Credential) {
+func OtherInit(authConfigIn *auth.Config, mux *http.ServeMux, initialCred *auth.Credential) {
+	authConfig = authConfigIn
 	if authConfig != nil {
-		authjwt.Init(*authConfig, mux)
+		auth.Init(*authConfig, mux)
 	}
 
 	if initialCred != nil {
@@ -43,6 +67,83 @@ func OtherInit(authConfig *authjwt.Config, mux *http.ServeMux, initialCred *auth
 	}
 }
 
+// LogAPIInit registers the core/logs handlers, which allow administrators to list, tail, stream,
+// and download the application and audit logs, and the audit log verification handler. Must be called
+// after ConfigInit and OtherInit, and requires authentication be configured in OtherInit. The
+// handlers require auth.RoleAdmin.
+func LogAPIInit(mux *http.ServeMux) {
+	if authConfig == nil {
+		log.Fatalf("fatal: %s authentication is required for the log API", runtimeh.SourceInfo())
+	}
+	cnfg := logs.Config{LogName: *config.DefaultConfig.LogName}
+	if config.DefaultConfig.LogFilepath != nil {
+		cnfg.LogFilepath = *config.DefaultConfig.LogFilepath
+	}
+	if config.DefaultConfig.AuditLogFilepath != nil {
+		cnfg.AuditLogFilepath = *config.DefaultConfig.AuditLogFilepath
+	}
+	adminWrapper := func(hf func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return auth.HandlerFuncRoleWrapper(auth.RoleAdmin, hf)
+	}
+	logs.Init(cnfg, mux, adminWrapper)
+	mux.HandleFunc(pathAuditVerify, adminWrapper(audit.HandlerVerify))
+	logh.Map[cnfg.LogName].Printf(logh.Info, "Registered handler: %s\n", pathAuditVerify)
+}
+
+// AuditCheckpointInit enables signed checkpoints in the audit log, using the PKCS8 RSA private
+// key at keyFilepath. Use a key dedicated to the audit log, not the TLS or JWT keys; those are
+// rotated, while the public key of the audit key is needed to verify checkpoints for as long as
+// the audit log is kept. Must be called after ConfigInit.
+func AuditCheckpointInit(keyFilepath string) {
+	b, err := os.ReadFile(keyFilepath)
+	if err != nil {
+		log.Fatalf("fatal: %s could not read key from path: %s, error: %v", runtimeh.SourceInfo(), keyFilepath, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		log.Fatalf("fatal: %s no PEM data in key: %s", runtimeh.SourceInfo(), keyFilepath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatalf("fatal: %s x509.ParsePKCS8PrivateKey error: %v", runtimeh.SourceInfo(), err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		log.Fatalf("fatal: %s key is not an RSA key: %s", runtimeh.SourceInfo(), keyFilepath)
+	}
+	auditCheckpointStop = audit.CheckpointInit(rsaKey)
+}
+
+// SyslogInit forwards the application and audit logs to the syslog collector configured by CLI
+// parameters; does nothing when no collector is configured. tlsConfig is used for the tls network,
+// and may be nil to use the system roots. Must be called after ConfigInit; logs written to STDOUT
+// cannot be forwarded. Forwarding stops at Shutdown.
+func SyslogInit(tlsConfig *tls.Config) {
+	cnfg := config.DefaultConfig
+	if cnfg.SyslogAddress == nil || *cnfg.SyslogAddress == "" {
+		return
+	}
+	if cnfg.LogFilepath == nil || *cnfg.LogFilepath == "" {
+		logh.Map[*cnfg.LogName].Printf(logh.Error, "syslog forwarding requires a log file path, logs are not forwarded")
+		return
+	}
+	var err error
+	syslogSink, err = syslog.New(syslog.Config{
+		Address:          *cnfg.SyslogAddress,
+		AppName:          *cnfg.AppName,
+		AuditLogFilepath: *cnfg.AuditLogFilepath,
+		LogFilepath:      *cnfg.LogFilepath,
+		LogName:          *cnfg.LogName,
+		Network:          *cnfg.SyslogNetwork,
+		TLSConfig:        tlsConfig,
+	})
+	if err != nil {
+		log.Fatalf("fatal: %s syslog.New error: %v", runtimeh.SourceInfo(), err)
+	}
+	logh.Map[*cnfg.LogName].Printf(logh.Info, "forwarding logs to syslog, network: %s, address: %s",
+		*cnfg.SyslogNetwork, *cnfg.SyslogAddress)
+}
+
 // ListenAndServeTLS IS A BLOCKING FUNCTION that starts the HTTP server.
 func ListenAndServeTLS(logName string, mux *http.ServeMux, port string, readTimeout time.Duration, writeTimeout time.Duration,
 	certFilepath string, keyFilepath string) {
@@ -56,4 +157,20 @@ func ListenAndServeTLS(logName string, mux *http.ServeMux, port string, readTime
 
 	logh.Map[logName].Printf(logh.Error, "ListenAndServeTLS error: %v",
 		server.ListenAndServeTLS(certFilepath, keyFilepath))
+	Shutdown()
+}
+
+// Shutdown stops the background work started by the Init functions; I.E. audit log checkpoints
+// (a checkpoint is written for any new records) and syslog forwarding. Called by
+// ListenAndServeTLS when the server returns; call it before exiting when ListenAndServeTLS is
+// not used.
+func Shutdown() {
+	if auditCheckpointStop != nil {
+		auditCheckpointStop()
+		auditCheckpointStop = nil
+	}
+	if syslogSink != nil {
+		syslogSink.Close()
+		syslogSink = nil
+	}
 }
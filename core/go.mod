@@ -3,15 +3,18 @@ module github.com/paulfdunn/rest-app/core
 go 1.21.8
 
 require (
-	github.com/paulfdunn/authjwt v1.3.0
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/paulfdunn/go-helper/databaseh v1.8.3
 	github.com/paulfdunn/go-helper/logh v1.8.3
+	github.com/paulfdunn/go-helper/neth v1.8.3
 	github.com/paulfdunn/go-helper/osh v1.8.3
+	golang.org/x/crypto v0.22.0
 )
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/uuid v1.3.1 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22 // indirect
-	github.com/paulfdunn/go-helper/neth v1.8.3 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
 )
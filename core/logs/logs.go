@@ -0,0 +1,654 @@
+// Package logs provides handlers to retrieve the application and audit logs without shell access.
+// Callers can list the log files, tail the logs with level, time range, and regex filters,
+// stream new lines as they are written, and download all rotated files in a ZIP file.
+// The handlers expose potentially sensitive data; wrap them so only administrators have access.
+package logs
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+type Config struct {
+	// AuditLogFilepath is the logh file path of the audit log; rotations add a suffix .0, .1
+	AuditLogFilepath string
+	// LogFilepath is the logh file path of the application log; rotations add a suffix .0, .1
+	LogFilepath string
+	// LogName is the name of the logh logger for general logging.
+	LogName string
+}
+
+// File is returned when listing log files.
+type File struct {
+	// Log is one of LogApp or LogAudit.
+	Log     string
+	ModTime time.Time
+	Name    string
+	Size    int64
+}
+
+// filter is used to select records from a log. Zero values do not filter. Records without a
+// logh prefix cannot be filtered by level or time and are only filtered by regex.
+type filter struct {
+	// level is the minimum logh.LoghLevel of returned records, when levelSet is true.
+	level    logh.LoghLevel
+	levelSet bool
+	regex    *regexp.Regexp
+	since    time.Time
+	until    time.Time
+}
+
+// record is a single log entry; the first line has the logh prefix, and any following lines
+// (a message with embedded new lines) are part of the same record.
+type record struct {
+	level logh.LoghLevel
+	// parsed is true when the first line had a valid logh prefix
+	parsed bool
+	text   string
+	time   time.Time
+}
+
+const (
+	// LogApp and LogAudit are the values for queryParamLog.
+	LogApp   = "app"
+	LogAudit = "audit"
+
+	PathDownload = "/logs/download/"
+	PathFiles    = "/logs/files/"
+	PathStream   = "/logs/stream/"
+	PathTail     = "/logs/tail/"
+
+	queryParamLevel = "level"
+	queryParamLines = "lines"
+	queryParamLog   = "log"
+	queryParamRegex = "regex"
+	queryParamSince = "since"
+	queryParamUntil = "until"
+
+	// logh writes the time using these flags: log.LUTC | log.Ltime | log.Lmicroseconds | log.Ldate
+	loghTimeFormat = "2006/01/02 15:04:05.000000"
+	// queryTimeFormat is the format for since/until; UTC, 24 hour notation.
+	queryTimeFormat = "2006-01-02 15:04:05"
+
+	defaultTailLines = 100
+	maxTailLines     = 10000
+)
+
+var (
+	config Config
+
+	lpf func(level logh.LoghLevel, format string, v ...interface{})
+
+	// loghRecordStart matches the prefix logh writes with logh.DefaultFlags; I.E.
+	// "2024/03/25 18:30:00.123456 file.go:123:    info: message"
+	loghRecordStart = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6}) \S+:\d+: +(\w+): `)
+
+	// streamPollInterval is how often the log file is checked for new data while streaming.
+	streamPollInterval = 500 * time.Millisecond
+)
+
+// Init registers the handlers. wrapper is applied to every handler and must enforce that the caller
+// is an administrator.
+func Init(configIn Config, mux *http.ServeMux, wrapper func(func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request)) {
+	config = configIn
+	lpf = logh.Map[config.LogName].Printf
+
+	for path, handler := range map[string]func(http.ResponseWriter, *http.Request){
+		PathDownload: handlerDownload,
+		PathFiles:    handlerFiles,
+		PathStream:   handlerStream,
+		PathTail:     handlerTail,
+	} {
+		mux.HandleFunc(path, wrapper(handler))
+		lpf(logh.Info, "Registered handler: %s\n", path)
+	}
+}
+
+// handlerDownload
+// http.MethodGet - download a ZIP file of all rotations of the log specified with queryParamLog;
+// if queryParamLog is not provided, both the application and audit logs are included.
+func handlerDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	logs := []string{LogApp, LogAudit}
+	if lg := r.URL.Query().Get(queryParamLog); lg != "" {
+		logs = []string{lg}
+	}
+	var files []File
+	for _, lg := range logs {
+		fls, err := logFiles(lg)
+		if err != nil {
+			lpf(logh.Error, "logFiles error:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		files = append(files, fls...)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=logs.zip")
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		if err := zipAdd(zw, file.Name); err != nil {
+			lpf(logh.Error, "zipAdd error:%v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		lpf(logh.Error, "zip Close error:%v", err)
+	}
+}
+
+// handlerFiles
+// http.MethodGet - list all application and audit log files.
+func handlerFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	files := []File{}
+	for _, lg := range []string{LogApp, LogAudit} {
+		fls, err := logFiles(lg)
+		if err != nil {
+			lpf(logh.Error, "logFiles error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		files = append(files, fls...)
+	}
+
+	b, err := json.Marshal(files)
+	if err != nil {
+		lpf(logh.Error, "json.Marshal error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(b); err != nil {
+		lpf(logh.Error, "w.Write error:%v", err)
+	}
+}
+
+// handlerStream
+// http.MethodGet - stream records, as they are written, from the log specified with queryParamLog.
+// queryParamLevel and queryParamRegex filter the records. The response continues until the
+// caller closes the connection.
+func handlerStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fp, flt, err := logAndFilterFromQuery(r)
+	if err != nil {
+		lpf(logh.Error, "logAndFilterFromQuery error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Position prior to writing the header, so the caller gets all records written after the
+	// response starts.
+	flw := newFollower(fp)
+
+	// The server WriteTimeout would end the stream; remove the deadline for this response.
+	// The http.ResponseController needs the http.ResponseWriter provided by the server, not any
+	// wrapper, so unwrap to that writer.
+	rc := http.NewResponseController(unwrap(w))
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		lpf(logh.Warning, "SetWriteDeadline error:%v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		lpf(logh.Error, "Flush error:%v", err)
+		return
+	}
+
+	err = flw.follow(r.Context().Done(), func(rcd string) error {
+		if !flt.match(parseRecord(rcd)) {
+			return nil
+		}
+		if _, err := w.Write([]byte(rcd)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil {
+		lpf(logh.Info, "stream ended, error:%v", err)
+	}
+}
+
+// handlerTail
+// http.MethodGet - return the last queryParamLines records from the log specified with
+// queryParamLog, after filtering with queryParamLevel, queryParamRegex, queryParamSince,
+// and queryParamUntil.
+func handlerTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fp, flt, err := logAndFilterFromQuery(r)
+	if err != nil {
+		lpf(logh.Error, "logAndFilterFromQuery error:%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lines := defaultTailLines
+	if ls := r.URL.Query().Get(queryParamLines); ls != "" {
+		if lines, err = strconv.Atoi(ls); err != nil || lines <= 0 || lines > maxTailLines {
+			lpf(logh.Error, "invalid %s: %s", queryParamLines, ls)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	files, err := Rotations(fp)
+	if err != nil {
+		lpf(logh.Error, "Rotations error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	records, err := tail(files, lines, flt)
+	if err != nil {
+		lpf(logh.Error, "tail error:%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, rcd := range records {
+		if _, err = w.Write([]byte(rcd.text)); err != nil {
+			lpf(logh.Error, "w.Write error:%v", err)
+			return
+		}
+	}
+}
+
+// Follow calls fn with each record appended to the logh log at logFilepath, following the
+// log through rotations, until done is closed or fn returns an error. Only records written
+// after Follow is called are provided.
+func Follow(done <-chan struct{}, logFilepath string, fn func(rcd string) error) error {
+	return newFollower(logFilepath).follow(done, fn)
+}
+
+// follower keeps the position in a logh log while following it.
+type follower struct {
+	current     string
+	logFilepath string
+	offset      int64
+	pending     string
+}
+
+// newFollower returns a follower positioned at the end of the newest rotation of logFilepath.
+func newFollower(logFilepath string) *follower {
+	flw := follower{logFilepath: logFilepath}
+	if files, err := Rotations(logFilepath); err == nil && len(files) > 0 {
+		flw.current = files[len(files)-1]
+		if fi, err := os.Stat(flw.current); err == nil {
+			flw.offset = fi.Size()
+		}
+	}
+	return &flw
+}
+
+// follow - see Follow.
+func (flw *follower) follow(done <-chan struct{}, fn func(rcd string) error) error {
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
+		files, err := Rotations(flw.logFilepath)
+		if err != nil {
+			return err
+		}
+		newest := ""
+		if len(files) > 0 {
+			newest = files[len(files)-1]
+		}
+
+		if flw.current != "" {
+			fi, err := os.Stat(flw.current)
+			if err != nil || fi.Size() < flw.offset {
+				// The file was removed or truncated by rotation; start again from the beginning.
+				flw.offset = 0
+			}
+			if err == nil {
+				var b []byte
+				if b, flw.offset, err = readFrom(flw.current, flw.offset); err != nil {
+					return err
+				}
+				var rcds []string
+				rcds, flw.pending = splitRecords(flw.pending + string(b))
+				// logh writes each record with a single write, so when nothing new was written
+				// a pending record ending in a new line is complete.
+				if len(b) == 0 && strings.HasSuffix(flw.pending, "\n") {
+					rcds = append(rcds, flw.pending)
+					flw.pending = ""
+				}
+				for _, rcd := range rcds {
+					if err := fn(rcd); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if newest != flw.current {
+			// logh rotated to a new file; anything pending from the prior file is complete.
+			if flw.pending != "" {
+				if err := fn(flw.pending); err != nil {
+					return err
+				}
+				flw.pending = ""
+			}
+			flw.current = newest
+			flw.offset = 0
+			continue
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// logFiles returns the existing files for log, where log is LogApp or LogAudit.
+func logFiles(log string) ([]File, error) {
+	fp, err := logFilepath(log)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := Rotations(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(paths))
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		files = append(files, File{Log: log, ModTime: fi.ModTime().UTC(), Name: p, Size: fi.Size()})
+	}
+	return files, nil
+}
+
+// logFilepath returns the logh file path for the log, where log is LogApp or LogAudit.
+func logFilepath(log string) (string, error) {
+	var fp string
+	switch log {
+	case LogApp:
+		fp = config.LogFilepath
+	case LogAudit:
+		fp = config.AuditLogFilepath
+	default:
+		return "", fmt.Errorf("%s invalid log: %s", runtimeh.SourceInfo(), log)
+	}
+	if fp == "" {
+		return "", fmt.Errorf("%s log %s is written to STDOUT; there are no files", runtimeh.SourceInfo(), log)
+	}
+	return fp, nil
+}
+
+// logAndFilterFromQuery returns the log file path and filter from the request query parameters.
+func logAndFilterFromQuery(r *http.Request) (string, filter, error) {
+	query := r.URL.Query()
+	lg := query.Get(queryParamLog)
+	if lg == "" {
+		lg = LogApp
+	}
+	fp, err := logFilepath(lg)
+	if err != nil {
+		return "", filter{}, err
+	}
+
+	flt := filter{}
+	if lvl := query.Get(queryParamLevel); lvl != "" {
+		i := slices.Index(logh.DefaultLevels, strings.ToLower(lvl))
+		if i < 0 {
+			return "", filter{}, fmt.Errorf("%s invalid level: %s", runtimeh.SourceInfo(), lvl)
+		}
+		flt.level = logh.LoghLevel(i)
+		flt.levelSet = true
+	}
+	if rgx := query.Get(queryParamRegex); rgx != "" {
+		if flt.regex, err = regexp.Compile(rgx); err != nil {
+			return "", filter{}, runtimeh.SourceInfoError("regex", err)
+		}
+	}
+	if snc := query.Get(queryParamSince); snc != "" {
+		if flt.since, err = time.Parse(queryTimeFormat, snc); err != nil {
+			return "", filter{}, runtimeh.SourceInfoError("since", err)
+		}
+	}
+	if utl := query.Get(queryParamUntil); utl != "" {
+		if flt.until, err = time.Parse(queryTimeFormat, utl); err != nil {
+			return "", filter{}, runtimeh.SourceInfoError("until", err)
+		}
+	}
+	return fp, flt, nil
+}
+
+// match returns true if the record passes the filter.
+func (flt filter) match(rcd record) bool {
+	if flt.levelSet && rcd.parsed && rcd.level < flt.level {
+		return false
+	}
+	if !flt.since.IsZero() && rcd.parsed && rcd.time.Before(flt.since) {
+		return false
+	}
+	if !flt.until.IsZero() && rcd.parsed && rcd.time.After(flt.until) {
+		return false
+	}
+	if flt.regex != nil && !flt.regex.MatchString(rcd.text) {
+		return false
+	}
+	return true
+}
+
+// ParseRecord parses the time and level from the logh prefix of a record, as provided by Follow;
+// ok is false when the record does not have a logh prefix.
+func ParseRecord(text string) (level logh.LoghLevel, tm time.Time, ok bool) {
+	rcd := parseRecord(text)
+	return rcd.level, rcd.time, rcd.parsed
+}
+
+// parseRecord parses the time and level from the logh prefix of a record.
+func parseRecord(text string) record {
+	rcd := record{text: text}
+	m := loghRecordStart.FindStringSubmatch(text)
+	if m == nil {
+		return rcd
+	}
+	tm, err := time.Parse(loghTimeFormat, m[1])
+	if err != nil {
+		return rcd
+	}
+	lvl := slices.Index(logh.DefaultLevels, m[2])
+	if lvl < 0 {
+		return rcd
+	}
+	rcd.level = logh.LoghLevel(lvl)
+	rcd.parsed = true
+	rcd.time = tm
+	return rcd
+}
+
+// readFrom returns the data in the file at path starting at offset, and the new offset.
+func readFrom(path string, offset int64) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, runtimeh.SourceInfoError("", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, runtimeh.SourceInfoError("", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, runtimeh.SourceInfoError("", err)
+	}
+	return b, offset + int64(len(b)), nil
+}
+
+// Rotations returns the existing logh rotations for logFilepath, oldest first.
+func Rotations(logFilepath string) ([]string, error) {
+	paths, err := filepath.Glob(logFilepath + ".[0-9]*")
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	rotationSuffix := regexp.MustCompile(`\.[0-9]+$`)
+	type pathTime struct {
+		path    string
+		modTime time.Time
+	}
+	pts := make([]pathTime, 0, len(paths))
+	for _, p := range paths {
+		// Only the logh rotations, not other logs sharing the prefix; I.E. LOG.audit.0 for LOG
+		if strings.TrimSuffix(p, rotationSuffix.FindString(p)) != logFilepath {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		pts = append(pts, pathTime{p, fi.ModTime()})
+	}
+	sort.SliceStable(pts, func(i, j int) bool { return pts[i].modTime.Before(pts[j].modTime) })
+
+	out := make([]string, len(pts))
+	for i := range pts {
+		out[i] = pts[i].path
+	}
+	return out, nil
+}
+
+// splitRecords splits data into complete records. A record starts with a logh prefix and
+// continues until the next logh prefix. The last record is incomplete, as more lines may follow,
+// and is returned as pending.
+func splitRecords(data string) (records []string, pending string) {
+	lines := strings.SplitAfter(data, "\n")
+	current := ""
+	for _, line := range lines {
+		if !strings.HasSuffix(line, "\n") {
+			// Partial line; wait for the rest.
+			pending = current + line
+			return records, pending
+		}
+		if loghRecordStart.MatchString(line) && current != "" {
+			records = append(records, current)
+			current = ""
+		}
+		current += line
+	}
+	return records, current
+}
+
+// tail returns the last n records, after filtering, from files.
+func tail(files []string, n int, flt filter) ([]record, error) {
+	ring := make([]record, 0, n)
+	add := func(text string) {
+		rcd := parseRecord(text)
+		if !flt.match(rcd) {
+			return
+		}
+		if len(ring) == n {
+			ring = ring[1:]
+		}
+		ring = append(ring, rcd)
+	}
+
+	for _, fp := range files {
+		f, err := os.Open(fp)
+		if err != nil {
+			return nil, runtimeh.SourceInfoError("", err)
+		}
+		rdr := bufio.NewReader(f)
+		current := ""
+		for {
+			line, err := rdr.ReadString('\n')
+			if line != "" {
+				if loghRecordStart.MatchString(line) && current != "" {
+					add(current)
+					current = ""
+				}
+				current += line
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, runtimeh.SourceInfoError("", err)
+			}
+		}
+		if current != "" {
+			add(current)
+		}
+		f.Close()
+	}
+	return ring, nil
+}
+
+// unwrap returns the http.ResponseWriter provided by the server, removing any wrappers.
+func unwrap(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		switch ww := w.(type) {
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = ww.Unwrap()
+		default:
+			return w
+		}
+	}
+}
+
+// zipAdd adds the file at path to the zip.
+func zipAdd(zw *zip.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	hdr.Method = zip.Deflate
+	zf, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	_, err = io.Copy(zf, f)
+	return runtimeh.SourceInfoError("", err)
+}
@@ -0,0 +1,224 @@
+package logs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+var (
+	testAppLog   string
+	testAuditLog string
+)
+
+func init() {
+	t := testing.T{}
+	testDir := t.TempDir()
+	testAppLog = filepath.Join(testDir, "test.log")
+	testAuditLog = testAppLog + ".audit"
+
+	err := logh.New("test", testAppLog, logh.DefaultLevels, logh.Debug, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating log, error: %v", runtimeh.SourceInfo(), err)
+	}
+	err = logh.New("test.audit", testAuditLog, logh.DefaultLevels, logh.Audit, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating audit log, error: %v", runtimeh.SourceInfo(), err)
+	}
+
+	// No authentication for testing.
+	noAuth := func(hf func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		return hf
+	}
+	Init(Config{AuditLogFilepath: testAuditLog, LogFilepath: testAppLog, LogName: "test"}, http.NewServeMux(), noAuth)
+	streamPollInterval = 10 * time.Millisecond
+}
+
+func Example_parseRecord() {
+	for _, rcd := range []string{
+		"2024/03/25 18:30:00.123456 logs.go:12:    info: first\n",
+		"2024/03/25 18:30:01.123456 logs.go:13: warning: second\nwith a second line\n",
+		"no prefix\n",
+	} {
+		r := parseRecord(rcd)
+		if !r.parsed {
+			fmt.Println("not parsed")
+			continue
+		}
+		fmt.Printf("level: %s, time: %s\n", logh.DefaultLevels[r.level], r.time.Format(queryTimeFormat))
+	}
+
+	// Output:
+	// level: info, time: 2024-03-25 18:30:00
+	// level: warning, time: 2024-03-25 18:30:01
+	// not parsed
+}
+
+func TestSplitRecords(t *testing.T) {
+	data := "2024/03/25 18:30:00.123456 logs.go:12:    info: first\n" +
+		"2024/03/25 18:30:01.123456 logs.go:13: warning: second\nwith a second line\n" +
+		"2024/03/25 18:30:02.123456 logs.go:14:   error: third\n" +
+		"2024/03/25 18:30:03.123456 logs.go:15:   error: partial"
+	records, pending := splitRecords(data)
+	if len(records) != 2 {
+		t.Errorf("wrong number of records: %d, records: %+v", len(records), records)
+	}
+	if !strings.HasSuffix(records[1], "with a second line\n") {
+		t.Errorf("continuation line not included in record: %s", records[1])
+	}
+	if !strings.HasPrefix(pending, "2024/03/25 18:30:02") || !strings.HasSuffix(pending, "partial") {
+		t.Errorf("wrong pending: %s", pending)
+	}
+}
+
+// TestTail writes records at each level then validates tail with level, regex, and line count filters.
+func TestTail(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(handlerTail))
+	defer testServer.Close()
+
+	// A unique marker so records from prior runs, with -count, are not matched.
+	marker := fmt.Sprintf("TestTail%d", time.Now().UnixNano())
+	for i := 0; i < 5; i++ {
+		for lvl := range logh.DefaultLevels {
+			logh.Map["test"].Printf(logh.LoghLevel(lvl), "%s %d", marker, i)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		count  int
+	}{
+		{"?regex=" + marker, http.StatusOK, 25},
+		{"?regex=" + marker + "&lines=3", http.StatusOK, 3},
+		{"?regex=" + marker + "&level=audit", http.StatusOK, 10},
+		{"?regex=" + marker + "%204&level=error", http.StatusOK, 1},
+		{"?regex=" + marker + "&until=2000-01-01%2000:00:00", http.StatusOK, 0},
+		{"?regex=" + marker + "&since=2000-01-01%2000:00:00", http.StatusOK, 25},
+		{"?level=notalevel", http.StatusBadRequest, 0},
+		{"?log=notalog", http.StatusBadRequest, 0},
+		{"?lines=0", http.StatusBadRequest, 0},
+	}
+	for i, tst := range tests {
+		resp, err := http.Get(testServer.URL + tst.query)
+		if err != nil || resp.StatusCode != tst.status {
+			t.Errorf("test %d, error: %v, status: %d", i, err, resp.StatusCode)
+			continue
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("ReadAll error: %v", err)
+			continue
+		}
+		if tst.status != http.StatusOK {
+			continue
+		}
+		if c := strings.Count(string(b), marker); c != tst.count {
+			t.Errorf("test %d, query: %s, wrong count: %d, expected: %d", i, tst.query, c, tst.count)
+		}
+	}
+}
+
+// TestFilesAndDownload validates the log files are listed and that the download includes them.
+func TestFilesAndDownload(t *testing.T) {
+	logh.Map["test"].Printf(logh.Info, "TestFilesAndDownload")
+	logh.Map["test.audit"].Printf(logh.Audit, "TestFilesAndDownload")
+
+	testServerFiles := httptest.NewServer(http.HandlerFunc(handlerFiles))
+	defer testServerFiles.Close()
+	resp, err := http.Get(testServerFiles.URL)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("files error: %v", err)
+		return
+	}
+	files := []File{}
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		t.Errorf("Decode error: %v", err)
+	}
+	resp.Body.Close()
+	names := map[string]bool{}
+	for _, f := range files {
+		names[filepath.Base(f.Name)] = true
+	}
+	if len(files) != 2 || !names["test.log.0"] || !names["test.log.audit.0"] {
+		t.Errorf("wrong files: %+v", files)
+	}
+
+	testServerDownload := httptest.NewServer(http.HandlerFunc(handlerDownload))
+	defer testServerDownload.Close()
+	for query, count := range map[string]int{"": 2, "?log=audit": 1} {
+		resp, err = http.Get(testServerDownload.URL + query)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("download error: %v", err)
+			return
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("ReadAll error: %v", err)
+			return
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Errorf("zip.NewReader error: %v", err)
+			return
+		}
+		if len(zr.File) != count {
+			t.Errorf("query: %s, wrong number of files in zip: %d", query, len(zr.File))
+		}
+	}
+}
+
+// TestStream validates records written after the stream starts are received, and filtered.
+func TestStream(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(handlerStream))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logh.Map["test"].Printf(logh.Error, "TestStream before")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, testServer.URL+"?level=error&regex=TestStream", nil)
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("stream error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	logh.Map["test"].Printf(logh.Info, "TestStream filtered")
+	logh.Map["test"].Printf(logh.Error, "TestStream first")
+	logh.Map["test"].Printf(logh.Error, "TestStream second")
+
+	buf := make([]byte, 4096)
+	received := ""
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(received, "TestStream first") && time.Now().Before(deadline) {
+		n, err := resp.Body.Read(buf)
+		received += string(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	if !strings.Contains(received, "TestStream first") || strings.Contains(received, "TestStream before") ||
+		strings.Contains(received, "TestStream filtered") {
+		t.Errorf("wrong stream data: %s", received)
+	}
+}
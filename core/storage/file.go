@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// File is a pure Go Store, persisted as a JSON file per table in the directory dataSourcePath.
+// All values are held in memory, and every change rewrites the table file (write, sync, then
+// rename), so a power loss leaves either the prior or the new file intact. Use for modest amounts
+// of data, such as configuration and task metadata.
+type File struct {
+	// fileTable is shared by all File instances for the same table file.
+	*fileTable
+}
+
+// fileTable is the state for a single table file.
+type fileTable struct {
+	// deleted is set by DeleteStore; NewFile then creates a new fileTable.
+	deleted bool
+	mutex   sync.RWMutex
+	path    string
+	values  map[string][]byte
+}
+
+const (
+	fileTableSuffix = ".json"
+)
+
+var (
+	// fileTables allows multiple File instances for the same table file in one process.
+	fileTables      = map[string]*fileTable{}
+	fileTablesMutex sync.Mutex
+)
+
+// NewFile creates a new File store, with a new or existing table, in the directory dataSourcePath.
+// The directory is created if it does not exist.
+func NewFile(dataSourcePath string, table string) (File, error) {
+	fileTablesMutex.Lock()
+	defer fileTablesMutex.Unlock()
+	path := filepath.Join(dataSourcePath, table+fileTableSuffix)
+	if ft, ok := fileTables[path]; ok {
+		return File{ft}, nil
+	}
+
+	if err := os.MkdirAll(dataSourcePath, 0755); err != nil {
+		return File{}, runtimeh.SourceInfoError("", err)
+	}
+	ft := &fileTable{path: path, values: map[string][]byte{}}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return File{}, runtimeh.SourceInfoError("", err)
+	}
+	if err == nil {
+		// Values are stored base64 encoded, so any []byte is valid.
+		encoded := map[string]string{}
+		if err := json.Unmarshal(b, &encoded); err != nil {
+			return File{}, fmt.Errorf("%s table file: %s is corrupt, error: %v", runtimeh.SourceInfo(), path, err)
+		}
+		for k, v := range encoded {
+			if ft.values[k], err = base64.StdEncoding.DecodeString(v); err != nil {
+				return File{}, fmt.Errorf("%s table file: %s key: %s is corrupt, error: %v", runtimeh.SourceInfo(), path, k, err)
+			}
+		}
+	}
+	fileTables[path] = ft
+	return File{ft}, nil
+}
+
+// fileForget removes the cached tables in the directory dataSourcePath, so the next NewFile reads
+// the table files.
+func fileForget(dataSourcePath string) {
+	fileTablesMutex.Lock()
+	defer fileTablesMutex.Unlock()
+	for path := range fileTables {
+		if filepath.Dir(path) == filepath.Clean(dataSourcePath) {
+			delete(fileTables, path)
+		}
+	}
+}
+
+func (f File) Close() error {
+	return nil
+}
+
+func (f File) CompareAndSwap(key string, old []byte, new []byte) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.deleted {
+		return false, runtimeh.SourceInfoError("", errDeleted)
+	}
+	return compareAndSwap(fileUnlocked{f.fileTable}, f.values[key], key, old, new)
+}
+
+func (f File) Delete(key string) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return fileUnlocked{f.fileTable}.Delete(key)
+}
+
+// DeleteStore deletes all values and the table file.
+func (f File) DeleteStore() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.deleted {
+		// The table file may belong to a new fileTable.
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return runtimeh.SourceInfoError("", err)
+	}
+	for k := range f.values {
+		delete(f.values, k)
+	}
+	f.deleted = true
+	fileTablesMutex.Lock()
+	if fileTables[f.path] == f.fileTable {
+		delete(fileTables, f.path)
+	}
+	fileTablesMutex.Unlock()
+	return nil
+}
+
+func (f File) Deserialize(key string, obj interface{}) error {
+	return deserialize(f, key, obj)
+}
+
+func (f File) Get(key string) ([]byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.deleted {
+		return nil, runtimeh.SourceInfoError("", errDeleted)
+	}
+	v, ok := f.values[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (f File) Keys() ([]string, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.deleted {
+		return nil, runtimeh.SourceInfoError("", errDeleted)
+	}
+	keys := make([]string, 0, len(f.values))
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f File) Serialize(key string, obj interface{}) error {
+	return serialize(f, key, obj)
+}
+
+func (f File) Set(key string, value []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return fileUnlocked{f.fileTable}.Set(key, value)
+}
+
+// fileUnlocked provides Delete and Set for callers already holding the mutex.
+type fileUnlocked struct {
+	*fileTable
+}
+
+func (f fileUnlocked) Delete(key string) (int64, error) {
+	if f.deleted {
+		return 0, runtimeh.SourceInfoError("", errDeleted)
+	}
+	v, ok := f.values[key]
+	if !ok {
+		return 0, nil
+	}
+	delete(f.values, key)
+	if err := f.write(); err != nil {
+		f.values[key] = v
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (f fileUnlocked) Set(key string, value []byte) error {
+	if f.deleted {
+		return runtimeh.SourceInfoError("", errDeleted)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	prior, existed := f.values[key]
+	f.values[key] = append([]byte{}, value...)
+	if err := f.write(); err != nil {
+		if existed {
+			f.values[key] = prior
+		} else {
+			delete(f.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// write writes all values to the table file. The caller must hold the mutex.
+func (ft *fileTable) write() error {
+	encoded := make(map[string]string, len(ft.values))
+	for k, v := range ft.values {
+		encoded[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+
+	tmp := ft.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return runtimeh.SourceInfoError("", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return runtimeh.SourceInfoError("", err)
+	}
+	if err := f.Close(); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return runtimeh.SourceInfoError("", os.Rename(tmp, ft.path))
+}
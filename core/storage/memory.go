@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Memory is a Store that is not persisted; use for testing. After DeleteStore, use NewMemory for
+// an empty store.
+type Memory struct {
+	// deleted is set by DeleteStore.
+	deleted *bool
+	mutex   *sync.RWMutex
+	values  map[string][]byte
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory() Memory {
+	return Memory{deleted: new(bool), mutex: &sync.RWMutex{}, values: map[string][]byte{}}
+}
+
+func (m Memory) Close() error {
+	return nil
+}
+
+func (m Memory) CompareAndSwap(key string, old []byte, new []byte) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if *m.deleted {
+		return false, runtimeh.SourceInfoError("", errDeleted)
+	}
+	return compareAndSwap(memoryUnlocked(m), m.values[key], key, old, new)
+}
+
+func (m Memory) Delete(key string) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return memoryUnlocked(m).Delete(key)
+}
+
+func (m Memory) DeleteStore() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k := range m.values {
+		delete(m.values, k)
+	}
+	*m.deleted = true
+	return nil
+}
+
+func (m Memory) Deserialize(key string, obj interface{}) error {
+	return deserialize(m, key, obj)
+}
+
+func (m Memory) Get(key string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if *m.deleted {
+		return nil, runtimeh.SourceInfoError("", errDeleted)
+	}
+	v, ok := m.values[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m Memory) Keys() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if *m.deleted {
+		return nil, runtimeh.SourceInfoError("", errDeleted)
+	}
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m Memory) Serialize(key string, obj interface{}) error {
+	return serialize(m, key, obj)
+}
+
+func (m Memory) Set(key string, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return memoryUnlocked(m).Set(key, value)
+}
+
+// memoryUnlocked provides Delete and Set for callers already holding the mutex.
+type memoryUnlocked Memory
+
+func (m memoryUnlocked) Delete(key string) (int64, error) {
+	if *m.deleted {
+		return 0, runtimeh.SourceInfoError("", errDeleted)
+	}
+	if _, ok := m.values[key]; !ok {
+		return 0, nil
+	}
+	delete(m.values, key)
+	return 1, nil
+}
+
+func (m memoryUnlocked) Set(key string, value []byte) error {
+	if *m.deleted {
+		return runtimeh.SourceInfoError("", errDeleted)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	m.values[key] = append([]byte{}, value...)
+	return nil
+}
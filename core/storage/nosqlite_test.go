@@ -0,0 +1,15 @@
+//go:build nosqlite
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// corrupt overwrites the table file so it cannot be read, as Open uses File, and forgets the
+// cached table as a restart would.
+func corrupt(dataSourcePath string, table string) error {
+	fileForget(dataSourcePath)
+	return os.WriteFile(filepath.Join(dataSourcePath, table+fileTableSuffix), []byte("{not json"), 0644)
+}
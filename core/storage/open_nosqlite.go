@@ -0,0 +1,13 @@
+//go:build nosqlite
+
+package storage
+
+// Open creates a new Store, with a new or existing table, at dataSourcePath. This build uses File;
+// build without the tag "nosqlite" to use SQLite.
+func Open(dataSourcePath string, table string) (Store, error) {
+	f, err := NewFile(dataSourcePath, table)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
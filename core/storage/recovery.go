@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// RecoveryConfig is used by OpenChecked.
+type RecoveryConfig struct {
+	// LogName is the name of the logh logger for errors taking periodic snapshots.
+	LogName string
+	// SnapshotInterval is the interval between snapshots; zero uses defaultSnapshotInterval,
+	// and a negative value disables periodic snapshots.
+	SnapshotInterval time.Duration
+	// SnapshotsToKeep is the number of snapshots retained; zero uses defaultSnapshotsToKeep.
+	SnapshotsToKeep int
+	// Validate is called for every record during the integrity check; records that cannot be
+	// read, or for which Validate returns an error, are quarantined. May be nil.
+	Validate func(key string, value []byte) error
+}
+
+// Recovery reports the result of the integrity check done by OpenChecked.
+type Recovery struct {
+	DataSourcePath string
+	// Keys is the count of records that passed the integrity check.
+	Keys int
+	// QuarantinedDataSource is the path the data source was moved to, when it could not be opened
+	// or read.
+	QuarantinedDataSource string
+	// QuarantinedKeys are the keys of records that were quarantined.
+	QuarantinedKeys []string
+	// RestoredKeys is the count of records restored from RestoredSnapshot.
+	RestoredKeys     int
+	RestoredSnapshot string
+	// Snapshot is the snapshot taken after the integrity check.
+	Snapshot string
+	Table    string
+}
+
+// quarantinedRecord is written, one per line, to the quarantine file for a table.
+type quarantinedRecord struct {
+	Key    string
+	Reason string
+	Time   string
+	// Value is base64 encoded; blank when the value could not be read.
+	Value string
+}
+
+const (
+	defaultSnapshotInterval = time.Hour
+	defaultSnapshotsToKeep  = 5
+	quarantineSuffix        = ".quarantine"
+	snapshotsSuffix         = ".snapshots"
+	snapshotTimeFormat      = "20060102T150405.000000000Z"
+)
+
+// Changed is true when recovery modified the data source; I.E. something was quarantined or restored.
+func (rcv Recovery) Changed() bool {
+	return rcv.QuarantinedDataSource != "" || len(rcv.QuarantinedKeys) > 0 || rcv.RestoredSnapshot != ""
+}
+
+func (rcv Recovery) String() string {
+	s := fmt.Sprintf("data source: %s, table: %s, keys: %d", rcv.DataSourcePath, rcv.Table, rcv.Keys)
+	if rcv.QuarantinedDataSource != "" {
+		s += fmt.Sprintf(", data source unreadable and quarantined to: %s", rcv.QuarantinedDataSource)
+	}
+	if rcv.RestoredSnapshot != "" {
+		s += fmt.Sprintf(", restored %d keys from snapshot: %s", rcv.RestoredKeys, rcv.RestoredSnapshot)
+	}
+	if len(rcv.QuarantinedKeys) > 0 {
+		s += fmt.Sprintf(", quarantined keys: %s", strings.Join(rcv.QuarantinedKeys, ","))
+	}
+	return s
+}
+
+// OpenChecked opens the Store, like Open, then checks the integrity of every record and recovers
+// rather than failing:
+//   - A data source that cannot be opened or read is moved to the quarantine directory
+//     (dataSourcePath + ".quarantine"), and a new data source is restored from the newest readable
+//     snapshot.
+//   - Records that cannot be read or fail cnfg.Validate are quarantined; see QuarantineRecord.
+//
+// A snapshot is then taken, and snapshots continue every cnfg.SnapshotInterval; snapshots are kept
+// in the directory dataSourcePath + ".snapshots". Callers should audit the returned Recovery when
+// Changed. A data source must hold a single table when using OpenChecked.
+func OpenChecked(dataSourcePath string, table string, cnfg RecoveryConfig) (Store, Recovery, error) {
+	if cnfg.SnapshotInterval == 0 {
+		cnfg.SnapshotInterval = defaultSnapshotInterval
+	}
+	if cnfg.SnapshotsToKeep == 0 {
+		cnfg.SnapshotsToKeep = defaultSnapshotsToKeep
+	}
+	rcv := Recovery{DataSourcePath: dataSourcePath, Table: table}
+
+	s, keys, err := openAndKeys(dataSourcePath, table)
+	if err != nil {
+		if rcv.QuarantinedDataSource, err = quarantineDataSource(s, dataSourcePath, table); err != nil {
+			return nil, rcv, err
+		}
+		if s, err = Open(dataSourcePath, table); err != nil {
+			return nil, rcv, err
+		}
+		if rcv.RestoredSnapshot, rcv.RestoredKeys, err = restoreNewest(s, dataSourcePath, table); err != nil {
+			return nil, rcv, err
+		}
+		if keys, err = s.Keys(); err != nil {
+			return nil, rcv, err
+		}
+	}
+
+	for _, key := range keys {
+		value, err := s.Get(key)
+		if err == nil && cnfg.Validate != nil {
+			err = cnfg.Validate(key, value)
+		}
+		if err != nil {
+			if err := QuarantineRecord(s, dataSourcePath, table, key, err); err != nil {
+				return nil, rcv, err
+			}
+			rcv.QuarantinedKeys = append(rcv.QuarantinedKeys, key)
+			continue
+		}
+		rcv.Keys++
+	}
+
+	if rcv.Snapshot, err = Snapshot(s, dataSourcePath, table, cnfg.SnapshotsToKeep); err != nil {
+		return nil, rcv, err
+	}
+	if cnfg.SnapshotInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(cnfg.SnapshotInterval)
+				if _, err := Snapshot(s, dataSourcePath, table, cnfg.SnapshotsToKeep); err != nil {
+					logh.Map[cnfg.LogName].Printf(logh.Error, "Snapshot error:%v", err)
+				}
+			}
+		}()
+	}
+	return s, rcv, nil
+}
+
+// RemoveAll removes the data source, and the snapshot and quarantine directories.
+func RemoveAll(dataSourcePath string) error {
+	fileForget(dataSourcePath)
+	for _, path := range []string{dataSourcePath, dataSourcePath + snapshotsSuffix, dataSourcePath + quarantineSuffix} {
+		if err := os.RemoveAll(path); err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+	}
+	return nil
+}
+
+// QuarantineRecord appends the record, and the reason, to the quarantine file for the table
+// (dataSourcePath + ".quarantine/" + table + ".jsonl") then deletes the record from the Store.
+// If the value cannot be read, only the key and reason are written.
+func QuarantineRecord(s Store, dataSourcePath string, table string, key string, reason error) error {
+	qr := quarantinedRecord{Key: key, Reason: fmt.Sprintf("%v", reason), Time: time.Now().UTC().Format(time.RFC3339Nano)}
+	if value, err := s.Get(key); err == nil && value != nil {
+		qr.Value = base64.StdEncoding.EncodeToString(value)
+	}
+	b, err := json.Marshal(qr)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+
+	dir := dataSourcePath + quarantineSuffix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, table+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return runtimeh.SourceInfoError("", err)
+	}
+	if err := f.Close(); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	_, err = s.Delete(key)
+	return runtimeh.SourceInfoError("", err)
+}
+
+// Snapshot writes all records in the Store to a new snapshot file in the directory
+// dataSourcePath + ".snapshots", then removes all but the newest keep snapshots for the table.
+// Returns the snapshot file path.
+func Snapshot(s Store, dataSourcePath string, table string, keep int) (string, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return "", err
+	}
+	encoded := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, err := s.Get(k)
+		if err != nil {
+			return "", err
+		}
+		encoded[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+
+	dir := dataSourcePath + snapshotsSuffix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	path := filepath.Join(dir, table+"."+time.Now().UTC().Format(snapshotTimeFormat)+fileTableSuffix)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+
+	snapshots, err := snapshots(dataSourcePath, table)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(snapshots)-keep; i++ {
+		if err := os.Remove(snapshots[i]); err != nil {
+			return "", runtimeh.SourceInfoError("", err)
+		}
+	}
+	return path, nil
+}
+
+// openAndKeys opens the Store and reads the keys. On error the Store may be non-nil and should
+// be closed.
+func openAndKeys(dataSourcePath string, table string) (Store, []string, error) {
+	s, err := Open(dataSourcePath, table)
+	if err != nil {
+		return s, nil, err
+	}
+	keys, err := s.Keys()
+	return s, keys, err
+}
+
+// quarantineDataSource closes s, if not nil, and moves the data source to the quarantine directory.
+// Returns the new path.
+func quarantineDataSource(s Store, dataSourcePath string, table string) (string, error) {
+	if s != nil {
+		s.Close()
+	}
+	fileForget(dataSourcePath)
+	dir := dataSourcePath + quarantineSuffix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	path := filepath.Join(dir, filepath.Base(dataSourcePath)+"."+time.Now().UTC().Format(snapshotTimeFormat))
+	return path, runtimeh.SourceInfoError("", os.Rename(dataSourcePath, path))
+}
+
+// restoreNewest restores s from the newest readable snapshot. Returns the snapshot path and count
+// of restored keys; the path is blank when there was no readable snapshot.
+func restoreNewest(s Store, dataSourcePath string, table string) (string, int, error) {
+	snapshots, err := snapshots(dataSourcePath, table)
+	if err != nil {
+		return "", 0, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		b, err := os.ReadFile(snapshots[i])
+		if err != nil {
+			continue
+		}
+		encoded := map[string]string{}
+		if err := json.Unmarshal(b, &encoded); err != nil {
+			continue
+		}
+		values := make(map[string][]byte, len(encoded))
+		for k, v := range encoded {
+			if values[k], err = base64.StdEncoding.DecodeString(v); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		for k, v := range values {
+			if err := s.Set(k, v); err != nil {
+				return "", 0, err
+			}
+		}
+		return snapshots[i], len(values), nil
+	}
+	return "", 0, nil
+}
+
+// snapshots returns the snapshot file paths for the table, oldest first.
+func snapshots(dataSourcePath string, table string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dataSourcePath+snapshotsSuffix, table+".*"+fileTableSuffix))
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+	// The time format sorts lexically.
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenChecked validates records that fail validation are quarantined, and that an unreadable
+// data source is quarantined and restored from the newest snapshot.
+func TestOpenChecked(t *testing.T) {
+	dsp := filepath.Join(testDir, "checked.db")
+	validate := func(key string, value []byte) error {
+		obj := map[string]int{}
+		return json.Unmarshal(value, &obj)
+	}
+	cnfg := RecoveryConfig{SnapshotInterval: -1, Validate: validate}
+
+	s, rcv, err := OpenChecked(dsp, "test", cnfg)
+	if err != nil || rcv.Changed() || rcv.Snapshot == "" {
+		t.Errorf("OpenChecked error: %v, recovery: %+v", err, rcv)
+		return
+	}
+	if err := s.Serialize("good", map[string]int{"a": 1}); err != nil {
+		t.Errorf("Serialize error: %v", err)
+	}
+	if err := s.Set("bad", []byte("not json")); err != nil {
+		t.Errorf("Set error: %v", err)
+	}
+
+	s, rcv, err = OpenChecked(dsp, "test", cnfg)
+	if err != nil || rcv.Keys != 1 || len(rcv.QuarantinedKeys) != 1 || rcv.QuarantinedKeys[0] != "bad" {
+		t.Errorf("OpenChecked error: %v, recovery: %+v", err, rcv)
+		return
+	}
+	if v, err := s.Get("bad"); v != nil || err != nil {
+		t.Errorf("quarantined key was not deleted, value: %s, error: %v", v, err)
+	}
+	s.Close()
+
+	if err := corrupt(dsp, "test"); err != nil {
+		t.Errorf("corrupt error: %v", err)
+		return
+	}
+	s, rcv, err = OpenChecked(dsp, "test", cnfg)
+	if err != nil || rcv.QuarantinedDataSource == "" || rcv.RestoredSnapshot == "" || rcv.RestoredKeys != 1 {
+		t.Errorf("OpenChecked error: %v, recovery: %+v", err, rcv)
+		return
+	}
+	d := map[string]int{}
+	if err := s.Deserialize("good", &d); err != nil || d["a"] != 1 {
+		t.Errorf("restored value: %v, error: %v", d, err)
+	}
+	s.Close()
+}
+
+// TestSnapshotsToKeep validates old snapshots are removed.
+func TestSnapshotsToKeep(t *testing.T) {
+	dsp := filepath.Join(testDir, "snapshots.db")
+	s := NewMemory()
+	for i := 0; i < 4; i++ {
+		if _, err := Snapshot(s, dsp, "test", 2); err != nil {
+			t.Errorf("Snapshot error: %v", err)
+			return
+		}
+	}
+	if ss, err := snapshots(dsp, "test"); err != nil || len(ss) != 2 {
+		t.Errorf("wrong snapshots: %v, error: %v", ss, err)
+	}
+}
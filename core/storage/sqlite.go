@@ -0,0 +1,96 @@
+//go:build !nosqlite
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/paulfdunn/go-helper/databaseh/kvs"
+)
+
+// SQLite is a Store using github.com/paulfdunn/go-helper/databaseh/kvs, which requires cgo.
+type SQLite struct {
+	kvs kvs.KVS
+	// mutex makes CompareAndSwap atomic with respect to other changes made in this process.
+	mutex *sync.Mutex
+}
+
+var (
+	// sqliteMutexes are shared by all SQLite instances for the same database and table.
+	sqliteMutexes      = map[string]*sync.Mutex{}
+	sqliteMutexesMutex sync.Mutex
+)
+
+// NewSQLite creates a new SQLite store, with a new or existing table, in the database file at
+// dataSourcePath. The database file is created if it does not exist.
+func NewSQLite(dataSourcePath string, table string) (SQLite, error) {
+	k, err := kvs.New(dataSourcePath, table)
+	if err != nil {
+		return SQLite{}, err
+	}
+	sqliteMutexesMutex.Lock()
+	defer sqliteMutexesMutex.Unlock()
+	mk := dataSourcePath + "|" + table
+	if _, ok := sqliteMutexes[mk]; !ok {
+		sqliteMutexes[mk] = &sync.Mutex{}
+	}
+	return SQLite{kvs: k, mutex: sqliteMutexes[mk]}, nil
+}
+
+func (s SQLite) Close() error {
+	return s.kvs.Close()
+}
+
+func (s SQLite) CompareAndSwap(key string, old []byte, new []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, err := s.kvs.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return compareAndSwap(s.kvs, current, key, old, new)
+}
+
+func (s SQLite) Delete(key string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.kvs.Delete(key)
+}
+
+func (s SQLite) DeleteStore() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.kvs.DeleteStore()
+}
+
+func (s SQLite) Deserialize(key string, obj interface{}) error {
+	return deserialize(s, key, obj)
+}
+
+func (s SQLite) Get(key string) ([]byte, error) {
+	return s.kvs.Get(key)
+}
+
+func (s SQLite) Keys() ([]string, error) {
+	return s.kvs.Keys()
+}
+
+func (s SQLite) Serialize(key string, obj interface{}) error {
+	return serialize(s, key, obj)
+}
+
+func (s SQLite) Set(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.kvs.Set(key, value)
+}
+
+// Open creates a new Store, with a new or existing table, at dataSourcePath. This build uses SQLite;
+// build with the tag "nosqlite" to use File.
+func Open(dataSourcePath string, table string) (Store, error) {
+	s, err := NewSQLite(dataSourcePath, table)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
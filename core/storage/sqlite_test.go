@@ -0,0 +1,18 @@
+//go:build !nosqlite
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	testStores = append(testStores,
+		testStore{"sqlite", func() (Store, error) { return NewSQLite(filepath.Join(testDir, "sqlite.db"), "test") }})
+}
+
+// corrupt overwrites the data source so it cannot be opened, as Open uses SQLite.
+func corrupt(dataSourcePath string, table string) error {
+	return os.WriteFile(dataSourcePath, []byte("not a database, not a database, not a database, not a database"), 0644)
+}
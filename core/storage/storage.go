@@ -0,0 +1,88 @@
+// Package storage defines the key/value Store used by rest-app for persisted data, with
+// implementations for SQLITE (github.com/paulfdunn/go-helper/databaseh/kvs), memory (for testing),
+// and files (pure Go, for builds without cgo).
+//
+// The SQLITE implementation requires cgo; build with the tag "nosqlite" to exclude it. Open uses
+// SQLITE by default, or the file implementation when built with "nosqlite".
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// Store is a key/value store. Implementations are safe for concurrent use.
+type Store interface {
+	// Close releases resources held by the Store.
+	Close() error
+	// CompareAndSwap sets key to new only if the current value equals old, returning whether the
+	// swap was done. A nil old requires that key does not exist; a nil new deletes key.
+	CompareAndSwap(key string, old []byte, new []byte) (bool, error)
+	// Delete deletes key; returns the count, which is zero (and no error) if the key did not exist.
+	Delete(key string) (int64, error)
+	// DeleteStore deletes all data in the Store, and the Store; I.E. the SQLITE table, or the
+	// table file. All other methods, except Close, then return an error; Open the Store again to
+	// use it. Deleting a deleted Store is not an error.
+	DeleteStore() error
+	// Deserialize deserializes an object from the Store. Call with a pointer to the object.
+	// Persisted fields overwrite fields in obj; other fields in obj are unchanged.
+	// If the key is not in the Store, obj is unchanged and there is no error.
+	Deserialize(key string, obj interface{}) error
+	// Get gets a value; if the value and error are both nil, the key did not exist.
+	Get(key string) ([]byte, error)
+	// Keys returns all keys in the Store.
+	Keys() ([]string, error)
+	// Serialize serializes obj, as JSON, into the Store.
+	Serialize(key string, obj interface{}) error
+	// Set sets the value for key.
+	Set(key string, value []byte) error
+}
+
+var (
+	// errDeleted is returned by File and Memory after DeleteStore.
+	errDeleted = errors.New("store deleted")
+)
+
+// setDeleter is the subset of Store used by compareAndSwap.
+type setDeleter interface {
+	Delete(key string) (int64, error)
+	Set(key string, value []byte) error
+}
+
+// compareAndSwap implements CompareAndSwap for a Store, given the current value; the caller must
+// make the call atomic.
+func compareAndSwap(s setDeleter, current []byte, key string, old []byte, new []byte) (bool, error) {
+	if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+		return false, nil
+	}
+	if new == nil {
+		_, err := s.Delete(key)
+		return err == nil, err
+	}
+	err := s.Set(key, new)
+	return err == nil, err
+}
+
+// deserialize implements Deserialize for a Store.
+func deserialize(s Store, key string, obj interface{}) error {
+	b, err := s.Get(key)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	if b == nil {
+		return nil
+	}
+	return runtimeh.SourceInfoError("", json.Unmarshal(b, &obj))
+}
+
+// serialize implements Serialize for a Store.
+func serialize(s Store, key string, obj interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	return runtimeh.SourceInfoError("", s.Set(key, b))
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStore is used to run the same tests against each Store implementation.
+type testStore struct {
+	name string
+	// open returns the Store; calling it again must return a Store with the same data, or after
+	// DeleteStore an empty Store.
+	open func() (Store, error)
+}
+
+var (
+	testDir    string
+	testStores []testStore
+)
+
+func init() {
+	t := testing.T{}
+	testDir = t.TempDir()
+	testStores = append(testStores,
+		testStore{"memory", func() func() (Store, error) {
+			m := NewMemory()
+			return func() (Store, error) {
+				if _, err := m.Keys(); err != nil {
+					// A deleted Memory cannot be opened again; replace it.
+					m = NewMemory()
+				}
+				return m, nil
+			}
+		}()},
+		testStore{"file", func() (Store, error) { return NewFile(filepath.Join(testDir, "file.db"), "test") }},
+	)
+}
+
+func ExampleStore() {
+	s := NewMemory()
+	type obj struct {
+		A string
+		B int
+	}
+	if err := s.Serialize("key", obj{A: "a", B: 1}); err != nil {
+		fmt.Println(err)
+	}
+	// Persisted fields overwrite the fields in the object.
+	d := obj{B: 2}
+	if err := s.Deserialize("key", &d); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("%+v\n", d)
+
+	// Output:
+	// {A:a B:1}
+}
+
+func TestStore(t *testing.T) {
+	for _, ts := range testStores {
+		s, err := ts.open()
+		if err != nil {
+			t.Errorf("store: %s, open error: %v", ts.name, err)
+			continue
+		}
+		if err := s.DeleteStore(); err != nil {
+			t.Errorf("store: %s, DeleteStore error: %v", ts.name, err)
+		}
+		if s, err = ts.open(); err != nil {
+			t.Errorf("store: %s, open error: %v", ts.name, err)
+			continue
+		}
+
+		if v, err := s.Get("missing"); v != nil || err != nil {
+			t.Errorf("store: %s, missing key, value: %v, error: %v", ts.name, v, err)
+		}
+		if err := s.Set("k1", []byte("v1")); err != nil {
+			t.Errorf("store: %s, Set error: %v", ts.name, err)
+		}
+		if err := s.Serialize("k2", map[string]int{"a": 1}); err != nil {
+			t.Errorf("store: %s, Serialize error: %v", ts.name, err)
+		}
+		if keys, err := s.Keys(); err != nil || len(keys) != 2 {
+			t.Errorf("store: %s, Keys: %v, error: %v", ts.name, keys, err)
+		}
+
+		// CompareAndSwap
+		if ok, err := s.CompareAndSwap("k1", []byte("wrong"), []byte("v2")); ok || err != nil {
+			t.Errorf("store: %s, CompareAndSwap with wrong old, ok: %t, error: %v", ts.name, ok, err)
+		}
+		if ok, err := s.CompareAndSwap("k1", []byte("v1"), []byte("v2")); !ok || err != nil {
+			t.Errorf("store: %s, CompareAndSwap, ok: %t, error: %v", ts.name, ok, err)
+		}
+		if ok, err := s.CompareAndSwap("k3", nil, []byte("v3")); !ok || err != nil {
+			t.Errorf("store: %s, CompareAndSwap create, ok: %t, error: %v", ts.name, ok, err)
+		}
+		if ok, err := s.CompareAndSwap("k3", nil, []byte("v3")); ok || err != nil {
+			t.Errorf("store: %s, CompareAndSwap create existing, ok: %t, error: %v", ts.name, ok, err)
+		}
+		if ok, err := s.CompareAndSwap("k3", []byte("v3"), nil); !ok || err != nil {
+			t.Errorf("store: %s, CompareAndSwap delete, ok: %t, error: %v", ts.name, ok, err)
+		}
+
+		// Re-open and validate the data persisted.
+		if s, err = ts.open(); err != nil {
+			t.Errorf("store: %s, open error: %v", ts.name, err)
+			continue
+		}
+		if v, err := s.Get("k1"); string(v) != "v2" || err != nil {
+			t.Errorf("store: %s, Get value: %s, error: %v", ts.name, v, err)
+		}
+		d := map[string]int{}
+		if err := s.Deserialize("k2", &d); err != nil || d["a"] != 1 {
+			t.Errorf("store: %s, Deserialize value: %v, error: %v", ts.name, d, err)
+		}
+		if n, err := s.Delete("k1"); n != 1 || err != nil {
+			t.Errorf("store: %s, Delete count: %d, error: %v", ts.name, n, err)
+		}
+		if n, err := s.Delete("k1"); n != 0 || err != nil {
+			t.Errorf("store: %s, Delete missing count: %d, error: %v", ts.name, n, err)
+		}
+
+		// After DeleteStore, the Store returns errors until opened again, then is empty.
+		if err := s.DeleteStore(); err != nil {
+			t.Errorf("store: %s, DeleteStore error: %v", ts.name, err)
+		}
+		if v, err := s.Get("k2"); v != nil || err == nil {
+			t.Errorf("store: %s, Get after DeleteStore value: %s, error: %v", ts.name, v, err)
+		}
+		if keys, err := s.Keys(); len(keys) != 0 || err == nil {
+			t.Errorf("store: %s, Keys after DeleteStore: %v, error: %v", ts.name, keys, err)
+		}
+		if err := s.Set("k1", []byte("v1")); err == nil {
+			t.Errorf("store: %s, Set after DeleteStore did not error", ts.name)
+		}
+		if _, err := s.Delete("k2"); err == nil {
+			t.Errorf("store: %s, Delete after DeleteStore did not error", ts.name)
+		}
+		if ok, err := s.CompareAndSwap("k1", nil, []byte("v1")); ok || err == nil {
+			t.Errorf("store: %s, CompareAndSwap after DeleteStore, ok: %t, error: %v", ts.name, ok, err)
+		}
+		if err := s.DeleteStore(); err != nil {
+			t.Errorf("store: %s, second DeleteStore error: %v", ts.name, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("store: %s, Close error: %v", ts.name, err)
+		}
+		if s, err = ts.open(); err != nil {
+			t.Errorf("store: %s, open error: %v", ts.name, err)
+			continue
+		}
+		if keys, err := s.Keys(); len(keys) != 0 || err != nil {
+			t.Errorf("store: %s, Keys after open: %v, error: %v", ts.name, keys, err)
+		}
+		if err := s.Set("k1", []byte("v1")); err != nil {
+			t.Errorf("store: %s, Set after open error: %v", ts.name, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("store: %s, Close error: %v", ts.name, err)
+		}
+	}
+}
+
+// TestCompareAndSwapConcurrent validates concurrent increments using CompareAndSwap are not lost.
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	for _, ts := range testStores {
+		s, err := ts.open()
+		if err != nil {
+			t.Errorf("store: %s, open error: %v", ts.name, err)
+			continue
+		}
+		if _, err := s.Delete("counter"); err != nil {
+			t.Errorf("store: %s, Delete error: %v", ts.name, err)
+			continue
+		}
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					old, err := s.Get("counter")
+					if err != nil {
+						t.Errorf("store: %s, Get error: %v", ts.name, err)
+						return
+					}
+					n := 0
+					if old != nil {
+						fmt.Sscanf(string(old), "%d", &n)
+					}
+					if ok, err := s.CompareAndSwap("counter", old, []byte(fmt.Sprint(n+1))); err != nil || ok {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if v, _ := s.Get("counter"); string(v) != "10" {
+			t.Errorf("store: %s, wrong counter: %s", ts.name, v)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Package syslog forwards the application and audit logs to a syslog collector using RFC 5424
+// messages, over a Unix socket, UDP, TCP, or TCP+TLS. Records are read from the logh log files
+// (see logs.Follow), so logging calls do not block on the network. Records are buffered in
+// memory while the collector is unavailable, and the connection is retried; when the buffer is
+// full the oldest records are dropped, and the count of dropped records is sent when the
+// collector is available again. Audit records are sent with a separate facility.
+//
+// Stream transports (unix, tcp, tls) use octet counting framing (RFC 6587/RFC 5425); datagram
+// transports (unixgram, udp) send one message per datagram.
+package syslog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/logs"
+)
+
+type Config struct {
+	// Address is the collector address; host:port for udp/tcp/tls, or a socket path for unix/unixgram.
+	Address string
+	// AppName is the RFC 5424 APP-NAME.
+	AppName string
+	// AuditFacility is the facility for audit log records; zero uses FacilityLogAudit.
+	AuditFacility Facility
+	// AuditLogFilepath is the logh file path of the audit log; blank to not forward the audit log.
+	AuditLogFilepath string
+	// BufferSize is the maximum number of records held while the collector is unavailable;
+	// zero uses defaultBufferSize.
+	BufferSize int
+	// Facility is the facility for application log records; zero uses FacilityUser.
+	Facility Facility
+	// Hostname is the RFC 5424 HOSTNAME; blank uses os.Hostname.
+	Hostname string
+	// LogFilepath is the logh file path of the application log; blank to not forward the application log.
+	LogFilepath string
+	// LogName is the name of the logh logger for general logging.
+	LogName string
+	// Network is one of NetworkUnix, NetworkUnixgram, NetworkUDP, NetworkTCP, or NetworkTLS.
+	Network string
+	// RetryInterval is the initial interval between connection attempts, which doubles up to
+	// maxRetryInterval; zero uses defaultRetryInterval.
+	RetryInterval time.Duration
+	// TLSConfig is used for NetworkTLS; nil uses the system roots.
+	TLSConfig *tls.Config
+}
+
+// Facility is the syslog facility; see RFC 5424 section 6.2.1.
+type Facility int
+
+// Sink forwards logs to a syslog collector.
+type Sink struct {
+	config Config
+	done   chan struct{}
+	pid    int
+	wg     sync.WaitGroup
+
+	// mutex protects the fields below; cond signals the sender when there are messages or on Close.
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	dropped int
+	// popped counts messages removed from the front of queue, by sending or dropping.
+	popped uint64
+	queue  []string
+}
+
+const (
+	FacilityUser     Facility = 1
+	FacilityAuth     Facility = 4
+	FacilityAuthpriv Facility = 10
+	FacilityLogAudit Facility = 13
+	FacilityLocal0   Facility = 16
+
+	NetworkTCP      = "tcp"
+	NetworkTLS      = "tls"
+	NetworkUDP      = "udp"
+	NetworkUnix     = "unix"
+	NetworkUnixgram = "unixgram"
+
+	// msgIDApp and msgIDAudit are the RFC 5424 MSGID, identifying the source log.
+	msgIDApp   = "app"
+	msgIDAudit = "audit"
+
+	defaultBufferSize    = 10000
+	defaultRetryInterval = time.Second
+	dialTimeout          = 10 * time.Second
+	maxRetryInterval     = time.Minute
+	// maxDatagram is the maximum message size for datagram transports; longer messages are truncated.
+	maxDatagram  = 8192
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	// severities maps logh.DefaultLevels to RFC 5424 severities.
+	severities = map[logh.LoghLevel]int{
+		logh.Debug:   7,
+		logh.Info:    6,
+		logh.Warning: 4,
+		logh.Audit:   5,
+		logh.Error:   3,
+	}
+)
+
+// New validates the config and starts forwarding records written to the logs after New is called.
+// Call Close to stop forwarding.
+func New(config Config) (*Sink, error) {
+	switch config.Network {
+	case NetworkTCP, NetworkTLS, NetworkUDP, NetworkUnix, NetworkUnixgram:
+	default:
+		return nil, fmt.Errorf("%s invalid network: %s", runtimeh.SourceInfo(), config.Network)
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("%s address is required", runtimeh.SourceInfo())
+	}
+	if config.AuditFacility == 0 {
+		config.AuditFacility = FacilityLogAudit
+	}
+	if config.BufferSize == 0 {
+		config.BufferSize = defaultBufferSize
+	}
+	if config.Facility == 0 {
+		config.Facility = FacilityUser
+	}
+	if config.Hostname == "" {
+		if hn, err := os.Hostname(); err == nil {
+			config.Hostname = hn
+		}
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultRetryInterval
+	}
+
+	snk := &Sink{config: config, done: make(chan struct{}), pid: os.Getpid()}
+	snk.cond = sync.NewCond(&snk.mutex)
+	for _, src := range []struct {
+		facility Facility
+		fp       string
+		msgID    string
+	}{
+		{config.Facility, config.LogFilepath, msgIDApp},
+		{config.AuditFacility, config.AuditLogFilepath, msgIDAudit},
+	} {
+		if src.fp == "" {
+			continue
+		}
+		src := src
+		snk.wg.Add(1)
+		go func() {
+			defer snk.wg.Done()
+			err := logs.Follow(snk.done, src.fp, func(rcd string) error {
+				snk.enqueue(snk.format(src.facility, src.msgID, rcd))
+				return nil
+			})
+			if err != nil {
+				logh.Map[config.LogName].Printf(logh.Error, "logs.Follow error, log: %s, error: %v", src.fp, err)
+			}
+		}()
+	}
+	snk.wg.Add(1)
+	go snk.send()
+	return snk, nil
+}
+
+// Close stops forwarding. Records not yet sent are discarded.
+func (snk *Sink) Close() {
+	snk.mutex.Lock()
+	if snk.closed {
+		snk.mutex.Unlock()
+		return
+	}
+	snk.closed = true
+	close(snk.done)
+	snk.cond.Broadcast()
+	snk.mutex.Unlock()
+	snk.wg.Wait()
+}
+
+// Dropped returns the total count of records dropped because the buffer was full.
+func (snk *Sink) Dropped() int {
+	snk.mutex.Lock()
+	defer snk.mutex.Unlock()
+	return snk.dropped
+}
+
+// dial connects to the collector.
+func (snk *Sink) dial() (net.Conn, error) {
+	if snk.config.Network == NetworkTLS {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", snk.config.Address, snk.config.TLSConfig)
+	}
+	return net.DialTimeout(snk.config.Network, snk.config.Address, dialTimeout)
+}
+
+// enqueue adds msg to the queue, dropping the oldest message when the queue is full.
+func (snk *Sink) enqueue(msg string) {
+	snk.mutex.Lock()
+	defer snk.mutex.Unlock()
+	if len(snk.queue) >= snk.config.BufferSize {
+		snk.queue = snk.queue[1:]
+		snk.dropped++
+		snk.popped++
+	}
+	snk.queue = append(snk.queue, msg)
+	snk.cond.Signal()
+}
+
+// format returns the RFC 5424 message for a logh record. The timestamp and severity come from
+// the logh prefix when present; the MSG is the complete record.
+func (snk *Sink) format(facility Facility, msgID string, rcd string) string {
+	level, tm, ok := logs.ParseRecord(rcd)
+	severity := severities[logh.Info]
+	if ok {
+		severity = severities[level]
+	} else {
+		tm = time.Now()
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", int(facility)*8+severity, tm.UTC().Format(time.RFC3339Nano),
+		header(snk.config.Hostname), header(snk.config.AppName), snk.pid, msgID, strings.TrimRight(rcd, "\n"))
+}
+
+// send writes queued messages to the collector, connecting and reconnecting as required.
+func (snk *Sink) send() {
+	defer snk.wg.Done()
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	retry := snk.config.RetryInterval
+	reportedDown := false
+	reportedDropped := 0
+	for {
+		snk.mutex.Lock()
+		for len(snk.queue) == 0 && !snk.closed {
+			snk.cond.Wait()
+		}
+		if snk.closed {
+			snk.mutex.Unlock()
+			return
+		}
+		msg := snk.queue[0]
+		popped := snk.popped
+		snk.mutex.Unlock()
+
+		if conn == nil {
+			var err error
+			if conn, err = snk.dial(); err != nil {
+				// Only log the first failure; logging every retry would fill the application log,
+				// which is forwarded once the collector is available.
+				if !reportedDown {
+					logh.Map[snk.config.LogName].Printf(logh.Warning, "syslog collector unavailable, buffering, error: %v", err)
+					reportedDown = true
+				}
+				select {
+				case <-snk.done:
+					return
+				case <-time.After(retry):
+				}
+				retry = min(retry*2, maxRetryInterval)
+				continue
+			}
+			retry = snk.config.RetryInterval
+			if reportedDown {
+				logh.Map[snk.config.LogName].Printf(logh.Info, "syslog collector available")
+				reportedDown = false
+			}
+			if dropped := snk.Dropped(); dropped > reportedDropped {
+				logh.Map[snk.config.LogName].Printf(logh.Warning, "syslog buffer full, dropped %d records",
+					dropped-reportedDropped)
+				reportedDropped = dropped
+			}
+		}
+
+		if err := snk.write(conn, msg); err != nil {
+			logh.Map[snk.config.LogName].Printf(logh.Warning, "syslog write error, reconnecting, error: %v", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		snk.mutex.Lock()
+		// The message may have been dropped while writing, so only remove it if it is still first.
+		if snk.popped == popped {
+			snk.queue = snk.queue[1:]
+			snk.popped++
+		}
+		snk.mutex.Unlock()
+	}
+}
+
+// write writes a single message to conn, framed for the transport.
+func (snk *Sink) write(conn net.Conn, msg string) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	var err error
+	switch snk.config.Network {
+	case NetworkUDP, NetworkUnixgram:
+		if len(msg) > maxDatagram {
+			msg = msg[:maxDatagram]
+		}
+		_, err = conn.Write([]byte(msg))
+	default:
+		_, err = fmt.Fprintf(conn, "%d %s", len(msg), msg)
+	}
+	return runtimeh.SourceInfoError("", err)
+}
+
+// header returns s as a valid RFC 5424 header field; printable US-ASCII without spaces, or the
+// NILVALUE when blank.
+func header(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,304 @@
+package syslog
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+)
+
+// receiver is an in-process syslog collector that stores the messages it receives.
+type receiver struct {
+	address  string
+	closer   func()
+	mutex    sync.Mutex
+	messages []string
+}
+
+var (
+	testAppLog   string
+	testAuditLog string
+	testDir      string
+
+	// rfc5424 matches the messages sent by Sink.
+	rfc5424 = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ test \d+ (app|audit) - (.*)$`)
+)
+
+func init() {
+	t := testing.T{}
+	testDir = t.TempDir()
+	testAppLog = filepath.Join(testDir, "test.log")
+	testAuditLog = testAppLog + ".audit"
+
+	err := logh.New("test", testAppLog, logh.DefaultLevels, logh.Debug, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating log, error: %v", runtimeh.SourceInfo(), err)
+	}
+	err = logh.New("test.audit", testAuditLog, logh.DefaultLevels, logh.Audit, logh.DefaultFlags, 100, 1e6)
+	if err != nil {
+		log.Fatalf("fatal: %s error creating audit log, error: %v", runtimeh.SourceInfo(), err)
+	}
+}
+
+func Example_header() {
+	fmt.Println(header("my host"))
+	fmt.Println(header(""))
+
+	// Output:
+	// myhost
+	// -
+}
+
+// TestSink validates records are received, with the correct facility and severity, for each network.
+func TestSink(t *testing.T) {
+	tlsServer, tlsClient, err := testTLSConfigs()
+	if err != nil {
+		t.Errorf("testTLSConfigs error: %v", err)
+		return
+	}
+	for _, network := range []string{NetworkTCP, NetworkTLS, NetworkUDP, NetworkUnix, NetworkUnixgram} {
+		rcv, err := newReceiver(network, "", tlsServer)
+		if err != nil {
+			t.Errorf("network: %s, newReceiver error: %v", network, err)
+			continue
+		}
+		snk, err := New(Config{Address: rcv.address, AppName: "test", AuditLogFilepath: testAuditLog,
+			LogFilepath: testAppLog, LogName: "test", Network: network, TLSConfig: tlsClient})
+		if err != nil {
+			t.Errorf("network: %s, New error: %v", network, err)
+			rcv.closer()
+			continue
+		}
+
+		marker := fmt.Sprintf("TestSink%s%d", network, time.Now().UnixNano())
+		appPri := strconv.Itoa(int(FacilityUser)*8 + severities[logh.Error])
+		auditPri := strconv.Itoa(int(FacilityLogAudit)*8 + severities[logh.Audit])
+		ok := rcv.waitFor(func() {
+			logh.Map["test"].Printf(logh.Error, "%s app", marker)
+			logh.Map["test.audit"].Printf(logh.Audit, "%s audit", marker)
+		}, func(msgs []string) bool {
+			app, aud := false, false
+			for _, m := range msgs {
+				sm := rfc5424.FindStringSubmatch(m)
+				if sm == nil || !strings.Contains(sm[3], marker) {
+					continue
+				}
+				app = app || (sm[1] == appPri && sm[2] == msgIDApp)
+				aud = aud || (sm[1] == auditPri && sm[2] == msgIDAudit)
+			}
+			return app && aud
+		})
+		if !ok {
+			t.Errorf("network: %s, records not received, messages: %v", network, rcv.received())
+		}
+		snk.Close()
+		rcv.closer()
+	}
+}
+
+// TestBuffering validates records written while the collector is down are sent once it is up.
+func TestBuffering(t *testing.T) {
+	// Get a free port, then close the listener so the collector is down.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Listen error: %v", err)
+		return
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	snk, err := New(Config{Address: address, AppName: "test", LogFilepath: testAppLog, LogName: "test",
+		Network: NetworkTCP, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Errorf("New error: %v", err)
+		return
+	}
+	defer snk.Close()
+
+	marker := fmt.Sprintf("TestBuffering%d", time.Now().UnixNano())
+	// Allow the follower to start, then write while the collector is down.
+	time.Sleep(100 * time.Millisecond)
+	logh.Map["test"].Printf(logh.Info, "%s buffered", marker)
+	time.Sleep(time.Second)
+
+	rcv, err := newReceiver(NetworkTCP, address, nil)
+	if err != nil {
+		t.Errorf("newReceiver error: %v", err)
+		return
+	}
+	defer rcv.closer()
+	ok := rcv.waitFor(func() {}, func(msgs []string) bool {
+		for _, m := range msgs {
+			if strings.Contains(m, marker+" buffered") {
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		t.Errorf("buffered record not received, messages: %v", rcv.received())
+	}
+}
+
+// TestDropOldest validates the oldest messages are dropped when the buffer is full.
+func TestDropOldest(t *testing.T) {
+	snk := &Sink{config: Config{BufferSize: 2}}
+	snk.cond = sync.NewCond(&snk.mutex)
+	for _, m := range []string{"1", "2", "3"} {
+		snk.enqueue(m)
+	}
+	if snk.Dropped() != 1 || strings.Join(snk.queue, "") != "23" {
+		t.Errorf("wrong dropped: %d, queue: %v", snk.Dropped(), snk.queue)
+	}
+}
+
+// newReceiver starts a receiver for network; address may be blank to use a free address.
+func newReceiver(network string, address string, tlsConfig *tls.Config) (*receiver, error) {
+	rcv := &receiver{}
+	if address == "" {
+		switch network {
+		case NetworkUnix, NetworkUnixgram:
+			address = filepath.Join(testDir, network+".sock")
+		default:
+			address = "127.0.0.1:0"
+		}
+	}
+
+	switch network {
+	case NetworkUDP, NetworkUnixgram:
+		var pc net.PacketConn
+		var err error
+		if pc, err = net.ListenPacket(network, address); err != nil {
+			return nil, err
+		}
+		rcv.address = pc.LocalAddr().String()
+		rcv.closer = func() { pc.Close() }
+		go func() {
+			buf := make([]byte, maxDatagram)
+			for {
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				rcv.add(string(buf[:n]))
+			}
+		}()
+	default:
+		var l net.Listener
+		var err error
+		if network == NetworkTLS {
+			l, err = tls.Listen("tcp", address, tlsConfig)
+		} else {
+			l, err = net.Listen(network, address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rcv.address = l.Addr().String()
+		rcv.closer = func() { l.Close() }
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go rcv.readOctetCounted(conn)
+			}
+		}()
+	}
+	return rcv, nil
+}
+
+func (rcv *receiver) add(msg string) {
+	rcv.mutex.Lock()
+	defer rcv.mutex.Unlock()
+	rcv.messages = append(rcv.messages, msg)
+}
+
+// readOctetCounted reads "LEN SP MSG" framed messages from conn.
+func (rcv *receiver) readOctetCounted(conn net.Conn) {
+	defer conn.Close()
+	rdr := bufio.NewReader(conn)
+	for {
+		ln, err := rdr.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(ln))
+		if err != nil {
+			return
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rdr, buf); err != nil {
+			return
+		}
+		rcv.add(string(buf))
+	}
+}
+
+func (rcv *receiver) received() []string {
+	rcv.mutex.Lock()
+	defer rcv.mutex.Unlock()
+	return append([]string{}, rcv.messages...)
+}
+
+// waitFor calls write, then checks the received messages with done, repeating until done returns
+// true or a timeout. write is repeated since records written before the Sink starts following
+// the log are not sent.
+func (rcv *receiver) waitFor(write func(), done func(msgs []string) bool) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		write()
+		for i := 0; i < 10; i++ {
+			if done(rcv.received()) {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return false
+}
+
+// testTLSConfigs returns server and client configs using a self signed certificate.
+func testTLSConfigs() (*tls.Config, *tls.Config, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}, nil
+}
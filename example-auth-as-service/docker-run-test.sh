@@ -24,13 +24,29 @@ cleanup
 
 echo -e "\n\nbuild and run the container"
 docker build -t rest-app/example-auth-as-service:v0.0.0 .
-docker run -p 127.0.0.1:8000:8000/tcp -d --hostname example-auth-as-service --name example-auth-as-service rest-app/example:v0.0.0
+# The initial admin password is provided in the environment, and must be changed at first login.
+INITIAL_PASSWORD='Init1@l!234'
+ADMIN_PASSWORD='Adm1n@ss!234'
+docker run -e REST_APP_INITIAL_PASSWORD=$INITIAL_PASSWORD -p 127.0.0.1:8000:8000/tcp -d --hostname example-auth-as-service --name example-auth-as-service rest-app/example:v0.0.0
 
 # Give time for the container to start.
 sleep 5
 
+echo -e "\n\nlogin with the initial password, and set a new password"
+TOKEN_INITIAL=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$INITIAL_PASSWORD\"}" \
+    "https://127.0.0.1:8000/auth/login/")
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT \
+    -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    -H "Authorization: Bearer $TOKEN_INITIAL" \
+    "https://127.0.0.1:8000/auth/createorupdate/" | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "initial password change failed"
+    exitOnError
+fi
+
 echo -e "\n\nget admin token"
-TOKEN_ADMIN=$(curl -k -s -X PUT -d '{"Email":"admin", "Password":"P@ss!234"}' \
+TOKEN_ADMIN=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
     "https://127.0.0.1:8000/auth/login/")
 echo $TOKEN_ADMIN
 
@@ -1,28 +1,39 @@
 // example-auth-as-service is an example of using github.com/paulfdunn/rest-app (a framework for a
 // GO (GOLANG) based ReST APIs) to create a standalone application that
-// uses github.com/paulfdunn/authjwt for authentication.
+// uses github.com/paulfdunn/rest-app/core/auth for authentication.
 // This application includes the authentication directly in the service.
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/paulfdunn/authjwt"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
 	"github.com/paulfdunn/rest-app/core"
+	"github.com/paulfdunn/rest-app/core/auth"
 	"github.com/paulfdunn/rest-app/core/config"
 )
 
 const (
 	authFileSuffix = ".auth.db"
+	// initialPasswordEnv and initialPasswordFileEnv are the environment variables for the password,
+	// or the path of a file containing the password, of the initial administrator.
+	initialPasswordEnv     = "REST_APP_INITIAL_PASSWORD"
+	initialPasswordFileEnv = "REST_APP_INITIAL_PASSWORD_FILE"
+	// initialPasswordFileSuffix is for the file a generated initial password is written to.
+	initialPasswordFileSuffix = ".initial-password"
+	initialPasswordLength     = 20
 	// relative file paths will be joined with appPath to create the path to the file.
+	relativeAuditKeyPath   = "/key/audit.rsa.private"
 	relativeCertFilePath   = "/key/rest-app.crt"
 	relativeKeyFilePath    = "/key/rest-app.key"
 	relativePrivateKeyPath = "/key/jwt.rsa.private"
@@ -31,22 +42,30 @@ const (
 
 var (
 	appName = "example-auth-as-service"
+	// audiences are the services for which tokens are issued; tokens for example-telemetry are
+	// only accepted by example-telemetry, and have the scopes the roles of the user grant.
+	audiences = []auth.Audience{{Name: "example-telemetry",
+		Scopes: map[string]string{"telemetry:execute": auth.RoleOperator, "telemetry:read": auth.RoleViewer}}}
 
 	// API timeouts
 	apiReadTimeout  = 10 * time.Second
 	apiWriteTimeout = 10 * time.Second
 
 	// Any files in this list will be deleted on application reset using the CLI parameter
-	// See core/config.Init
-	filepathsToDeleteOnReset = []string{}
+	// See core/config.Init. The auth data source (with any snapshots and quarantined data) and the
+	// generated initial password are deleted, so the initial administrator is bootstrapped again.
+	filepathsToDeleteOnReset = []string{appName + authFileSuffix + "*", appName + initialPasswordFileSuffix}
 
 	// logh function pointers make logging calls more compact, but are optional.
 	lp  func(level logh.LoghLevel, v ...interface{})
 	lpf func(level logh.LoghLevel, format string, v ...interface{})
 
-	// initial credentials
-	initialEmail    = "admin"
-	initialPassword = "P@ss!234"
+	// initial credentials; the password is from initialPassword.
+	initialEmail = "admin"
+
+	// password character classes; generated passwords contain at least one of each.
+	passwordClasses = []string{"abcdefghijklmnopqrstuvwxyz", "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"0123456789", "!#$%*+-=?@^_"}
 )
 
 func main() {
@@ -75,6 +94,7 @@ func main() {
 	// Create the default config, then read overwrite any config that might have been saved at
 	// runtime (from a previous run, using config.Set()) with a call to config.Get()
 	core.ConfigInit(inputConfig, filepathsToDeleteOnReset)
+	core.SyslogInit(nil)
 	// logh function pointers make logging calls more compact, but are optional. Must be done after config
 	// has initialized logging
 	lp = logh.Map[appName].Println
@@ -89,33 +109,60 @@ func main() {
 	publicKeyPath := filepath.Join(appPath, relativePublicKeyPath)
 	jwtRemovalInterval := time.Minute
 	jwtExpirationInterval := time.Minute * 15
-	// Technically the authjwt.Config could be embedded in the core.Config, but that opens
+	refreshExpirationInterval := time.Hour * 24 * 7
+	refreshMaxInterval := time.Hour * 24 * 30
+	keyRotationInterval := time.Hour * 24 * 30
+	// Technically the auth.Config could be embedded in the core.Config, but that opens
 	// security holes allowing someone to redirect authentication to a different source.
-	ac := authjwt.Config{
-		AppName:                   *runtimeConfig.AppName,
-		AuditLogName:              *runtimeConfig.AuditLogName,
-		DataSourcePath:            filepath.Join(filepath.Dir(*runtimeConfig.DataSourcePath), *runtimeConfig.AppName+authFileSuffix),
-		CreateRequiresAuth:        true,
-		JWTAuthRemoveInterval:     jwtRemovalInterval,
-		JWTAuthExpirationInterval: jwtExpirationInterval,
-		JWTPrivateKeyPath:         privateKeyPath,
-		JWTPublicKeyPath:          publicKeyPath,
-		LogName:                   *runtimeConfig.LogName,
+	ac := auth.Config{
+		AdminEmails:                    []string{initialEmail},
+		AppName:                        *runtimeConfig.AppName,
+		Audiences:                      audiences,
+		DataSourcePath:                 filepath.Join(filepath.Dir(*runtimeConfig.DataSourcePath), *runtimeConfig.AppName+authFileSuffix),
+		CreateRequiresAuth:             true,
+		JWTAuthRemoveInterval:          jwtRemovalInterval,
+		JWTAuthExpirationInterval:      jwtExpirationInterval,
+		JWTPrivateKeyPath:              privateKeyPath,
+		JWTPublicKeyPath:               publicKeyPath,
+		KeyRotationInterval:            keyRotationInterval,
+		LogName:                        *runtimeConfig.LogName,
+		PasswordResetNotifier:          auth.LogNotifier{}, // no mail server; tokens are logged
+		RefreshTokenExpirationInterval: refreshExpirationInterval,
+		RefreshTokenMaxInterval:        refreshMaxInterval,
 	}
 	mux := http.NewServeMux()
-	var initialCreds *authjwt.Credential
-	if *runtimeConfig.DataSourceIsNew {
-		initialCreds = &authjwt.Credential{Email: &initialEmail, Password: &initialPassword}
+	core.OtherInit(&ac, mux, nil)
+	// The initial administrator is created when it is not in the auth data source; I.E. the first
+	// run, or after -reset. runtimeConfig.DataSourceIsNew is for the config data source, so it is
+	// not used.
+	exists, err := auth.AuthExists(initialEmail)
+	if err != nil {
+		log.Fatalf("fatal: %s initial administrator error:%v", runtimeh.SourceInfo(), err)
+	}
+	if !exists {
+		pfp := filepath.Join(filepath.Dir(*runtimeConfig.DataSourcePath), *runtimeConfig.AppName+initialPasswordFileSuffix)
+		initialPassword, err := initialPassword(pfp)
+		if err != nil {
+			log.Fatalf("fatal: %s initial password error:%v", runtimeh.SourceInfo(), err)
+		}
+		// The initial administrator must set a new password before any other use.
+		initialCreds := auth.Credential{Email: &initialEmail, Password: &initialPassword,
+			PasswordResetRequired: true, Roles: []string{auth.RoleAdmin}}
+		if err := initialCreds.AuthCreate(); err != nil {
+			log.Fatalf("fatal: %s creating initial administrator, error:%v", runtimeh.SourceInfo(), err)
+		}
+		lpf(logh.Info, "initial administrator created: %s", initialEmail)
 	}
-	core.OtherInit(&ac, mux, initialCreds)
+	core.LogAPIInit(mux)
+	cfp := filepath.Join(appPath, relativeCertFilePath)
+	kfp := filepath.Join(appPath, relativeKeyFilePath)
+	core.AuditCheckpointInit(filepath.Join(appPath, relativeAuditKeyPath))
 
 	// Registering with the trailing slash means the naked path is redirected to this path.
 	path := "/"
-	mux.HandleFunc(path, authjwt.HandlerFuncAuthJWTWrapper(handler))
+	mux.HandleFunc(path, auth.HandlerFuncRoleWrapper(auth.RoleViewer, handler))
 	lpf(logh.Info, "Registered handler: %s\n", path)
 
-	cfp := filepath.Join(appPath, relativeCertFilePath)
-	kfp := filepath.Join(appPath, relativeKeyFilePath)
 	// blocking call
 	core.ListenAndServeTLS(appName, mux, fmt.Sprintf(":%d", *runtimeConfig.HTTPSPort),
 		apiReadTimeout, apiWriteTimeout, cfp, kfp)
@@ -135,3 +182,86 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		lpf(logh.Error, "handler error: %v\n", err)
 	}
 }
+
+// initialPassword returns the password for the initial administrator from initialPasswordEnv, or
+// the file at initialPasswordFileEnv. Otherwise the password in the file at path is used when
+// the file exists; I.E. from a bootstrap that did not complete. Otherwise a random password is
+// generated and written to the file at path, readable only by the owner; the file is never
+// overwritten.
+func initialPassword(path string) (string, error) {
+	if pw := os.Getenv(initialPasswordEnv); pw != "" {
+		return pw, nil
+	}
+	if fp := os.Getenv(initialPasswordFileEnv); fp != "" {
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			return "", runtimeh.SourceInfoError("", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	if err == nil {
+		pw := strings.TrimSpace(string(b))
+		if pw == "" {
+			return "", fmt.Errorf("%s initial password file: %s is empty; delete it to generate a new password", runtimeh.SourceInfo(), path)
+		}
+		lpf(logh.Warning, "initial password for %s read from existing file: %s; it must be changed at first login", initialEmail, path)
+		return pw, nil
+	}
+
+	pw, err := passwordGenerate(initialPasswordLength)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	if _, err := f.WriteString(pw + "\n"); err != nil {
+		f.Close()
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", runtimeh.SourceInfoError("", err)
+	}
+	lpf(logh.Warning, "initial password for %s written to: %s; it must be changed at first login", initialEmail, path)
+	return pw, nil
+}
+
+// passwordGenerate returns a random password of length characters, with at least one character
+// from each of passwordClasses.
+func passwordGenerate(length int) (string, error) {
+	randInt := func(n int) (int, error) {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return 0, runtimeh.SourceInfoError("", err)
+		}
+		return int(i.Int64()), nil
+	}
+	all := strings.Join(passwordClasses, "")
+	pw := make([]byte, length)
+	for i := range pw {
+		chars := all
+		if i < len(passwordClasses) {
+			chars = passwordClasses[i]
+		}
+		j, err := randInt(len(chars))
+		if err != nil {
+			return "", err
+		}
+		pw[i] = chars[j]
+	}
+	// Shuffle so the class characters are not always first.
+	for i := len(pw) - 1; i > 0; i-- {
+		j, err := randInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		pw[i], pw[j] = pw[j], pw[i]
+	}
+	return string(pw), nil
+}
@@ -5,7 +5,6 @@ go 1.21.8
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/mattn/go-sqlite3 v1.14.22 // indirect
-	github.com/paulfdunn/authjwt v1.3.0 // indirect
 	github.com/paulfdunn/go-helper/databaseh v1.8.3 // indirect
 	github.com/paulfdunn/go-helper/logh v1.8.3 // indirect
 	github.com/paulfdunn/go-helper/neth v1.8.3 // indirect
@@ -14,6 +14,8 @@ function cleanup {
     rm example-auth-as-service
     rm example-auth-as-service.config.db
     rm example-auth-as-service.auth.db
+    rm example-auth-as-service.initial-password
+    rm -rf ./*.db.snapshots
     rm example-auth-as-service.log.*
 }
 
@@ -34,10 +36,118 @@ fi
 # Wait for app to start.
 sleep 5
 
-echo -e "\n\n Get admin token"
-TOKEN_ADMIN=$(curl -k -s -X PUT -d '{"Email":"admin", "Password":"P@ss!234"}' \
+echo -e "\n\n The initial admin password was generated, and written to a file only the owner can read."
+if [[ $(stat -c %a ./example-auth-as-service.initial-password) != 600 ]]; then
+    echo "initial password file was not created with mode 600"
+    exitOnError
+fi
+INITIAL_PASSWORD=$(cat ./example-auth-as-service.initial-password)
+ADMIN_PASSWORD='Adm1n@ss!234'
+
+echo -e "\n\n Login with the initial password; the token can only be used to set a new password."
+TOKEN_INITIAL=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$INITIAL_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/login/)
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "Authorization: Bearer $TOKEN_INITIAL" \
+    https://127.0.0.1:8000/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 403 ]]; then
+    echo "initial password token was not rejected on root path"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT \
+    -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    -H "Authorization: Bearer $TOKEN_INITIAL" \
+    https://127.0.0.1:8000/auth/createorupdate/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "initial password change failed"
+    exitOnError
+fi
+
+echo -e "\n\n Get admin token, and the refresh token from the Refresh-Token header"
+TOKEN_ADMIN=$(curl -k -s -D ./headers.txt -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
     https://127.0.0.1:8000/auth/login/)
 echo $TOKEN_ADMIN
+REFRESH_TOKEN=$(grep -i "^Refresh-Token:" ./headers.txt | cut -d' ' -f2 | tr -d '\r')
+rm ./headers.txt
+
+echo -e "\n\n Exchange the refresh token for a new token, without sending the password."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X POST -d "{\"RefreshToken\":\"$REFRESH_TOKEN\"}" \
+    https://127.0.0.1:8000/auth/refresh-token/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 201 ]]; then
+    echo "refresh token exchange failed"
+    exitOnError
+fi
+
+echo -e "\n\n Reusing the refresh token is detected, and gets a 401."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X POST -d "{\"RefreshToken\":\"$REFRESH_TOKEN\"}" \
+    https://127.0.0.1:8000/auth/refresh-token/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 401 ]]; then
+    echo "refresh token reuse was not detected"
+    exitOnError
+fi
+
+echo -e "\n\n Reuse also revoked the access tokens of the session, so login again."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 401 ]]; then
+    echo "access token was not revoked by refresh token reuse"
+    exitOnError
+fi
+TOKEN_ADMIN=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/login/)
+
+echo -e "\n\n The JWKS has the public key, and does not require auth."
+KID=$(curl -k -s https://127.0.0.1:8000/.well-known/jwks.json | jq -r '.keys[0].kid')
+if [[ -z $KID || $KID == null ]]; then
+    echo "JWKS did not have a key"
+    exitOnError
+fi
+
+echo -e "\n\n Rotate the signing key; the JWKS has both keys until the prior key is retired."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X POST \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/keys/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+KEYS=$(curl -k -s https://127.0.0.1:8000/.well-known/jwks.json | jq -r '.keys | length')
+if [[ $HTTP_STATUS != 201 || $KEYS != 2 ]]; then
+    echo "key rotation failed"
+    exitOnError
+fi
+
+echo -e "\n\n Create a service account and an API key, and use the API key on the root path."
+curl -k -s -X POST -d '{"Email":"robot", "Roles":["viewer"]}' \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/service-accounts/
+API_KEY=$(curl -k -s -X POST -d '{"Email":"robot", "Name":"test"}' \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/api-keys/ | jq -r '.Key')
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "X-API-Key: $API_KEY" \
+    https://127.0.0.1:8000/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 200 ]]; then
+    echo "API key was not accepted"
+    exitOnError
+fi
+
+echo -e "\n\n Use the API key as an OAuth2 client; get a token with the client credentials grant, and introspect it."
+CLIENT_ID=${API_KEY%%.*}
+CLIENT_SECRET=${API_KEY#*.}
+TOKEN_ENDPOINT=$(curl -k -s https://127.0.0.1:8000/.well-known/openid-configuration | jq -r '.token_endpoint')
+TOKEN_CLIENT=$(curl -k -s -u "$CLIENT_ID:$CLIENT_SECRET" -d grant_type=client_credentials \
+    $TOKEN_ENDPOINT | jq -r '.access_token')
+ACTIVE=$(curl -k -s -u "$CLIENT_ID:$CLIENT_SECRET" -d token=$TOKEN_CLIENT \
+    https://127.0.0.1:8000/oauth/introspect | jq -r '.active')
+if [[ $ACTIVE != true ]]; then
+    echo "client credentials token was not active"
+    exitOnError
+fi
 
 echo -e "\n\n Root path requires auth. Try root path with no auth and get a 401."
 HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
@@ -58,6 +168,19 @@ if [[ $HTTP_STATUS != 200 ]]; then
     exitOnError
 fi
 
+echo -e "\n\n A token for the example-telemetry audience is rejected by this service with a 401."
+TOKEN_TELEMETRY=$(curl -k -s -X PUT \
+    -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\", \"Audience\":\"example-telemetry\"}" \
+    https://127.0.0.1:8000/auth/login/)
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "Authorization: Bearer $TOKEN_TELEMETRY" \
+    https://127.0.0.1:8000/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 401 ]]; then
+    echo "token for another audience was accepted on root path"
+    exitOnError
+fi
+
 echo -e "\n\n Create a user."
 HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -d '{"Email":"user", "Password":"P@ss!234"}'\
     -H "Authorization: Bearer $TOKEN_ADMIN" \
@@ -68,6 +191,60 @@ if [[ $HTTP_STATUS != 201 ]]; then
     exitOnError
 fi
 
+echo -e "\n\n List the users; the admin and the user."
+USERS=$(curl -k -s -H "Authorization: Bearer $TOKEN_ADMIN" \
+    "https://127.0.0.1:8000/auth/users/?limit=10" | jq -r '[.Users[] | select(.ServiceAccount | not)] | length')
+if [[ $USERS != 2 ]]; then
+    echo "user list did not have the admin and the user"
+    exitOnError
+fi
+
+echo -e "\n\n View the password policy, and update it to ban a common password."
+POLICY=$(curl -k -s -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/password-policy/ | jq -c '.Banned = ["P@ssw0rd!"] | .History = 3')
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT -d "$POLICY" \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/password-policy/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "password policy update failed"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -d '{"Email":"banned", "Password":"P@ssw0rd!"}'\
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/createorupdate/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 400 ]]; then
+    echo "banned password was not rejected"
+    exitOnError
+fi
+
+echo -e "\n\n List the admin's sessions; the current session is flagged."
+CURRENT=$(curl -k -s -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8000/auth/sessions/ | jq -r '[.[] | select(.Current)] | length')
+if [[ $CURRENT != 1 ]]; then
+    echo "session list did not have the current session"
+    exitOnError
+fi
+
+echo -e "\n\n The admin impersonates the user; the user's sessions show the admin as the Actor, and the token cannot be refreshed."
+TOKEN_IMPERSONATE=$(curl -k -s -X POST -H "Authorization: Bearer $TOKEN_ADMIN" \
+    "https://127.0.0.1:8000/auth/impersonate/?email=user")
+ACTORS=$(curl -k -s -H "Authorization: Bearer $TOKEN_ADMIN" \
+    "https://127.0.0.1:8000/auth/sessions/?email=user" | jq -r '[.[] | select(.Actor == "admin")] | length')
+if [[ $ACTORS != 1 ]]; then
+    echo "user sessions did not have the impersonation session"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X POST -d '{}' \
+    -H "Authorization: Bearer $TOKEN_IMPERSONATE" \
+    https://127.0.0.1:8000/auth/refresh/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 403 ]]; then
+    echo "impersonation token refresh did not get 403"
+    exitOnError
+fi
+
 echo -e "\n\n User logs in and deletes their own account"
 TOKEN_USER=$(curl -k -s -X PUT -d '{"Email":"user", "Password":"P@ss!234"}' \
     https://127.0.0.1:8000/auth/login/)
@@ -81,6 +258,50 @@ if [[ $HTTP_STATUS != 204 ]]; then
     exitOnError
 fi
 
+echo -e "\n\n The revocation list has the deleted user's tokens, and does not require auth."
+SUBJECTS=$(curl -k -s https://127.0.0.1:8000/auth/revocations/ | jq -r '[.Revocations[] | select(.Subject)] | length')
+if [[ $SUBJECTS != 1 ]]; then
+    echo "revocation list did not have the deleted user"
+    exitOnError
+fi
+
+echo -e "\n\n Self-service password reset; the reset token is written to the log, then used to set a new password."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X POST -d '{"Email":"admin"}' \
+    https://127.0.0.1:8000/auth/password-reset/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 202 ]]; then
+    echo "password reset request failed"
+    exitOnError
+fi
+sleep 1
+RESET_TOKEN=$(grep -o "notification for email: admin, subject: .* password reset, token: [0-9a-f]*" \
+    example-auth-as-service.log.0 | tail -1 | sed 's/.*token: //')
+ADMIN_PASSWORD='R3set@ss!234'
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT \
+    -d "{\"Token\":\"$RESET_TOKEN\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/password-reset/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "password reset failed"
+    exitOnError
+fi
+
+echo -e "\n\n A failed login delays the next login, which gets a 429, even with the correct password."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT -d '{"Email":"admin", "Password":"wrong"}' \
+    https://127.0.0.1:8000/auth/login/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 401 ]]; then
+    echo "failed login was not rejected"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/login/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 429 ]]; then
+    echo "login after a failed login was not delayed"
+    exitOnError
+fi
+
 echo -e "\n\n"
 cat example-auth-as-service.log.0
 echo -e "\n\n"
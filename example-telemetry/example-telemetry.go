@@ -13,11 +13,18 @@
 // occur other than those that occur within runner. I.E. don't update a Task in the foreground while
 // updates are happening in the background (go routine), or the foreground updates will be lost.
 //
-// TODO: REGEX filter to reject/limit values in command/shell
+// The Command, File, and Shell values of tasks are restricted by a CommandPolicy; see policy.go.
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,19 +34,21 @@ import (
 	"runtime/debug"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
-	"github.com/paulfdunn/authjwt"
 	"github.com/paulfdunn/go-helper/archiveh/ziph"
-	"github.com/paulfdunn/go-helper/databaseh/kvs"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/osh"
 	"github.com/paulfdunn/go-helper/osh/exech"
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
 	"github.com/paulfdunn/rest-app/core"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/auth"
 	"github.com/paulfdunn/rest-app/core/config"
+	"github.com/paulfdunn/rest-app/core/storage"
 )
 
 type Task struct {
@@ -59,6 +68,10 @@ type Task struct {
 	// The File slice is filtered to only included files with a modified time within the last
 	// FileModifiedSeconds. Default is no filtering based on file modified time.
 	FileModifiedSeconds *int `json:",omitempty"`
+	// Owner is the Email of the account that created the task; output only, do not provide with
+	// PUT/POST. Only the owner, or an administrator, can get the status of, download, cancel, or
+	// delete the task.
+	Owner string `json:",omitempty"`
 	// ProcessError, ProcessCommand, ProcessShell, ProcessZip are status information provided as the task runs.
 	ProcessCommand []string `json:",omitempty"`
 	ProcessError   []string `json:",omitempty"`
@@ -72,6 +85,9 @@ type Task struct {
 	// should never be parsed for data processing; use the numeric value as string output is subject to change.
 	// Internally this value is never stored; it is only added to ReST API output as data is returned.
 	StatusString string `json:",omitempty"`
+	// Tenant is the tenant of the account that created the task; output only, do not provide with
+	// PUT/POST. Tasks are only visible to accounts of the same tenant.
+	Tenant string `json:",omitempty"`
 	// UUID is a UUID that is returned with a task POST
 	UUID *uuid.UUID `json:",omitempty"`
 }
@@ -103,10 +119,20 @@ const (
 	dateFormat = "2006-01-02 15:04:05" //UTC, 24 hour notation
 
 	// relative file paths will be joined with appPath to create the path to the file.
-	relativeCertFilePath  = "/key/rest-app.crt"
-	relativeKeyFilePath   = "/key/rest-app.key"
+	relativeAuditKeyPath = "/key/audit.rsa.private"
+	relativeCertFilePath = "/key/rest-app.crt"
+	relativeKeyFilePath  = "/key/rest-app.key"
+	// relativeAuthCertFilePath is the TLS certificate of example-auth-as-service, which is pinned
+	// for requests to the auth service; the certificate is self signed.
+	relativeAuthCertFilePath = "../example-auth-as-service/key/rest-app.crt"
+	// relativePublicKeyPath is the pinned public key, used when the JWKS cannot be fetched.
 	relativePublicKeyPath = "../example-auth-as-service/key/jwt.rsa.public"
 
+	// scopes of the telemetry audience, required in addition to the roles of tokens issued for
+	// the audience; see auth.Audience.
+	scopeExecute = "telemetry:execute"
+	scopeRead    = "telemetry:read"
+
 	stderrFileSuffix = ".stderr.txt"
 	stdoutFileSuffix = ".stdout.txt"
 	zipFileSuffix    = ".zip"
@@ -117,11 +143,13 @@ const (
 	taskKeyFile           = "File"
 	taskKeyProcessError   = "ProcessError"
 	taskKeyExpiration     = "Expiration"
+	taskKeyOwner          = "Owner"
 	taskKeyProcessCommand = "ProcessCommand"
 	taskKeyProcessShell   = "ProcessShell"
 	taskKeyProcessZip     = "ProcessZip"
 	taskKeyShell          = "Shell"
 	taskKeyStatus         = "Status"
+	taskKeyTenant         = "Tenant"
 	taskKeyUUID           = "UUID"
 
 	taskDataDirectory   = "taskdata"
@@ -130,10 +158,12 @@ const (
 )
 
 const (
+	pathPolicy = "/policy/"
 	pathTask   = "/task/"
 	pathStatus = "/status/"
 
-	queryParamUUID = "uuid"
+	queryParamOwner = "owner"
+	queryParamUUID  = "uuid"
 )
 
 const (
@@ -147,6 +177,9 @@ var (
 	// maxTasks is the maximum number of tasks that can be running in parallel.
 	// This is a variable so it can be increased during testing.
 	maxTasks = 5
+	// tenantTasksMutex serializes counting the active tasks of a tenant and creating a task, so
+	// tenantMaxTasks cannot be exceeded by concurrent requests.
+	tenantTasksMutex sync.Mutex
 	// task channels take a Task.Key()
 	taskCancel    chan string
 	taskCompleted chan string
@@ -156,10 +189,31 @@ var (
 	// filepath.Join(task.Dir(),taskDirInclude)
 	taskDirIncludeMarker = "{TASK_DIR_INCLUDE}"
 	taskDirInclude       = "include/"
+
+	// taskPermissions are the roles required for pathTask. Creating a task with a Command requires
+	// auth.RoleOperator, with a Shell requires auth.RoleAdmin; see taskPost. GET also requires
+	// scopeRead, and other methods scopeExecute; see handlerTask.
+	taskPermissions = auth.Permissions{
+		http.MethodDelete: auth.RoleOperator,
+		http.MethodGet:    auth.RoleViewer,
+		http.MethodPost:   auth.RoleOperator,
+		http.MethodPut:    auth.RoleOperator,
+	}
 )
 
 var (
 	appName = "example-telemetry"
+	// authURL is the URL of example-auth-as-service; the JWKS is fetched from it, and API keys
+	// are exchanged with it.
+	authURL = flag.String("auth-url", "https://127.0.0.1:8000", "URL of the auth service, used to fetch the keys for validating tokens.")
+	// commandPolicyFilepath is a JSON CommandPolicy, used until administrators update the policy
+	// using pathPolicy.
+	commandPolicyFilepath = flag.String("command-policy-filepath", "", "Fully qualified path to a JSON command policy, "+
+		"used until the policy is updated at runtime; default (blank) allows all commands.")
+	// tenantMaxTasks is the maximum number of active (accepted, running, or canceling) tasks for
+	// each tenant, so one tenant cannot use all of maxTasks. The default tenant, of accounts
+	// without a tenant, is only limited by maxTasks.
+	tenantMaxTasks = flag.Int("tenant-max-tasks", 3, "Maximum number of active tasks for each tenant; 0 for no limit.")
 	// Path to this executable
 	appPath string
 
@@ -178,7 +232,9 @@ var (
 	runtimeConfig config.Config
 
 	// The KVS stores all task data
-	telemetryKVS kvs.KVS
+	telemetryKVS storage.Store
+	// telemetryDataSourcePath is the path of telemetryKVS; used to quarantine unreadable tasks.
+	telemetryDataSourcePath string
 )
 
 func main() {
@@ -207,6 +263,7 @@ func main() {
 	// Create the default config, then read overwrite any config that might have been saved at
 	// runtime (from a previous run, using config.Set()) with a call to config.Get()
 	core.ConfigInit(inputConfig, filepathsToDeleteOnReset)
+	core.SyslogInit(nil)
 	// logh function pointers make logging calls more compact, but are optional. Must be done after config
 	// has initialized logging
 	lp = logh.Map[appName].Println
@@ -217,30 +274,45 @@ func main() {
 	lpf(logh.Info, "Config: %s", runtimeConfig)
 
 	publicKeyPath := filepath.Join(appPath, relativePublicKeyPath)
-	ac := authjwt.Config{
+	ac := auth.Config{
+		APIKeyTokenURL:   strings.TrimSuffix(*authURL, "/") + "/auth/api-key-token/",
 		AppName:          *runtimeConfig.AppName,
+		Audience:         *runtimeConfig.AppName,
+		JWKSURL:          strings.TrimSuffix(*authURL, "/") + "/.well-known/jwks.json",
 		JWTPublicKeyPath: publicKeyPath,
 		LogName:          *runtimeConfig.LogName,
+		RevocationsURL:   strings.TrimSuffix(*authURL, "/") + "/auth/revocations/",
+	}
+	if ac.AuthServiceClient, err = pinnedClient(filepath.Join(appPath, relativeAuthCertFilePath)); err != nil {
+		lpf(logh.Error, "pinnedClient error, the auth service will be verified using the system roots:%v", err)
 	}
 	mux := http.NewServeMux()
 	core.OtherInit(&ac, nil, nil)
+	core.LogAPIInit(mux)
+	cfp := filepath.Join(appPath, relativeCertFilePath)
+	kfp := filepath.Join(appPath, relativeKeyFilePath)
+	core.AuditCheckpointInit(filepath.Join(appPath, relativeAuditKeyPath))
 
 	initializeKVS(filepath.Dir(*runtimeConfig.DataSourcePath), *runtimeConfig.AppName+telemetryFileSuffix)
+	initializePolicyKVS(filepath.Dir(*runtimeConfig.DataSourcePath), *runtimeConfig.AppName+commandPolicyFileSuffix)
+	if err := commandPolicyLoad(); err != nil {
+		log.Fatalf("fatal: %s loading command policy, error:%v", runtimeh.SourceInfo(), err)
+	}
 
 	path := "/"
-	mux.HandleFunc(path, authjwt.HandlerFuncAuthJWTWrapper(handlerRoot))
+	mux.HandleFunc(path, auth.HandlerFuncRoleWrapper(auth.RoleViewer, handlerRoot))
 	lpf(logh.Info, "Registered handler: %s\n", path)
-	mux.HandleFunc(pathStatus, authjwt.HandlerFuncAuthJWTWrapper(handlerStatus))
+	mux.HandleFunc(pathPolicy, auth.HandlerFuncRoleWrapper(auth.RoleAdmin, handlerPolicy))
+	lpf(logh.Info, "Registered handler: %s\n", pathPolicy)
+	mux.HandleFunc(pathStatus, auth.HandlerFuncRoleWrapper(auth.RoleViewer, handlerStatus))
 	lpf(logh.Info, "Registered handler: %s\n", pathStatus)
-	mux.HandleFunc(pathTask, authjwt.HandlerFuncAuthJWTWrapper(handlerTask))
+	mux.HandleFunc(pathTask, auth.HandlerFuncPermissionsWrapper(taskPermissions, handlerTask))
 	lpf(logh.Info, "Registered handler: %s\n", pathTask)
 
 	deleteExpiredTasks()
 	initializeTaskInfrastructure()
 	startupAddRunningTasks()
 
-	cfp := filepath.Join(appPath, relativeCertFilePath)
-	kfp := filepath.Join(appPath, relativeKeyFilePath)
 	// blocking call
 	core.ListenAndServeTLS(appName, mux, fmt.Sprintf(":%d", *runtimeConfig.HTTPSPort),
 		apiReadTimeout, apiWriteTimeout, cfp, kfp)
@@ -322,7 +394,8 @@ func (tsk *Task) Equal(inputTask *Task, allowedExpirationDifference time.Duratio
 	return false
 }
 
-// Dir returns the filepath to data directory for the task.
+// Dir returns the filepath to data directory for the task; the directories of the tasks of a
+// tenant are in a directory for the tenant.
 func (tsk *Task) Dir() string {
 	return filepath.Join(*runtimeConfig.PersistentDirectory, taskDataDirectory, tsk.Key())
 }
@@ -333,9 +406,14 @@ func (tsk *Task) DirInclude() string {
 }
 
 // Key returns the key used for storing/retrieving a task from telemetryKVS. Having this in a
-// function will make changing the key to something else easier. I.E. maybe add the JWT Email so
-// to the key so only the owner can operator on the task.
+// function will make changing the key to something else easier.
+// The Tenant is part of the key, so a task can only be addressed with the tenant of the task;
+// tasks of the default tenant are keyed by UUID alone. The Owner is not part of the key, so
+// administrators can address any task of the tenant by UUID; see taskAccess.
 func (tsk *Task) Key() string {
+	if tsk.Tenant != "" {
+		return tsk.Tenant + "/" + tsk.UUID.String()
+	}
 	return tsk.UUID.String()
 }
 
@@ -668,18 +746,15 @@ func deleteExpiredTasks() {
 	for _, key := range keys {
 		dtask := Task{}
 		err := telemetryKVS.Deserialize(key, &dtask)
-		if err != nil {
-			log.Fatalf("Deserialize task: %+v", err)
+		if err == nil {
+			err = validateTask(dtask)
 		}
-		// A Task in the KVS should always have non-nil expiration.
-		if dtask.Expiration == nil {
-			lpf(logh.Error, "Task has nil expiration in KVS: %s", key)
-		}
-		exp, err := time.Parse(dateFormat, *dtask.Expiration)
 		if err != nil {
-			log.Fatalf("time.Parse: %+v", err)
+			quarantineTask(key, err)
+			continue
 		}
-		if dtask.Expiration != nil && time.Now().After(exp) {
+		exp, _ := time.Parse(dateFormat, *dtask.Expiration)
+		if time.Now().After(exp) {
 			if err := os.RemoveAll(dtask.Dir()); err != nil {
 				lpf(logh.Error, "delete data directory %s error:%v", dtask.Dir(), err)
 			}
@@ -698,13 +773,92 @@ func filenameFromCommand(cmd string) string {
 }
 
 // initializeKVS initializes the KVS, creating a new KVS if required otherwise attaching to the existing KVS.
+// The KVS is checked for integrity; unreadable tasks are quarantined and an unreadable KVS is
+// restored from a snapshot, rather than failing to start. The CommandPolicy has its own data
+// source; see initializePolicyKVS.
 func initializeKVS(datasourcePath string, filename string) {
-	dataSourcePath := filepath.Join(datasourcePath, filename)
-	lpf(logh.Info, "telemetryKVS path: %s", dataSourcePath)
+	telemetryDataSourcePath = filepath.Join(datasourcePath, filename)
+	lpf(logh.Info, "telemetryKVS path: %s", telemetryDataSourcePath)
 	var err error
-	if telemetryKVS, err = kvs.New(dataSourcePath, telemetryTable); err != nil {
-		log.Fatalf("fatal: %s fatal: could not create New kvs, error: %v", runtimeh.SourceInfo(), err)
+	var rcv storage.Recovery
+	validate := func(key string, value []byte) error {
+		dtask := Task{}
+		if err := json.Unmarshal(value, &dtask); err != nil {
+			return err
+		}
+		return validateTask(dtask)
+	}
+	rc := storage.RecoveryConfig{Validate: validate}
+	if runtimeConfig.LogName != nil {
+		rc.LogName = *runtimeConfig.LogName
+	}
+	telemetryKVS, rcv, err = storage.OpenChecked(telemetryDataSourcePath, telemetryTable, rc)
+	if err != nil {
+		log.Fatalf("fatal: %s fatal: could not open storage, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if rcv.Changed() {
+		lpf(logh.Error, "telemetryKVS recovered: %s", rcv)
+		audit.Printf("telemetryKVS recovered: %s", rcv)
+	} else {
+		lpf(logh.Info, "telemetryKVS integrity check passed: %s", rcv)
+	}
+}
+
+// pinnedClient returns an HTTP client that only trusts the TLS certificate in certPath. The
+// example certificates are self signed, and have no subject alternative names, so the standard
+// verification cannot be used.
+func pinnedClient(certPath string) (*http.Client, error) {
+	b, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
 	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s no PEM data in certificate: %s", runtimeh.SourceInfo(), certPath)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, runtimeh.SourceInfoError("", err)
+	}
+
+	tlsConfig := &tls.Config{
+		// The certificate is verified by VerifyPeerCertificate.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+				return errors.New("certificate does not match the pinned certificate")
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// quarantineTask quarantines a task that could not be read or is not valid.
+func quarantineTask(key string, reason error) {
+	lpf(logh.Error, "quarantining task: %s, reason: %v", key, reason)
+	if err := storage.QuarantineRecord(telemetryKVS, telemetryDataSourcePath, telemetryTable, key, reason); err != nil {
+		lpf(logh.Error, "QuarantineRecord error: %v", err)
+		return
+	}
+	audit.Printf("task quarantined: %s, reason: %v", key, reason)
+}
+
+// validateTask validates the fields of a persisted Task that are required after startup.
+func validateTask(tsk Task) error {
+	if tsk.UUID == nil {
+		return fmt.Errorf("task has nil UUID")
+	}
+	// A Task in the KVS should always have non-nil expiration.
+	if tsk.Expiration == nil {
+		return fmt.Errorf("task has nil Expiration")
+	}
+	if _, err := time.Parse(dateFormat, *tsk.Expiration); err != nil {
+		return fmt.Errorf("task Expiration: %v", err)
+	}
+	return nil
 }
 
 func initializeTaskInfrastructure() {
@@ -728,7 +882,8 @@ func startupAddRunningTasks() {
 		dtask := Task{}
 		err := telemetryKVS.Deserialize(v, &dtask)
 		if err != nil {
-			log.Fatalf("Deserialize task: %+v", err)
+			quarantineTask(v, err)
+			continue
 		}
 		if dtask.Status != nil && slices.Contains([]TaskStatus{Accepted, Running}, *dtask.Status) {
 			taskRun <- v
@@ -736,6 +891,29 @@ func startupAddRunningTasks() {
 	}
 }
 
+// tenantActiveTasks returns the number of tasks of the tenant that are accepted, running, or
+// canceling.
+func tenantActiveTasks(tenant string) (int, error) {
+	keys, err := telemetryKVS.Keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, tenant+"/") {
+			continue
+		}
+		dtask := Task{}
+		if err := telemetryKVS.Deserialize(key, &dtask); err != nil {
+			return 0, err
+		}
+		if dtask.Status != nil && slices.Contains([]TaskStatus{Accepted, Canceling, Running}, *dtask.Status) {
+			count++
+		}
+	}
+	return count, nil
+}
+
 // taskRunner accepts new tasks on the taskRun channel. Callers will be blocked until the task
 // is accepted.
 func taskRunner() {
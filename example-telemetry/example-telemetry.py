@@ -6,6 +6,7 @@ import shutil
 import ssl
 import time
 import urllib
+import urllib.error
 import urllib.request
 
 parser = argparse.ArgumentParser(
@@ -14,6 +15,10 @@ parser = argparse.ArgumentParser(
 
 parser.add_argument('--ip', required=True,
                     help='IP of the telemetry target.')
+parser.add_argument('--email', default='admin',
+                    help='Email of the account to login with.')
+parser.add_argument('--password', required=True,
+                    help='Password of the account; the initial admin password must be changed first.')
 
 args = parser.parse_args()
 
@@ -23,30 +28,57 @@ sscContext = ssl.create_default_context()
 sscContext.check_hostname = False
 sscContext.verify_mode = ssl.CERT_NONE
 
-# Get an auth token.
+# Get an auth token, and a refresh token that is used to get new auth tokens without resending
+# the password.
 loginURL = f"https://{args.ip}:8000/auth/login/"
 req = urllib.request.Request(
-    loginURL, data=b'{"Email":"admin", "Password":"P@ss!234"}', method='PUT')
+    loginURL, data=json.dumps({"Audience": "example-telemetry", "Email": args.email, "Password": args.password}).encode('utf-8'),
+    method='PUT')
 try:
     response = urllib.request.urlopen(req, context=sscContext)
 except Exception as error:
     print(f"\nlogin error:{error}")
     exit()
 token = response.read()
+refreshToken = response.headers.get("Refresh-Token")
 response.close()
 
+
+def refresh():
+    """Exchange the refresh token for a new auth token; the refresh token is rotated."""
+    global token, refreshToken
+    refreshURL = f"https://{args.ip}:8000/auth/refresh-token/"
+    req = urllib.request.Request(
+        refreshURL, data=json.dumps({"RefreshToken": refreshToken}).encode('utf-8'), method='POST')
+    response = urllib.request.urlopen(req, context=sscContext)
+    token = response.read()
+    refreshToken = response.headers.get("Refresh-Token")
+    response.close()
+
+
+def urlopen(url, data=None, method='GET'):
+    """Open url with the auth token, refreshing the token once if it has expired."""
+    for attempt in range(2):
+        headers = {
+            "Authorization": "Bearer " + token.decode("utf-8")
+        }
+        req = urllib.request.Request(
+            url, data=data, headers=headers, method=method)
+        try:
+            return urllib.request.urlopen(req, context=sscContext)
+        except urllib.error.HTTPError as error:
+            if error.code != 401 or attempt > 0 or refreshToken is None:
+                raise
+            refresh()
+
+
 # Create a task
 taskURL = f"https://{args.ip}:8001/task/"
 payload = {
     "Command": ["ls -al"],
 }
-headers = {
-    "Authorization": "Bearer " + token.decode("utf-8")
-}
-req = urllib.request.Request(
-    taskURL, data=json.dumps(payload).encode('utf-8'), headers=headers, method='POST')
 try:
-    response = urllib.request.urlopen(req, context=sscContext)
+    response = urlopen(taskURL, data=json.dumps(payload).encode('utf-8'), method='POST')
 except Exception as error:
     print(f"\ntask create error:{error}")
     exit()
@@ -58,13 +90,8 @@ print(f"\ncreatedTask:{createdTask}")
 completed = False
 while not completed:
     statusURL = f"https://{args.ip}:8001/status/?uuid={createdTask['UUID']}"
-    headers = {
-        "Authorization": "Bearer " + token.decode("utf-8")
-    }
-    req = urllib.request.Request(
-        statusURL, headers=headers, method='GET')
     try:
-        response = urllib.request.urlopen(req, context=sscContext)
+        response = urlopen(statusURL)
     except Exception as error:
         print(f"\nstatus get error:{error}")
         exit()
@@ -81,13 +108,8 @@ print(f"status at completion: {statusGet[0]}")
 
 # Download the file
 downloadURL = f"https://{args.ip}:8001/task/?uuid={createdTask['UUID']}"
-headers = {
-    "Authorization": "Bearer " + token.decode("utf-8")
-}
-req = urllib.request.Request(
-    downloadURL, headers=headers, method='GET')
 try:
-    response = urllib.request.urlopen(req, context=sscContext)
+    response = urlopen(downloadURL)
 except Exception as error:
     print(f"\nstatus get error:{error}")
     exit()
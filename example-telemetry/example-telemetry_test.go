@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
@@ -19,6 +20,8 @@ import (
 	"github.com/paulfdunn/go-helper/archiveh/ziph"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/auth"
+	"github.com/paulfdunn/rest-app/core/storage"
 )
 
 type expectedResponse struct {
@@ -30,6 +33,11 @@ type expectedResponse struct {
 	task        *Task
 }
 
+var (
+	// handlerTaskAdmin is handlerTask called by an administrator.
+	handlerTaskAdmin = withRole(auth.RoleAdmin, handlerTask)
+)
+
 func init() {
 	t := testing.T{}
 	testSetup(&t)
@@ -204,7 +212,7 @@ func TestExpectedResponse(t *testing.T) {
 	// http.MethoDelete tests
 	// negative tests - invalid UUID
 	task1 := Task{UUID: &invalidUUID}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodDelete, http.StatusBadRequest, nil, "?uuid=" + invalidUUID.String(), &task1})
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodDelete, http.StatusBadRequest, nil, "?uuid=" + invalidUUID.String(), &task1})
 	// positive tests - for a valid UUID, the Task status must be one of Canceled, Completed, or Expired. So
 	// create valid tasks and test against those.
 	for i := Accepted; i <= Running; i++ {
@@ -222,34 +230,34 @@ func TestExpectedResponse(t *testing.T) {
 		default:
 			expectedStatus = http.StatusBadRequest
 		}
-		expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodDelete, expectedStatus, nil, "?uuid=" + vu.String(), nil})
+		expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodDelete, expectedStatus, nil, "?uuid=" + vu.String(), nil})
 	}
 
 	// http.MethodGet tests
 	// negative tests - invalid UUID
 	task4 := Task{UUID: &invalidUUID}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodGet, http.StatusBadRequest, nil, "?uuid=" + invalidUUID.String(), &task4})
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodGet, http.StatusBadRequest, nil, "?uuid=" + invalidUUID.String(), &task4})
 
 	// http.MethodPost tests
 	// Post with a UUID is not valid
 	task5 := Task{UUID: &validUUID}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodPost, http.StatusBadRequest, nil, "", &task5})
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodPost, http.StatusBadRequest, nil, "", &task5})
 	task6 := Task{}
 	ik := []string{taskKeyCancel, taskKeyProcessCommand, taskKeyProcessError,
-		taskKeyProcessShell, taskKeyProcessZip, taskKeyStatus}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodPost, http.StatusBadRequest, ik, "", &task6})
+		taskKeyProcessShell, taskKeyProcessZip, taskKeyOwner, taskKeyStatus, taskKeyTenant}
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodPost, http.StatusBadRequest, ik, "", &task6})
 
 	// http.MethodPut tests
 	// PUT is only valid with both Cancel==true and a valid UUID
 	tr := true
 	task7 := Task{UUID: &validUUID}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodPut, http.StatusBadRequest, nil, "", &task7})
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodPut, http.StatusBadRequest, nil, "", &task7})
 	task8 := Task{UUID: &validUUID, Cancel: &tr}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodPut, http.StatusAccepted, nil, "", &task8})
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodPut, http.StatusAccepted, nil, "", &task8})
 	task9 := Task{UUID: &validUUID}
 	ik = []string{taskKeyCommand, taskKeyFile, taskKeyExpiration, taskKeyProcessCommand, taskKeyProcessError,
-		taskKeyProcessShell, taskKeyProcessZip, taskKeyShell, taskKeyStatus}
-	expectedResponses = append(expectedResponses, expectedResponse{handlerTask, http.MethodPut, http.StatusBadRequest, ik, "", &task9})
+		taskKeyProcessShell, taskKeyProcessZip, taskKeyOwner, taskKeyShell, taskKeyStatus, taskKeyTenant}
+	expectedResponses = append(expectedResponses, expectedResponse{handlerTaskAdmin, http.MethodPut, http.StatusBadRequest, ik, "", &task9})
 
 	for i, er := range expectedResponses {
 		if i == 11 {
@@ -270,7 +278,7 @@ func TestExpectedResponse(t *testing.T) {
 // TestStatus POSTs several tasks, and validates it can get a single status with a query string and
 // that it can get all status for all created tasks.
 func TestStatus(t *testing.T) {
-	testServerStatus := httptest.NewServer(http.HandlerFunc(handlerStatus))
+	testServerStatus := httptest.NewServer(http.HandlerFunc(withRole(auth.RoleAdmin, handlerStatus)))
 	defer testServerStatus.Close()
 
 	if err := clearTelemetryKVS(t); err != nil {
@@ -320,7 +328,7 @@ func TestStatus(t *testing.T) {
 // TestTaskPost verifies POSTs with default and specified expirations
 // run and complete. Verification is done by reading the KVS
 func TestTaskPost(t *testing.T) {
-	testServer := httptest.NewServer(http.HandlerFunc(handlerTask))
+	testServer := httptest.NewServer(http.HandlerFunc(handlerTaskAdmin))
 	defer testServer.Close()
 
 	// Loop0 - POST a task with no expiration and validate it is set to the default.
@@ -369,9 +377,439 @@ func TestTaskPost(t *testing.T) {
 	}
 }
 
+// TestTaskPostRoles verifies the roles required to POST a Command or Shell task.
+func TestTaskPostRoles(t *testing.T) {
+	tests := []struct {
+		role   string
+		task   Task
+		status int
+	}{
+		{auth.RoleViewer, Task{Command: []string{"ls"}}, http.StatusForbidden},
+		{auth.RoleOperator, Task{Shell: []string{"ls"}}, http.StatusForbidden},
+		{auth.RoleOperator, Task{Command: []string{"ls"}, Shell: []string{"ls"}}, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		er := expectedResponse{withRole(test.role, handlerTask), http.MethodPost, test.status, nil, "", &test.task}
+		er.test(t, i)
+	}
+}
+
+// TestTaskScopes verifies tokens for the telemetry audience require the scope of the method.
+func TestTaskScopes(t *testing.T) {
+	tests := []struct {
+		method string
+		scopes []string
+		status int
+	}{
+		{http.MethodPost, []string{scopeRead}, http.StatusForbidden},
+		{http.MethodDelete, []string{scopeRead}, http.StatusForbidden},
+		{http.MethodGet, []string{scopeExecute}, http.StatusForbidden},
+		{http.MethodGet, []string{scopeRead}, http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		hf := func(w http.ResponseWriter, r *http.Request) {
+			claims := &auth.CustomClaims{Email: "admin@test.com", Roles: []string{auth.RoleAdmin}, Scopes: test.scopes}
+			claims.Audience = appName
+			handlerTask(w, r.WithContext(auth.ContextWithClaims(r.Context(), claims)))
+		}
+		er := expectedResponse{hf, test.method, test.status, nil, "", &Task{Command: []string{"ls"}}}
+		er.test(t, i)
+	}
+}
+
+// TestTaskAPIKeyScopes verifies API keys for the telemetry audience require the scope of the
+// method, and API keys without the audience are rejected.
+func TestTaskAPIKeyScopes(t *testing.T) {
+	mux := http.NewServeMux()
+	auth.Init(auth.Config{AppName: appName, Audience: appName,
+		Audiences: []auth.Audience{{Name: appName,
+			Scopes: map[string]string{scopeExecute: auth.RoleOperator, scopeRead: auth.RoleViewer}}},
+		DataSourcePath: filepath.Join(t.TempDir(), "auth.db"), JWTAuthExpirationInterval: time.Minute,
+		JWTAuthRemoveInterval: -1, JWTPrivateKeyPath: "../example-auth-as-service/key/jwt.rsa.private",
+		JWTPublicKeyPath: relativePublicKeyPath}, mux)
+	authServer := httptest.NewServer(mux)
+	defer authServer.Close()
+	taskServer := httptest.NewServer(http.HandlerFunc(auth.HandlerFuncPermissionsWrapper(taskPermissions, handlerTask)))
+	defer taskServer.Close()
+	statusServer := httptest.NewServer(http.HandlerFunc(auth.HandlerFuncRoleWrapper(auth.RoleViewer, handlerStatus)))
+	defer statusServer.Close()
+
+	em, pw := "admin@test.com", "P@ssword1234"
+	cred := auth.Credential{Email: &em, Password: &pw, Roles: []string{auth.RoleAdmin}}
+	if err := cred.AuthCreate(); err != nil {
+		t.Errorf("AuthCreate error: %v", err)
+		return
+	}
+	// The administrator's token is for this service, which requires its audience.
+	cred.Audience = appName
+	body, _ := json.Marshal(cred)
+	status, token := apiKeyTestRequest(t, http.MethodPut, authServer.URL+"/auth/login/", "", "", body)
+	if status != http.StatusOK {
+		t.Errorf("login status: %d", status)
+		return
+	}
+	sa := "robot@test.com"
+	body, _ = json.Marshal(auth.Credential{Email: &sa, Roles: []string{auth.RoleOperator}})
+	if status, _ := apiKeyTestRequest(t, http.MethodPost, authServer.URL+"/auth/service-accounts/", string(token), "", body); status != http.StatusCreated {
+		t.Errorf("service account status: %d", status)
+		return
+	}
+	keys := map[string]string{}
+	for name, akr := range map[string]auth.APIKeyRequest{
+		"read":     {Audience: appName, Email: &sa, Scopes: []string{scopeRead}},
+		"execute":  {Audience: appName, Email: &sa, Scopes: []string{scopeExecute}},
+		"audience": {Email: &sa}} {
+		body, _ = json.Marshal(akr)
+		status, b := apiKeyTestRequest(t, http.MethodPost, authServer.URL+"/auth/api-keys/", string(token), "", body)
+		created := auth.APIKeyCreated{}
+		if err := json.Unmarshal(b, &created); status != http.StatusCreated || err != nil {
+			t.Errorf("API key status: %d, error: %v", status, err)
+			return
+		}
+		keys[name] = created.Key
+	}
+
+	task, _ := json.Marshal(Task{Command: []string{"ls"}})
+	tests := []struct {
+		method string
+		url    string
+		key    string
+		status int
+	}{
+		{http.MethodPost, taskServer.URL, keys["read"], http.StatusForbidden},
+		{http.MethodGet, statusServer.URL, keys["read"], http.StatusOK},
+		{http.MethodGet, statusServer.URL, keys["execute"], http.StatusForbidden},
+		{http.MethodPost, taskServer.URL, keys["execute"], http.StatusCreated},
+		{http.MethodGet, statusServer.URL, keys["audience"], http.StatusUnauthorized},
+		{http.MethodPost, taskServer.URL, keys["audience"], http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		if status, _ := apiKeyTestRequest(t, test.method, test.url, "", test.key, task); status != test.status {
+			t.Errorf("i: %d, status: %d", i, status)
+			return
+		}
+	}
+}
+
+// TestTenants verifies the tasks of a tenant are not visible to other tenants, by status or by
+// UUID, are stored in a directory of the tenant, and are limited by tenantMaxTasks.
+func TestTenants(t *testing.T) {
+	serverA := httptest.NewServer(withTenant("team-a", handlerTask))
+	defer serverA.Close()
+	serverB := httptest.NewServer(withTenant("team-b", handlerTask))
+	defer serverB.Close()
+	statusA := httptest.NewServer(withTenant("team-a", handlerStatus))
+	defer statusA.Close()
+	statusB := httptest.NewServer(withTenant("team-b", handlerStatus))
+	defer statusB.Close()
+
+	resp, err := http.Post(serverA.URL, "application/json", bytes.NewBuffer([]byte("{}")))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST error: %v, status: %d", err, resp.StatusCode)
+		return
+	}
+	rtask := Task{}
+	if err := json.NewDecoder(resp.Body).Decode(&rtask); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	rtask.Tenant = "team-a"
+	if err := telemetryKVS.Deserialize(rtask.Key(), &rtask); err != nil || rtask.Status == nil ||
+		!strings.Contains(rtask.Dir(), filepath.Join("team-a", rtask.UUID.String())) {
+		t.Errorf("task: %+v, dir: %s, error: %v", rtask, rtask.Dir(), err)
+		return
+	}
+
+	query := "?" + queryParamUUID + "=" + rtask.UUID.String()
+	rtasks := []Task{}
+	if err := getAndUnmarshal(t, statusA.URL+query, &rtasks); err != nil || len(rtasks) != 1 {
+		t.Errorf("tenant status: %+v", rtasks)
+		return
+	}
+	rtasks = []Task{}
+	if err := getAndUnmarshal(t, statusB.URL+query, &rtasks); err != nil || len(rtasks) != 0 {
+		t.Errorf("other tenant status: %+v", rtasks)
+		return
+	}
+
+	// Other tenants get the same response as for a UUID that does not exist.
+	tr := true
+	for i, er := range []expectedResponse{
+		{withTenant("team-b", handlerTask), http.MethodGet, http.StatusBadRequest, nil, query, nil},
+		{withTenant("team-b", handlerTask), http.MethodDelete, http.StatusBadRequest, nil, query, nil},
+		{withTenant("team-b", handlerTask), http.MethodPut, http.StatusBadRequest, nil, "", &Task{Cancel: &tr, UUID: rtask.UUID}},
+	} {
+		er.test(t, i)
+	}
+
+	defer func(max int) { *tenantMaxTasks = max }(*tenantMaxTasks)
+	*tenantMaxTasks = 1
+	running := Running
+	u := uuid.New()
+	ctask := Task{Status: &running, Tenant: "team-c", UUID: &u}
+	if err := telemetryKVS.Serialize(ctask.Key(), ctask); err != nil {
+		t.Errorf("Serialize error: %+v", err)
+		return
+	}
+	er := expectedResponse{withTenant("team-c", handlerTask), http.MethodPost, http.StatusTooManyRequests, nil, "", &Task{}}
+	er.test(t, 0)
+	// The command policy decision is kept in the audit record of the rejected task.
+	aw := &auth.AuditWriter{ResponseWriter: httptest.NewRecorder()}
+	withTenant("team-c", handlerTask)(aw, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer([]byte("{}"))))
+	if aw.StatusCode != http.StatusTooManyRequests || !strings.Contains(aw.Message, "allowed by command policy") ||
+		!strings.Contains(aw.Message, "active tasks") {
+		t.Errorf("status: %d, audit message: %s", aw.StatusCode, aw.Message)
+		return
+	}
+	er = expectedResponse{withTenant("team-b", handlerTask), http.MethodPost, http.StatusCreated, nil, "", &Task{}}
+	er.test(t, 1)
+}
+
+// TestTaskOwner verifies tasks are only visible to their owner, and administrators, who can filter
+// the status by owner.
+func TestTaskOwner(t *testing.T) {
+	owner := &auth.CustomClaims{Email: "owner@test.com", Roles: []string{auth.RoleOperator}}
+	other := &auth.CustomClaims{Email: "other@test.com", Roles: []string{auth.RoleOperator}}
+	admin := &auth.CustomClaims{Email: "admin@test.com", Roles: []string{auth.RoleAdmin}}
+	ownerServer := httptest.NewServer(withClaims(owner, handlerTask))
+	defer ownerServer.Close()
+	statusServers := map[*auth.CustomClaims]*httptest.Server{}
+	for _, claims := range []*auth.CustomClaims{owner, other, admin} {
+		statusServers[claims] = httptest.NewServer(withClaims(claims, handlerStatus))
+		defer statusServers[claims].Close()
+	}
+
+	resp, err := http.Post(ownerServer.URL, "application/json", bytes.NewBuffer([]byte("{}")))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST error: %v, status: %d", err, resp.StatusCode)
+		return
+	}
+	rtask := Task{}
+	if err := json.NewDecoder(resp.Body).Decode(&rtask); err != nil {
+		t.Errorf("Decode error: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	query := "?" + queryParamUUID + "=" + rtask.UUID.String()
+	for i, test := range []struct {
+		claims *auth.CustomClaims
+		query  string
+		count  int
+	}{
+		{owner, query, 1},
+		{other, query, 0},
+		{admin, query, 1},
+		{admin, query + "&" + queryParamOwner + "=" + owner.Email, 1},
+		{admin, query + "&" + queryParamOwner + "=" + other.Email, 0},
+	} {
+		rtasks := []Task{}
+		if err := getAndUnmarshal(t, statusServers[test.claims].URL+test.query, &rtasks); err != nil || len(rtasks) != test.count {
+			t.Errorf("i: %d, tasks: %+v", i, rtasks)
+			return
+		}
+		if test.count == 1 && rtasks[0].Owner != owner.Email {
+			t.Errorf("i: %d, owner: %s", i, rtasks[0].Owner)
+			return
+		}
+	}
+	if resp, err := http.Get(statusServers[other].URL + "?" + queryParamOwner + "=" + owner.Email); err != nil ||
+		resp.StatusCode != http.StatusForbidden {
+		t.Errorf("owner filter by non administrator error: %v, status: %d", err, resp.StatusCode)
+		return
+	}
+
+	// Other users get the same response as for a UUID that does not exist.
+	tr := true
+	for i, er := range []expectedResponse{
+		{withClaims(other, handlerTask), http.MethodGet, http.StatusBadRequest, nil, query, nil},
+		{withClaims(other, handlerTask), http.MethodDelete, http.StatusBadRequest, nil, query, nil},
+		{withClaims(other, handlerTask), http.MethodPut, http.StatusBadRequest, nil, "", &Task{Cancel: &tr, UUID: rtask.UUID}},
+	} {
+		er.test(t, i)
+	}
+
+	time.Sleep(taskRunnerCycleTime * 5)
+	if err := telemetryKVS.Deserialize(rtask.Key(), &rtask); err != nil {
+		t.Errorf("Deserialize error: %+v", err)
+		return
+	}
+	cmplt := Completed
+	rtask.Status = &cmplt
+	if err := telemetryKVS.Serialize(rtask.Key(), rtask); err != nil {
+		t.Errorf("Serialize error: %+v", err)
+		return
+	}
+	er := expectedResponse{withClaims(admin, handlerTask), http.MethodDelete, http.StatusNoContent, nil, query, nil}
+	er.test(t, 0)
+}
+
+// TestCommandPolicy verifies administrators view and update the command policy, the policy is
+// persisted, rules apply per role, and rejected tasks get the violations.
+func TestCommandPolicy(t *testing.T) {
+	defer func() {
+		if _, err := commandPolicyKVS.Delete(commandPolicyKey); err != nil {
+			t.Errorf("Delete error: %v", err)
+		}
+		if err := commandPolicySet(CommandPolicy{}); err != nil {
+			t.Errorf("commandPolicySet error: %v", err)
+		}
+	}()
+	operator := &auth.CustomClaims{Email: "operator@test.com", Roles: []string{auth.RoleOperator}}
+	admin := &auth.CustomClaims{Email: "admin@test.com", Roles: []string{auth.RoleAdmin}}
+	policyServer := httptest.NewServer(withClaims(admin, handlerPolicy))
+	defer policyServer.Close()
+
+	for i, invalid := range []CommandPolicy{
+		{Rules: []CommandRule{{Roles: []string{"none"}}}},
+		{Rules: []CommandRule{{ShellDeny: []string{"("}}}},
+	} {
+		b, _ := json.Marshal(invalid)
+		if status := policyRequest(t, policyServer.URL, b); status != http.StatusBadRequest {
+			t.Errorf("i: %d, status: %d", i, status)
+			return
+		}
+	}
+	policy := CommandPolicy{Rules: []CommandRule{
+		{CommandAllow: []string{"^echo "}, CommandDeny: []string{"secret"}, Roles: []string{auth.RoleOperator}},
+		{FileDeny: []string{"^/etc/"}},
+	}}
+	b, _ := json.Marshal(policy)
+	if status := policyRequest(t, policyServer.URL, b); status != http.StatusNoContent {
+		t.Errorf("update policy status: %d", status)
+		return
+	}
+	rpolicy := CommandPolicy{}
+	if err := getAndUnmarshal(t, policyServer.URL, &rpolicy); err != nil || len(rpolicy.Rules) != 2 {
+		t.Errorf("policy: %+v", rpolicy)
+		return
+	}
+
+	zero, one := 0, 1
+	for i, test := range []struct {
+		claims     *auth.CustomClaims
+		task       Task
+		status     int
+		violations []PolicyViolation
+	}{
+		{operator, Task{Command: []string{"echo policy"}}, http.StatusCreated, nil},
+		{operator, Task{Command: []string{"echo policy", "echo secret"}}, http.StatusForbidden,
+			[]PolicyViolation{{Field: taskKeyCommand, Index: 1, Reason: "matches a deny REGEX", Regex: "secret", Rule: &zero, Value: "echo secret"}}},
+		{operator, Task{Command: []string{"ls"}}, http.StatusForbidden,
+			[]PolicyViolation{{Field: taskKeyCommand, Index: 0, Reason: "matches no allow REGEX", Value: "ls"}}},
+		// Rules for operators do not apply to administrators; rules without Roles apply to all.
+		{admin, Task{Command: []string{"ls"}}, http.StatusCreated, nil},
+		{admin, Task{File: []string{"/etc/passwd"}}, http.StatusForbidden,
+			[]PolicyViolation{{Field: taskKeyFile, Index: 0, Reason: "matches a deny REGEX", Regex: "^/etc/", Rule: &one, Value: "/etc/passwd"}}},
+	} {
+		taskServer := httptest.NewServer(withClaims(test.claims, handlerTask))
+		b, _ := json.Marshal(test.task)
+		resp, err := http.Post(taskServer.URL, "application/json", bytes.NewBuffer(b))
+		taskServer.Close()
+		if err != nil || resp.StatusCode != test.status {
+			t.Errorf("i: %d, error: %v, status: %d", i, err, resp.StatusCode)
+			return
+		}
+		if test.violations != nil {
+			violations := []PolicyViolation{}
+			if err := json.NewDecoder(resp.Body).Decode(&violations); err != nil ||
+				!reflect.DeepEqual(violations, test.violations) {
+				t.Errorf("i: %d, violations: %+v, error: %v", i, violations, err)
+				return
+			}
+		}
+		resp.Body.Close()
+	}
+
+	// The persisted policy is used instead of commandPolicyFilepath.
+	fp := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(fp, []byte("{}"), 0644); err != nil {
+		t.Errorf("WriteFile error: %v", err)
+		return
+	}
+	priorFilepath := *commandPolicyFilepath
+	*commandPolicyFilepath = fp
+	defer func() { *commandPolicyFilepath = priorFilepath }()
+	if err := commandPolicyLoad(); err != nil || !reflect.DeepEqual(commandPolicy, policy) {
+		t.Errorf("loaded policy: %+v, error: %v", commandPolicy, err)
+		return
+	}
+
+	// A policy that cannot be persisted is not used.
+	closed, err := storage.Open(filepath.Join(t.TempDir(), "closed.db"), commandPolicyTable)
+	if err != nil {
+		t.Errorf("Open error: %v", err)
+		return
+	}
+	if err := closed.Close(); err != nil {
+		t.Errorf("Close error: %v", err)
+		return
+	}
+	priorKVS := commandPolicyKVS
+	commandPolicyKVS = closed
+	defer func() { commandPolicyKVS = priorKVS }()
+	b, _ = json.Marshal(CommandPolicy{})
+	if status := policyRequest(t, policyServer.URL, b); status != http.StatusInternalServerError {
+		t.Errorf("unpersisted policy status: %d", status)
+		return
+	}
+	commandPolicyMutex.RLock()
+	defer commandPolicyMutex.RUnlock()
+	if !reflect.DeepEqual(commandPolicy, policy) {
+		t.Errorf("unpersisted policy was used: %+v", commandPolicy)
+		return
+	}
+}
+
+// TestCommandPolicyRecovery validates the persisted command policy survives corruption of the
+// telemetry data source, and is restored from a snapshot when its own data source is corrupted.
+func TestCommandPolicyRecovery(t *testing.T) {
+	priorKVS, priorDataSourcePath, priorPolicyKVS := telemetryKVS, telemetryDataSourcePath, commandPolicyKVS
+	defer func() {
+		telemetryKVS, telemetryDataSourcePath, commandPolicyKVS = priorKVS, priorDataSourcePath, priorPolicyKVS
+		if err := commandPolicySet(CommandPolicy{}); err != nil {
+			t.Errorf("commandPolicySet error: %v", err)
+		}
+	}()
+	dir := t.TempDir()
+	initializeKVS(dir, appName+telemetryFileSuffix)
+	initializePolicyKVS(dir, appName+commandPolicyFileSuffix)
+	policy := CommandPolicy{Rules: []CommandRule{{CommandDeny: []string{"^rm "}}}}
+	if err := commandPolicyKVS.Serialize(commandPolicyKey, policy); err != nil {
+		t.Errorf("Serialize error: %v", err)
+		return
+	}
+	// Opening again takes a snapshot with the policy.
+	if err := commandPolicyKVS.Close(); err != nil {
+		t.Errorf("Close error: %v", err)
+		return
+	}
+	initializePolicyKVS(dir, appName+commandPolicyFileSuffix)
+
+	for _, fp := range []string{appName + telemetryFileSuffix, appName + commandPolicyFileSuffix} {
+		for _, s := range []storage.Store{telemetryKVS, commandPolicyKVS} {
+			if err := s.Close(); err != nil {
+				t.Errorf("Close error: %v", err)
+				return
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fp), []byte("not a database, not a database, not a database"), 0644); err != nil {
+			t.Errorf("WriteFile error: %v", err)
+			return
+		}
+		initializeKVS(dir, appName+telemetryFileSuffix)
+		initializePolicyKVS(dir, appName+commandPolicyFileSuffix)
+		if err := commandPolicyLoad(); err != nil || !reflect.DeepEqual(commandPolicy, policy) {
+			t.Errorf("corrupted: %s, policy: %+v, error: %v", fp, commandPolicy, err)
+			return
+		}
+	}
+}
+
 // TestTaskPostAndDelete does a POST to create a task, updates the status to Completed, then deletes that task.
 func TestTaskPostAndDelete(t *testing.T) {
-	testServer := httptest.NewServer(http.HandlerFunc(handlerTask))
+	testServer := httptest.NewServer(http.HandlerFunc(handlerTaskAdmin))
 	defer testServer.Close()
 
 	task := Task{}
@@ -410,7 +848,7 @@ func TestTaskPostAndDelete(t *testing.T) {
 
 // TestTaskPostAndCancel POSTs a new task, validates it status gets changed to Completed, and validates canceling that task
 func TestTaskPostAndCancel(t *testing.T) {
-	testServer := httptest.NewServer(http.HandlerFunc(handlerTask))
+	testServer := httptest.NewServer(http.HandlerFunc(handlerTaskAdmin))
 	defer testServer.Close()
 
 	task := Task{Shell: []string{"ls -alt"}}
@@ -464,6 +902,33 @@ func TestTaskPostAndCancel(t *testing.T) {
 	}
 }
 
+// TestQuarantineTask validates invalid tasks are quarantined at startup rather than fatal.
+func TestQuarantineTask(t *testing.T) {
+	// Use a separate KVS, as other tests persist tasks without Expiration.
+	priorKVS, priorDataSourcePath := telemetryKVS, telemetryDataSourcePath
+	defer func() { telemetryKVS, telemetryDataSourcePath = priorKVS, priorDataSourcePath }()
+	initializeKVS(t.TempDir(), appName+telemetryFileSuffix)
+
+	validUUID := uuid.New()
+	exp := time.Now().Add(time.Hour).UTC().Format(dateFormat)
+	st := Completed
+	valid := Task{Expiration: &exp, Status: &st, UUID: &validUUID}
+	invalidUUID := uuid.New()
+	invalid := Task{UUID: &invalidUUID}
+	for _, tsk := range []Task{valid, invalid} {
+		if err := telemetryKVS.Serialize(tsk.Key(), tsk); err != nil {
+			t.Errorf("Serialize error: %+v", err)
+			return
+		}
+	}
+
+	deleteExpiredTasks()
+	keys, err := telemetryKVS.Keys()
+	if err != nil || len(keys) != 1 || keys[0] != valid.Key() {
+		t.Errorf("invalid task not quarantined, keys: %v, error: %v", keys, err)
+	}
+}
+
 // Post new task, poll status until completed, download file and validate.
 // Test twice: loop 0 tests no FileModifiedSeconds, loop 1 tests FileModifiedSeconds
 // with a short value to filter out the test file.
@@ -500,9 +965,9 @@ func TestRoundTrip(t *testing.T) {
 				filenameFromCommand(cmd) + stdoutFileSuffix}
 		}
 
-		testServerStatus := httptest.NewServer(http.HandlerFunc(handlerStatus))
+		testServerStatus := httptest.NewServer(http.HandlerFunc(withRole(auth.RoleAdmin, handlerStatus)))
 		defer testServerStatus.Close()
-		testServerTask := httptest.NewServer(http.HandlerFunc(handlerTask))
+		testServerTask := httptest.NewServer(http.HandlerFunc(handlerTaskAdmin))
 		defer testServerTask.Close()
 
 		// Sleep long enough for files to age out when testing FileModifiedSeconds
@@ -616,6 +1081,50 @@ func (er expectedResponse) test(t *testing.T, i int) {
 	}
 }
 
+// withRole returns hf called with the claims of a user having role.
+func withRole(role string, hf http.HandlerFunc) http.HandlerFunc {
+	return withClaims(&auth.CustomClaims{Email: role + "@test.com", Roles: []string{role}}, hf)
+}
+
+// withClaims returns hf called with claims.
+func withClaims(claims *auth.CustomClaims, hf http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hf(w, r.WithContext(auth.ContextWithClaims(r.Context(), claims)))
+	}
+}
+
+// withTenant returns hf called by an administrator of tenant.
+func withTenant(tenant string, hf http.HandlerFunc) http.HandlerFunc {
+	return withClaims(&auth.CustomClaims{Email: "admin@" + tenant + ".com", Roles: []string{auth.RoleAdmin}, Tenant: tenant}, hf)
+}
+
+// apiKeyTestRequest sends the request with the token, or the API key, and returns the response
+// status and body.
+func apiKeyTestRequest(t *testing.T, method string, url string, token string, key string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return 0, nil
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if key != "" {
+		req.Header.Set(auth.APIKeyHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Do error: %v", err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("ReadAll error: %v", err)
+	}
+	return resp.StatusCode, b
+}
+
 // setKey will either set or clear a key for testing.
 func (tsk *Task) setKey(key string, set bool) {
 	if set {
@@ -643,6 +1152,10 @@ func (tsk *Task) setKey(key string, set bool) {
 		case taskKeyStatus:
 			accptd := Accepted
 			tsk.Status = &accptd
+		case taskKeyOwner:
+			tsk.Owner = "other@test.com"
+		case taskKeyTenant:
+			tsk.Tenant = "other"
 		}
 	} else {
 		switch key {
@@ -666,6 +1179,10 @@ func (tsk *Task) setKey(key string, set bool) {
 			tsk.Shell = nil
 		case taskKeyStatus:
 			tsk.Status = nil
+		case taskKeyOwner:
+			tsk.Owner = ""
+		case taskKeyTenant:
+			tsk.Tenant = ""
 		}
 	}
 }
@@ -706,6 +1223,22 @@ func getAndUnmarshal(t *testing.T, URL string, obj interface{}) error {
 	return nil
 }
 
+// policyRequest will PUT the policy in b and return the status.
+func policyRequest(t *testing.T, URL string, b []byte) int {
+	req, err := http.NewRequest(http.MethodPut, URL, bytes.NewBuffer(b))
+	if err != nil {
+		t.Errorf("NewRequest error: %v", err)
+		return 0
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Do error: %v", err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
 // requestAndDeserialize will make a request using httpMethod, sending inputBytes, then deserialize key into obj.
 func requestAndDeserialize(t *testing.T, httpMethod string, URL string, inputBytes []byte, key string, obj interface{}) error {
 	client := &http.Client{}
@@ -729,7 +1262,7 @@ func requestAndDeserialize(t *testing.T, httpMethod string, URL string, inputByt
 
 // testTaskPost is a helper function to POST a Task and return the returned Task.
 func testTaskPost(t *testing.T, task Task) (*Task, error) {
-	testServer := httptest.NewServer(http.HandlerFunc(handlerTask))
+	testServer := httptest.NewServer(http.HandlerFunc(handlerTaskAdmin))
 	defer testServer.Close()
 
 	taskBytes, err := json.Marshal(task)
@@ -779,6 +1312,7 @@ func testSetup(t *testing.T) {
 
 	// Every call to TempDir returns a unique directory; there is no need to remove files.
 	initializeKVS(tempDir, appName+telemetryFileSuffix)
+	initializePolicyKVS(tempDir, appName+commandPolicyFileSuffix)
 	maxTasks = 500
 	initializeTaskInfrastructure()
 }
@@ -4,7 +4,6 @@ go 1.21.8
 
 require (
 	github.com/google/uuid v1.6.0
-	github.com/paulfdunn/authjwt v1.3.2
 	github.com/paulfdunn/go-helper/archiveh v1.10.1
 	github.com/paulfdunn/go-helper/databaseh v1.10.1
 	github.com/paulfdunn/go-helper/logh v1.10.1
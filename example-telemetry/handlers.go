@@ -11,9 +11,9 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/paulfdunn/authjwt"
 	"github.com/paulfdunn/go-helper/logh"
 	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/rest-app/core/auth"
 )
 
 // handlerRoot does nothing other than return application information.
@@ -31,8 +31,10 @@ func handlerRoot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handlerStatus
-// http.MethodGet - get status for all tasks or tasks specified using queryParamUUID
+// handlerStatus requires scopeRead.
+// http.MethodGet - get status for all tasks, of the tenant of the caller, or tasks specified using
+// queryParamUUID. Callers only get the status of their own tasks; administrators get the status
+// of the tasks of all owners, or of the owner in queryParamOwner.
 func handlerStatus(w http.ResponseWriter, r *http.Request) {
 	lpf(logh.Debug, "handlerStatus http.request: %v\n", *r)
 
@@ -40,6 +42,13 @@ func handlerStatus(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if !auth.RequireScope(w, r, scopeRead) {
+		return
+	}
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
 
 	keys, err := telemetryKVS.Keys()
 	if err != nil {
@@ -50,14 +59,12 @@ func handlerStatus(w http.ResponseWriter, r *http.Request) {
 
 	query := r.URL.Query()
 	uuids, filterUUID := query[queryParamUUID]
-	var tasks []Task
-	if filterUUID {
-		tasks = make([]Task, len(uuids))
-	} else {
-		tasks = make([]Task, len(keys))
+	owners, filterOwner := query[queryParamOwner]
+	if filterOwner && !auth.RequireRole(w, r, auth.RoleAdmin) {
+		return
 	}
-	index := 0
-	for i, key := range keys {
+	tasks := []Task{}
+	for _, key := range keys {
 		dtask := Task{}
 		err := telemetryKVS.Deserialize(key, &dtask)
 		dtask.StatusString = dtask.Status.String()
@@ -66,11 +73,13 @@ func handlerStatus(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if filterUUID && slices.Contains(uuids, key) {
-			tasks[index] = dtask
-			index++
-		} else if !filterUUID {
-			tasks[i] = dtask
+		// Tasks of other tenants are not visible.
+		if dtask.Tenant != tenant || dtask.UUID == nil || !taskAccess(r, dtask) ||
+			(filterOwner && !slices.Contains(owners, dtask.Owner)) {
+			continue
+		}
+		if !filterUUID || slices.Contains(uuids, dtask.UUID.String()) {
+			tasks = append(tasks, dtask)
 		}
 	}
 	b, err := json.Marshal(tasks)
@@ -86,12 +95,17 @@ func handlerStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handlerTask
+// handlerTask requires scopeRead for http.MethodGet, and scopeExecute for other methods.
 // http.MethodDelete - deletes files for Task.UUID; TaskStatus MUST be Canceled, Completed, or Expired.
 // Use queryParamUUID with a single UUID; more than one UUID is invalid.
 // http.MethodGet - fetch files for a task for Task.UUID; TaskStatus MUST be Canceled, Completed, or Expired.
 // Use queryParamUUID with a single UUID; more than one UUID is invalid.
 // http.MethodPost - create a new task. It is invalid to any keys other than: Command, Expiration, or Shell.
+// Command requires auth.RoleOperator and Shell requires auth.RoleAdmin. Tenants with tenantMaxTasks
+// active tasks get http.StatusTooManyRequests. Tasks the CommandPolicy rejects get
+// http.StatusForbidden, and the body is a slice of PolicyViolation.
+// Tasks are those of the tenant of the caller; a UUID of a task of another tenant is not found.
+// Tasks of other owners are not found, except by administrators; see taskAccess.
 // http.MethodPut - with Cancel key 'true' and valid UUID to cancel; providing any other fields or
 // value 'false' will error. (Tasks cannot be un-canceled.) You cannot change fields once posted; delete
 // the task and create a new task.
@@ -103,6 +117,13 @@ func handlerTask(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	scope := scopeExecute
+	if r.Method == http.MethodGet {
+		scope = scopeRead
+	}
+	if !auth.RequireScope(w, r, scope) {
+		return
+	}
 
 	if r.Method == http.MethodDelete {
 		taskDelete(w, r)
@@ -133,13 +154,17 @@ func taskDelete(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	key, ok := tenantTaskKey(w, r, uuids[0])
+	if !ok {
+		return
+	}
 	dtask := Task{}
-	err := telemetryKVS.Deserialize(uuids[0], &dtask)
+	err := telemetryKVS.Deserialize(key, &dtask)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if dtask.UUID == nil || dtask.Status == nil ||
+	if dtask.UUID == nil || dtask.Status == nil || !taskAccess(r, dtask) ||
 		(*dtask.Status != Canceled && *dtask.Status != Completed && *dtask.Status != Expired) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -153,7 +178,7 @@ func taskDelete(w http.ResponseWriter, r *http.Request) {
 		lpf(logh.Error, "telemetryKVS.Delete error:%v", err)
 	}
 
-	if aw, ok := w.(*authjwt.AuditWriter); ok {
+	if aw, ok := w.(*auth.AuditWriter); ok {
 		aw.Message = fmt.Sprintf("delete issued for task with UUID: %s", *dtask.UUID)
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -167,13 +192,17 @@ func taskGet(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	key, ok := tenantTaskKey(w, r, uuids[0])
+	if !ok {
+		return
+	}
 	dtask := Task{}
-	err := telemetryKVS.Deserialize(uuids[0], &dtask)
+	err := telemetryKVS.Deserialize(key, &dtask)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if dtask.UUID == nil || dtask.Status == nil {
+	if dtask.UUID == nil || dtask.Status == nil || !taskAccess(r, dtask) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -191,10 +220,42 @@ func taskPost(w http.ResponseWriter, r *http.Request) {
 	}
 	if task.Cancel != nil || task.ProcessCommand != nil ||
 		task.ProcessError != nil || task.ProcessShell != nil || task.ProcessZip != nil ||
-		task.Status != nil || task.UUID != nil {
+		task.Owner != "" || task.Status != nil || task.Tenant != "" || task.UUID != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if task.Shell != nil && !auth.RequireRole(w, r, auth.RoleAdmin) {
+		return
+	}
+	if task.Command != nil && !auth.RequireRole(w, r, auth.RoleOperator) {
+		return
+	}
+	if violations := commandPolicyCheck(r, task); len(violations) > 0 {
+		if aw, ok := w.(*auth.AuditWriter); ok {
+			aw.Message = fmt.Sprintf("task rejected by command policy, %s", policyViolationsString(violations))
+		}
+		b, err := json.Marshal(violations)
+		if err != nil {
+			lpf(logh.Error, "json.Marshal error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		if _, err = w.Write(b); err != nil {
+			lpf(logh.Error, "w.Write error:%v", err)
+		}
+		return
+	}
+	// The policy decision is audited whatever the outcome of the request; later outcomes are
+	// appended to the message.
+	if aw, ok := w.(*auth.AuditWriter); ok {
+		aw.Message = "task allowed by command policy"
+	}
 
 	var expiration time.Time
 	var err error
@@ -215,6 +276,10 @@ func taskPost(w http.ResponseWriter, r *http.Request) {
 	task.UUID = &nu
 	acpt := Accepted
 	task.Status = &acpt
+	task.Tenant = tenant
+	if claims, ok := auth.ClaimsFromRequest(r); ok {
+		task.Owner = claims.Email
+	}
 
 	// Create the directory used to hold output data for the task
 	if _, err := os.Stat(task.DirInclude()); os.IsNotExist(err) {
@@ -228,8 +293,8 @@ func taskPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return the task UUID
-	if aw, ok := w.(*authjwt.AuditWriter); ok {
-		aw.Message = fmt.Sprintf("task create with UUID: %s", *task.UUID)
+	if aw, ok := w.(*auth.AuditWriter); ok {
+		aw.Message += fmt.Sprintf(", task create with UUID: %s, tenant: %s", *task.UUID, task.Tenant)
 	}
 	// Return a Task with only a UUID
 	rtask := Task{UUID: task.UUID}
@@ -242,12 +307,22 @@ func taskPost(w http.ResponseWriter, r *http.Request) {
 
 	// Serialize prior to putting in the taskRun channel so there is no race condition.
 	// But this means the task needs deleted on error.
-	err = telemetryKVS.Serialize(task.Key(), task)
+	created, err := taskSerialize(task)
 	if err != nil {
 		lpf(logh.Error, "%v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !created {
+		if err := os.RemoveAll(task.Dir()); err != nil {
+			lpf(logh.Error, "delete data directory %s error:%v", task.Dir(), err)
+		}
+		if aw, ok := w.(*auth.AuditWriter); ok {
+			aw.Message += fmt.Sprintf(", task rejected, tenant: %s has %d active tasks", tenant, *tenantMaxTasks)
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 
 	// Schedule the task or error if there are no slots open to run another task
 	select {
@@ -257,13 +332,16 @@ func taskPost(w http.ResponseWriter, r *http.Request) {
 		if _, err := telemetryKVS.Delete(task.Key()); err != nil {
 			lpf(logh.Error, "telemetryKVS.Delete error:%v", err)
 		}
+		if aw, ok := w.(*auth.AuditWriter); ok {
+			aw.Message += ", task deleted as it could not be scheduled"
+		}
 		w.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
 
 	// TODO: This needs to be an absolute path...
 	// w.Header().Set("Location", strings.Replace(r.URL.RequestURI(), pathTask, pathStatus, -1))
-	w.Header().Set("Location", path.Join(pathStatus, task.Key()))
+	w.Header().Set("Location", path.Join(pathStatus, task.UUID.String()))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if _, err = w.Write(b); err != nil {
@@ -281,11 +359,15 @@ func taskPut(w http.ResponseWriter, r *http.Request) {
 		(task.Cancel != nil && !*task.Cancel) ||
 		task.Command != nil || task.Expiration != nil || task.File != nil ||
 		task.ProcessCommand != nil || task.ProcessError != nil || task.ProcessShell != nil || task.ProcessZip != nil ||
-		task.Shell != nil || task.Status != nil ||
+		task.Owner != "" || task.Shell != nil || task.Status != nil || task.Tenant != "" ||
 		task.UUID == nil || *task.UUID == uuid.Nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	var ok bool
+	if task.Tenant, ok = requestTenant(w, r); !ok {
+		return
+	}
 
 	dtask := Task{}
 	err := telemetryKVS.Deserialize(task.Key(), &dtask)
@@ -293,7 +375,7 @@ func taskPut(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if dtask.UUID == nil {
+	if dtask.UUID == nil || !taskAccess(r, dtask) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -306,8 +388,68 @@ func taskPut(w http.ResponseWriter, r *http.Request) {
 	}
 	taskCancel <- task.Key()
 
-	if aw, ok := w.(*authjwt.AuditWriter); ok {
+	if aw, ok := w.(*auth.AuditWriter); ok {
 		aw.Message = fmt.Sprintf("task status changed to %s with UUID: %s", Canceling, *task.UUID)
 	}
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// requestTenant returns the tenant of the claims of the request; the default tenant, "", when
+// there are no claims. A tenant that is not valid gets http.StatusForbidden and false is
+// returned; callers should then return without writing header status.
+func requestTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	claims, ok := auth.ClaimsFromRequest(r)
+	if !ok {
+		return "", true
+	}
+	if err := auth.TenantValidate(claims.Tenant); err != nil {
+		lpf(logh.Error, "TenantValidate error:%v", err)
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	return claims.Tenant, true
+}
+
+// taskAccess returns true when the caller of the request is the Owner of the task, or an
+// administrator. Callers without access get the same response as for a task that does not exist.
+func taskAccess(r *http.Request, tsk Task) bool {
+	claims, ok := auth.ClaimsFromRequest(r)
+	return ok && (claims.Email == tsk.Owner || claims.HasRole(auth.RoleAdmin))
+}
+
+// taskSerialize stores the task, unless the tenant of the task has tenantMaxTasks active tasks;
+// then false is returned.
+func taskSerialize(task Task) (bool, error) {
+	tenantTasksMutex.Lock()
+	defer tenantTasksMutex.Unlock()
+	if task.Tenant != "" && *tenantMaxTasks > 0 {
+		n, err := tenantActiveTasks(task.Tenant)
+		if err != nil {
+			return false, err
+		}
+		if n >= *tenantMaxTasks {
+			return false, nil
+		}
+	}
+	if err := telemetryKVS.Serialize(task.Key(), task); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tenantTaskKey returns the key of the task with UUID id of the tenant of the request; see
+// Task.Key. An id that is not a UUID gets http.StatusBadRequest. On error false is returned;
+// callers should then return without writing header status.
+func tenantTaskKey(w http.ResponseWriter, r *http.Request, id string) (string, bool) {
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return "", false
+	}
+	u, err := uuid.Parse(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	tsk := Task{Tenant: tenant, UUID: &u}
+	return tsk.Key(), true
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/paulfdunn/go-helper/logh"
+	"github.com/paulfdunn/go-helper/neth/httph"
+	"github.com/paulfdunn/go-helper/osh/runtimeh"
+	"github.com/paulfdunn/rest-app/core/audit"
+	"github.com/paulfdunn/rest-app/core/auth"
+	"github.com/paulfdunn/rest-app/core/storage"
+)
+
+// CommandPolicy restricts the Command, File, and Shell values of tasks; see commandPolicyFilepath
+// and pathPolicy. Tasks are checked when posted, and rejected with the PolicyViolations. Every
+// decision is audited.
+type CommandPolicy struct {
+	// Rules apply to the caller per CommandRule.Roles. A value is rejected when it matches a deny
+	// REGEX of any rule that applies, or when rules that apply have allow REGEX for the field and
+	// the value matches none of them. Deny takes precedence over allow.
+	Rules []CommandRule `json:",omitempty"`
+}
+
+// CommandRule is a set of REGEX for the values of the Command, File, and Shell fields of a Task.
+// REGEX are not anchored; use ^ and $ to match the whole value.
+type CommandRule struct {
+	CommandAllow []string `json:",omitempty"`
+	CommandDeny  []string `json:",omitempty"`
+	FileAllow    []string `json:",omitempty"`
+	FileDeny     []string `json:",omitempty"`
+	// Roles are the roles the rule applies to; it applies to callers with one of Roles in their
+	// token. Roles do not grant lesser roles here, so a rule for auth.RoleOperator does not apply
+	// to administrators. If empty, the rule applies to all callers.
+	Roles      []string `json:",omitempty"`
+	ShellAllow []string `json:",omitempty"`
+	ShellDeny  []string `json:",omitempty"`
+}
+
+// PolicyViolation explains why a value of a Task was rejected by the CommandPolicy; the body of a
+// rejected POST is a slice of PolicyViolation.
+type PolicyViolation struct {
+	// Field is the Task field; Command, File, or Shell.
+	Field string
+	// Index is the index of Value in Field.
+	Index int
+	// Reason is human readable; do not parse it.
+	Reason string
+	// Regex is the deny REGEX the value matched, of the rule at index Rule of CommandPolicy.Rules.
+	// Both are omitted when the value matched no allow REGEX.
+	Regex string `json:",omitempty"`
+	Rule  *int   `json:",omitempty"`
+	Value string
+}
+
+// commandRule is a CommandRule with the REGEX compiled; allow and deny are keyed by Task field.
+type commandRule struct {
+	allow map[string][]*regexp.Regexp
+	deny  map[string][]*regexp.Regexp
+	roles []string
+}
+
+const (
+	// commandPolicyFileSuffix is for the data source of the CommandPolicy; it is not stored with
+	// the tasks, as storage.OpenChecked requires a single table per data source.
+	commandPolicyFileSuffix = ".policy.db"
+	commandPolicyKey        = "policy"
+	commandPolicyTable      = "commandPolicy"
+)
+
+var (
+	// commandPolicy is the current policy, with the compiled Rules in commandPolicyRules.
+	commandPolicy      CommandPolicy
+	commandPolicyKVS   storage.Store
+	commandPolicyMutex sync.RWMutex
+	commandPolicyRules []commandRule
+)
+
+// handlerPolicy is for administrators to view and update the CommandPolicy. Updates are
+// persisted, and used instead of commandPolicyFilepath thereafter. Requires auth.RoleAdmin, and
+// scopeRead for http.MethodGet, and scopeExecute for http.MethodPut.
+// http.MethodGet - get the CommandPolicy.
+// http.MethodPut - replace the CommandPolicy; the body is the CommandPolicy.
+func handlerPolicy(w http.ResponseWriter, r *http.Request) {
+	lpf(logh.Debug, "handlerPolicy http.request: %v\n", *r)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !auth.RequireScope(w, r, scopeRead) {
+			return
+		}
+		commandPolicyMutex.RLock()
+		policy := commandPolicy
+		commandPolicyMutex.RUnlock()
+		b, err := json.Marshal(policy)
+		if err != nil {
+			lpf(logh.Error, "json.Marshal error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(b); err != nil {
+			lpf(logh.Error, "w.Write error:%v", err)
+		}
+	case http.MethodPut:
+		if !auth.RequireScope(w, r, scopeExecute) {
+			return
+		}
+		policy := CommandPolicy{}
+		if err := httph.BodyUnmarshal(w, r, &policy); err != nil {
+			lpf(logh.Error, "handlerPolicy error:%v", err)
+			// WriteHeader provided by BodyUnmarshal
+			return
+		}
+		// The policy is only used once it is valid and persisted.
+		rules, err := commandPolicyCompile(policy)
+		if err != nil {
+			lpf(logh.Error, "commandPolicyCompile error:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := commandPolicyKVS.Serialize(commandPolicyKey, policy); err != nil {
+			lpf(logh.Error, "commandPolicyKVS.Serialize error:%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		commandPolicyActivate(policy, rules)
+		if aw, ok := w.(*auth.AuditWriter); ok {
+			aw.Message = fmt.Sprintf("command policy updated, rules: %d", len(policy.Rules))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// commandPolicyCheck returns the values of the Command, File, and Shell fields of task that the
+// CommandPolicy rejects for the caller of the request; none when the task is allowed.
+func commandPolicyCheck(r *http.Request, task Task) []PolicyViolation {
+	var roles []string
+	if claims, ok := auth.ClaimsFromRequest(r); ok {
+		roles = claims.Roles
+	}
+	commandPolicyMutex.RLock()
+	defer commandPolicyMutex.RUnlock()
+	rules := []int{}
+	for i, rule := range commandPolicyRules {
+		if len(rule.roles) == 0 || slices.ContainsFunc(rule.roles, func(role string) bool { return slices.Contains(roles, role) }) {
+			rules = append(rules, i)
+		}
+	}
+
+	violations := []PolicyViolation{}
+	fields := []struct {
+		name   string
+		values []string
+	}{
+		{taskKeyCommand, task.Command},
+		{taskKeyFile, task.File},
+		{taskKeyShell, task.Shell},
+	}
+	for _, field := range fields {
+	values:
+		for index, value := range field.values {
+			allowRequired, allowed := false, false
+			for _, i := range rules {
+				for _, rg := range commandPolicyRules[i].deny[field.name] {
+					if rg.MatchString(value) {
+						rule := i
+						violations = append(violations, PolicyViolation{Field: field.name, Index: index,
+							Reason: "matches a deny REGEX", Regex: rg.String(), Rule: &rule, Value: value})
+						continue values
+					}
+				}
+				for _, rg := range commandPolicyRules[i].allow[field.name] {
+					allowRequired = true
+					allowed = allowed || rg.MatchString(value)
+				}
+			}
+			if allowRequired && !allowed {
+				violations = append(violations, PolicyViolation{Field: field.name, Index: index,
+					Reason: "matches no allow REGEX", Value: value})
+			}
+		}
+	}
+	return violations
+}
+
+// commandPolicyLoad loads the persisted command policy, or when none was persisted, the policy in
+// commandPolicyFilepath. With neither, all values are allowed.
+func commandPolicyLoad() error {
+	policy := CommandPolicy{}
+	if *commandPolicyFilepath != "" {
+		b, err := os.ReadFile(*commandPolicyFilepath)
+		if err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+		if err := json.Unmarshal(b, &policy); err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+	}
+	b, err := commandPolicyKVS.Get(commandPolicyKey)
+	if err != nil {
+		return runtimeh.SourceInfoError("", err)
+	}
+	if b != nil {
+		policy = CommandPolicy{}
+		if err := commandPolicyKVS.Deserialize(commandPolicyKey, &policy); err != nil {
+			return runtimeh.SourceInfoError("", err)
+		}
+	}
+	return commandPolicySet(policy)
+}
+
+// commandPolicyActivate makes policy, with the rules compiled by commandPolicyCompile, the current
+// command policy.
+func commandPolicyActivate(policy CommandPolicy, rules []commandRule) {
+	commandPolicyMutex.Lock()
+	defer commandPolicyMutex.Unlock()
+	commandPolicy = policy
+	commandPolicyRules = rules
+}
+
+// commandPolicyCompile validates the policy and returns the compiled rules.
+func commandPolicyCompile(policy CommandPolicy) ([]commandRule, error) {
+	roles := []string{auth.RoleAdmin, auth.RoleOperator, auth.RoleViewer}
+	rules := make([]commandRule, len(policy.Rules))
+	for i, rule := range policy.Rules {
+		for _, role := range rule.Roles {
+			if !slices.Contains(roles, role) {
+				return nil, fmt.Errorf("%s rule: %d, invalid role: %s, valid roles: %s", runtimeh.SourceInfo(), i, role,
+					strings.Join(roles, ","))
+			}
+		}
+		rules[i] = commandRule{allow: map[string][]*regexp.Regexp{}, deny: map[string][]*regexp.Regexp{}, roles: rule.Roles}
+		regexes := []struct {
+			compiled map[string][]*regexp.Regexp
+			field    string
+			regex    []string
+		}{
+			{rules[i].allow, taskKeyCommand, rule.CommandAllow},
+			{rules[i].deny, taskKeyCommand, rule.CommandDeny},
+			{rules[i].allow, taskKeyFile, rule.FileAllow},
+			{rules[i].deny, taskKeyFile, rule.FileDeny},
+			{rules[i].allow, taskKeyShell, rule.ShellAllow},
+			{rules[i].deny, taskKeyShell, rule.ShellDeny},
+		}
+		for _, rgx := range regexes {
+			for _, v := range rgx.regex {
+				rg, err := regexp.Compile(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s rule: %d, %s regex %s does not compile", runtimeh.SourceInfo(), i, rgx.field, v)
+				}
+				rgx.compiled[rgx.field] = append(rgx.compiled[rgx.field], rg)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// initializePolicyKVS opens the data source of the CommandPolicy. The data source is checked for
+// integrity, and an unreadable data source is restored from a snapshot, like the telemetry data
+// source. Startup fails when the persisted policy cannot be recovered, rather than continuing with
+// a less restrictive policy.
+func initializePolicyKVS(datasourcePath string, filename string) {
+	dsp := filepath.Join(datasourcePath, filename)
+	lpf(logh.Info, "commandPolicyKVS path: %s", dsp)
+	validate := func(key string, value []byte) error {
+		policy := CommandPolicy{}
+		if err := json.Unmarshal(value, &policy); err != nil {
+			return err
+		}
+		_, err := commandPolicyCompile(policy)
+		return err
+	}
+	rc := storage.RecoveryConfig{Validate: validate}
+	if runtimeConfig.LogName != nil {
+		rc.LogName = *runtimeConfig.LogName
+	}
+	var err error
+	var rcv storage.Recovery
+	commandPolicyKVS, rcv, err = storage.OpenChecked(dsp, commandPolicyTable, rc)
+	if err != nil {
+		log.Fatalf("fatal: %s fatal: could not open storage, error: %v", runtimeh.SourceInfo(), err)
+	}
+	if !rcv.Changed() {
+		lpf(logh.Info, "commandPolicyKVS integrity check passed: %s", rcv)
+		return
+	}
+	lpf(logh.Error, "commandPolicyKVS recovered: %s", rcv)
+	audit.Printf("commandPolicyKVS recovered: %s", rcv)
+	if len(rcv.QuarantinedKeys) > 0 || rcv.RestoredSnapshot == "" {
+		log.Fatalf("fatal: %s the command policy could not be recovered and was quarantined: %s", runtimeh.SourceInfo(), rcv)
+	}
+}
+
+// commandPolicySet validates the policy and makes it the current command policy.
+func commandPolicySet(policy CommandPolicy) error {
+	rules, err := commandPolicyCompile(policy)
+	if err != nil {
+		return err
+	}
+	commandPolicyActivate(policy, rules)
+	return nil
+}
+
+// policyViolationsString formats violations for the audit log.
+func policyViolationsString(violations []PolicyViolation) string {
+	s := make([]string, len(violations))
+	for i, v := range violations {
+		s[i] = fmt.Sprintf("%s[%d]: %s, %s", v.Field, v.Index, v.Value, v.Reason)
+		if v.Rule != nil {
+			s[i] += fmt.Sprintf(" %q of rule %d", v.Regex, *v.Rule)
+		}
+	}
+	return strings.Join(s, "; ")
+}
@@ -22,6 +22,7 @@ function cleanup {
     rm example-auth-as-service
     rm example-auth-as-service*.db
     rm example-auth-as-service.log.*
+    rm -rf ./*.db.snapshots
     rm -rf ./taskdata
 }
 
@@ -44,17 +45,46 @@ if [[ $? != 0 ]]; then
     echo "FAILED: go build failed"
     exit
 fi
-# Run the apps in the background.
-../example-auth-as-service/example-auth-as-service  -https-port=8000 -log-level=0 -log-filepath=./example-auth-as-service.log  -persistent-directory=./ &
+# Run the apps in the background. The initial admin password is provided in the environment, and
+# must be changed before the admin can do anything else.
+INITIAL_PASSWORD='Init1@l!234'
+ADMIN_PASSWORD='Adm1n@ss!234'
+REST_APP_INITIAL_PASSWORD=$INITIAL_PASSWORD ../example-auth-as-service/example-auth-as-service  -https-port=8000 -log-level=0 -log-filepath=./example-auth-as-service.log  -persistent-directory=./ &
 ./example-telemetry  -https-port=8001 -log-level=0 -log-filepath=./example-telemetry.log -persistent-directory=./ &
 # Wait for apps to start.
 sleep 5
 
-echo -e "\n\n Get admin token from the authentication service"
-TOKEN_ADMIN=$(curl -k -s -X PUT -d '{"Email":"admin", "Password":"P@ss!234"}' \
+echo -e "\n\n Login with the initial password, and set a new password."
+TOKEN_INITIAL=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$INITIAL_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/login/)
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -X PUT \
+    -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    -H "Authorization: Bearer $TOKEN_INITIAL" \
+    https://127.0.0.1:8000/auth/createorupdate/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "initial password change failed"
+    exitOnError
+fi
+
+echo -e "\n\n Get admin token for the example-telemetry audience from the authentication service"
+TOKEN_ADMIN=$(curl -k -s -X PUT \
+    -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\", \"Audience\":\"example-telemetry\"}" \
     https://127.0.0.1:8000/auth/login/)
 echo $TOKEN_ADMIN
 
+echo -e "\n\n A token without the example-telemetry audience gets a 401."
+TOKEN_AUTH=$(curl -k -s -X PUT -d "{\"Email\":\"admin\", \"Password\":\"$ADMIN_PASSWORD\"}" \
+    https://127.0.0.1:8000/auth/login/)
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "Authorization: Bearer $TOKEN_AUTH" \
+    https://127.0.0.1:8001/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 401 ]]; then
+    echo "token without the audience was accepted on root path"
+    exitOnError
+fi
+
 echo -e "\n\n Root path requires auth. Try root path with no auth and get a 401."
 HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
      https://127.0.0.1:8001/ | \
@@ -96,6 +126,43 @@ if [[ $HTTP_STATUS != 200 ]]; then
     exitOnError
 fi
 
+echo -e "\n\n Update the command policy to deny rm, then a task with rm gets a 403 with the violations."
+HTTP_STATUS=$(curl -k -s -X PUT -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -d '{"Rules":[{"CommandDeny":["^rm "]}]}' \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8001/policy/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "command policy update failed"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" -d '{"Command":["rm -rf /tmp/none"]}' \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8001/task/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 403 ]]; then
+    echo "task denied by the command policy was accepted"
+    exitOnError
+fi
+HTTP_STATUS=$(curl -k -s -X PUT -w "\n|HTTP_STATUS=%{http_code}|\n" -d '{}' \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8001/policy/ | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 204 ]]; then
+    echo "command policy reset failed"
+    exitOnError
+fi
+
+echo -e "\n\n Tail the application log, info level and higher, using the log API."
+HTTP_STATUS=$(curl -k -s -w "\n|HTTP_STATUS=%{http_code}|\n" \
+    -H "Authorization: Bearer $TOKEN_ADMIN" \
+    https://127.0.0.1:8001/logs/tail/\?log=app\&level=info\&lines=20 | \
+    grep HTTP_STATUS | grep -o -E [0-9]*)
+if [[ $HTTP_STATUS != 200 ]]; then
+    echo "log tail failed"
+    exitOnError
+fi
+
 echo -e "\n\n"
 cat example-telemetry.log.0
 echo -e "\n\n"